@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+// repoRole tells what a user may do in a repo; each role includes the ones below it
+type repoRole int
+
+const (
+	noRole     repoRole = iota
+	readerRole          // may list and read the drawings
+	editorRole          // may also change the drawings
+	adminRole           // may also break the edit locks of others
+)
+
+var repoRoleNames = map[repoRole]string{
+	noRole:     "none",
+	readerRole: "reader",
+	editorRole: "editor",
+	adminRole:  "admin",
+}
+
+func (role repoRole) String() string {
+	return repoRoleNames[role]
+}
+
+func parseRepoRole(name string) (repoRole, error) {
+	for role, roleName := range repoRoleNames {
+		if roleName == name && role != noRole {
+			return role, nil
+		}
+	}
+	return noRole, fmt.Errorf("unknown role %q", name)
+}
+
+// allRepos and everyone are the wildcards of the access file
+const (
+	allRepos = "*"
+	everyone = "*"
+)
+
+// roleAssignment grants the role to a user or to the members of a group
+type roleAssignment struct {
+	User  string `json:"user,omitempty"` // "*" is every authenticated user
+	Group string `json:"group,omitempty"`
+	Role  string `json:"role"`
+}
+
+// accessConfig is read from the JSON file named by XCALIAPP_ACCESSFILE, for example:
+//
+//	{
+//	  "groups": {"designers": ["jane", "joe"]},
+//	  "repos": {
+//	    "*": [{"user": "*", "role": "reader"}],
+//	    "wsgw": [{"group": "designers", "role": "editor"}, {"user": "jane", "role": "admin"}]
+//	  }
+//	}
+type accessConfig struct {
+	Groups map[string][]string         `json:"groups"`
+	Repos  map[string][]roleAssignment `json:"repos"` // by repo name; "*" applies to every repo
+}
+
+func loadAccessConfig(fileName string) (*accessConfig, error) {
+	content, readErr := os.ReadFile(fileName)
+	if readErr != nil {
+		return nil, fmt.Errorf("failed to read access file %s: %w", fileName, readErr)
+	}
+	config := accessConfig{}
+	if unmarshalErr := json.Unmarshal(content, &config); unmarshalErr != nil {
+		return nil, fmt.Errorf("failed to parse access file %s: %w", fileName, unmarshalErr)
+	}
+	for repoName, assignments := range config.Repos {
+		for _, assignment := range assignments {
+			if _, roleErr := parseRepoRole(assignment.Role); roleErr != nil {
+				return nil, fmt.Errorf("access file %s, repo %s: %w", fileName, repoName, roleErr)
+			}
+			if (len(assignment.User) == 0) == (len(assignment.Group) == 0) {
+				return nil, fmt.Errorf("access file %s, repo %s: exactly one of user and group must be set", fileName, repoName)
+			}
+			if _, knownGroup := config.Groups[assignment.Group]; len(assignment.Group) > 0 && !knownGroup {
+				return nil, fmt.Errorf("access file %s, repo %s: unknown group %s", fileName, repoName, assignment.Group)
+			}
+		}
+	}
+	return &config, nil
+}
+
+// accessControl tells the roles of the users in the repos. Without an access file every user is
+// an editor in every repo. The admins configured globally are admins in every repo.
+type accessControl struct {
+	config *accessConfig
+	admins []string
+}
+
+func newAccessControl(config *accessConfig, admins []string) *accessControl {
+	return &accessControl{config: config, admins: admins}
+}
+
+func (access *accessControl) role(username string, repoName drawingRepoName) repoRole {
+	if slices.Contains(access.admins, username) {
+		return adminRole
+	}
+	if access.config == nil {
+		return editorRole
+	}
+
+	role := noRole
+	for _, assignments := range [][]roleAssignment{access.config.Repos[allRepos], access.config.Repos[string(repoName)]} {
+		for _, assignment := range assignments {
+			applies := assignment.User == username || assignment.User == everyone ||
+				(len(assignment.Group) > 0 && slices.Contains(access.config.Groups[assignment.Group], username))
+			if !applies {
+				continue
+			}
+			if assigned, _ := parseRepoRole(assignment.Role); assigned > role {
+				role = assigned
+			}
+		}
+	}
+	return role
+}
+
+func (access *accessControl) canRead(username string, repoName drawingRepoName) bool {
+	return access.role(username, repoName) >= readerRole
+}
+
+// roleOf tells the role of the user of the request in the repo, capped to what the API token
+// of the request, if any, is good for
+func (hf *handlerFactory) roleOf(c *gin.Context, username string, repoName drawingRepoName) repoRole {
+	role := hf.access.role(username, repoName)
+	if token, viaToken := requestAPIToken(c); viaToken {
+		role = min(role, token.maxRole(repoName))
+	}
+	return role
+}
+
+func (hf *handlerFactory) canRead(c *gin.Context, username string, repoName drawingRepoName) bool {
+	return hf.roleOf(c, username, repoName) >= readerRole
+}
+
+// checkRole tells whether the user has at least the role in the repo; the error response has
+// been sent when not. Repos the user may not read are reported as unknown, so as not to reveal them.
+func (hf *handlerFactory) checkRole(c *gin.Context, logger zerolog.Logger, repoName string, username string, required repoRole) bool {
+	role := hf.roleOf(c, username, drawingRepoName(repoName))
+	switch {
+	case role >= required:
+		return true
+	case role == noRole:
+		logger.Info().Str("username", username).Msg("no access to repo")
+		abortWithError(c, http.StatusNotFound, unknownRepoError(repoName))
+	default:
+		logger.Info().Str("username", username).Stringer("role", role).Stringer("requiredRole", required).Msg("insufficient role")
+		abortWithError(c, http.StatusForbidden, fmt.Errorf("the %s role is required in drawing repository %s", required, repoName))
+	}
+	return false
+}
+
+// requireRole lets the request through if the user has at least the role in the repo of the request
+func (hf *handlerFactory) requireRole(required repoRole) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		repoName := c.Param("repo")
+		logger := zerolog.Ctx(c.Request.Context()).With().Str("repoName", repoName).Logger()
+
+		user, userExtractErr := getUserFromContext(c)
+		if userExtractErr != nil {
+			logger.Error().Err(userExtractErr).Msg("failed to extract user from context")
+			abortWithError(c, http.StatusInternalServerError, userExtractErr)
+			return
+		}
+		if !hf.checkRole(c, logger, repoName, user.Username, required) {
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type accessTestSuite struct {
+	suite.Suite
+}
+
+func TestAccess(t *testing.T) {
+	suite.Run(t, &accessTestSuite{})
+}
+
+func (t *accessTestSuite) writeAccessFile(content string) string {
+	fileName := filepath.Join(t.T().TempDir(), "access.json")
+	t.Require().NoError(os.WriteFile(fileName, []byte(content), 0o600))
+	return fileName
+}
+
+func (t *accessTestSuite) TestRoles() {
+	config, loadErr := loadAccessConfig(t.writeAccessFile(`{
+		"groups": {"designers": ["jane", "joe"]},
+		"repos": {
+			"*": [{"user": "*", "role": "reader"}],
+			"wsgw": [{"group": "designers", "role": "editor"}, {"user": "jane", "role": "admin"}],
+			"secret": [{"user": "joe", "role": "reader"}]
+		}
+	}`))
+	t.Require().NoError(loadErr)
+	access := newAccessControl(config, []string{"root"})
+
+	t.Equal(adminRole, access.role("jane", "wsgw"))
+	t.Equal(editorRole, access.role("joe", "wsgw"))
+	t.Equal(readerRole, access.role("bob", "wsgw"))
+	t.Equal(readerRole, access.role("jane", "xcali"))
+	t.Equal(adminRole, access.role("root", "xcali"))
+	t.True(access.canRead("bob", "secret"), "the wildcard repo applies to every repo")
+}
+
+func (t *accessTestSuite) TestWithoutAccessFile() {
+	access := newAccessControl(nil, []string{"root"})
+
+	t.Equal(editorRole, access.role("jane", "wsgw"))
+	t.Equal(adminRole, access.role("root", "wsgw"))
+}
+
+func (t *accessTestSuite) TestInvalidAccessFile() {
+	for _, content := range []string{
+		`{"repos": {"wsgw": [{"user": "jane", "role": "owner"}]}}`,
+		`{"repos": {"wsgw": [{"user": "jane", "group": "designers", "role": "reader"}]}}`,
+		`{"repos": {"wsgw": [{"group": "designers", "role": "reader"}]}}`,
+		`[]`,
+	} {
+		_, loadErr := loadAccessConfig(t.writeAccessFile(content))
+		t.Error(loadErr, content)
+	}
+}
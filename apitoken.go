@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"myxcaliapp/backend/repoerr"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+)
+
+const (
+	apiTokenPrefix  = "xcat_"
+	apiTokenKey     = "api-token" // the token of the request in the gin context
+	maxAPITokenName = 200
+)
+
+type apiTokenScope string
+
+const (
+	readScope  apiTokenScope = "read"  // the token may list and read drawings
+	writeScope apiTokenScope = "write" // the token may also change them
+)
+
+// apiToken is a personal access token; only the hash of its secret is kept
+type apiToken struct {
+	Id         string        `json:"id"`
+	Name       string        `json:"name"`
+	Username   string        `json:"username"`
+	Repos      []string      `json:"repos,omitempty"` // the token is good for every repo of the user when empty
+	Scope      apiTokenScope `json:"scope"`
+	CreatedAt  time.Time     `json:"createdAt"`
+	ExpiresAt  time.Time     `json:"expiresAt,omitzero"`
+	LastUsedAt time.Time     `json:"lastUsedAt,omitzero"`
+	Hash       string        `json:"hash,omitempty"` // SHA-256 of the secret; the secrets are random, so no salt or stretching is needed
+}
+
+func (token apiToken) expired(now time.Time) bool {
+	return !token.ExpiresAt.IsZero() && !now.Before(token.ExpiresAt)
+}
+
+// maxRole caps the role of the user in the repo to what the token is good for
+func (token apiToken) maxRole(repoName drawingRepoName) repoRole {
+	if len(token.Repos) > 0 && !slices.Contains(token.Repos, string(repoName)) {
+		return noRole
+	}
+	if token.Scope == writeScope {
+		return editorRole
+	}
+	return readerRole
+}
+
+func hashAPITokenSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// apiTokenStore keeps the tokens in a JSON file, or in memory only when no file is configured
+type apiTokenStore struct {
+	fileName string
+	now      func() time.Time
+
+	lock   sync.Mutex
+	tokens map[string]apiToken // by id
+	byHash map[string]string   // the ids of the tokens by the hash of their secret
+}
+
+func loadAPITokenStore(fileName string) (*apiTokenStore, error) {
+	store := &apiTokenStore{fileName: fileName, now: time.Now, tokens: map[string]apiToken{}, byHash: map[string]string{}}
+	if len(fileName) == 0 {
+		return store, nil
+	}
+	content, readErr := os.ReadFile(fileName)
+	if errors.Is(readErr, fs.ErrNotExist) {
+		return store, nil
+	}
+	if readErr != nil {
+		return nil, fmt.Errorf("failed to read token file %s: %w", fileName, readErr)
+	}
+	tokens := []apiToken{}
+	if unmarshalErr := json.Unmarshal(content, &tokens); unmarshalErr != nil {
+		return nil, fmt.Errorf("failed to parse token file %s: %w", fileName, unmarshalErr)
+	}
+	for _, token := range tokens {
+		store.tokens[token.Id] = token
+		store.byHash[token.Hash] = token.Id
+	}
+	return store, nil
+}
+
+// saveLocked must be called with the lock held
+func (store *apiTokenStore) saveLocked() error {
+	if len(store.fileName) == 0 {
+		return nil
+	}
+	tokens := make([]apiToken, 0, len(store.tokens))
+	for _, token := range store.tokens {
+		tokens = append(tokens, token)
+	}
+	slices.SortFunc(tokens, func(a, b apiToken) int { return strings.Compare(a.Id, b.Id) })
+	content, marshalErr := json.MarshalIndent(tokens, "", "  ")
+	if marshalErr != nil {
+		return marshalErr
+	}
+	if writeErr := writeFile(store.fileName, content, passwordFilePermissions); writeErr != nil {
+		return fmt.Errorf("failed to write token file %s: %w", store.fileName, writeErr)
+	}
+	return nil
+}
+
+// create creates a token for the user, returning it with its secret, which is not kept
+func (store *apiTokenStore) create(token apiToken) (apiToken, string, error) {
+	secret := apiTokenPrefix + rand.Text()
+	token.Id = xid.New().String()
+	token.CreatedAt = store.now().UTC()
+	token.Hash = hashAPITokenSecret(secret)
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.tokens[token.Id] = token
+	store.byHash[token.Hash] = token.Id
+	if saveErr := store.saveLocked(); saveErr != nil {
+		delete(store.tokens, token.Id)
+		delete(store.byHash, token.Hash)
+		return apiToken{}, "", saveErr
+	}
+	return token, secret, nil
+}
+
+// list returns the tokens of the user, oldest first
+func (store *apiTokenStore) list(username string) []apiToken {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	tokens := []apiToken{}
+	for _, token := range store.tokens {
+		if token.Username == username {
+			tokens = append(tokens, token)
+		}
+	}
+	slices.SortFunc(tokens, func(a, b apiToken) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return tokens
+}
+
+func (store *apiTokenStore) revoke(username string, id string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	token, exists := store.tokens[id]
+	if !exists || token.Username != username {
+		return fmt.Errorf("token %s: %w", id, repoerr.ErrNotFound)
+	}
+	delete(store.tokens, id)
+	delete(store.byHash, token.Hash)
+	if saveErr := store.saveLocked(); saveErr != nil {
+		store.tokens[id] = token
+		store.byHash[token.Hash] = id
+		return saveErr
+	}
+	return nil
+}
+
+// authenticate returns the token having the secret unless it has expired. The time of last use is
+// only saved with the next change of the tokens.
+func (store *apiTokenStore) authenticate(secret string) (apiToken, bool) {
+	hash := hashAPITokenSecret(secret)
+	now := store.now()
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	id, known := store.byHash[hash]
+	if !known {
+		return apiToken{}, false
+	}
+	token := store.tokens[id]
+	if token.expired(now) {
+		return apiToken{}, false
+	}
+	token.LastUsedAt = now.UTC()
+	store.tokens[id] = token
+	return token, true
+}
+
+// bearerToken returns the token of the Authorization header, if it is a Bearer one
+func bearerToken(c *gin.Context) (string, bool) {
+	scheme, token, hasToken := strings.Cut(c.GetHeader("Authorization"), " ")
+	if !hasToken || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// requestAPIToken returns the token the request has been authenticated with, if any
+func requestAPIToken(c *gin.Context) (apiToken, bool) {
+	token, hasToken := c.Get(apiTokenKey)
+	if !hasToken {
+		return apiToken{}, false
+	}
+	return token.(apiToken), true
+}
+
+type createAPITokenRequest struct {
+	Name      string        `json:"name"`
+	Repos     []string      `json:"repos,omitempty"`
+	Scope     apiTokenScope `json:"scope"`
+	ExpiresAt time.Time     `json:"expiresAt,omitzero"`
+}
+
+// createAPITokenResponse is the only response having the secret of the token
+type createAPITokenResponse struct {
+	apiToken
+	Token string `json:"token"`
+}
+
+// sessionUser returns the user of the request unless it has been authenticated with a token:
+// tokens can't be used for managing tokens. The error response has been sent when it returns nil.
+func sessionUser(c *gin.Context, logger zerolog.Logger) *User {
+	if _, viaToken := requestAPIToken(c); viaToken {
+		logger.Info().Msg("tokens can't be managed with tokens")
+		abortWithError(c, http.StatusForbidden, errors.New("tokens can't be managed with tokens"))
+		return nil
+	}
+	user, userExtractErr := getUserFromContext(c)
+	if userExtractErr != nil {
+		logger.Error().Err(userExtractErr).Msg("failed to extract user from context")
+		abortWithError(c, http.StatusInternalServerError, userExtractErr)
+		return nil
+	}
+	return user
+}
+
+func (hf *handlerFactory) listAPITokens() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		logger := zerolog.Ctx(c.Request.Context()).With().Logger()
+		user := sessionUser(c, logger)
+		if user == nil {
+			return
+		}
+		tokens := hf.tokens.list(user.Username)
+		for i := range tokens {
+			tokens[i].Hash = ""
+		}
+		c.JSON(http.StatusOK, tokens)
+	}
+}
+
+func (hf *handlerFactory) createAPIToken() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		logger := zerolog.Ctx(c.Request.Context()).With().Logger()
+		user := sessionUser(c, logger)
+		if user == nil {
+			return
+		}
+
+		var request createAPITokenRequest
+		if bindErr := c.ShouldBindJSON(&request); bindErr != nil {
+			logger.Debug().Err(bindErr).Msg("failed to unmarshal request body")
+			abortWithError(c, http.StatusBadRequest, bindErr)
+			return
+		}
+		request.Name = strings.TrimSpace(request.Name)
+		if len(request.Name) == 0 || len(request.Name) > maxAPITokenName {
+			abortWithError(c, http.StatusBadRequest, fmt.Errorf("the name of the token must be 1 to %d bytes long", maxAPITokenName))
+			return
+		}
+		if request.Scope != readScope && request.Scope != writeScope {
+			abortWithError(c, http.StatusBadRequest, fmt.Errorf("invalid scope %q, expected %q or %q", request.Scope, readScope, writeScope))
+			return
+		}
+		if !request.ExpiresAt.IsZero() && !request.ExpiresAt.After(time.Now()) {
+			abortWithError(c, http.StatusBadRequest, errors.New("the expiry of the token must be in the future"))
+			return
+		}
+		for _, repoName := range request.Repos {
+			if _, hasRepo := hf.repos.getRepo(drawingRepoName(repoName)); !hasRepo || !hf.canRead(c, user.Username, drawingRepoName(repoName)) {
+				abortWithError(c, http.StatusBadRequest, unknownRepoError(repoName))
+				return
+			}
+		}
+
+		token, secret, createErr := hf.tokens.create(apiToken{
+			Name:      request.Name,
+			Username:  user.Username,
+			Repos:     request.Repos,
+			Scope:     request.Scope,
+			ExpiresAt: request.ExpiresAt.UTC(),
+		})
+		if createErr != nil {
+			logger.Error().Err(createErr).Msg("failed to create token")
+			abortWithError(c, http.StatusInternalServerError, createErr)
+			return
+		}
+		logger.Info().Str("tokenId", token.Id).Str("username", user.Username).Msg("token created")
+		token.Hash = ""
+		c.JSON(http.StatusCreated, createAPITokenResponse{apiToken: token, Token: secret})
+	}
+}
+
+func (hf *handlerFactory) revokeAPIToken() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		logger := zerolog.Ctx(c.Request.Context()).With().Str("tokenId", c.Param("tokenId")).Logger()
+		user := sessionUser(c, logger)
+		if user == nil {
+			return
+		}
+		if revokeErr := hf.tokens.revoke(user.Username, c.Param("tokenId")); revokeErr != nil {
+			logger.Info().Err(revokeErr).Msg("failed to revoke token")
+			abortWithRepoError(c, revokeErr)
+			return
+		}
+		logger.Info().Msg("token revoked")
+		c.Status(http.StatusNoContent)
+	}
+}
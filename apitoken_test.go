@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type apiTokenTestSuite struct {
+	suite.Suite
+}
+
+func TestAPITokenStore(t *testing.T) {
+	suite.Run(t, &apiTokenTestSuite{})
+}
+
+func (t *apiTokenTestSuite) TestPersistsHashedTokens() {
+	fileName := filepath.Join(t.T().TempDir(), "tokens.json")
+	store, loadErr := loadAPITokenStore(fileName)
+	t.Require().NoError(loadErr)
+
+	created, secret, createErr := store.create(apiToken{Name: "ci", Username: "jane", Scope: writeScope})
+	t.Require().NoError(createErr)
+	t.True(strings.HasPrefix(secret, apiTokenPrefix))
+	content, readErr := os.ReadFile(fileName)
+	t.Require().NoError(readErr)
+	t.NotContains(string(content), secret)
+	info, statErr := os.Stat(fileName)
+	t.Require().NoError(statErr)
+	t.Equal(os.FileMode(passwordFilePermissions), info.Mode().Perm())
+
+	reloaded, reloadErr := loadAPITokenStore(fileName)
+	t.Require().NoError(reloadErr)
+	token, valid := reloaded.authenticate(secret)
+	t.True(valid)
+	t.Equal(created.Id, token.Id)
+	t.Equal("jane", token.Username)
+	_, valid = reloaded.authenticate(secret + "x")
+	t.False(valid)
+}
+
+func (t *apiTokenTestSuite) TestExpiryAndRevocation() {
+	store, _ := loadAPITokenStore("")
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	expiring, expiringSecret, _ := store.create(apiToken{Name: "short", Username: "jane", Scope: readScope, ExpiresAt: now.Add(time.Hour)})
+	_, otherSecret, _ := store.create(apiToken{Name: "other", Username: "joe", Scope: readScope})
+
+	_, valid := store.authenticate(expiringSecret)
+	t.True(valid)
+	now = now.Add(time.Hour)
+	_, valid = store.authenticate(expiringSecret)
+	t.False(valid, "expired")
+
+	t.Error(store.revoke("joe", expiring.Id), "only the owner may revoke the token")
+	t.NoError(store.revoke("jane", expiring.Id))
+	t.Empty(store.list("jane"))
+	t.Len(store.list("joe"), 1)
+	_, valid = store.authenticate(otherSecret)
+	t.True(valid)
+}
+
+func (t *apiTokenTestSuite) TestMaxRole() {
+	token := apiToken{Repos: []string{"wsgw"}, Scope: readScope}
+	t.Equal(readerRole, token.maxRole("wsgw"))
+	t.Equal(noRole, token.maxRole("xcali"))
+	token = apiToken{Scope: writeScope}
+	t.Equal(editorRole, token.maxRole("xcali"))
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
 	"strings"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
+	gsessions "github.com/gorilla/sessions"
 	"github.com/rs/zerolog"
 )
 
@@ -34,48 +38,130 @@ func decodeBasicAuthnHeaderValue(headerValue string) (userid string, password st
 	return pair[0], pair[1], true
 }
 
-type basicConfig struct {
-	passwordCreds []passwordCredentials
+// authenticationConfig tells how the users are authenticated; at least one of the methods is
+// expected to be enabled
+type authenticationConfig struct {
+	basic  *passwordFile      // the users of Basic authentication; nil disables it
+	oidc   *oidcAuthenticator // nil disables OpenID Connect login
+	tokens *apiTokenStore     // nil disables personal API tokens
 }
 
-func checkBasicAuthentication(options basicConfig) func(c *gin.Context) {
+// userExists tells whether the user can still log in; the users of OpenID Connect can't be
+// checked, so only the password file is consulted, when it is the only login method
+func (options authenticationConfig) userExists(username string) bool {
+	if options.basic == nil || options.oidc != nil {
+		return true
+	}
+	return options.basic.has(username)
+}
+
+// checkBasicCredentials stores the user in the session if the request has valid Basic credentials
+func checkBasicCredentials(c *gin.Context, session sessions.Session, passwords *passwordFile) bool {
+	logger := zerolog.Ctx(c.Request.Context())
+	authnHeaderValue, hasHeader := c.Request.Header["Authorization"]
+	logger.Debug().Bool("hasHeader", hasHeader).Send()
+	if !hasHeader {
+		return false
+	}
+	username, password, decodeOK := decodeBasicAuthnHeaderValue(authnHeaderValue[0])
+	logger.Debug().Bool("headerCouldBeDecoded", decodeOK).Send()
+	if !decodeOK {
+		return false
+	}
+	logger.Debug().Str("username", username).Send()
+	if !passwords.check(username, password) {
+		return false
+	}
+	if renewErr := renewSession(c, session); renewErr != nil {
+		logger.Error().Err(renewErr).Msg("failed to renew session")
+		return false
+	}
+	session.Set(userKey, User{username})
+	return true
+}
+
+// discardResponseWriter swallows the cookie of a session deleted only to be replaced
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardResponseWriter) WriteHeader(int)             {}
+
+// renewSession deletes the stored session and has the values saved under a new session id, so
+// that a session id planted before the login doesn't become authenticated
+func renewSession(c *gin.Context, session sessions.Session) error {
+	wrapper, isWrapper := session.(interface{ Session() *gsessions.Session })
+	if !isWrapper {
+		return errors.New("unsupported session type")
+	}
+	current := wrapper.Session()
+	if len(current.ID) == 0 {
+		return nil
+	}
+	old := gsessions.NewSession(current.Store(), current.Name())
+	old.ID = current.ID
+	options := *current.Options
+	options.MaxAge = -1
+	old.Options = &options
+	if deleteErr := old.Store().Save(c.Request, &discardResponseWriter{header: http.Header{}}, old); deleteErr != nil {
+		return deleteErr
+	}
+	current.ID = ""
+	current.IsNew = true
+	return nil
+}
+
+// wantsHTML tells whether the request is a browser navigation, which can be redirected to the login
+func wantsHTML(c *gin.Context) bool {
+	return c.Request.Method == http.MethodGet && strings.Contains(c.GetHeader("Accept"), "text/html")
+}
+
+func checkAuthentication(options authenticationConfig) func(c *gin.Context) {
 	return func(c *gin.Context) {
 		logger := zerolog.Ctx(c.Request.Context())
 		authenticated := false
 
+		if secret, hasToken := bearerToken(c); hasToken && options.tokens != nil {
+			token, valid := options.tokens.authenticate(secret)
+			if valid && !options.userExists(token.Username) {
+				logger.Info().Str("username", token.Username).Msg("API token of a removed user")
+				valid = false
+			}
+			if !valid {
+				logger.Info().Msg("invalid API token")
+				c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+				abortWithError(c, http.StatusUnauthorized, errors.New("invalid or expired token"))
+				return
+			}
+			c.Set(userKey, User{token.Username})
+			c.Set(apiTokenKey, token)
+			c.Next()
+			return
+		}
+
 		session := sessions.Default(c)
 		user := session.Get(userKey)
 		logger.Debug().Bool("isAuthenticated", authenticated).Send()
 		if user != nil {
 			authenticated = true
-		} else {
-			authnHeaderValue, hasHeader := c.Request.Header["Authorization"]
-			logger.Debug().Bool("hasHeader", hasHeader).Send()
-			if hasHeader {
-				username, password, decodeOK := decodeBasicAuthnHeaderValue(authnHeaderValue[0])
-				logger.Debug().Bool("headerCouldBeDecoded", decodeOK).Send()
-				if decodeOK {
-					logger.Debug().Str("username", username).Send()
-					logger.Debug().Int("passwordCredentialsList length", len(options.passwordCreds)).Send()
-					for _, pc := range options.passwordCreds {
-						logger.Debug().Str("currentUserName", pc.Username).Send()
-						if pc.Username == username && pc.Password == password {
-							session.Set(userKey, User{username})
-							session.Save()
-							authenticated = true
-							break
-						}
-					}
-				}
-			}
+		} else if options.basic != nil {
+			authenticated = checkBasicCredentials(c, session, options.basic)
 		}
 		session.Save()
 
-		if authenticated {
+		switch {
+		case authenticated:
 			c.Next()
-		} else {
-			c.Header("WWW-Authenticate", "Basic")
-			c.AbortWithStatus(401)
+		case options.oidc != nil && wantsHTML(c):
+			c.Redirect(http.StatusFound, oidcLoginPath+"?"+url.Values{"redirect": {c.Request.URL.RequestURI()}}.Encode())
+			c.Abort()
+		default:
+			if options.basic != nil {
+				c.Header("WWW-Authenticate", "Basic")
+			}
+			abortWithError(c, http.StatusUnauthorized, errors.New("authentication required"))
 		}
 	}
 }
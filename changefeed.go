@@ -0,0 +1,170 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+type changeEventType string
+
+const (
+	drawingCreated  changeEventType = "created"
+	drawingUpdated  changeEventType = "updated"
+	drawingDeleted  changeEventType = "deleted"
+	drawingRestored changeEventType = "restored"
+)
+
+const (
+	changeFeedBufferSize      = 64
+	changeFeedKeepAlivePeriod = 30 * time.Second
+)
+
+type changeEvent struct {
+	Type      changeEventType `json:"type"`
+	Repo      string          `json:"repo"`
+	Id        string          `json:"id"`
+	User      string          `json:"user,omitempty"`
+	External  bool            `json:"external,omitempty"` // made outside the server, e.g. by a git pull
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+// changeFeed fans out the changes of the drawings to the subscribers. Subscribers not keeping up
+// are dropped, so that they reconnect and reload their lists instead of missing changes silently.
+type changeFeed struct {
+	lock          sync.Mutex
+	subscribers   map[chan changeEvent]struct{}
+	lastPublished map[string]time.Time // repo/id -> time of the last change made via the server
+	retention     time.Duration        // how long the times of the changes are needed by the watchers
+}
+
+func newChangeFeed() *changeFeed {
+	return &changeFeed{
+		subscribers:   map[chan changeEvent]struct{}{},
+		lastPublished: map[string]time.Time{},
+	}
+}
+
+func (feed *changeFeed) publish(eventType changeEventType, repoName string, drawingId string, user string) {
+	feed.send(changeEvent{
+		Type:      eventType,
+		Repo:      repoName,
+		Id:        drawingId,
+		User:      user,
+		Timestamp: time.Now(),
+	})
+}
+
+func (feed *changeFeed) publishExternal(eventType changeEventType, repoName string, drawingId string) {
+	feed.send(changeEvent{
+		Type:      eventType,
+		Repo:      repoName,
+		Id:        drawingId,
+		External:  true,
+		Timestamp: time.Now(),
+	})
+}
+
+// retainPublished has the times of the changes kept for at least twice the interval, so that a
+// watcher polling at that interval can tell the changes made via the server since its previous poll
+func (feed *changeFeed) retainPublished(interval time.Duration) {
+	feed.lock.Lock()
+	defer feed.lock.Unlock()
+	feed.retention = max(feed.retention, 2*interval)
+}
+
+// publishedSince tells whether a change of the drawing has been made via the server since the given time
+func (feed *changeFeed) publishedSince(repoName string, drawingId string, since time.Time) bool {
+	feed.lock.Lock()
+	defer feed.lock.Unlock()
+	last, published := feed.lastPublished[repoName+"/"+drawingId]
+	return published && !last.Before(since)
+}
+
+func (feed *changeFeed) send(event changeEvent) {
+	feed.lock.Lock()
+	defer feed.lock.Unlock()
+	if !event.External && feed.retention > 0 {
+		for key, last := range feed.lastPublished {
+			if event.Timestamp.Sub(last) > feed.retention {
+				delete(feed.lastPublished, key)
+			}
+		}
+		feed.lastPublished[event.Repo+"/"+event.Id] = event.Timestamp
+	}
+	for subscriber := range feed.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			delete(feed.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+// subscribe returns the channel of the events, which is closed when the subscriber is dropped,
+// and the function ending the subscription
+func (feed *changeFeed) subscribe() (<-chan changeEvent, func()) {
+	subscriber := make(chan changeEvent, changeFeedBufferSize)
+
+	feed.lock.Lock()
+	feed.subscribers[subscriber] = struct{}{}
+	feed.lock.Unlock()
+
+	return subscriber, func() {
+		feed.lock.Lock()
+		defer feed.lock.Unlock()
+		if _, subscribed := feed.subscribers[subscriber]; subscribed {
+			delete(feed.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+// drawingChangeEvents streams the changes of the drawings in the repos the user may read as
+// server-sent events named after the type of the change
+func (hf *handlerFactory) drawingChangeEvents() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		logger := zerolog.Ctx(c.Request.Context())
+
+		user, userExtractErr := getUserFromContext(c)
+		if userExtractErr != nil {
+			logger.Error().Err(userExtractErr).Msg("failed to extract user from context")
+			abortWithError(c, http.StatusInternalServerError, userExtractErr)
+			return
+		}
+
+		events, unsubscribe := hf.changes.subscribe()
+		defer unsubscribe()
+
+		keepAlive := time.NewTicker(changeFeedKeepAlivePeriod)
+		defer keepAlive.Stop()
+
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Content-Type", "text/event-stream")
+		c.Status(http.StatusOK)
+		c.Writer.Flush() // lets the client know that it has subscribed
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case event, open := <-events:
+				if !open {
+					return false
+				}
+				if !hf.canRead(c, user.Username, drawingRepoName(event.Repo)) {
+					return true
+				}
+				c.SSEvent(string(event.Type), event)
+				return true
+			case <-keepAlive.C:
+				_, writeErr := io.WriteString(w, ":\n\n")
+				return writeErr == nil
+			case <-c.Request.Context().Done():
+				return false
+			}
+		})
+	}
+}
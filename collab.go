@@ -0,0 +1,677 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"myxcaliapp/backend/repoerr"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+)
+
+const (
+	collabPersistInterval = 10 * time.Second
+	collabSendBufferSize  = 64
+	collabWriteTimeout    = 10 * time.Second
+	collabPongTimeout     = 60 * time.Second
+	collabPingInterval    = collabPongTimeout * 9 / 10
+	collabMaxMessageSize  = 8 << 20
+)
+
+const (
+	collabMessageScene    = "scene"    // server -> client: the full scene, sent on joining and when replaced outside the session
+	collabMessageElements = "elements" // both ways: changed elements
+	collabMessagePointer  = "pointer"  // both ways: the pointer position of a user
+	collabMessagePresence = "presence" // server -> client: the users in the session
+	collabMessageConflict = "conflict" // server -> client: live changes weren't taken or couldn't be stored
+)
+
+type collabMessage struct {
+	Type      string              `json:"type"`
+	Elements  []excalidrawElement `json:"elements,omitempty"`
+	Pointer   json.RawMessage     `json:"pointer,omitempty"`
+	User      string              `json:"user,omitempty"`
+	Users     []string            `json:"users,omitempty"`
+	Message   string              `json:"message,omitempty"`
+	Conflicts []string            `json:"conflicts,omitempty"` // the ids of the elements changed differently elsewhere
+	Lock      *editLock           `json:"lock,omitempty"`      // the edit lock held by another user
+}
+
+// collabHub keeps track of the live editing sessions, one room per drawing
+type collabHub struct {
+	lock            sync.Mutex
+	rooms           map[string]*collabRoom
+	locks           *drawingLocks
+	editLocks       *editLocks
+	changes         *changeFeed
+	users           userDirectory
+	persistInterval time.Duration
+	upgrader        websocket.Upgrader
+}
+
+func newCollabHub(locks *drawingLocks, editLocks *editLocks, changes *changeFeed, users userDirectory) *collabHub {
+	return &collabHub{
+		rooms:           map[string]*collabRoom{},
+		locks:           locks,
+		editLocks:       editLocks,
+		changes:         changes,
+		users:           users,
+		persistInterval: collabPersistInterval,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  4096,
+			WriteBufferSize: 4096,
+		},
+	}
+}
+
+type collabClient struct {
+	user string
+	conn *websocket.Conn
+	send chan collabMessage
+}
+
+// collabRoom holds the scene being edited live. Changes are persisted periodically and when the
+// last client leaves.
+type collabRoom struct {
+	hub       *collabHub
+	key       string
+	repoName  string
+	drawingId string
+	repo      drawingRepo
+	logger    zerolog.Logger
+
+	lock          sync.Mutex
+	clients       map[*collabClient]struct{}
+	scene         map[string]json.RawMessage // the top-level properties of the scene, "elements" excluded
+	elements      []excalidrawElement
+	elementIndex  map[string]int
+	persisted     string // the content last loaded or stored, the base for merging with changes made elsewhere
+	dirty         bool
+	lastEditor    string
+	lockedBy      string // the holder of the edit lock the last persisting was refused for, if any
+	stopPersister chan struct{}
+}
+
+// joinRoom returns the room of the drawing, loading the drawing when the room is opened
+func (hub *collabHub) joinRoom(ctx context.Context, repoName string, drawingId string, repo drawingRepo, client *collabClient, logger zerolog.Logger) (*collabRoom, error) {
+	key := editLockKey(repoName, drawingId)
+
+	hub.lock.Lock()
+	_, exists := hub.rooms[key]
+	hub.lock.Unlock()
+
+	// The drawing is loaded without holding the hub lock, so that a slow store doesn't hold up
+	// the other rooms; should the room have been opened meanwhile, the content is dropped.
+	var content string
+	if !exists {
+		var getErr error
+		content, getErr = repo.GetDrawing(ctx, drawingId)
+		if getErr != nil && !errors.Is(getErr, repoerr.ErrNotFound) {
+			return nil, getErr
+		}
+	}
+
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+
+	room, exists := hub.rooms[key]
+	if !exists {
+		room = &collabRoom{
+			hub:           hub,
+			key:           key,
+			repoName:      repoName,
+			drawingId:     drawingId,
+			repo:          repo,
+			logger:        logger.With().Str("collabRoom", key).Logger(),
+			clients:       map[*collabClient]struct{}{},
+			persisted:     content,
+			stopPersister: make(chan struct{}),
+		}
+		if resetErr := room.resetLocked(content); resetErr != nil {
+			return nil, fmt.Errorf("%w: %w", repoerr.ErrInvalidInput, resetErr)
+		}
+		hub.rooms[key] = room
+		go room.persistPeriodically()
+	}
+
+	room.lock.Lock()
+	room.clients[client] = struct{}{}
+	client.send <- collabMessage{Type: collabMessageScene, Elements: append([]excalidrawElement{}, room.elements...)}
+	room.broadcastPresence()
+	room.lock.Unlock()
+
+	return room, nil
+}
+
+// leave removes the client; the room is closed and its changes are persisted when it was the last one
+func (room *collabRoom) leave(client *collabClient) {
+	room.hub.lock.Lock()
+	room.lock.Lock()
+	delete(room.clients, client)
+	close(client.send)
+	last := len(room.clients) == 0
+	if last {
+		delete(room.hub.rooms, room.key)
+		close(room.stopPersister)
+	} else {
+		room.broadcastPresence()
+	}
+	room.lock.Unlock()
+	room.hub.lock.Unlock()
+
+	if last {
+		room.persist()
+	}
+}
+
+// broadcast must be called with the room lock held
+func (room *collabRoom) broadcast(message collabMessage, except *collabClient) {
+	for client := range room.clients {
+		if client == except {
+			continue
+		}
+		select {
+		case client.send <- message:
+		default:
+			// The client can't keep up; it gets closed and will have to rejoin for a fresh scene
+			room.logger.Info().Str("user", client.user).Msg("dropping slow client")
+			client.conn.Close()
+		}
+	}
+}
+
+// rejectElements sends the scene back to the client whose changes weren't taken because of the
+// edit lock held by another user, so that the client drops them
+func (room *collabRoom) rejectElements(client *collabClient, current editLock) {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	for _, message := range []collabMessage{
+		{Type: collabMessageScene, Elements: append([]excalidrawElement{}, room.elements...)},
+		{Type: collabMessageConflict, Message: errEditLockHeld.Error(), Lock: &current},
+	} {
+		select {
+		case client.send <- message:
+		default:
+			room.logger.Info().Str("user", client.user).Msg("dropping slow client")
+			client.conn.Close()
+			return
+		}
+	}
+}
+
+// broadcastPresence must be called with the room lock held
+func (room *collabRoom) broadcastPresence() {
+	users := []string{}
+	seen := map[string]struct{}{}
+	for client := range room.clients {
+		if _, duplicate := seen[client.user]; !duplicate {
+			seen[client.user] = struct{}{}
+			users = append(users, client.user)
+		}
+	}
+	room.broadcast(collabMessage{Type: collabMessagePresence, Users: users}, nil)
+}
+
+// elementVersion returns the "version" and the "versionNonce" of an element
+func elementVersion(element excalidrawElement) (float64, float64) {
+	version, _ := element["version"].(float64)
+	nonce, _ := element["versionNonce"].(float64)
+	return version, nonce
+}
+
+// applyElements takes the elements newer than the ones in the scene, the same way Excalidraw
+// reconciles remote elements: the higher version wins, on a tie the lower nonce.
+// It returns the elements taken.
+func (room *collabRoom) applyElements(elements []excalidrawElement, user string) []excalidrawElement {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
+	accepted := room.applyElementsLocked(elements)
+	if len(accepted) > 0 {
+		room.dirty = true
+		room.lastEditor = user
+	}
+	return accepted
+}
+
+// applyElementsLocked must be called with the room lock held
+func (room *collabRoom) applyElementsLocked(elements []excalidrawElement) []excalidrawElement {
+	accepted := []excalidrawElement{}
+	for _, element := range elements {
+		id := element.id()
+		if len(id) == 0 {
+			continue
+		}
+		index, exists := room.elementIndex[id]
+		if exists {
+			version, nonce := elementVersion(element)
+			currentVersion, currentNonce := elementVersion(room.elements[index])
+			if version < currentVersion || (version == currentVersion && nonce >= currentNonce) {
+				continue
+			}
+			room.elements[index] = element
+		} else {
+			room.elementIndex[id] = len(room.elements)
+			room.elements = append(room.elements, element)
+		}
+		accepted = append(accepted, element)
+	}
+	return accepted
+}
+
+// resetLocked replaces the scene of the room with the given content. It must be called with the
+// room lock held, unless the room isn't shared yet.
+func (room *collabRoom) resetLocked(content string) error {
+	scene, elements, parseErr := parseSceneForMerge(content)
+	if parseErr != nil {
+		return parseErr
+	}
+	delete(scene, "elements")
+	room.scene = scene
+	room.elements = nil
+	room.elementIndex = map[string]int{}
+	for _, element := range elements {
+		room.elementIndex[element.id()] = len(room.elements)
+		room.elements = append(room.elements, element)
+	}
+	return nil
+}
+
+// contentLocked returns the scene of the room as stored. It must be called with the room lock held.
+func (room *collabRoom) contentLocked() (string, error) {
+	scene := map[string]json.RawMessage{}
+	for name, value := range room.scene {
+		scene[name] = value
+	}
+	elements, marshalElementsErr := json.Marshal(room.elements)
+	if marshalElementsErr != nil {
+		return "", fmt.Errorf("failed to marshal elements: %w", marshalElementsErr)
+	}
+	scene["elements"] = elements
+	sceneBytes, marshalSceneErr := json.Marshal(scene)
+	if marshalSceneErr != nil {
+		return "", fmt.Errorf("failed to marshal scene: %w", marshalSceneErr)
+	}
+	return string(sceneBytes), nil
+}
+
+// reloadFromStore replaces the scene of the room open for the drawing, if any, with the one stored
+// outside the live session (e.g. by a checkout or a revert), and sends it to the clients in full.
+// Live changes not persisted yet are merged in where they don't conflict with the stored ones.
+func (hub *collabHub) reloadFromStore(repoName string, drawingId string) {
+	hub.lock.Lock()
+	room, exists := hub.rooms[repoName+"/"+drawingId]
+	hub.lock.Unlock()
+	if !exists {
+		return
+	}
+
+	stored, getErr := room.repo.GetDrawing(context.Background(), drawingId)
+	if getErr != nil {
+		room.logger.Info().Err(getErr).Msg("failed to reload the drawing changed outside the live session")
+		return
+	}
+
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
+	content := stored
+	keptLiveChanges := false
+	if room.dirty {
+		live, liveErr := room.contentLocked()
+		if liveErr != nil {
+			room.logger.Error().Err(liveErr).Msg("failed to merge live changes with the drawing changed outside the live session")
+		} else {
+			merged, conflicts, mergeErr := mergeScenes(room.persisted, live, stored)
+			switch {
+			case mergeErr != nil:
+				room.logger.Warn().Err(mergeErr).Msg("failed to merge live changes with the drawing changed outside the live session, dropping them")
+			case len(conflicts) > 0:
+				room.logger.Warn().Strs("conflicts", conflicts).Msg("live changes conflict with the drawing changed outside the live session, dropping them")
+			default:
+				content = merged
+				keptLiveChanges = true
+			}
+		}
+	}
+
+	if resetErr := room.resetLocked(content); resetErr != nil {
+		room.logger.Info().Err(resetErr).Msg("failed to parse the drawing changed outside the live session")
+		return
+	}
+	room.persisted = stored
+	room.dirty = keptLiveChanges && content != stored
+	room.broadcast(collabMessage{Type: collabMessageScene, Elements: append([]excalidrawElement{}, room.elements...)}, nil)
+	room.logger.Debug().Bool("keptLiveChanges", keptLiveChanges).Msg("reloaded the drawing changed outside the live session")
+}
+
+func (room *collabRoom) persistPeriodically() {
+	ticker := time.NewTicker(room.hub.persistInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			room.persist()
+		case <-room.stopPersister:
+			return
+		}
+	}
+}
+
+// persist stores the scene if it has changed, unless another user holds the edit lock of the
+// drawing. Changes stored elsewhere in the meantime (e.g. via the REST API) are merged in; where
+// they conflict with the live ones, the stored ones win and the clients are told.
+func (room *collabRoom) persist() {
+	room.lock.Lock()
+	if !room.dirty {
+		room.lock.Unlock()
+		return
+	}
+	content, contentErr := room.contentLocked()
+	base := room.persisted
+	modifiedBy := room.lastEditor
+	room.dirty = false
+	room.lock.Unlock()
+
+	markDirty := func() {
+		room.lock.Lock()
+		room.dirty = true
+		room.lock.Unlock()
+	}
+
+	if contentErr != nil {
+		room.logger.Error().Err(contentErr).Msg("failed to marshal live scene")
+		return
+	}
+
+	if current, allowed := room.hub.editLocks.check(room.key, modifiedBy); !allowed {
+		room.logger.Info().Str("lockHolder", current.Holder).Msg("not persisting live scene of a drawing locked by another user")
+		room.lock.Lock()
+		room.dirty = true
+		if room.lockedBy != current.Holder {
+			room.lockedBy = current.Holder
+			room.broadcast(collabMessage{Type: collabMessageConflict, Message: errEditLockHeld.Error(), Lock: &current}, nil)
+		}
+		room.lock.Unlock()
+		return
+	}
+
+	author := room.hub.users.author(modifiedBy)
+	ctx := withCommitInfo(context.Background(), commitInfo{author: &author})
+	release := room.hub.locks.acquire(room.repoName, room.drawingId)
+	defer release()
+
+	live := content
+	var conflicts []string
+	stored, getErr := room.repo.GetDrawing(ctx, room.drawingId)
+	if getErr == nil && stored != base {
+		var merged string
+		var mergeErr error
+		merged, conflicts, mergeErr = mergeScenes(base, stored, content)
+		if mergeErr == nil && len(conflicts) > 0 {
+			merged, mergeErr = takeStoredElements(base, stored, content, conflicts)
+		}
+		if mergeErr != nil {
+			room.logger.Warn().Err(mergeErr).Msg("failed to merge with changes stored elsewhere, overwriting them")
+		} else {
+			content = merged
+		}
+	}
+
+	putErr := room.repo.PutDrawing(ctx, room.drawingId, strings.NewReader(content), modifiedBy)
+	if putErr != nil {
+		room.logger.Error().Err(putErr).Msg("failed to persist live scene")
+		markDirty()
+		return
+	}
+
+	room.lock.Lock()
+	room.persisted = content
+	room.lockedBy = ""
+	if content != live {
+		if absorbErr := room.absorbLocked(live, content); absorbErr != nil {
+			room.logger.Error().Err(absorbErr).Msg("failed to take the changes stored elsewhere into the live scene")
+		}
+	}
+	if len(conflicts) > 0 {
+		room.logger.Info().Strs("conflicts", conflicts).Msg("conflicting changes stored elsewhere took precedence")
+		room.broadcast(collabMessage{Type: collabMessageConflict, Message: "changes stored elsewhere took precedence", Conflicts: conflicts}, nil)
+	}
+	room.lock.Unlock()
+	room.hub.changes.publish(drawingUpdated, room.repoName, room.drawingId, modifiedBy)
+	room.logger.Debug().Str("modifiedBy", modifiedBy).Msg("live scene persisted")
+}
+
+// takeStoredElements merges the live changes with those stored elsewhere since the base, taking
+// the stored states of the conflicting elements
+func takeStoredElements(base string, stored string, live string, conflicts []string) (string, error) {
+	liveScene, liveElements, liveErr := parseSceneForMerge(live)
+	if liveErr != nil {
+		return "", liveErr
+	}
+	_, storedElements, storedErr := parseSceneForMerge(stored)
+	if storedErr != nil {
+		return "", storedErr
+	}
+	storedById := elementsById(storedElements)
+	conflicting := map[string]struct{}{}
+	for _, id := range conflicts {
+		conflicting[id] = struct{}{}
+	}
+
+	elements := []excalidrawElement{}
+	for _, element := range liveElements {
+		if _, isConflict := conflicting[element.id()]; !isConflict {
+			elements = append(elements, element)
+		} else if storedElement, isStored := storedById[element.id()]; isStored {
+			elements = append(elements, storedElement)
+		}
+	}
+	elementsBytes, marshalElementsErr := json.Marshal(elements)
+	if marshalElementsErr != nil {
+		return "", fmt.Errorf("failed to marshal elements: %w", marshalElementsErr)
+	}
+	liveScene["elements"] = elementsBytes
+	sceneBytes, marshalSceneErr := json.Marshal(liveScene)
+	if marshalSceneErr != nil {
+		return "", fmt.Errorf("failed to marshal scene: %w", marshalSceneErr)
+	}
+
+	merged, remaining, mergeErr := mergeScenes(base, stored, string(sceneBytes))
+	if mergeErr != nil {
+		return "", mergeErr
+	}
+	if len(remaining) > 0 {
+		return "", fmt.Errorf("unresolved conflicts: %v", remaining)
+	}
+	return merged, nil
+}
+
+// absorbLocked takes the changes between the scene persisted and the content stored, i.e. the
+// ones merged in from elsewhere, into the live scene and sends it to the clients. Elements
+// changed live in the meantime are left alone. It must be called with the room lock held.
+func (room *collabRoom) absorbLocked(persisted string, stored string) error {
+	_, before, beforeErr := parseSceneForMerge(persisted)
+	if beforeErr != nil {
+		return beforeErr
+	}
+	storedScene, after, afterErr := parseSceneForMerge(stored)
+	if afterErr != nil {
+		return afterErr
+	}
+	delete(storedScene, "elements")
+	room.scene = storedScene
+
+	beforeById := elementsById(before)
+	afterById := elementsById(after)
+	current := elementsById(room.elements)
+	ids := []string{}
+	for _, element := range after {
+		ids = append(ids, element.id())
+	}
+	for _, element := range before {
+		if _, kept := afterById[element.id()]; !kept {
+			ids = append(ids, element.id())
+		}
+	}
+	for _, id := range ids {
+		if sameElementRevision(beforeById[id], afterById[id]) || !sameElementRevision(current[id], beforeById[id]) {
+			continue
+		}
+		if afterById[id] == nil {
+			delete(current, id)
+		} else {
+			current[id] = afterById[id]
+		}
+	}
+
+	elements := []excalidrawElement{}
+	for _, element := range room.elements {
+		if kept, exists := current[element.id()]; exists {
+			elements = append(elements, kept)
+			delete(current, element.id())
+		}
+	}
+	for _, element := range after {
+		if added, exists := current[element.id()]; exists {
+			elements = append(elements, added)
+		}
+	}
+	room.elements = elements
+	room.elementIndex = map[string]int{}
+	for index, element := range elements {
+		room.elementIndex[element.id()] = index
+	}
+	room.broadcast(collabMessage{Type: collabMessageScene, Elements: append([]excalidrawElement{}, room.elements...)}, nil)
+	return nil
+}
+
+func (client *collabClient) writePump() {
+	ticker := time.NewTicker(collabPingInterval)
+	defer func() {
+		ticker.Stop()
+		client.conn.Close()
+	}()
+
+	for {
+		select {
+		case message, open := <-client.send:
+			client.conn.SetWriteDeadline(time.Now().Add(collabWriteTimeout))
+			if !open {
+				client.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if writeErr := client.conn.WriteJSON(message); writeErr != nil {
+				return
+			}
+		case <-ticker.C:
+			client.conn.SetWriteDeadline(time.Now().Add(collabWriteTimeout))
+			if pingErr := client.conn.WriteMessage(websocket.PingMessage, nil); pingErr != nil {
+				return
+			}
+		}
+	}
+}
+
+func (client *collabClient) readPump(room *collabRoom, logger zerolog.Logger) {
+	client.conn.SetReadLimit(collabMaxMessageSize)
+	client.conn.SetReadDeadline(time.Now().Add(collabPongTimeout))
+	client.conn.SetPongHandler(func(string) error {
+		return client.conn.SetReadDeadline(time.Now().Add(collabPongTimeout))
+	})
+
+	for {
+		var message collabMessage
+		readErr := client.conn.ReadJSON(&message)
+		if readErr != nil {
+			if websocket.IsUnexpectedCloseError(readErr, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				logger.Info().Err(readErr).Msg("live connection closed unexpectedly")
+			}
+			return
+		}
+
+		switch message.Type {
+		case collabMessageElements:
+			if current, allowed := room.hub.editLocks.check(room.key, client.user); !allowed {
+				logger.Info().Str("lockHolder", current.Holder).Msg("rejecting live changes to a drawing locked by another user")
+				room.rejectElements(client, current)
+				continue
+			}
+			accepted := room.applyElements(message.Elements, client.user)
+			if len(accepted) > 0 {
+				room.lock.Lock()
+				room.broadcast(collabMessage{Type: collabMessageElements, Elements: accepted, User: client.user}, client)
+				room.lock.Unlock()
+			}
+		case collabMessagePointer:
+			room.lock.Lock()
+			room.broadcast(collabMessage{Type: collabMessagePointer, Pointer: message.Pointer, User: client.user}, client)
+			room.lock.Unlock()
+		default:
+			logger.Debug().Str("messageType", message.Type).Msg("ignoring unknown message type")
+		}
+	}
+}
+
+func (hf *handlerFactory) liveDrawing() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		repoName := c.Param("repo")
+		drawingId := c.Param("id")
+
+		logger := zerolog.Ctx(c.Request.Context()).With().Str("repoName", repoName).Str("drawingId", drawingId).Logger()
+
+		user, userExtractErr := getUserFromContext(c)
+		if userExtractErr != nil {
+			logger.Error().Err(userExtractErr).Msg("failed to extract user from context")
+			abortWithError(c, http.StatusInternalServerError, userExtractErr)
+			return
+		}
+
+		repo, hasRepo := hf.repos.getRepo(drawingRepoName(repoName))
+		if !hasRepo {
+			logger.Info().Msg("failed to find repo")
+			abortWithError(c, http.StatusNotFound, unknownRepoError(repoName))
+			return
+		}
+		if !hf.checkedOutOnly(c, logger, repoName) {
+			return
+		}
+
+		if !hf.checkEditLock(c, logger, repoName, drawingId, user.Username) {
+			return
+		}
+
+		conn, upgradeErr := hf.collab.upgrader.Upgrade(c.Writer, c.Request, nil)
+		if upgradeErr != nil {
+			// The upgrader has already responded
+			logger.Info().Err(upgradeErr).Msg("failed to upgrade to WebSocket")
+			return
+		}
+
+		client := &collabClient{
+			user: user.Username,
+			conn: conn,
+			send: make(chan collabMessage, collabSendBufferSize),
+		}
+		room, joinErr := hf.collab.joinRoom(c.Request.Context(), repoName, drawingId, repo, client, logger)
+		if joinErr != nil {
+			logger.Error().Err(joinErr).Msg("failed to open live session")
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "failed to load drawing"))
+			conn.Close()
+			return
+		}
+		logger.Debug().Str("user", user.Username).Msg("joined live session")
+
+		go client.writePump()
+		client.readPump(room, logger)
+		room.leave(client)
+		logger.Debug().Str("user", user.Username).Msg("left live session")
+	}
+}
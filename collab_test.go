@@ -0,0 +1,282 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/suite"
+)
+
+type collabTestSuite struct {
+	suite.Suite
+	repo       *memoryStore
+	httpServer *httptest.Server
+}
+
+func TestCollab(t *testing.T) {
+	suite.Run(t, &collabTestSuite{})
+}
+
+func (t *collabTestSuite) SetupTest() {
+	gin.SetMode(gin.TestMode)
+	useTestPasswordFile(t.T())
+	s := newTestServer(t.T(), drawingReposConfigs{
+		firstTestRepo: drawingRepoConfig{name: firstTestRepo, label: "First Repo", storeType: MEMORY},
+	})
+	repo, _ := s.repos.getRepo(firstTestRepo)
+	t.repo = repo.(*memoryStore)
+	t.httpServer = httptest.NewServer(s.createEngine())
+}
+
+func (t *collabTestSuite) TearDownTest() {
+	t.httpServer.Close()
+}
+
+func (t *collabTestSuite) connect(drawingId string) *websocket.Conn {
+	header := http.Header{}
+	request, _ := http.NewRequest(http.MethodGet, "/", nil)
+	request.SetBasicAuth(testUser, "pass")
+	header.Set("Authorization", request.Header.Get("Authorization"))
+
+	url := "ws" + strings.TrimPrefix(t.httpServer.URL, "http") + "/api/drawing/" + firstTestRepo + "/" + drawingId + "/live"
+	conn, _, dialErr := websocket.DefaultDialer.Dial(url, header)
+	t.Require().NoError(dialErr)
+	return conn
+}
+
+// receive returns the next message of the given type, skipping the others
+func (t *collabTestSuite) receive(conn *websocket.Conn, messageType string) collabMessage {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var message collabMessage
+		t.Require().NoError(conn.ReadJSON(&message))
+		if message.Type == messageType {
+			return message
+		}
+	}
+}
+
+func (t *collabTestSuite) TestLiveEditing() {
+	ctx := t.T().Context()
+	t.Require().NoError(t.repo.PutDrawing(ctx, "drawing", strings.NewReader(`{"type":"excalidraw","elements":[{"id":"a","x":0,"version":1,"versionNonce":1}]}`), "someone"))
+
+	first := t.connect("drawing")
+	defer first.Close()
+	initial := t.receive(first, collabMessageScene)
+	t.Len(initial.Elements, 1)
+
+	second := t.connect("drawing")
+	defer second.Close()
+	t.receive(second, collabMessageScene)
+	presence := t.receive(first, collabMessagePresence)
+	t.Equal([]string{testUser}, presence.Users)
+
+	t.Require().NoError(first.WriteJSON(collabMessage{
+		Type: collabMessageElements,
+		Elements: []excalidrawElement{
+			{"id": "a", "x": float64(5), "version": float64(2), "versionNonce": float64(2)},
+			{"id": "b", "x": float64(1), "version": float64(1), "versionNonce": float64(3)},
+		},
+	}))
+	update := t.receive(second, collabMessageElements)
+	t.Len(update.Elements, 2)
+	t.Equal(testUser, update.User)
+
+	t.Require().NoError(second.WriteJSON(collabMessage{Type: collabMessagePointer, Pointer: []byte(`{"x":10,"y":20}`)}))
+	pointer := t.receive(first, collabMessagePointer)
+	t.JSONEq(`{"x":10,"y":20}`, string(pointer.Pointer))
+
+	first.Close()
+	second.Close()
+
+	t.Eventually(func() bool {
+		content, getErr := t.repo.GetDrawing(ctx, "drawing")
+		if getErr != nil {
+			return false
+		}
+		elements, parseErr := parseSceneElements(content)
+		return parseErr == nil && len(elements) == 2 && elements["a"]["x"] == float64(5)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// joinTestRoom opens a live session on the drawing without a connection, returning what it's sent
+func (t *collabTestSuite) joinTestRoom(hub *collabHub, repo drawingRepo, drawingId string) (*collabRoom, chan collabMessage) {
+	client := &collabClient{user: testUser, send: make(chan collabMessage, collabSendBufferSize)}
+	room, joinErr := hub.joinRoom(t.T().Context(), firstTestRepo, drawingId, repo, client, getLogger())
+	t.Require().NoError(joinErr)
+	t.T().Cleanup(func() { room.leave(client) })
+	t.Equal(collabMessageScene, (<-client.send).Type)
+	return room, client.send
+}
+
+// receiveQueued returns the next queued message of the given type, skipping the others
+func (t *collabTestSuite) receiveQueued(send chan collabMessage, messageType string) collabMessage {
+	for {
+		select {
+		case message := <-send:
+			if message.Type == messageType {
+				return message
+			}
+		case <-time.After(5 * time.Second):
+			t.FailNow("no message of type " + messageType)
+		}
+	}
+}
+
+func (t *collabTestSuite) TestReloadReplacesScene() {
+	ctx := t.T().Context()
+	repo := newMemoryStore()
+	hub := newCollabHub(newDrawingLocks(), newEditLocks(editLockTTL), newChangeFeed(), userDirectory{})
+	t.Require().NoError(repo.PutDrawing(ctx, "drawing", strings.NewReader(`{"elements":[{"id":"a","version":3,"versionNonce":1},{"id":"b","version":1,"versionNonce":1}]}`), "someone"))
+	room, send := t.joinTestRoom(hub, repo, "drawing")
+
+	// e.g. a revert: "a" goes back to an older version, "b" didn't exist then
+	reverted := `{"elements":[{"id":"a","version":2,"versionNonce":5}]}`
+	t.Require().NoError(repo.PutDrawing(ctx, "drawing", strings.NewReader(reverted), "someone"))
+	hub.reloadFromStore(firstTestRepo, "drawing")
+
+	reset := t.receiveQueued(send, collabMessageScene)
+	t.Equal([]excalidrawElement{{"id": "a", "version": float64(2), "versionNonce": float64(5)}}, reset.Elements)
+
+	room.persist()
+	t.Equal(reverted, t.mustGetDrawing(repo, "drawing"), "the stale scene isn't written back")
+
+	room.applyElements([]excalidrawElement{{"id": "c", "version": float64(1), "versionNonce": float64(1)}}, testUser)
+	room.persist()
+	elements, parseErr := parseSceneElements(t.mustGetDrawing(repo, "drawing"))
+	t.Require().NoError(parseErr)
+	t.Len(elements, 2)
+	t.Equal(float64(2), elements["a"]["version"])
+	t.NotContains(elements, "b")
+}
+
+func (t *collabTestSuite) TestReloadKeepsLiveChanges() {
+	ctx := t.T().Context()
+	repo := newMemoryStore()
+	hub := newCollabHub(newDrawingLocks(), newEditLocks(editLockTTL), newChangeFeed(), userDirectory{})
+	t.Require().NoError(repo.PutDrawing(ctx, "drawing", strings.NewReader(`{"elements":[{"id":"a","version":1,"versionNonce":1},{"id":"b","version":1,"versionNonce":1}]}`), "someone"))
+	room, send := t.joinTestRoom(hub, repo, "drawing")
+
+	room.applyElements([]excalidrawElement{{"id": "c", "version": float64(1), "versionNonce": float64(1)}}, testUser)
+	t.Require().NoError(repo.PutDrawing(ctx, "drawing", strings.NewReader(`{"elements":[{"id":"a","version":1,"versionNonce":1}]}`), "someone"))
+	hub.reloadFromStore(firstTestRepo, "drawing")
+
+	reset := t.receiveQueued(send, collabMessageScene)
+	ids := []string{}
+	for _, element := range reset.Elements {
+		ids = append(ids, element.id())
+	}
+	t.Equal([]string{"a", "c"}, ids, "the element removed outside is gone, the one added live is kept")
+
+	room.persist()
+	elements, parseErr := parseSceneElements(t.mustGetDrawing(repo, "drawing"))
+	t.Require().NoError(parseErr)
+	t.Len(elements, 2)
+	t.NotContains(elements, "b")
+}
+
+func (t *collabTestSuite) mustGetDrawing(repo drawingRepo, drawingId string) string {
+	content, getErr := repo.GetDrawing(t.T().Context(), drawingId)
+	t.Require().NoError(getErr)
+	return content
+}
+
+// lockAs takes the edit lock of the drawing for the user
+func (t *collabTestSuite) lockAs(username string, drawingId string) {
+	request, _ := http.NewRequest(http.MethodPut, t.httpServer.URL+"/api/drawing/"+firstTestRepo+"/"+drawingId+"/lock", nil)
+	request.SetBasicAuth(username, "pass")
+	response, requestErr := http.DefaultClient.Do(request)
+	t.Require().NoError(requestErr)
+	response.Body.Close()
+	t.Require().Equal(http.StatusOK, response.StatusCode)
+}
+
+func (t *collabTestSuite) TestEditLocks() {
+	t.Require().NoError(t.repo.PutDrawing(t.T().Context(), "drawing", strings.NewReader(`{"elements":[{"id":"a","version":1,"versionNonce":1}]}`), "someone"))
+	conn := t.connect("drawing")
+	defer conn.Close()
+	t.receive(conn, collabMessageScene)
+
+	t.lockAs(otherTestUser, "drawing")
+	t.Require().NoError(conn.WriteJSON(collabMessage{
+		Type:     collabMessageElements,
+		Elements: []excalidrawElement{{"id": "a", "version": float64(2), "versionNonce": float64(2)}},
+	}))
+	reset := t.receive(conn, collabMessageScene)
+	t.Equal(float64(1), reset.Elements[0]["version"], "the rejected change is reverted")
+	conflict := t.receive(conn, collabMessageConflict)
+	t.Equal(otherTestUser, conflict.Lock.Holder)
+
+	url := "ws" + strings.TrimPrefix(t.httpServer.URL, "http") + "/api/drawing/" + firstTestRepo + "/drawing/live"
+	request, _ := http.NewRequest(http.MethodGet, "/", nil)
+	request.SetBasicAuth(testUser, "pass")
+	_, response, dialErr := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": request.Header["Authorization"]})
+	t.Error(dialErr)
+	t.Require().NotNil(response)
+	t.Equal(http.StatusLocked, response.StatusCode, "joining a drawing locked by another user is refused")
+}
+
+func (t *collabTestSuite) TestPersistingRespectsEditLocks() {
+	ctx := t.T().Context()
+	repo := newMemoryStore()
+	editLocks := newEditLocks(editLockTTL)
+	hub := newCollabHub(newDrawingLocks(), editLocks, newChangeFeed(), userDirectory{})
+	original := `{"elements":[{"id":"a","version":1,"versionNonce":1}]}`
+	t.Require().NoError(repo.PutDrawing(ctx, "drawing", strings.NewReader(original), "someone"))
+	room, send := t.joinTestRoom(hub, repo, "drawing")
+
+	room.applyElements([]excalidrawElement{{"id": "a", "version": float64(2), "versionNonce": float64(2)}}, testUser)
+	_, acquireErr := editLocks.acquire(editLockKey(firstTestRepo, "drawing"), otherTestUser)
+	t.Require().NoError(acquireErr)
+	room.persist()
+
+	t.Equal(original, t.mustGetDrawing(repo, "drawing"))
+	conflict := t.receiveQueued(send, collabMessageConflict)
+	t.Equal(otherTestUser, conflict.Lock.Holder)
+
+	_, releaseErr := editLocks.release(editLockKey(firstTestRepo, "drawing"), otherTestUser, false)
+	t.Require().NoError(releaseErr)
+	room.persist()
+	elements, parseErr := parseSceneElements(t.mustGetDrawing(repo, "drawing"))
+	t.Require().NoError(parseErr)
+	t.Equal(float64(2), elements["a"]["version"], "the live changes are stored once the lock is released")
+}
+
+func (t *collabTestSuite) TestConflictingChangesStoredElsewhere() {
+	ctx := t.T().Context()
+	repo := newMemoryStore()
+	hub := newCollabHub(newDrawingLocks(), newEditLocks(editLockTTL), newChangeFeed(), userDirectory{})
+	t.Require().NoError(repo.PutDrawing(ctx, "drawing", strings.NewReader(`{"elements":[{"id":"a","version":1,"versionNonce":1},{"id":"b","version":1,"versionNonce":1}]}`), "someone"))
+	room, send := t.joinTestRoom(hub, repo, "drawing")
+
+	room.applyElements([]excalidrawElement{
+		{"id": "a", "version": float64(2), "versionNonce": float64(2)},
+		{"id": "c", "version": float64(1), "versionNonce": float64(1)},
+	}, testUser)
+	// e.g. a REST save, not seen by the live session
+	t.Require().NoError(repo.PutDrawing(ctx, "drawing", strings.NewReader(`{"elements":[{"id":"a","version":3,"versionNonce":3},{"id":"b","version":2,"versionNonce":2}]}`), "someone"))
+	room.persist()
+
+	elements, parseErr := parseSceneElements(t.mustGetDrawing(repo, "drawing"))
+	t.Require().NoError(parseErr)
+	t.Equal(float64(3), elements["a"]["version"], "the stored change wins the conflict")
+	t.Equal(float64(2), elements["b"]["version"])
+	t.Contains(elements, "c")
+	reset := t.receiveQueued(send, collabMessageScene)
+	t.Len(reset.Elements, 3)
+	conflict := t.receiveQueued(send, collabMessageConflict)
+	t.Equal([]string{"a"}, conflict.Conflicts)
+
+	room.applyElements([]excalidrawElement{{"id": "d", "version": float64(1), "versionNonce": float64(1)}}, testUser)
+	room.persist()
+	elements, parseErr = parseSceneElements(t.mustGetDrawing(repo, "drawing"))
+	t.Require().NoError(parseErr)
+	t.Len(elements, 4)
+	t.Equal(float64(3), elements["a"]["version"], "the stored changes were taken into the live scene")
+	t.Equal(float64(2), elements["b"]["version"])
+}
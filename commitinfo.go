@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxCommitMessageLength limits the commit messages given by the clients
+const maxCommitMessageLength = 4096
+
+// commitAuthor is the identity recorded as the author of the commits made on behalf of a user
+type commitAuthor struct {
+	name  string
+	email string
+}
+
+// userDirectoryEntry holds the details of a user recorded in the commits made on their behalf
+type userDirectoryEntry struct {
+	FullName string `json:"fullName"`
+	Email    string `json:"email"`
+}
+
+// userDirectory maps usernames to the details of the users. It is read from a JSON file such as
+//
+//	{"jdoe": {"fullName": "Jane Doe", "email": "jane.doe@example.com"}}
+type userDirectory map[string]userDirectoryEntry
+
+func loadUserDirectory(fileName string) (userDirectory, error) {
+	content, readErr := os.ReadFile(fileName)
+	if readErr != nil {
+		return nil, fmt.Errorf("failed to read user directory %s: %w", fileName, readErr)
+	}
+	users := userDirectory{}
+	if unmarshalErr := json.Unmarshal(content, &users); unmarshalErr != nil {
+		return nil, fmt.Errorf("failed to parse user directory %s: %w", fileName, unmarshalErr)
+	}
+	return users, nil
+}
+
+// author returns the commit identity of the user; the username stands in for the details
+// missing from the directory
+func (users userDirectory) author(username string) commitAuthor {
+	author := commitAuthor{name: username, email: username}
+	if entry, found := users[username]; found {
+		if len(entry.FullName) > 0 {
+			author.name = entry.FullName
+		}
+		if len(entry.Email) > 0 {
+			author.email = entry.Email
+		}
+	}
+	return author
+}
+
+// commitInfo is passed to the stores in the context of the writes, so that version-controlled
+// stores can record the message and the author given with the request
+type commitInfo struct {
+	message string // replaces the message generated by the store when not empty
+	author  *commitAuthor
+}
+
+type commitInfoKey struct{}
+
+func withCommitInfo(ctx context.Context, info commitInfo) context.Context {
+	return context.WithValue(ctx, commitInfoKey{}, info)
+}
+
+// commitDetails returns the message and the author of a commit made by a store on behalf of the
+// user, falling back to the message given and to the username as both the name and the email of
+// the author when the context doesn't tell
+func commitDetails(ctx context.Context, modifiedBy string, defaultMessage string) (string, commitAuthor) {
+	message := defaultMessage
+	author := commitAuthor{name: modifiedBy, email: modifiedBy}
+	if info, hasInfo := ctx.Value(commitInfoKey{}).(commitInfo); hasInfo {
+		if len(info.message) > 0 {
+			message = info.message
+		}
+		if info.author != nil {
+			author = *info.author
+		}
+	}
+	return message, author
+}
+
+// checkCommitMessage normalizes the commit message given by a client
+func checkCommitMessage(message string) (string, error) {
+	message = strings.TrimSpace(message)
+	if len(message) > maxCommitMessageLength {
+		return "", fmt.Errorf("commit message longer than %d bytes", maxCommitMessageLength)
+	}
+	return message, nil
+}
+
+// commitContext returns the context for the writes made on behalf of the user of the request
+func (hf *handlerFactory) commitContext(c *gin.Context, username string, message string) context.Context {
+	author := hf.users.author(username)
+	return withCommitInfo(c.Request.Context(), commitInfo{message: message, author: &author})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type commitInfoTestSuite struct {
+	suite.Suite
+}
+
+func TestCommitInfo(t *testing.T) {
+	suite.Run(t, &commitInfoTestSuite{})
+}
+
+func (t *commitInfoTestSuite) TestUserDirectory() {
+	fileName := filepath.Join(t.T().TempDir(), "users.json")
+	t.Require().NoError(os.WriteFile(fileName, []byte(`{"jdoe": {"fullName": "Jane Doe", "email": "jane.doe@example.com"}, "joe": {"email": "joe@example.com"}}`), 0o600))
+
+	users, loadErr := loadUserDirectory(fileName)
+	t.Require().NoError(loadErr)
+
+	t.Equal(commitAuthor{name: "Jane Doe", email: "jane.doe@example.com"}, users.author("jdoe"))
+	t.Equal(commitAuthor{name: "joe", email: "joe@example.com"}, users.author("joe"))
+	t.Equal(commitAuthor{name: "someone", email: "someone"}, users.author("someone"))
+}
+
+func (t *commitInfoTestSuite) TestInvalidUserDirectory() {
+	fileName := filepath.Join(t.T().TempDir(), "users.json")
+	t.Require().NoError(os.WriteFile(fileName, []byte(`["jdoe"]`), 0o600))
+
+	_, loadErr := loadUserDirectory(fileName)
+	t.Error(loadErr)
+}
+
+func (t *commitInfoTestSuite) TestCommitDetails() {
+	ctx := t.T().Context()
+	message, author := commitDetails(ctx, "joe", "Update d1")
+	t.Equal("Update d1", message)
+	t.Equal(commitAuthor{name: "joe", email: "joe"}, author)
+
+	jane := commitAuthor{name: "Jane Doe", email: "jane.doe@example.com"}
+	message, author = commitDetails(withCommitInfo(ctx, commitInfo{author: &jane}), "jdoe", "Update d1")
+	t.Equal("Update d1", message)
+	t.Equal(jane, author)
+
+	message, _ = commitDetails(withCommitInfo(ctx, commitInfo{message: "Add the database"}), "jdoe", "Update d1")
+	t.Equal("Add the database", message)
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type drawingStoreType string
@@ -13,27 +17,39 @@ const (
 	LOCAL_GIT drawingStoreType = "LOCAL_GIT"
 	GITLAB    drawingStoreType = "GITLAB"
 	S3        drawingStoreType = "S3"
+	FS        drawingStoreType = "FS"
+	MEMORY    drawingStoreType = "MEMORY"
 )
 
-type passwordCredentials struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-}
-
 type drawingRepoConfig struct {
-	name      string
-	label     string
-	storeType drawingStoreType
-	root      string
-	path      string
+	name          string
+	label         string
+	storeType     drawingStoreType
+	root          string
+	path          string
+	project       string
+	branch        string
+	token         string
+	region        string
+	endpoint      string
+	watchInterval string
+	remote        string
+	pull          string
+	pushDelay     string
 }
 
 type drawingReposConfigs map[string]drawingRepoConfig
 
 type options struct {
 	port            int
-	passwordCreds   []passwordCredentials
 	drawingStoreTyp drawingStoreType
+	admins          []string      // the users who are admins in every repo
+	access          *accessConfig // the roles of the users in the repos; every user is an editor everywhere when nil
+	users           userDirectory
+	oidc            oidcConfig
+	basicAuth       bool
+	passwordFile    string // the htpasswd-style file of the users of Basic authentication
+	session         sessionConfig
 }
 
 const (
@@ -41,8 +57,17 @@ const (
 	drawingRepoEnvvarNameFeaturePart     = "DRAWINGREPO"
 	drawingRepoEnvvarNameListPart        = "LIST" // maps names to labels; sample value: "wsgw:WebSocket Gateway,xcaliapp:Xcalidraw App"
 	drawingRepoEnvvarNameStorageTypePart = "STORETYPE"
-	drawingRepoEnvvarNameRootPart        = "ROOT"
-	drawingRepoEnvvarNamePathPart        = "PATH"
+	drawingRepoEnvvarNameRootPart        = "ROOT"    // the base URL of the GitLab instance for GITLAB repos, the bucket for S3 repos, a directory otherwise
+	drawingRepoEnvvarNamePathPart        = "PATH"    // the key prefix for S3 repos
+	drawingRepoEnvvarNameProjectPart     = "PROJECT" // GitLab project id or URL-encoded path
+	drawingRepoEnvvarNameBranchPart      = "BRANCH"
+	drawingRepoEnvvarNameTokenPart       = "TOKEN"
+	drawingRepoEnvvarNameRegionPart      = "REGION"
+	drawingRepoEnvvarNameEndpointPart    = "ENDPOINT"      // custom S3 endpoint, e.g. of a MinIO instance
+	drawingRepoEnvvarNameWatchPart       = "WATCHINTERVAL" // how often LOCAL_GIT working copies are checked for external changes, e.g. "10s"; "0" disables
+	drawingRepoEnvvarNameRemotePart      = "REMOTE"        // the git remote LOCAL_GIT repos are synced with, e.g. "origin"; no syncing when empty
+	drawingRepoEnvvarNamePullPart        = "PULL"          // "false" disables pulling from the remote before writes
+	drawingRepoEnvvarNamePushDelayPart   = "PUSHDELAY"     // how long pushes are debounced, e.g. "30s"; "0" pushes after every commit
 )
 
 func getDrawingRepoConfigs() (drawingReposConfigs, error) {
@@ -72,7 +97,7 @@ func getDrawingRepoConfigs() (drawingReposConfigs, error) {
 	setupConfigForName := func(config drawingRepoConfig) drawingRepoConfig {
 		for _, env := range os.Environ() {
 			envVarNamePrefix := envVarFeatureBaseName + "_" + config.name + "_"
-			envNameAndValue := strings.Split(env, "=")
+			envNameAndValue := strings.SplitN(env, "=", 2)
 			envName := envNameAndValue[0]
 			envValue := envNameAndValue[1]
 			if len(envName) > len(envVarNamePrefix) && envName[0:len(envVarNamePrefix)] == envVarNamePrefix {
@@ -84,6 +109,24 @@ func getDrawingRepoConfigs() (drawingReposConfigs, error) {
 					config.root = envValue
 				case drawingRepoEnvvarNamePathPart:
 					config.path = envValue
+				case drawingRepoEnvvarNameProjectPart:
+					config.project = envValue
+				case drawingRepoEnvvarNameBranchPart:
+					config.branch = envValue
+				case drawingRepoEnvvarNameTokenPart:
+					config.token = envValue
+				case drawingRepoEnvvarNameRegionPart:
+					config.region = envValue
+				case drawingRepoEnvvarNameEndpointPart:
+					config.endpoint = envValue
+				case drawingRepoEnvvarNameWatchPart:
+					config.watchInterval = envValue
+				case drawingRepoEnvvarNameRemotePart:
+					config.remote = envValue
+				case drawingRepoEnvvarNamePullPart:
+					config.pull = envValue
+				case drawingRepoEnvvarNamePushDelayPart:
+					config.pushDelay = envValue
 				}
 
 				if envName == envVarNamePrefix+"_"+drawingRepoEnvvarNameStorageTypePart {
@@ -105,6 +148,9 @@ func getDrawingRepoConfigs() (drawingReposConfigs, error) {
 	}
 
 	for _, value := range nameToConfigMap {
+		if validationErr := value.validate(); validationErr != nil {
+			return nil, validationErr
+		}
 		if value.root == "" {
 			logger.Warn().Interface("drawingRepoConfig", value).Msg("No root")
 		}
@@ -116,8 +162,87 @@ func getDrawingRepoConfigs() (drawingReposConfigs, error) {
 	return nameToConfigMap, nil
 }
 
+var s3BucketNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// validate checks the store-type specific settings, so that misconfigured repos are reported at startup
+// rather than on first use
+func (config drawingRepoConfig) validate() error {
+	switch config.storeType {
+	case S3:
+		if !s3BucketNamePattern.MatchString(config.root) {
+			return fmt.Errorf("invalid S3 bucket name %q for drawing repo %s", config.root, config.name)
+		}
+		if strings.HasPrefix(config.path, "/") {
+			return fmt.Errorf("S3 key prefix %q for drawing repo %s must not start with '/'", config.path, config.name)
+		}
+		if len(config.endpoint) > 0 {
+			endpointURL, parseErr := url.Parse(config.endpoint)
+			if parseErr != nil || (endpointURL.Scheme != "http" && endpointURL.Scheme != "https") || len(endpointURL.Host) == 0 {
+				return fmt.Errorf("invalid S3 endpoint %q for drawing repo %s", config.endpoint, config.name)
+			}
+		}
+	case LOCAL_GIT:
+		if _, intervalErr := config.getWatchInterval(); intervalErr != nil {
+			return intervalErr
+		}
+		if _, syncErr := config.getGitSyncOptions(); syncErr != nil {
+			return syncErr
+		}
+	case FS:
+		if len(config.root) == 0 {
+			return fmt.Errorf("missing root directory for drawing repo %s", config.name)
+		}
+	case GITLAB:
+		if len(config.project) == 0 {
+			return fmt.Errorf("missing GitLab project for drawing repo %s", config.name)
+		}
+	}
+	return nil
+}
+
+// getWatchInterval returns how often the working copy of a LOCAL_GIT repo is to be checked for
+// changes made outside the server; zero means not at all
+func (config drawingRepoConfig) getWatchInterval() (time.Duration, error) {
+	if config.storeType != LOCAL_GIT {
+		return 0, nil
+	}
+	if len(config.watchInterval) == 0 {
+		return defaultWatchInterval, nil
+	}
+	interval, parseErr := time.ParseDuration(config.watchInterval)
+	if parseErr != nil || interval < 0 {
+		return 0, fmt.Errorf("invalid watch interval %q for drawing repo %s", config.watchInterval, config.name)
+	}
+	return interval, nil
+}
+
+// getGitSyncOptions returns how a LOCAL_GIT repo is to be synced with its remote; the remote is
+// empty when it isn't to be synced
+func (config drawingRepoConfig) getGitSyncOptions() (gitSyncOptions, error) {
+	options := gitSyncOptions{
+		remote:    config.remote,
+		branch:    config.branch,
+		pull:      true,
+		pushDelay: defaultPushDelay,
+	}
+	if len(config.pull) > 0 {
+		pull, parseErr := strconv.ParseBool(config.pull)
+		if parseErr != nil {
+			return gitSyncOptions{}, fmt.Errorf("invalid pull setting %q for drawing repo %s", config.pull, config.name)
+		}
+		options.pull = pull
+	}
+	if len(config.pushDelay) > 0 {
+		pushDelay, parseErr := time.ParseDuration(config.pushDelay)
+		if parseErr != nil || pushDelay < 0 {
+			return gitSyncOptions{}, fmt.Errorf("invalid push delay %q for drawing repo %s", config.pushDelay, config.name)
+		}
+		options.pushDelay = pushDelay
+	}
+	return options, nil
+}
+
 const DefaultServerPort = 8080
-const defaultUsername = "peter.dunay.kovacs@gmail.com"
 
 func getServerPort() int {
 	envvar := os.Getenv("SERVER_PORT")
@@ -131,10 +256,150 @@ func getServerPort() int {
 	return DefaultServerPort
 }
 
-func getUsername() string {
-	envvar := os.Getenv("XCALIAPP_USERNAME")
-	if len(envvar) > 0 {
-		return envvar
+// getUserDirectory reads the user directory from the JSON file named by XCALIAPP_USERDIRECTORY, if any
+func getUserDirectory() (userDirectory, error) {
+	fileName := os.Getenv("XCALIAPP_USERDIRECTORY")
+	if len(fileName) == 0 {
+		return userDirectory{}, nil
+	}
+	return loadUserDirectory(fileName)
+}
+
+// getOIDCConfig reads the OpenID Connect settings from the XCALIAPP_OIDC_* environment variables;
+// OIDC login is disabled when no issuer is set
+func getOIDCConfig() (oidcConfig, error) {
+	config := oidcConfig{
+		issuer:        os.Getenv("XCALIAPP_OIDC_ISSUER"),
+		clientId:      os.Getenv("XCALIAPP_OIDC_CLIENTID"),
+		clientSecret:  os.Getenv("XCALIAPP_OIDC_CLIENTSECRET"),
+		redirectURL:   os.Getenv("XCALIAPP_OIDC_REDIRECTURL"), // e.g. "https://xcaliapp.example.com/auth/callback"
+		scopes:        defaultOIDCScopes,
+		usernameClaim: "email",
+	}
+	if scopes := os.Getenv("XCALIAPP_OIDC_SCOPES"); len(scopes) > 0 {
+		config.scopes = strings.FieldsFunc(scopes, func(r rune) bool { return r == ',' || r == ' ' })
+	}
+	if claim := os.Getenv("XCALIAPP_OIDC_USERNAMECLAIM"); len(claim) > 0 {
+		config.usernameClaim = claim
+	}
+	return config, config.validate()
+}
+
+// getBasicAuth tells whether Basic authentication is enabled: XCALIAPP_BASICAUTH defaults to
+// enabled only when OIDC login is not. Basic authentication requires a password file.
+func getBasicAuth(oidcEnabled bool, passwordFile string) (bool, error) {
+	enabled := !oidcEnabled
+	if envvar := os.Getenv("XCALIAPP_BASICAUTH"); len(envvar) > 0 {
+		var parseErr error
+		if enabled, parseErr = strconv.ParseBool(envvar); parseErr != nil {
+			return false, fmt.Errorf("invalid XCALIAPP_BASICAUTH %q", envvar)
+		}
+	}
+	if !enabled && !oidcEnabled {
+		return false, fmt.Errorf("XCALIAPP_BASICAUTH can only be disabled when OIDC login is configured")
+	}
+	if enabled && len(passwordFile) == 0 {
+		return false, fmt.Errorf("basic authentication requires a password file: set XCALIAPP_PASSWORDFILE or configure OIDC login")
+	}
+	return enabled, nil
+}
+
+// getPasswordFileName returns the htpasswd-style file of the users from XCALIAPP_PASSWORDFILE, if any
+func getPasswordFileName() string {
+	return os.Getenv("XCALIAPP_PASSWORDFILE")
+}
+
+// getTokenFileName returns the file keeping the personal API tokens from XCALIAPP_TOKENFILE; the
+// tokens are kept in memory only when it isn't set
+func getTokenFileName() string {
+	return os.Getenv("XCALIAPP_TOKENFILE")
+}
+
+// getSessionConfig reads the session settings from the XCALIAPP_SESSION_* environment variables.
+// The keys are taken from the comma-separated XCALIAPP_SESSION_KEYS or from the lines of the file
+// named by XCALIAPP_SESSION_KEYFILE; the first key signs the cookies, the others are only accepted,
+// so that the key can be rotated.
+func getSessionConfig() (sessionConfig, error) {
+	config := sessionConfig{
+		storeType: memorySessionStore,
+		path:      os.Getenv("XCALIAPP_SESSION_PATH"),
+		redisURL:  os.Getenv("XCALIAPP_SESSION_REDISURL"),
+		secure:    true,
+		sameSite:  http.SameSiteLaxMode, // Strict would drop the cookie on the redirect back from the OIDC provider
+		maxAge:    defaultSessionMaxAge,
+	}
+	if storeType := os.Getenv("XCALIAPP_SESSION_STORE"); len(storeType) > 0 {
+		config.storeType = storeType
+	}
+
+	keys := os.Getenv("XCALIAPP_SESSION_KEYS")
+	keyFileName := os.Getenv("XCALIAPP_SESSION_KEYFILE")
+	if len(keys) > 0 && len(keyFileName) > 0 {
+		return config, fmt.Errorf("only one of XCALIAPP_SESSION_KEYS and XCALIAPP_SESSION_KEYFILE may be set")
+	}
+	var keyList []string
+	if len(keyFileName) > 0 {
+		content, readErr := os.ReadFile(keyFileName)
+		if readErr != nil {
+			return config, fmt.Errorf("failed to read session key file: %w", readErr)
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			if line = strings.TrimSpace(line); len(line) > 0 && !strings.HasPrefix(line, "#") {
+				keyList = append(keyList, line)
+			}
+		}
+		if len(keyList) == 0 {
+			return config, fmt.Errorf("no keys in session key file %s", keyFileName)
+		}
+	} else if len(keys) > 0 {
+		keyList = strings.Split(keys, ",")
+	}
+	for _, key := range keyList {
+		config.keys = append(config.keys, []byte(strings.TrimSpace(key)))
+	}
+
+	if secure := os.Getenv("XCALIAPP_SESSION_SECURE"); len(secure) > 0 {
+		var parseErr error
+		if config.secure, parseErr = strconv.ParseBool(secure); parseErr != nil {
+			return config, fmt.Errorf("invalid XCALIAPP_SESSION_SECURE %q", secure)
+		}
+	}
+	switch sameSite := strings.ToLower(os.Getenv("XCALIAPP_SESSION_SAMESITE")); sameSite {
+	case "", "lax":
+	case "strict":
+		config.sameSite = http.SameSiteStrictMode
+	case "none":
+		config.sameSite = http.SameSiteNoneMode
+	default:
+		return config, fmt.Errorf("invalid XCALIAPP_SESSION_SAMESITE %q, expected lax, strict or none", sameSite)
+	}
+	if maxAge := os.Getenv("XCALIAPP_SESSION_MAXAGE"); len(maxAge) > 0 {
+		var parseErr error
+		if config.maxAge, parseErr = time.ParseDuration(maxAge); parseErr != nil {
+			return config, fmt.Errorf("invalid XCALIAPP_SESSION_MAXAGE %q", maxAge)
+		}
+	}
+	return config, config.validate()
+}
+
+// getAccessConfig reads the roles of the users in the repos from the JSON file named by
+// XCALIAPP_ACCESSFILE, if any
+func getAccessConfig() (*accessConfig, error) {
+	fileName := os.Getenv("XCALIAPP_ACCESSFILE")
+	if len(fileName) == 0 {
+		return nil, nil
+	}
+	return loadAccessConfig(fileName)
+}
+
+// getAdmins reads the comma-separated list of admin usernames from XCALIAPP_ADMINS
+func getAdmins() []string {
+	admins := []string{}
+	for admin := range strings.SplitSeq(os.Getenv("XCALIAPP_ADMINS"), ",") {
+		admin = strings.TrimSpace(admin)
+		if len(admin) > 0 {
+			admins = append(admins, admin)
+		}
 	}
-	return defaultUsername
+	return admins
 }
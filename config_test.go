@@ -50,3 +50,67 @@ func (t *readConfigurationTestSuite) TestGetDrawingRepoConfig() {
 	t.NoError(err)
 	t.Equal(expectedSets, drawingRepos)
 }
+
+func (t *readConfigurationTestSuite) TestGetGitlabDrawingRepoConfig() {
+	t.T().Setenv("XCALIAPP_DRAWINGREPO_LIST", "diagrams:Design Diagrams")
+	t.T().Setenv("XCALIAPP_DRAWINGREPO_diagrams_STORETYPE", "GITLAB")
+	t.T().Setenv("XCALIAPP_DRAWINGREPO_diagrams_ROOT", "https://gitlab.example.com")
+	t.T().Setenv("XCALIAPP_DRAWINGREPO_diagrams_PATH", "doc/diagrams")
+	t.T().Setenv("XCALIAPP_DRAWINGREPO_diagrams_PROJECT", "design/diagrams")
+	t.T().Setenv("XCALIAPP_DRAWINGREPO_diagrams_BRANCH", "develop")
+	t.T().Setenv("XCALIAPP_DRAWINGREPO_diagrams_TOKEN", "glpat-abc==")
+
+	drawingRepos, err := getDrawingRepoConfigs()
+
+	t.NoError(err)
+	t.Equal(drawingReposConfigs{
+		"diagrams": drawingRepoConfig{
+			name:      "diagrams",
+			label:     "Design Diagrams",
+			storeType: GITLAB,
+			root:      "https://gitlab.example.com",
+			path:      "doc/diagrams",
+			project:   "design/diagrams",
+			branch:    "develop",
+			token:     "glpat-abc==",
+		},
+	}, drawingRepos)
+}
+
+func (t *readConfigurationTestSuite) TestGetS3DrawingRepoConfig() {
+	t.T().Setenv("XCALIAPP_DRAWINGREPO_LIST", "diagrams:Design Diagrams")
+	t.T().Setenv("XCALIAPP_DRAWINGREPO_diagrams_STORETYPE", "S3")
+	t.T().Setenv("XCALIAPP_DRAWINGREPO_diagrams_ROOT", "design-bucket")
+	t.T().Setenv("XCALIAPP_DRAWINGREPO_diagrams_PATH", "teams/design")
+	t.T().Setenv("XCALIAPP_DRAWINGREPO_diagrams_REGION", "eu-central-1")
+	t.T().Setenv("XCALIAPP_DRAWINGREPO_diagrams_ENDPOINT", "http://127.0.0.1:9000")
+
+	drawingRepos, err := getDrawingRepoConfigs()
+
+	t.NoError(err)
+	t.Equal(drawingReposConfigs{
+		"diagrams": drawingRepoConfig{
+			name:      "diagrams",
+			label:     "Design Diagrams",
+			storeType: S3,
+			root:      "design-bucket",
+			path:      "teams/design",
+			region:    "eu-central-1",
+			endpoint:  "http://127.0.0.1:9000",
+		},
+	}, drawingRepos)
+}
+
+func (t *readConfigurationTestSuite) TestGetS3DrawingRepoConfigValidation() {
+	t.T().Setenv("XCALIAPP_DRAWINGREPO_LIST", "diagrams:Design Diagrams")
+	t.T().Setenv("XCALIAPP_DRAWINGREPO_diagrams_STORETYPE", "S3")
+
+	_, missingBucketErr := getDrawingRepoConfigs()
+	t.Error(missingBucketErr)
+
+	t.T().Setenv("XCALIAPP_DRAWINGREPO_diagrams_ROOT", "design-bucket")
+	t.T().Setenv("XCALIAPP_DRAWINGREPO_diagrams_ENDPOINT", "127.0.0.1:9000")
+
+	_, invalidEndpointErr := getDrawingRepoConfigs()
+	t.Error(invalidEndpointErr)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const defaultWatchInterval = 5 * time.Second
+
+type watchedFile struct {
+	modTime time.Time
+	size    int64
+	hash    string
+}
+
+// drawingDirWatcher polls the directory of a repo kept in a working copy (e.g. of a LOCAL_GIT
+// repo) for changes made outside the server, such as commits, pulls or checkouts. Changes are
+// published to the change feed and the live sessions of the changed drawings are reloaded.
+//
+// Changes made via the server since the previous poll are not reported again; a change made outside
+// the server to the same drawing within the same polling interval is missed.
+type drawingDirWatcher struct {
+	repoName string
+	dir      string
+	interval time.Duration
+	changes  *changeFeed
+	collab   *collabHub
+	logger   zerolog.Logger
+	files    map[string]watchedFile // drawing id -> file state
+}
+
+func newDrawingDirWatcher(repoName string, dir string, interval time.Duration, changes *changeFeed, collab *collabHub, logger zerolog.Logger) *drawingDirWatcher {
+	changes.retainPublished(interval)
+	return &drawingDirWatcher{
+		repoName: repoName,
+		dir:      dir,
+		interval: interval,
+		changes:  changes,
+		collab:   collab,
+		logger:   logger.With().Str("drawingRepo", repoName).Str("watchedDir", dir).Logger(),
+		files:    map[string]watchedFile{},
+	}
+}
+
+// scan returns the current state of the drawing files; files whose size and modification time
+// haven't changed aren't read again
+func (watcher *drawingDirWatcher) scan() (map[string]watchedFile, error) {
+	entries, readDirErr := os.ReadDir(watcher.dir)
+	if readDirErr != nil {
+		if errors.Is(readDirErr, fs.ErrNotExist) {
+			return map[string]watchedFile{}, nil
+		}
+		return nil, readDirErr
+	}
+
+	files := map[string]watchedFile{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, drawingFileExtension) {
+			continue
+		}
+		id := strings.TrimSuffix(name, drawingFileExtension)
+		info, infoErr := entry.Info()
+		if infoErr != nil {
+			if errors.Is(infoErr, fs.ErrNotExist) {
+				continue
+			}
+			return nil, infoErr
+		}
+		state := watchedFile{modTime: info.ModTime(), size: info.Size()}
+		if previous, known := watcher.files[id]; known && previous.modTime.Equal(state.modTime) && previous.size == state.size {
+			state.hash = previous.hash
+		} else {
+			content, readErr := os.ReadFile(filepath.Join(watcher.dir, name))
+			if readErr != nil {
+				if errors.Is(readErr, fs.ErrNotExist) {
+					continue
+				}
+				return nil, readErr
+			}
+			hash := sha256.Sum256(content)
+			state.hash = hex.EncodeToString(hash[:])
+		}
+		files[id] = state
+	}
+	return files, nil
+}
+
+// poll compares the drawing files with their state at the previous poll started at the given time
+func (watcher *drawingDirWatcher) poll(previousPoll time.Time) {
+	files, scanErr := watcher.scan()
+	if scanErr != nil {
+		watcher.logger.Error().Err(scanErr).Msg("failed to scan the drawings directory")
+		return
+	}
+
+	report := func(eventType changeEventType, id string) {
+		if watcher.changes.publishedSince(watcher.repoName, id, previousPoll) {
+			return
+		}
+		watcher.logger.Info().Str("drawingId", id).Str("change", string(eventType)).Msg("drawing changed outside the server")
+		watcher.changes.publishExternal(eventType, watcher.repoName, id)
+		watcher.collab.reloadFromStore(watcher.repoName, id)
+	}
+
+	for id, state := range files {
+		previous, known := watcher.files[id]
+		switch {
+		case !known:
+			report(drawingCreated, id)
+		case previous.hash != state.hash:
+			report(drawingUpdated, id)
+		}
+	}
+	for id := range watcher.files {
+		if _, exists := files[id]; !exists {
+			report(drawingDeleted, id)
+		}
+	}
+	watcher.files = files
+}
+
+func (watcher *drawingDirWatcher) watch(stop <-chan struct{}) {
+	files, scanErr := watcher.scan()
+	if scanErr != nil {
+		watcher.logger.Error().Err(scanErr).Msg("failed to scan the drawings directory")
+	} else {
+		watcher.files = files
+	}
+	previousPoll := time.Now()
+
+	ticker := time.NewTicker(watcher.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pollStart := time.Now()
+			watcher.poll(previousPoll)
+			previousPoll = pollStart
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type dirWatchTestSuite struct {
+	suite.Suite
+	dir     string
+	changes *changeFeed
+	events  <-chan changeEvent
+	watcher *drawingDirWatcher
+}
+
+func TestDirWatch(t *testing.T) {
+	suite.Run(t, &dirWatchTestSuite{})
+}
+
+func (t *dirWatchTestSuite) SetupTest() {
+	t.dir = t.T().TempDir()
+	t.changes = newChangeFeed()
+	var unsubscribe func()
+	t.events, unsubscribe = t.changes.subscribe()
+	t.T().Cleanup(unsubscribe)
+	t.watcher = newDrawingDirWatcher("repo", t.dir, time.Second, t.changes, newCollabHub(newDrawingLocks(), newEditLocks(editLockTTL), t.changes, userDirectory{}), getLogger())
+}
+
+func (t *dirWatchTestSuite) writeDrawing(id string, content string) {
+	t.Require().NoError(os.WriteFile(filepath.Join(t.dir, id+drawingFileExtension), []byte(content), 0o644))
+}
+
+func (t *dirWatchTestSuite) receivedEvents() []changeEvent {
+	received := []changeEvent{}
+	for {
+		select {
+		case event := <-t.events:
+			received = append(received, event)
+		default:
+			return received
+		}
+	}
+}
+
+func (t *dirWatchTestSuite) TestExternalChanges() {
+	t.writeDrawing("kept", "kept")
+	t.writeDrawing("changed", "old content")
+	t.writeDrawing("deleted", "deleted")
+	t.Require().NoError(os.WriteFile(filepath.Join(t.dir, "notes.txt"), []byte("not a drawing"), 0o644))
+	t.watcher.poll(time.Now())
+	t.receivedEvents()
+
+	t.writeDrawing("changed", "new content")
+	t.writeDrawing("created", "created")
+	t.Require().NoError(os.Remove(filepath.Join(t.dir, "deleted"+drawingFileExtension)))
+	t.watcher.poll(time.Now())
+
+	changes := map[string]changeEventType{}
+	for _, event := range t.receivedEvents() {
+		t.True(event.External)
+		t.Equal("repo", event.Repo)
+		changes[event.Id] = event.Type
+	}
+	t.Equal(map[string]changeEventType{
+		"changed": drawingUpdated,
+		"created": drawingCreated,
+		"deleted": drawingDeleted,
+	}, changes)
+}
+
+func (t *dirWatchTestSuite) TestChangesViaServerNotReported() {
+	t.writeDrawing("drawing", "old content")
+	previousPoll := time.Now()
+	t.watcher.poll(previousPoll)
+	t.receivedEvents()
+
+	t.writeDrawing("drawing", "new content")
+	t.changes.publish(drawingUpdated, "repo", "drawing", "joe")
+	t.watcher.poll(previousPoll)
+
+	received := t.receivedEvents()
+	t.Require().Len(received, 1)
+	t.False(received[0].External)
+}
+
+func (t *dirWatchTestSuite) TestPublishedTimesPruned() {
+	longAgo := time.Now().Add(-time.Hour)
+	t.changes.send(changeEvent{Type: drawingUpdated, Repo: "repo", Id: "old", Timestamp: longAgo})
+	t.changes.publish(drawingUpdated, "repo", "recent", "joe")
+
+	t.False(t.changes.publishedSince("repo", "old", longAgo), "kept only as long as the watchers need it")
+	t.True(t.changes.publishedSince("repo", "recent", time.Now().Add(-time.Second)))
+
+	withoutWatchers := newChangeFeed()
+	withoutWatchers.publish(drawingUpdated, "repo", "drawing", "joe")
+	t.Empty(withoutWatchers.lastPublished)
+}
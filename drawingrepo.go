@@ -2,12 +2,20 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"gitstore"
+	"io"
+	"io/fs"
+	"myxcaliapp/backend/repoerr"
 	"s3store"
+	"strings"
+	"vcblobstore"
 )
 
-func newDrawingRepo(ctx context.Context, repoConfig drawingRepoConfig) drawingRepo {
+// newDrawingRepo creates the repo as configured; branches gives access to the working copy of
+// LOCAL_GIT repos
+func newDrawingRepo(ctx context.Context, repoConfig drawingRepoConfig, branches *gitBranches) drawingRepo {
 	var repo drawingRepo
 
 	switch repoConfig.storeType {
@@ -17,18 +25,160 @@ func newDrawingRepo(ctx context.Context, repoConfig drawingRepoConfig) drawingRe
 		if repoErr != nil {
 			panic(repoErr)
 		}
-		repo = blobStore
+		repo = newLocalGitRepo(newStoreErrorsRepo(blobStore), branches)
+		syncOptions, _ := repoConfig.getGitSyncOptions()
+		if len(syncOptions.remote) > 0 {
+			repo = newGitSyncRepo(repo, repoConfig.root, syncOptions, logger)
+		}
 	case GITLAB:
-		panic("Not yet supported")
+		logger := getLogger().With().Str("drawingRepo", repoConfig.name).Str("project", repoConfig.project).Logger()
+		blobStore, repoErr := newGitlabStore(repoConfig.root, repoConfig.project, repoConfig.branch, repoConfig.path, repoConfig.token, logger)
+		if repoErr != nil {
+			panic(fmt.Sprintf("failed to create GitLab store: %v", repoErr))
+		}
+		repo = blobStore
 	case S3:
-		blobStore, blobStoreErr := s3store.NewDrawingStore(ctx, "test-xcali-backend")
+		blobStore, blobStoreErr := s3store.NewDrawingStore(ctx, repoConfig.root, s3StoreOptions(repoConfig)...)
 		if blobStoreErr != nil {
 			panic(fmt.Sprintf("failed to created S3 store: %v", blobStoreErr))
 		}
+		repo = newPrefixedDrawingRepo(newStoreErrorsRepo(blobStore), repoConfig.path)
+	case FS:
+		logger := getLogger().With().Str("drawingRepo", repoConfig.name).Logger()
+		blobStore, repoErr := newFsStore(repoConfig.root, repoConfig.path, logger)
+		if repoErr != nil {
+			panic(fmt.Sprintf("failed to create file-system store: %v", repoErr))
+		}
 		repo = blobStore
+	case MEMORY:
+		repo = newMemoryStore()
 	default:
 		panic(fmt.Errorf("invalid drawingRepoConfig: %v", repoConfig))
 	}
 
 	return repo
 }
+
+// s3StoreOptions passes the region and the endpoint of the repo to the S3 store explicitly; the
+// defaults of the AWS SDK (e.g. AWS_REGION) apply to those not configured
+func s3StoreOptions(repoConfig drawingRepoConfig) []s3store.Option {
+	options := []s3store.Option{}
+	if len(repoConfig.region) > 0 {
+		options = append(options, s3store.WithRegion(repoConfig.region))
+	}
+	if len(repoConfig.endpoint) > 0 {
+		options = append(options, s3store.WithEndpoint(repoConfig.endpoint))
+	}
+	return options
+}
+
+// storeErrorsRepo translates the errors of a store reporting missing drawings and versions with
+// fs.ErrNotExist to the repoerr taxonomy
+type storeErrorsRepo struct {
+	repo drawingRepo
+}
+
+func newStoreErrorsRepo(repo drawingRepo) drawingRepo {
+	return &storeErrorsRepo{repo}
+}
+
+func translateStoreError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %w", repoerr.ErrNotFound, err)
+	}
+	return err
+}
+
+func (s *storeErrorsRepo) PutDrawing(ctx context.Context, key string, contentReader io.Reader, modifiedBy string) error {
+	return translateStoreError(s.repo.PutDrawing(ctx, key, contentReader, modifiedBy))
+}
+
+func (s *storeErrorsRepo) CopyDrawing(ctx context.Context, sourceId string, destinationId string, modifiedBy string) error {
+	return translateStoreError(s.repo.CopyDrawing(ctx, sourceId, destinationId, modifiedBy))
+}
+
+func (s *storeErrorsRepo) ListDrawings(ctx context.Context) (map[drawingId]drawingTitle, error) {
+	drawings, err := s.repo.ListDrawings(ctx)
+	return drawings, translateStoreError(err)
+}
+
+func (s *storeErrorsRepo) GetDrawing(ctx context.Context, key string) (string, error) {
+	content, err := s.repo.GetDrawing(ctx, key)
+	return content, translateStoreError(err)
+}
+
+func (s *storeErrorsRepo) DeleteDrawing(ctx context.Context, key string, modifiedBy string) error {
+	return translateStoreError(s.repo.DeleteDrawing(ctx, key, modifiedBy))
+}
+
+func (s *storeErrorsRepo) ListVersions(ctx context.Context, key string) ([]vcblobstore.BlobVersion, error) {
+	versions, err := s.repo.ListVersions(ctx, key)
+	return versions, translateStoreError(err)
+}
+
+func (s *storeErrorsRepo) GetVersion(ctx context.Context, key string, versionID string) (string, error) {
+	content, err := s.repo.GetVersion(ctx, key, versionID)
+	return content, translateStoreError(err)
+}
+
+func (s *storeErrorsRepo) RestoreVersion(ctx context.Context, key string, versionID string, modifiedBy string) (string, error) {
+	versionId, err := s.repo.RestoreVersion(ctx, key, versionID, modifiedBy)
+	return versionId, translateStoreError(err)
+}
+
+// prefixedDrawingRepo stores the drawings of a repo under a key prefix, so that several repos can
+// share the same bucket
+type prefixedDrawingRepo struct {
+	repo   drawingRepo
+	prefix string
+}
+
+func newPrefixedDrawingRepo(repo drawingRepo, prefix string) drawingRepo {
+	prefix = strings.Trim(prefix, "/")
+	if len(prefix) == 0 {
+		return repo
+	}
+	return &prefixedDrawingRepo{repo, prefix + "/"}
+}
+
+func (p *prefixedDrawingRepo) PutDrawing(ctx context.Context, key string, contentReader io.Reader, modifiedBy string) error {
+	return p.repo.PutDrawing(ctx, p.prefix+key, contentReader, modifiedBy)
+}
+
+func (p *prefixedDrawingRepo) CopyDrawing(ctx context.Context, sourceId string, destinationId string, modifiedBy string) error {
+	return p.repo.CopyDrawing(ctx, p.prefix+sourceId, p.prefix+destinationId, modifiedBy)
+}
+
+func (p *prefixedDrawingRepo) ListDrawings(ctx context.Context) (map[drawingId]drawingTitle, error) {
+	all, err := p.repo.ListDrawings(ctx)
+	if err != nil {
+		return nil, err
+	}
+	drawings := map[drawingId]drawingTitle{}
+	for id, title := range all {
+		if strings.HasPrefix(id, p.prefix) {
+			drawings[id[len(p.prefix):]] = title
+		}
+	}
+	return drawings, nil
+}
+
+func (p *prefixedDrawingRepo) GetDrawing(ctx context.Context, key string) (string, error) {
+	return p.repo.GetDrawing(ctx, p.prefix+key)
+}
+
+func (p *prefixedDrawingRepo) DeleteDrawing(ctx context.Context, key string, modifiedBy string) error {
+	return p.repo.DeleteDrawing(ctx, p.prefix+key, modifiedBy)
+}
+
+func (p *prefixedDrawingRepo) ListVersions(ctx context.Context, key string) ([]vcblobstore.BlobVersion, error) {
+	return p.repo.ListVersions(ctx, p.prefix+key)
+}
+
+func (p *prefixedDrawingRepo) GetVersion(ctx context.Context, key string, versionID string) (string, error) {
+	return p.repo.GetVersion(ctx, p.prefix+key, versionID)
+}
+
+func (p *prefixedDrawingRepo) RestoreVersion(ctx context.Context, key string, versionID string, modifiedBy string) (string, error) {
+	return p.repo.RestoreVersion(ctx, p.prefix+key, versionID, modifiedBy)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"myxcaliapp/backend/drawingrepotest"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestMemoryStoreConformance(t *testing.T) {
+	suite.Run(t, &drawingrepotest.DrawingRepoSuite{
+		NewRepo: func() drawingrepotest.DrawingRepo {
+			return newMemoryStore()
+		},
+	})
+}
+
+func TestFsStoreConformance(t *testing.T) {
+	suite.Run(t, &drawingrepotest.DrawingRepoSuite{
+		NewRepo: func() drawingrepotest.DrawingRepo {
+			store, err := newFsStore(t.TempDir(), "drawings", zerolog.Nop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		},
+	})
+}
+
+func TestGitlabStoreConformance(t *testing.T) {
+	suite.Run(t, &drawingrepotest.DrawingRepoSuite{
+		NewRepo: func() drawingrepotest.DrawingRepo {
+			server := httptest.NewServer(newFakeGitlab())
+			t.Cleanup(server.Close)
+			store, err := newGitlabStore(server.URL, fakeGitlabProject, fakeGitlabBranch, "doc/diagrams", fakeGitlabToken, zerolog.Nop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		},
+	})
+}
+
+func TestPrefixedDrawingRepoConformance(t *testing.T) {
+	suite.Run(t, &drawingrepotest.DrawingRepoSuite{
+		NewRepo: func() drawingrepotest.DrawingRepo {
+			shared := newMemoryStore()
+			shared.put("other-prefix/drawing", "content", "someone", "")
+			return newPrefixedDrawingRepo(shared, "teams/design")
+		},
+	})
+}
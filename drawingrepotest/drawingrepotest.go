@@ -0,0 +1,200 @@
+// Package drawingrepotest provides a conformance test suite for drawing repository implementations.
+//
+// Implementations are expected to report missing drawings and versions with errors wrapping
+// repoerr.ErrNotFound, so that callers can tell them apart from other failures with errors.Is.
+package drawingrepotest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"myxcaliapp/backend/repoerr"
+	"strings"
+	"vcblobstore"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// DrawingRepo is the contract the suite checks. It has the same method set as the drawing
+// repository interface of the server, so any implementation usable by the server satisfies it.
+type DrawingRepo interface {
+	PutDrawing(ctx context.Context, key string, contentReader io.Reader, modifiedBy string) error
+	CopyDrawing(ctx context.Context, sourceId string, destinationId string, modifiedBy string) error
+	ListDrawings(ctx context.Context) (map[string]string, error)
+	GetDrawing(ctx context.Context, key string) (string, error)
+	DeleteDrawing(ctx context.Context, key string, modifiedBy string) error
+	ListVersions(ctx context.Context, key string) ([]vcblobstore.BlobVersion, error)
+	GetVersion(ctx context.Context, key string, versionID string) (string, error)
+	RestoreVersion(ctx context.Context, key string, versionID string, modifiedBy string) (string, error)
+}
+
+const (
+	firstUser  = "first.user@example.com"
+	secondUser = "second.user@example.com"
+)
+
+// DrawingRepoSuite is run with suite.Run. NewRepo is called before each test and must return
+// an empty repository.
+//
+//	suite.Run(t, &drawingrepotest.DrawingRepoSuite{NewRepo: func() drawingrepotest.DrawingRepo { ... }})
+type DrawingRepoSuite struct {
+	suite.Suite
+	NewRepo func() DrawingRepo
+	repo    DrawingRepo
+}
+
+func (s *DrawingRepoSuite) SetupTest() {
+	s.repo = s.NewRepo()
+}
+
+func (s *DrawingRepoSuite) put(key string, content string, modifiedBy string) {
+	s.Require().NoError(s.repo.PutDrawing(s.T().Context(), key, strings.NewReader(content), modifiedBy))
+}
+
+func (s *DrawingRepoSuite) requireContent(key string, expected string) {
+	content, err := s.repo.GetDrawing(s.T().Context(), key)
+	s.Require().NoError(err)
+	s.Equal(expected, content)
+}
+
+func (s *DrawingRepoSuite) requireNotFound(err error) {
+	s.Require().Error(err)
+	s.True(errors.Is(err, repoerr.ErrNotFound), "expected a not-found error, got: %v", err)
+}
+
+func (s *DrawingRepoSuite) TestEmptyRepo() {
+	drawings, err := s.repo.ListDrawings(s.T().Context())
+
+	s.NoError(err)
+	s.Empty(drawings)
+}
+
+func (s *DrawingRepoSuite) TestPutAndGet() {
+	s.put("drawing", "first content", firstUser)
+	s.requireContent("drawing", "first content")
+
+	s.put("drawing", "second content", secondUser)
+	s.requireContent("drawing", "second content")
+}
+
+func (s *DrawingRepoSuite) TestPutEmptyContent() {
+	s.put("drawing", "", firstUser)
+
+	s.requireContent("drawing", "")
+}
+
+func (s *DrawingRepoSuite) TestGetMissing() {
+	_, err := s.repo.GetDrawing(s.T().Context(), "missing")
+
+	s.requireNotFound(err)
+}
+
+func (s *DrawingRepoSuite) TestList() {
+	s.put("first", "first content", firstUser)
+	s.put("second", "second content", firstUser)
+
+	drawings, err := s.repo.ListDrawings(s.T().Context())
+
+	s.NoError(err)
+	s.ElementsMatch([]string{"first", "second"}, keys(drawings))
+}
+
+func (s *DrawingRepoSuite) TestCopy() {
+	s.put("source", "content", firstUser)
+
+	s.Require().NoError(s.repo.CopyDrawing(s.T().Context(), "source", "destination", secondUser))
+
+	s.requireContent("source", "content")
+	s.requireContent("destination", "content")
+	versions, err := s.repo.ListVersions(s.T().Context(), "destination")
+	s.Require().NoError(err)
+	s.Require().NotEmpty(versions)
+	s.Equal(secondUser, versions[0].Author)
+}
+
+func (s *DrawingRepoSuite) TestCopyMissing() {
+	err := s.repo.CopyDrawing(s.T().Context(), "missing", "destination", firstUser)
+
+	s.requireNotFound(err)
+}
+
+func (s *DrawingRepoSuite) TestDelete() {
+	s.put("deleted", "content", firstUser)
+	s.put("kept", "content", firstUser)
+
+	s.Require().NoError(s.repo.DeleteDrawing(s.T().Context(), "deleted", secondUser))
+
+	_, getErr := s.repo.GetDrawing(s.T().Context(), "deleted")
+	s.requireNotFound(getErr)
+	drawings, listErr := s.repo.ListDrawings(s.T().Context())
+	s.NoError(listErr)
+	s.Equal([]string{"kept"}, keys(drawings))
+}
+
+func (s *DrawingRepoSuite) TestDeleteMissing() {
+	err := s.repo.DeleteDrawing(s.T().Context(), "missing", firstUser)
+
+	s.requireNotFound(err)
+}
+
+func (s *DrawingRepoSuite) TestVersions() {
+	s.put("drawing", "v1", firstUser)
+	s.put("drawing", "v2", secondUser)
+
+	versions, listErr := s.repo.ListVersions(s.T().Context(), "drawing")
+
+	s.Require().NoError(listErr)
+	s.Require().Len(versions, 2, "versions are expected latest first")
+	s.Equal(secondUser, versions[0].Author)
+	s.Equal(firstUser, versions[1].Author)
+	s.NotEqual(versions[0].VersionID, versions[1].VersionID)
+	s.False(versions[0].Timestamp.Before(versions[1].Timestamp))
+
+	for i, expected := range []string{"v2", "v1"} {
+		content, getErr := s.repo.GetVersion(s.T().Context(), "drawing", versions[i].VersionID)
+		s.NoError(getErr)
+		s.Equal(expected, content)
+	}
+}
+
+func (s *DrawingRepoSuite) TestVersionsOfMissing() {
+	_, listErr := s.repo.ListVersions(s.T().Context(), "missing")
+	s.requireNotFound(listErr)
+
+	s.put("drawing", "content", firstUser)
+	_, getErr := s.repo.GetVersion(s.T().Context(), "drawing", "no-such-version")
+	s.requireNotFound(getErr)
+}
+
+func (s *DrawingRepoSuite) TestRestore() {
+	s.put("drawing", "v1", firstUser)
+	s.put("drawing", "v2", firstUser)
+	versions, listErr := s.repo.ListVersions(s.T().Context(), "drawing")
+	s.Require().NoError(listErr)
+
+	restoredVersion, restoreErr := s.repo.RestoreVersion(s.T().Context(), "drawing", versions[1].VersionID, secondUser)
+
+	s.Require().NoError(restoreErr)
+	s.requireContent("drawing", "v1")
+	versionsAfterRestore, listAfterRestoreErr := s.repo.ListVersions(s.T().Context(), "drawing")
+	s.Require().NoError(listAfterRestoreErr)
+	s.Require().Len(versionsAfterRestore, 3, "restoring is expected to create a new version")
+	s.Equal(restoredVersion, versionsAfterRestore[0].VersionID)
+	s.Equal(secondUser, versionsAfterRestore[0].Author)
+}
+
+func (s *DrawingRepoSuite) TestRestoreMissing() {
+	s.put("drawing", "content", firstUser)
+
+	_, err := s.repo.RestoreVersion(s.T().Context(), "drawing", "no-such-version", firstUser)
+
+	s.requireNotFound(err)
+}
+
+func keys(drawings map[string]string) []string {
+	result := []string{}
+	for key := range drawings {
+		result = append(result, key)
+	}
+	return result
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+const (
+	editLockTTL         = 5 * time.Minute
+	editLockSweepPeriod = time.Minute
+)
+
+// editLock is an advisory lock telling others that a user is editing a drawing. It expires
+// unless the holder renews it in time.
+type editLock struct {
+	Holder     string    `json:"holder"`
+	AcquiredAt time.Time `json:"acquiredAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+var errEditLockHeld = errors.New("the drawing is locked by another user")
+
+type editLocks struct {
+	lock  sync.Mutex
+	ttl   time.Duration
+	now   func() time.Time
+	locks map[string]editLock
+}
+
+func newEditLocks(ttl time.Duration) *editLocks {
+	return &editLocks{
+		ttl:   ttl,
+		now:   time.Now,
+		locks: map[string]editLock{},
+	}
+}
+
+func editLockKey(repoName string, drawingId string) string {
+	return repoName + "/" + drawingId
+}
+
+// getLocked returns the unexpired lock of the drawing; must be called with the lock held
+func (el *editLocks) getLocked(key string) (editLock, bool) {
+	current, locked := el.locks[key]
+	if !locked {
+		return editLock{}, false
+	}
+	if !el.now().Before(current.ExpiresAt) {
+		delete(el.locks, key)
+		return editLock{}, false
+	}
+	return current, true
+}
+
+func (el *editLocks) get(key string) (editLock, bool) {
+	el.lock.Lock()
+	defer el.lock.Unlock()
+	return el.getLocked(key)
+}
+
+// acquire takes or renews the lock for the user. It fails with the current lock when another
+// user holds it.
+func (el *editLocks) acquire(key string, username string) (editLock, error) {
+	el.lock.Lock()
+	defer el.lock.Unlock()
+
+	now := el.now()
+	current, locked := el.getLocked(key)
+	if locked && current.Holder != username {
+		return current, errEditLockHeld
+	}
+	if !locked {
+		current = editLock{Holder: username, AcquiredAt: now}
+	}
+	current.ExpiresAt = now.Add(el.ttl)
+	el.locks[key] = current
+	return current, nil
+}
+
+// release removes the lock if it is held by the user, or unconditionally when force is set.
+// It fails with the current lock when another user holds it.
+func (el *editLocks) release(key string, username string, force bool) (editLock, error) {
+	el.lock.Lock()
+	defer el.lock.Unlock()
+
+	current, locked := el.getLocked(key)
+	if !locked {
+		return editLock{}, nil
+	}
+	if current.Holder != username && !force {
+		return current, errEditLockHeld
+	}
+	delete(el.locks, key)
+	return current, nil
+}
+
+// check tells whether the user may modify the drawing, returning the lock held by another
+// user when not
+func (el *editLocks) check(key string, username string) (editLock, bool) {
+	current, locked := el.get(key)
+	if locked && current.Holder != username {
+		return current, false
+	}
+	return editLock{}, true
+}
+
+// expire removes the expired locks
+func (el *editLocks) expire() {
+	el.lock.Lock()
+	defer el.lock.Unlock()
+	for key := range el.locks {
+		el.getLocked(key)
+	}
+}
+
+// expirePeriodically removes the expired locks until stop is closed
+func (el *editLocks) expirePeriodically(period time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			el.expire()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// editLockResponse is sent when the drawing is locked by another user
+type editLockResponse struct {
+	errorResponse
+	Lock editLock `json:"lock"`
+}
+
+func abortWithEditLock(c *gin.Context, status int, current editLock) {
+	err := fmt.Errorf("%w: %s until %s", errEditLockHeld, current.Holder, current.ExpiresAt.Format(time.RFC3339))
+	_ = c.Error(err)
+	c.AbortWithStatusJSON(status, editLockResponse{
+		errorResponse: errorResponse{
+			Status:  status,
+			Error:   http.StatusText(status),
+			Message: err.Error(),
+		},
+		Lock: current,
+	})
+}
+
+// checkEditLock tells whether the user may modify the drawing; the error response has been
+// sent when not
+func (hf *handlerFactory) checkEditLock(c *gin.Context, logger zerolog.Logger, repoName string, drawingId string, username string) bool {
+	current, allowed := hf.editLocks.check(editLockKey(repoName, drawingId), username)
+	if !allowed {
+		logger.Info().Str("lockHolder", current.Holder).Msg("the drawing is locked by another user")
+		abortWithEditLock(c, http.StatusLocked, current)
+	}
+	return allowed
+}
+
+func (hf *handlerFactory) getEditLock() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		current, locked := hf.editLocks.get(editLockKey(c.Param("repo"), c.Param("id")))
+		if !locked {
+			abortWithError(c, http.StatusNotFound, errors.New("the drawing is not locked"))
+			return
+		}
+		c.JSON(http.StatusOK, current)
+	}
+}
+
+// acquireEditLock takes the edit lock of the drawing or renews it if the user holds it already
+func (hf *handlerFactory) acquireEditLock() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		repoName := c.Param("repo")
+		drawingId := c.Param("id")
+
+		logger := zerolog.Ctx(c.Request.Context()).With().Str("repoName", repoName).Str("drawingId", drawingId).Logger()
+
+		user, userExtractErr := getUserFromContext(c)
+		if userExtractErr != nil {
+			logger.Error().Err(userExtractErr).Msg("failed to extract user from context")
+			abortWithError(c, http.StatusInternalServerError, userExtractErr)
+			return
+		}
+
+		if _, hasRepo := hf.repos.getRepo(drawingRepoName(repoName)); !hasRepo {
+			logger.Info().Msg("failed to find repo")
+			abortWithError(c, http.StatusNotFound, unknownRepoError(repoName))
+			return
+		}
+
+		current, acquireErr := hf.editLocks.acquire(editLockKey(repoName, drawingId), user.Username)
+		if acquireErr != nil {
+			logger.Info().Str("lockHolder", current.Holder).Msg("failed to acquire edit lock")
+			abortWithEditLock(c, http.StatusLocked, current)
+			return
+		}
+		c.JSON(http.StatusOK, current)
+	}
+}
+
+// releaseEditLock releases the edit lock of the drawing. Admins may break the locks of others
+// by setting the "force" query parameter.
+func (hf *handlerFactory) releaseEditLock() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		repoName := c.Param("repo")
+		drawingId := c.Param("id")
+		force := c.Query("force") == "true"
+
+		logger := zerolog.Ctx(c.Request.Context()).With().Str("repoName", repoName).Str("drawingId", drawingId).Bool("force", force).Logger()
+
+		user, userExtractErr := getUserFromContext(c)
+		if userExtractErr != nil {
+			logger.Error().Err(userExtractErr).Msg("failed to extract user from context")
+			abortWithError(c, http.StatusInternalServerError, userExtractErr)
+			return
+		}
+
+		if force && hf.roleOf(c, user.Username, drawingRepoName(repoName)) < adminRole {
+			logger.Info().Msg("only admins may break the locks of others")
+			abortWithError(c, http.StatusForbidden, errors.New("only admins may break the locks of others"))
+			return
+		}
+
+		released, releaseErr := hf.editLocks.release(editLockKey(repoName, drawingId), user.Username, force)
+		if releaseErr != nil {
+			logger.Info().Str("lockHolder", released.Holder).Msg("failed to release edit lock")
+			abortWithEditLock(c, http.StatusForbidden, released)
+			return
+		}
+		if force && len(released.Holder) > 0 && released.Holder != user.Username {
+			logger.Info().Str("lockHolder", released.Holder).Msg("edit lock broken")
+		}
+		c.Status(http.StatusOK)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type editLocksTestSuite struct {
+	suite.Suite
+	now   time.Time
+	locks *editLocks
+}
+
+func TestEditLocks(t *testing.T) {
+	suite.Run(t, &editLocksTestSuite{})
+}
+
+func (t *editLocksTestSuite) SetupTest() {
+	t.now = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	t.locks = newEditLocks(time.Minute)
+	t.locks.now = func() time.Time { return t.now }
+}
+
+func (t *editLocksTestSuite) TestRenewalExtendsExpiry() {
+	_, acquireErr := t.locks.acquire("repo/drawing", "joe")
+	t.Require().NoError(acquireErr)
+
+	t.now = t.now.Add(50 * time.Second)
+	renewed, renewErr := t.locks.acquire("repo/drawing", "joe")
+	t.Require().NoError(renewErr)
+	t.Equal(t.now.Add(time.Minute), renewed.ExpiresAt)
+
+	t.now = t.now.Add(50 * time.Second)
+	_, allowed := t.locks.check("repo/drawing", "jane")
+	t.False(allowed)
+}
+
+func (t *editLocksTestSuite) TestExpiredLockCanBeTaken() {
+	_, acquireErr := t.locks.acquire("repo/drawing", "joe")
+	t.Require().NoError(acquireErr)
+
+	current, heldErr := t.locks.acquire("repo/drawing", "jane")
+	t.ErrorIs(heldErr, errEditLockHeld)
+	t.Equal("joe", current.Holder)
+
+	t.now = t.now.Add(time.Minute)
+	taken, takeErr := t.locks.acquire("repo/drawing", "jane")
+	t.Require().NoError(takeErr)
+	t.Equal("jane", taken.Holder)
+	_, allowed := t.locks.check("repo/drawing", "joe")
+	t.False(allowed)
+}
+
+func (t *editLocksTestSuite) TestRelease() {
+	_, acquireErr := t.locks.acquire("repo/drawing", "joe")
+	t.Require().NoError(acquireErr)
+
+	_, releaseErr := t.locks.release("repo/drawing", "jane", false)
+	t.ErrorIs(releaseErr, errEditLockHeld)
+	broken, breakErr := t.locks.release("repo/drawing", "jane", true)
+	t.Require().NoError(breakErr)
+	t.Equal("joe", broken.Holder)
+
+	_, locked := t.locks.get("repo/drawing")
+	t.False(locked)
+}
+
+func (t *editLocksTestSuite) TestExpiredLocksSwept() {
+	_, acquireErr := t.locks.acquire("repo/abandoned", "joe")
+	t.Require().NoError(acquireErr)
+	t.now = t.now.Add(30 * time.Second)
+	_, acquireErr = t.locks.acquire("repo/drawing", "jane")
+	t.Require().NoError(acquireErr)
+
+	t.now = t.now.Add(40 * time.Second)
+	t.locks.expire()
+	t.Len(t.locks.locks, 1, "expired locks are removed without accessing their drawings")
+	t.Contains(t.locks.locks, "repo/drawing")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+)
+
+// contentETag derives a strong entity tag from the drawing content, so that it is the same
+// whichever store the drawing comes from
+func contentETag(content string) string {
+	hash := sha256.Sum256([]byte(content))
+	return `"` + hex.EncodeToString(hash[:]) + `"`
+}
+
+// strongETagMatches evaluates an If-Match header value against the current entity tag.
+// Weak tags never match, as If-Match requires the strong comparison.
+func strongETagMatches(headerValue string, currentETag string) bool {
+	return etagMatches(headerValue, currentETag, false)
+}
+
+// weakETagMatches evaluates an If-None-Match header value against the current entity tag.
+// Weak tags are compared by their opaque part.
+func weakETagMatches(headerValue string, currentETag string) bool {
+	return etagMatches(headerValue, currentETag, true)
+}
+
+func etagMatches(headerValue string, currentETag string, weak bool) bool {
+	for tag := range strings.SplitSeq(headerValue, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == "*" || tag == currentETag {
+			return true
+		}
+	}
+	return false
+}
+
+// drawingLocks serializes the writes to the same drawing, so that checking a precondition
+// and storing the new content happen atomically within this server instance
+type drawingLocks struct {
+	lock  sync.Mutex
+	locks map[string]*drawingLock
+}
+
+type drawingLock struct {
+	sync.Mutex
+	users int
+}
+
+func newDrawingLocks() *drawingLocks {
+	return &drawingLocks{locks: map[string]*drawingLock{}}
+}
+
+// acquire blocks until the drawing is free and returns the function releasing it
+func (dl *drawingLocks) acquire(repoName string, drawingId string) func() {
+	key := repoName + "/" + drawingId
+
+	dl.lock.Lock()
+	l, exists := dl.locks[key]
+	if !exists {
+		l = &drawingLock{}
+		dl.locks[key] = l
+	}
+	l.users++
+	dl.lock.Unlock()
+
+	l.Lock()
+
+	return func() {
+		l.Unlock()
+		dl.lock.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(dl.locks, key)
+		}
+		dl.lock.Unlock()
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// excalidrawElement keeps every property of a scene element, so that properties
+// introduced by newer Excalidraw versions survive a round trip through the server
+type excalidrawElement map[string]any
+
+func (e excalidrawElement) id() string {
+	id, _ := e["id"].(string)
+	return id
+}
+
+func (e excalidrawElement) elementType() string {
+	t, _ := e["type"].(string)
+	return t
+}
+
+func (e excalidrawElement) isDeleted() bool {
+	deleted, _ := e["isDeleted"].(bool)
+	return deleted
+}
+
+type excalidrawScene struct {
+	Elements []excalidrawElement `json:"elements"`
+}
+
+// parseSceneElements maps the ids of the live (not deleted) elements of a scene to the elements
+func parseSceneElements(content string) (map[string]excalidrawElement, error) {
+	if len(content) == 0 {
+		return map[string]excalidrawElement{}, nil
+	}
+
+	var scene excalidrawScene
+	unmarshalErr := json.Unmarshal([]byte(content), &scene)
+	if unmarshalErr != nil {
+		return nil, fmt.Errorf("failed to parse excalidraw scene: %w", unmarshalErr)
+	}
+
+	elements := map[string]excalidrawElement{}
+	for _, element := range scene.Elements {
+		if element.isDeleted() {
+			continue
+		}
+		id := element.id()
+		if len(id) == 0 {
+			return nil, fmt.Errorf("excalidraw element without id: %v", element)
+		}
+		elements[id] = element
+	}
+	return elements, nil
+}
+
+var (
+	geometryProperties = []string{"x", "y", "width", "height", "angle", "points"}
+	styleProperties    = []string{
+		"strokeColor", "backgroundColor", "fillStyle", "strokeWidth", "strokeStyle", "roughness",
+		"opacity", "roundness", "fontSize", "fontFamily", "textAlign", "verticalAlign",
+	}
+	textProperties = []string{"text", "originalText"}
+)
+
+type elementChange struct {
+	Id                string   `json:"id"`
+	Type              string   `json:"type"`
+	ChangedProperties []string `json:"changedProperties,omitempty"`
+}
+
+type drawingDiff struct {
+	Added       []elementChange `json:"added"`
+	Removed     []elementChange `json:"removed"`
+	Moved       []elementChange `json:"moved"`
+	Restyled    []elementChange `json:"restyled"`
+	TextChanged []elementChange `json:"textChanged"`
+}
+
+func changedProperties(from excalidrawElement, to excalidrawElement, properties []string) []string {
+	changed := []string{}
+	for _, property := range properties {
+		if !reflect.DeepEqual(from[property], to[property]) {
+			changed = append(changed, property)
+		}
+	}
+	return changed
+}
+
+// diffScenes compares two Excalidraw scenes element by element, matching elements by their id.
+// An element may show up in more than one category, e.g. when it was both moved and restyled.
+func diffScenes(fromContent string, toContent string) (*drawingDiff, error) {
+	fromElements, fromParseErr := parseSceneElements(fromContent)
+	if fromParseErr != nil {
+		return nil, fromParseErr
+	}
+	toElements, toParseErr := parseSceneElements(toContent)
+	if toParseErr != nil {
+		return nil, toParseErr
+	}
+
+	diff := &drawingDiff{
+		Added:       []elementChange{},
+		Removed:     []elementChange{},
+		Moved:       []elementChange{},
+		Restyled:    []elementChange{},
+		TextChanged: []elementChange{},
+	}
+
+	for id, from := range fromElements {
+		to, stillPresent := toElements[id]
+		if !stillPresent {
+			diff.Removed = append(diff.Removed, elementChange{Id: id, Type: from.elementType()})
+			continue
+		}
+		if moved := changedProperties(from, to, geometryProperties); len(moved) > 0 {
+			diff.Moved = append(diff.Moved, elementChange{Id: id, Type: to.elementType(), ChangedProperties: moved})
+		}
+		if restyled := changedProperties(from, to, styleProperties); len(restyled) > 0 {
+			diff.Restyled = append(diff.Restyled, elementChange{Id: id, Type: to.elementType(), ChangedProperties: restyled})
+		}
+		if textChanged := changedProperties(from, to, textProperties); len(textChanged) > 0 {
+			diff.TextChanged = append(diff.TextChanged, elementChange{Id: id, Type: to.elementType(), ChangedProperties: textChanged})
+		}
+	}
+
+	for id, to := range toElements {
+		if _, existedBefore := fromElements[id]; !existedBefore {
+			diff.Added = append(diff.Added, elementChange{Id: id, Type: to.elementType()})
+		}
+	}
+
+	for _, changes := range [][]elementChange{diff.Added, diff.Removed, diff.Moved, diff.Restyled, diff.TextChanged} {
+		sort.Slice(changes, func(i, j int) bool { return changes[i].Id < changes[j].Id })
+	}
+
+	return diff, nil
+}
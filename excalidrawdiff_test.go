@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type excalidrawDiffTestSuite struct {
+	suite.Suite
+}
+
+func TestExcalidrawDiff(t *testing.T) {
+	suite.Run(t, &excalidrawDiffTestSuite{})
+}
+
+func (t *excalidrawDiffTestSuite) TestDiffScenes() {
+	from := `{"type":"excalidraw","elements":[
+		{"id":"kept","type":"rectangle","x":0,"y":0,"strokeColor":"#000000"},
+		{"id":"moved","type":"ellipse","x":10,"y":10,"strokeColor":"#000000"},
+		{"id":"restyled","type":"rectangle","x":20,"y":20,"strokeColor":"#000000"},
+		{"id":"retexted","type":"text","x":30,"y":30,"text":"old"},
+		{"id":"removed","type":"arrow","x":40,"y":40},
+		{"id":"deleted-before","type":"line","x":50,"y":50,"isDeleted":true}
+	]}`
+	to := `{"type":"excalidraw","elements":[
+		{"id":"kept","type":"rectangle","x":0,"y":0,"strokeColor":"#000000"},
+		{"id":"moved","type":"ellipse","x":15,"y":10,"strokeColor":"#000000"},
+		{"id":"restyled","type":"rectangle","x":20,"y":20,"strokeColor":"#ff0000"},
+		{"id":"retexted","type":"text","x":30,"y":30,"text":"new"},
+		{"id":"added","type":"diamond","x":60,"y":60},
+		{"id":"deleted-before","type":"line","x":50,"y":50,"isDeleted":true}
+	]}`
+
+	diff, err := diffScenes(from, to)
+
+	t.NoError(err)
+	t.Equal(&drawingDiff{
+		Added:       []elementChange{{Id: "added", Type: "diamond"}},
+		Removed:     []elementChange{{Id: "removed", Type: "arrow"}},
+		Moved:       []elementChange{{Id: "moved", Type: "ellipse", ChangedProperties: []string{"x"}}},
+		Restyled:    []elementChange{{Id: "restyled", Type: "rectangle", ChangedProperties: []string{"strokeColor"}}},
+		TextChanged: []elementChange{{Id: "retexted", Type: "text", ChangedProperties: []string{"text"}}},
+	}, diff)
+}
+
+func (t *excalidrawDiffTestSuite) TestDiffScenesFromEmpty() {
+	diff, err := diffScenes("", `{"elements":[{"id":"a","type":"rectangle"}]}`)
+
+	t.NoError(err)
+	t.Equal([]elementChange{{Id: "a", Type: "rectangle"}}, diff.Added)
+	t.Empty(diff.Removed)
+}
+
+func (t *excalidrawDiffTestSuite) TestDiffScenesInvalidContent() {
+	_, err := diffScenes("not json", `{"elements":[]}`)
+
+	t.Error(err)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// sameElementRevision tells whether two states of an element are the same. Excalidraw bumps
+// "version" and regenerates "versionNonce" on every change of an element, so these identify
+// the revision; the full content is compared only for elements lacking them.
+func sameElementRevision(a excalidrawElement, b excalidrawElement) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	aVersion, aHasVersion := a["version"]
+	bVersion, bHasVersion := b["version"]
+	aNonce, aHasNonce := a["versionNonce"]
+	bNonce, bHasNonce := b["versionNonce"]
+	if aHasVersion && bHasVersion && aHasNonce && bHasNonce {
+		return reflect.DeepEqual(aVersion, bVersion) && reflect.DeepEqual(aNonce, bNonce)
+	}
+	return reflect.DeepEqual(map[string]any(a), map[string]any(b))
+}
+
+// newerElement tells whether a is a later revision of the element than b: the higher version
+// wins, then the higher versionNonce
+func newerElement(a excalidrawElement, b excalidrawElement) bool {
+	aVersion, _ := a["version"].(float64)
+	bVersion, _ := b["version"].(float64)
+	if aVersion != bVersion {
+		return aVersion > bVersion
+	}
+	aNonce, _ := a["versionNonce"].(float64)
+	bNonce, _ := b["versionNonce"].(float64)
+	return aNonce > bNonce
+}
+
+// dedupeElements keeps one element per id, the newest revision, at the position of the first
+// one; a scene may list an element more than once, e.g. after a faulty paste
+func dedupeElements(elements []excalidrawElement) []excalidrawElement {
+	positions := map[string]int{}
+	deduped := make([]excalidrawElement, 0, len(elements))
+	for _, element := range elements {
+		position, seen := positions[element.id()]
+		if !seen {
+			positions[element.id()] = len(deduped)
+			deduped = append(deduped, element)
+			continue
+		}
+		if newerElement(element, deduped[position]) {
+			deduped[position] = element
+		}
+	}
+	return deduped
+}
+
+// parseSceneForMerge returns the top-level properties of the scene and its elements, deleted
+// ones included, in scene order, with one element per id
+func parseSceneForMerge(content string) (map[string]json.RawMessage, []excalidrawElement, error) {
+	scene := map[string]json.RawMessage{}
+	if len(content) == 0 {
+		return scene, nil, nil
+	}
+	unmarshalErr := json.Unmarshal([]byte(content), &scene)
+	if unmarshalErr != nil {
+		return nil, nil, fmt.Errorf("failed to parse excalidraw scene: %w", unmarshalErr)
+	}
+	var elements []excalidrawElement
+	if rawElements, hasElements := scene["elements"]; hasElements {
+		elementsErr := json.Unmarshal(rawElements, &elements)
+		if elementsErr != nil {
+			return nil, nil, fmt.Errorf("failed to parse excalidraw elements: %w", elementsErr)
+		}
+	}
+	for _, element := range elements {
+		if len(element.id()) == 0 {
+			return nil, nil, fmt.Errorf("excalidraw element without id: %v", element)
+		}
+	}
+	return scene, dedupeElements(elements), nil
+}
+
+func elementsById(elements []excalidrawElement) map[string]excalidrawElement {
+	byId := map[string]excalidrawElement{}
+	for _, element := range elements {
+		byId[element.id()] = element
+	}
+	return byId
+}
+
+// mergeScenes merges the changes made to the base scene in the current (stored) and the
+// incoming scene. Elements changed on one side only take the changed state; elements changed
+// differently on both sides are conflicts, whose ids are returned instead of a merged scene.
+//
+// The merged scene keeps the element order and the top-level properties (e.g. appState) of the
+// incoming scene; elements only the current scene has are appended, and the "files" of both
+// scenes are kept.
+func mergeScenes(baseContent string, currentContent string, incomingContent string) (string, []string, error) {
+	_, baseElements, baseErr := parseSceneForMerge(baseContent)
+	if baseErr != nil {
+		return "", nil, baseErr
+	}
+	currentScene, currentElements, currentErr := parseSceneForMerge(currentContent)
+	if currentErr != nil {
+		return "", nil, currentErr
+	}
+	incomingScene, incomingElements, incomingErr := parseSceneForMerge(incomingContent)
+	if incomingErr != nil {
+		return "", nil, incomingErr
+	}
+
+	base := elementsById(baseElements)
+	current := elementsById(currentElements)
+	incoming := elementsById(incomingElements)
+
+	ids := []string{}
+	for _, element := range incomingElements {
+		ids = append(ids, element.id())
+	}
+	for _, element := range currentElements {
+		if _, inIncoming := incoming[element.id()]; !inIncoming {
+			ids = append(ids, element.id())
+		}
+	}
+	for _, element := range baseElements {
+		_, inIncoming := incoming[element.id()]
+		_, inCurrent := current[element.id()]
+		if !inIncoming && !inCurrent {
+			ids = append(ids, element.id())
+		}
+	}
+
+	merged := []excalidrawElement{}
+	conflicts := []string{}
+	for _, id := range ids {
+		b, o, t := base[id], current[id], incoming[id]
+		var result excalidrawElement
+		switch {
+		case sameElementRevision(b, o):
+			result = t
+		case sameElementRevision(b, t), sameElementRevision(o, t):
+			result = o
+		default:
+			conflicts = append(conflicts, id)
+			continue
+		}
+		if result != nil {
+			merged = append(merged, result)
+		}
+	}
+
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return "", conflicts, nil
+	}
+
+	mergedElements, marshalElementsErr := json.Marshal(merged)
+	if marshalElementsErr != nil {
+		return "", nil, fmt.Errorf("failed to marshal merged elements: %w", marshalElementsErr)
+	}
+	incomingScene["elements"] = mergedElements
+
+	mergedFiles, mergeFilesErr := mergeSceneFiles(currentScene["files"], incomingScene["files"])
+	if mergeFilesErr != nil {
+		return "", nil, mergeFilesErr
+	}
+	if mergedFiles != nil {
+		incomingScene["files"] = mergedFiles
+	}
+
+	mergedScene, marshalSceneErr := json.Marshal(incomingScene)
+	if marshalSceneErr != nil {
+		return "", nil, fmt.Errorf("failed to marshal merged scene: %w", marshalSceneErr)
+	}
+	return string(mergedScene), nil, nil
+}
+
+// mergeSceneFiles unites the binary files (e.g. embedded images) of two scenes. Files are keyed
+// by a hash of their content, so entries with the same key are the same.
+func mergeSceneFiles(currentFiles json.RawMessage, incomingFiles json.RawMessage) (json.RawMessage, error) {
+	if len(currentFiles) == 0 {
+		return incomingFiles, nil
+	}
+	files := map[string]json.RawMessage{}
+	for _, raw := range []json.RawMessage{currentFiles, incomingFiles} {
+		if len(raw) == 0 {
+			continue
+		}
+		unmarshalErr := json.Unmarshal(raw, &files)
+		if unmarshalErr != nil {
+			return nil, fmt.Errorf("failed to parse excalidraw files: %w", unmarshalErr)
+		}
+	}
+	merged, marshalErr := json.Marshal(files)
+	if marshalErr != nil {
+		return nil, fmt.Errorf("failed to marshal merged files: %w", marshalErr)
+	}
+	return merged, nil
+}
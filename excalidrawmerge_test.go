@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type excalidrawMergeTestSuite struct {
+	suite.Suite
+}
+
+func TestExcalidrawMerge(t *testing.T) {
+	suite.Run(t, &excalidrawMergeTestSuite{})
+}
+
+func (t *excalidrawMergeTestSuite) mergedElements(merged string) map[string]excalidrawElement {
+	var scene excalidrawScene
+	t.Require().NoError(json.Unmarshal([]byte(merged), &scene))
+	return elementsById(scene.Elements)
+}
+
+func (t *excalidrawMergeTestSuite) TestMergeNonOverlappingChanges() {
+	base := `{"type":"excalidraw","elements":[
+		{"id":"a","x":0,"version":1,"versionNonce":11},
+		{"id":"b","x":0,"version":1,"versionNonce":21},
+		{"id":"c","x":0,"version":1,"versionNonce":31}
+	],"files":{"f1":{"id":"f1"}}}`
+	current := `{"type":"excalidraw","elements":[
+		{"id":"a","x":5,"version":2,"versionNonce":12},
+		{"id":"b","x":0,"version":1,"versionNonce":21},
+		{"id":"c","x":0,"version":1,"versionNonce":31},
+		{"id":"d","x":0,"version":1,"versionNonce":41}
+	],"files":{"f1":{"id":"f1"},"f2":{"id":"f2"}}}`
+	incoming := `{"type":"excalidraw","elements":[
+		{"id":"a","x":0,"version":1,"versionNonce":11},
+		{"id":"b","x":7,"version":2,"versionNonce":22},
+		{"id":"c","x":0,"version":2,"versionNonce":32,"isDeleted":true}
+	],"appState":{"viewBackgroundColor":"#ffffff"},"files":{"f1":{"id":"f1"}}}`
+
+	merged, conflicts, err := mergeScenes(base, current, incoming)
+
+	t.Require().NoError(err)
+	t.Empty(conflicts)
+	elements := t.mergedElements(merged)
+	t.Len(elements, 4)
+	t.Equal(float64(5), elements["a"]["x"])
+	t.Equal(float64(7), elements["b"]["x"])
+	t.True(elements["c"].isDeleted())
+	t.Contains(elements, "d")
+
+	var scene struct {
+		AppState map[string]any `json:"appState"`
+		Files    map[string]any `json:"files"`
+	}
+	t.Require().NoError(json.Unmarshal([]byte(merged), &scene))
+	t.Contains(scene.Files, "f2")
+	t.Equal("#ffffff", scene.AppState["viewBackgroundColor"])
+}
+
+func (t *excalidrawMergeTestSuite) TestMergeSameChangeOnBothSides() {
+	base := `{"elements":[{"id":"a","x":0,"version":1,"versionNonce":11}]}`
+	changed := `{"elements":[{"id":"a","x":5,"version":2,"versionNonce":12}]}`
+
+	merged, conflicts, err := mergeScenes(base, changed, changed)
+
+	t.Require().NoError(err)
+	t.Empty(conflicts)
+	t.Equal(float64(5), t.mergedElements(merged)["a"]["x"])
+}
+
+func (t *excalidrawMergeTestSuite) TestMergeConflict() {
+	base := `{"elements":[{"id":"a","x":0,"version":1,"versionNonce":11},{"id":"b","x":0,"version":1,"versionNonce":21}]}`
+	current := `{"elements":[{"id":"a","x":5,"version":2,"versionNonce":12},{"id":"b","x":0,"version":1,"versionNonce":21}]}`
+	incoming := `{"elements":[{"id":"a","x":7,"version":2,"versionNonce":13},{"id":"b","x":3,"version":2,"versionNonce":22}]}`
+
+	merged, conflicts, err := mergeScenes(base, current, incoming)
+
+	t.NoError(err)
+	t.Empty(merged)
+	t.Equal([]string{"a"}, conflicts)
+}
+
+func (t *excalidrawMergeTestSuite) TestMergeDuplicateIds() {
+	base := `{"elements":[{"id":"a","x":0,"version":1,"versionNonce":11},{"id":"b","x":0,"version":1,"versionNonce":21}]}`
+	incoming := `{"elements":[
+		{"id":"a","x":3,"version":2,"versionNonce":12},
+		{"id":"b","x":0,"version":1,"versionNonce":21},
+		{"id":"a","x":5,"version":3,"versionNonce":13},
+		{"id":"a","x":4,"version":3,"versionNonce":10}
+	]}`
+
+	merged, conflicts, err := mergeScenes(base, base, incoming)
+
+	t.Require().NoError(err)
+	t.Empty(conflicts)
+	var scene excalidrawScene
+	t.Require().NoError(json.Unmarshal([]byte(merged), &scene))
+	t.Len(scene.Elements, 2)
+	t.Equal("a", scene.Elements[0].id())
+	t.Equal(float64(5), scene.Elements[0]["x"])
+}
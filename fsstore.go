@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"myxcaliapp/backend/repoerr"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"vcblobstore"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	fsStoreVersionsDirName  = ".versions"
+	fsStoreVersionIdFormat  = "20060102T150405.000000000Z"
+	fsStoreFilePermissions  = 0o644
+	fsStoreDirPermissions   = 0o755
+	fsStoreVersionExtension = ".json"
+)
+
+// fsStore keeps drawings as plain files in a directory. Every save also writes a timestamped
+// snapshot into a sidecar directory, which the version methods work off.
+type fsStore struct {
+	dir    string
+	lock   sync.Mutex
+	logger zerolog.Logger
+}
+
+type fsStoreSnapshot struct {
+	Author    string    `json:"author"`
+	Message   string    `json:"message,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Content   string    `json:"content"`
+}
+
+func newFsStore(root string, drawingsPath string, logger zerolog.Logger) (*fsStore, error) {
+	if len(root) == 0 {
+		return nil, fmt.Errorf("missing root directory")
+	}
+	dir := filepath.Join(root, drawingsPath)
+	mkdirErr := os.MkdirAll(filepath.Join(dir, fsStoreVersionsDirName), fsStoreDirPermissions)
+	if mkdirErr != nil {
+		return nil, fmt.Errorf("failed to create drawings directory %s: %w", dir, mkdirErr)
+	}
+	return &fsStore{dir: dir, logger: logger}, nil
+}
+
+func checkFsStoreKey(key string) error {
+	if len(key) == 0 || strings.ContainsAny(key, `/\`) || key == "." || key == ".." || strings.HasPrefix(key, ".") {
+		return fmt.Errorf("drawing key %q: %w", key, repoerr.ErrInvalidInput)
+	}
+	return nil
+}
+
+func (store *fsStore) drawingFile(key string) string {
+	return filepath.Join(store.dir, key+drawingFileExtension)
+}
+
+func (store *fsStore) versionsDir(key string) string {
+	return filepath.Join(store.dir, fsStoreVersionsDirName, key)
+}
+
+// writeFile replaces the file atomically, so that readers never see partially written drawings
+func writeFile(fileName string, content []byte, permissions os.FileMode) error {
+	tmpFile, createErr := os.CreateTemp(filepath.Dir(fileName), ".tmp-"+filepath.Base(fileName)+"-*")
+	if createErr != nil {
+		return createErr
+	}
+	_, writeErr := tmpFile.Write(content)
+	closeErr := tmpFile.Close()
+	if writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr == nil {
+		writeErr = os.Chmod(tmpFile.Name(), permissions)
+	}
+	if writeErr == nil {
+		writeErr = os.Rename(tmpFile.Name(), fileName)
+	}
+	if writeErr != nil {
+		os.Remove(tmpFile.Name())
+	}
+	return writeErr
+}
+
+// put must be called with the lock held
+func (store *fsStore) put(key string, content string, modifiedBy string, message string) (string, error) {
+	if keyErr := checkFsStoreKey(key); keyErr != nil {
+		return "", keyErr
+	}
+
+	writeErr := writeFile(store.drawingFile(key), []byte(content), fsStoreFilePermissions)
+	if writeErr != nil {
+		return "", fmt.Errorf("failed to write drawing %s: %w", key, writeErr)
+	}
+
+	snapshot := fsStoreSnapshot{
+		Author:    modifiedBy,
+		Message:   message,
+		Timestamp: time.Now().UTC(),
+		Content:   content,
+	}
+	versionId := snapshot.Timestamp.Format(fsStoreVersionIdFormat)
+	for store.hasSnapshot(key, versionId) {
+		// Saves in quick succession on systems with a coarse clock
+		snapshot.Timestamp = snapshot.Timestamp.Add(time.Nanosecond)
+		versionId = snapshot.Timestamp.Format(fsStoreVersionIdFormat)
+	}
+	snapshotBytes, marshalErr := json.Marshal(snapshot)
+	if marshalErr != nil {
+		return "", fmt.Errorf("failed to marshal snapshot of %s: %w", key, marshalErr)
+	}
+	mkdirErr := os.MkdirAll(store.versionsDir(key), fsStoreDirPermissions)
+	if mkdirErr != nil {
+		return "", fmt.Errorf("failed to create versions directory of %s: %w", key, mkdirErr)
+	}
+	snapshotErr := writeFile(store.snapshotFile(key, versionId), snapshotBytes, fsStoreFilePermissions)
+	if snapshotErr != nil {
+		return "", fmt.Errorf("failed to write snapshot of %s: %w", key, snapshotErr)
+	}
+
+	store.logger.Debug().Str("key", key).Str("versionId", versionId).Msg("drawing stored")
+	return versionId, nil
+}
+
+func (store *fsStore) PutDrawing(ctx context.Context, key string, contentReader io.Reader, modifiedBy string) error {
+	content, readErr := io.ReadAll(contentReader)
+	if readErr != nil {
+		return fmt.Errorf("failed to read content of %s: %w", key, readErr)
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	message, _ := commitDetails(ctx, modifiedBy, "")
+	_, err := store.put(key, string(content), modifiedBy, message)
+	return err
+}
+
+func (store *fsStore) CopyDrawing(ctx context.Context, sourceId string, destinationId string, modifiedBy string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	content, getErr := store.get(sourceId)
+	if getErr != nil {
+		return getErr
+	}
+	message, _ := commitDetails(ctx, modifiedBy, "")
+	_, err := store.put(destinationId, content, modifiedBy, message)
+	return err
+}
+
+func (store *fsStore) ListDrawings(ctx context.Context) (map[drawingId]drawingTitle, error) {
+	entries, readDirErr := os.ReadDir(store.dir)
+	if readDirErr != nil {
+		return nil, fmt.Errorf("failed to list drawings directory %s: %w", store.dir, readDirErr)
+	}
+
+	drawings := map[drawingId]drawingTitle{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, drawingFileExtension) {
+			continue
+		}
+		id := strings.TrimSuffix(name, drawingFileExtension)
+		drawings[id] = id
+	}
+	return drawings, nil
+}
+
+func (store *fsStore) get(key string) (string, error) {
+	if keyErr := checkFsStoreKey(key); keyErr != nil {
+		return "", keyErr
+	}
+	content, readErr := os.ReadFile(store.drawingFile(key))
+	if errors.Is(readErr, fs.ErrNotExist) {
+		return "", fmt.Errorf("drawing %s: %w", key, repoerr.ErrNotFound)
+	}
+	if readErr != nil {
+		return "", fmt.Errorf("failed to read drawing %s: %w", key, readErr)
+	}
+	return string(content), nil
+}
+
+func (store *fsStore) GetDrawing(ctx context.Context, key string) (string, error) {
+	return store.get(key)
+}
+
+// DeleteDrawing removes the drawing, but keeps its snapshots, so that it can still be restored
+func (store *fsStore) DeleteDrawing(ctx context.Context, key string, modifiedBy string) error {
+	if keyErr := checkFsStoreKey(key); keyErr != nil {
+		return keyErr
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	removeErr := os.Remove(store.drawingFile(key))
+	if errors.Is(removeErr, fs.ErrNotExist) {
+		return fmt.Errorf("drawing %s: %w", key, repoerr.ErrNotFound)
+	}
+	if removeErr != nil {
+		return fmt.Errorf("failed to delete drawing %s: %w", key, removeErr)
+	}
+	store.logger.Debug().Str("key", key).Str("modifiedBy", modifiedBy).Msg("drawing deleted")
+	return nil
+}
+
+func (store *fsStore) snapshotFile(key string, versionID string) string {
+	return filepath.Join(store.versionsDir(key), versionID+fsStoreVersionExtension)
+}
+
+func (store *fsStore) hasSnapshot(key string, versionID string) bool {
+	_, statErr := os.Stat(store.snapshotFile(key, versionID))
+	return statErr == nil
+}
+
+func (store *fsStore) readSnapshot(key string, versionID string) (*fsStoreSnapshot, error) {
+	if _, parseErr := time.Parse(fsStoreVersionIdFormat, versionID); parseErr != nil {
+		return nil, fmt.Errorf("version %q of %s: %w", versionID, key, repoerr.ErrNotFound)
+	}
+	snapshotBytes, readErr := os.ReadFile(store.snapshotFile(key, versionID))
+	if errors.Is(readErr, fs.ErrNotExist) {
+		return nil, fmt.Errorf("version %s of %s: %w", versionID, key, repoerr.ErrNotFound)
+	}
+	if readErr != nil {
+		return nil, fmt.Errorf("failed to read version %s of %s: %w", versionID, key, readErr)
+	}
+	var snapshot fsStoreSnapshot
+	unmarshalErr := json.Unmarshal(snapshotBytes, &snapshot)
+	if unmarshalErr != nil {
+		return nil, fmt.Errorf("failed to parse version %s of %s: %w", versionID, key, unmarshalErr)
+	}
+	return &snapshot, nil
+}
+
+// ListVersions lists the versions of a drawing, latest first
+func (store *fsStore) ListVersions(ctx context.Context, key string) ([]vcblobstore.BlobVersion, error) {
+	if keyErr := checkFsStoreKey(key); keyErr != nil {
+		return nil, keyErr
+	}
+
+	entries, readDirErr := os.ReadDir(store.versionsDir(key))
+	if errors.Is(readDirErr, fs.ErrNotExist) {
+		return nil, fmt.Errorf("drawing %s: %w", key, repoerr.ErrNotFound)
+	}
+	if readDirErr != nil {
+		return nil, fmt.Errorf("failed to list versions of %s: %w", key, readDirErr)
+	}
+
+	versionIds := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), fsStoreVersionExtension) {
+			versionIds = append(versionIds, strings.TrimSuffix(entry.Name(), fsStoreVersionExtension))
+		}
+	}
+	// The version id format sorts chronologically
+	sort.Sort(sort.Reverse(sort.StringSlice(versionIds)))
+
+	versions := []vcblobstore.BlobVersion{}
+	for _, versionId := range versionIds {
+		snapshot, snapshotErr := store.readSnapshot(key, versionId)
+		if snapshotErr != nil {
+			return nil, snapshotErr
+		}
+		versions = append(versions, vcblobstore.BlobVersion{
+			VersionID: versionId,
+			Author:    snapshot.Author,
+			Timestamp: snapshot.Timestamp,
+			Message:   snapshot.Message,
+		})
+	}
+	return versions, nil
+}
+
+func (store *fsStore) GetVersion(ctx context.Context, key string, versionID string) (string, error) {
+	if keyErr := checkFsStoreKey(key); keyErr != nil {
+		return "", keyErr
+	}
+	snapshot, err := store.readSnapshot(key, versionID)
+	if err != nil {
+		return "", err
+	}
+	return snapshot.Content, nil
+}
+
+// RestoreVersion saves the content of the version as the latest version and returns its id
+func (store *fsStore) RestoreVersion(ctx context.Context, key string, versionID string, modifiedBy string) (string, error) {
+	if keyErr := checkFsStoreKey(key); keyErr != nil {
+		return "", keyErr
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	snapshot, readErr := store.readSnapshot(key, versionID)
+	if readErr != nil {
+		return "", readErr
+	}
+	message, _ := commitDetails(ctx, modifiedBy, "")
+	return store.put(key, snapshot.Content, modifiedBy, message)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"myxcaliapp/backend/repoerr"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/suite"
+)
+
+type fsStoreTestSuite struct {
+	suite.Suite
+	root  string
+	store *fsStore
+}
+
+func TestFsStore(t *testing.T) {
+	suite.Run(t, &fsStoreTestSuite{})
+}
+
+func (t *fsStoreTestSuite) SetupTest() {
+	t.root = t.T().TempDir()
+	store, storeErr := newFsStore(t.root, "drawings", zerolog.Nop())
+	t.Require().NoError(storeErr)
+	t.store = store
+}
+
+func (t *fsStoreTestSuite) put(key string, content string) {
+	t.Require().NoError(t.store.PutDrawing(t.T().Context(), key, strings.NewReader(content), "joe"))
+}
+
+func (t *fsStoreTestSuite) TestPlainFiles() {
+	t.put("drawing", "content")
+
+	fileName := filepath.Join(t.root, "drawings", "drawing"+drawingFileExtension)
+	content, readErr := os.ReadFile(fileName)
+	t.Require().NoError(readErr)
+	t.Equal("content", string(content))
+	info, statErr := os.Stat(fileName)
+	t.Require().NoError(statErr)
+	t.Equal(os.FileMode(fsStoreFilePermissions), info.Mode().Perm())
+
+	entries, readDirErr := os.ReadDir(filepath.Join(t.root, "drawings"))
+	t.Require().NoError(readDirErr)
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	t.ElementsMatch([]string{fsStoreVersionsDirName, "drawing" + drawingFileExtension}, names, "no temporary files are left behind")
+}
+
+func (t *fsStoreTestSuite) TestNotFound() {
+	ctx := t.T().Context()
+
+	_, getErr := t.store.GetDrawing(ctx, "missing")
+	t.ErrorIs(getErr, repoerr.ErrNotFound)
+	_, listErr := t.store.ListVersions(ctx, "missing")
+	t.ErrorIs(listErr, repoerr.ErrNotFound)
+	t.ErrorIs(t.store.DeleteDrawing(ctx, "missing", "joe"), repoerr.ErrNotFound)
+	t.ErrorIs(t.store.CopyDrawing(ctx, "missing", "copy", "joe"), repoerr.ErrNotFound)
+
+	t.put("drawing", "content")
+	_, versionErr := t.store.GetVersion(ctx, "drawing", "20000101T000000.000000000Z")
+	t.ErrorIs(versionErr, repoerr.ErrNotFound)
+	_, malformedVersionErr := t.store.GetVersion(ctx, "drawing", "../drawing")
+	t.ErrorIs(malformedVersionErr, repoerr.ErrNotFound)
+}
+
+func (t *fsStoreTestSuite) TestInvalidKeys() {
+	ctx := t.T().Context()
+	for _, key := range []string{"", ".", "..", ".versions", "../outside", `sub\drawing`, "sub/drawing"} {
+		putErr := t.store.PutDrawing(ctx, key, strings.NewReader("content"), "joe")
+		t.ErrorIs(putErr, repoerr.ErrInvalidInput, key)
+		_, getErr := t.store.GetDrawing(ctx, key)
+		t.ErrorIs(getErr, repoerr.ErrInvalidInput, key)
+	}
+	t.NoFileExists(filepath.Join(t.root, "outside"+drawingFileExtension))
+}
+
+func (t *fsStoreTestSuite) TestDeletedDrawingCanBeRestored() {
+	ctx := t.T().Context()
+	t.put("drawing", "v1")
+	t.Require().NoError(t.store.DeleteDrawing(ctx, "drawing", "joe"))
+
+	drawings, listErr := t.store.ListDrawings(ctx)
+	t.Require().NoError(listErr)
+	t.Empty(drawings)
+	versions, versionsErr := t.store.ListVersions(ctx, "drawing")
+	t.Require().NoError(versionsErr)
+	t.Require().Len(versions, 1)
+
+	_, restoreErr := t.store.RestoreVersion(ctx, "drawing", versions[0].VersionID, "jane")
+	t.Require().NoError(restoreErr)
+	content, getErr := t.store.GetDrawing(ctx, "drawing")
+	t.Require().NoError(getErr)
+	t.Equal("v1", content)
+}
+
+func (t *fsStoreTestSuite) TestCommitMessage() {
+	ctx := withCommitInfo(t.T().Context(), commitInfo{message: "Add the database"})
+	t.Require().NoError(t.store.PutDrawing(ctx, "drawing", strings.NewReader("content"), "joe"))
+
+	versions, listErr := t.store.ListVersions(t.T().Context(), "drawing")
+	t.Require().NoError(listErr)
+	t.Require().Len(versions, 1)
+	t.Equal("Add the database", versions[0].Message)
+	t.Equal("joe", versions[0].Author)
+}
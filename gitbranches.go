@@ -0,0 +1,635 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"myxcaliapp/backend/repoerr"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"vcblobstore"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+// gitBranches gives access to the branches and other refs of a repo kept in a git working copy
+// (i.e. LOCAL_GIT). The checked-out branch is accessed via the store of the repo; the other refs
+// are read and written with git directly, without touching the working copy.
+type gitBranches struct {
+	workDir string
+	path    string
+	lock    sync.Mutex // serializes the updates of branches
+}
+
+func newGitBranches(workDir string, drawingsPath string) *gitBranches {
+	return &gitBranches{workDir: workDir, path: drawingsPath}
+}
+
+func (branches *gitBranches) git(ctx context.Context, args ...string) (string, error) {
+	return runGit(ctx, branches.workDir, nil, nil, args...)
+}
+
+func (branches *gitBranches) drawingFile(key string) string {
+	return path.Join(branches.path, key+drawingFileExtension)
+}
+
+func checkGitRef(ref string) error {
+	if len(ref) == 0 || strings.HasPrefix(ref, "-") || strings.ContainsAny(ref, ": \t\n") {
+		return fmt.Errorf("invalid ref %q: %w", ref, repoerr.ErrInvalidInput)
+	}
+	return nil
+}
+
+func (branches *gitBranches) current(ctx context.Context) (string, error) {
+	output, gitErr := branches.git(ctx, "symbolic-ref", "--short", "HEAD")
+	if gitErr != nil {
+		return "", fmt.Errorf("failed to get the current branch: %w", gitErr)
+	}
+	return strings.TrimSpace(output), nil
+}
+
+func (branches *gitBranches) list(ctx context.Context) ([]string, error) {
+	output, gitErr := branches.git(ctx, "for-each-ref", "--format=%(refname:short)", "refs/heads")
+	if gitErr != nil {
+		return nil, fmt.Errorf("failed to list branches: %w", gitErr)
+	}
+	names := strings.Fields(output)
+	sort.Strings(names)
+	return names, nil
+}
+
+// resolve returns the commit the ref points to
+func (branches *gitBranches) resolve(ctx context.Context, ref string) (string, error) {
+	if refErr := checkGitRef(ref); refErr != nil {
+		return "", refErr
+	}
+	output, gitErr := branches.git(ctx, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if gitErr != nil {
+		return "", fmt.Errorf("ref %s: %w", ref, repoerr.ErrNotFound)
+	}
+	return strings.TrimSpace(output), nil
+}
+
+// create creates the branch from the given ref, or from the current branch when it is empty
+func (branches *gitBranches) create(ctx context.Context, name string, from string) error {
+	if _, checkErr := branches.git(ctx, "check-ref-format", "--branch", name); checkErr != nil || strings.HasPrefix(name, "-") {
+		return fmt.Errorf("invalid branch name %q: %w", name, repoerr.ErrInvalidInput)
+	}
+	if len(from) == 0 {
+		current, currentErr := branches.current(ctx)
+		if currentErr != nil {
+			return currentErr
+		}
+		from = current
+	}
+
+	branches.lock.Lock()
+	defer branches.lock.Unlock()
+
+	start, resolveErr := branches.resolve(ctx, from)
+	if resolveErr != nil {
+		return resolveErr
+	}
+	if _, existsErr := branches.resolve(ctx, "refs/heads/"+name); existsErr == nil {
+		return fmt.Errorf("branch %s: %w", name, repoerr.ErrConflict)
+	}
+	_, branchErr := branches.git(ctx, "branch", name, start)
+	if branchErr != nil {
+		return fmt.Errorf("failed to create branch %s: %w", name, branchErr)
+	}
+	return nil
+}
+
+// at returns the repo as of the ref. Only refs which are branches can be written.
+func (branches *gitBranches) at(ref string) *gitRefRepo {
+	return &gitRefRepo{branches: branches, ref: ref}
+}
+
+// gitRefRepo is a drawingRepo reading the drawings from a git ref and committing the changes
+// to it, if it is a branch
+type gitRefRepo struct {
+	branches *gitBranches
+	ref      string
+}
+
+func (repo *gitRefRepo) readBlob(ctx context.Context, commitish string, key string) (string, error) {
+	commit, resolveErr := repo.branches.resolve(ctx, commitish)
+	if resolveErr != nil {
+		return "", resolveErr
+	}
+	content, gitErr := repo.branches.git(ctx, "cat-file", "blob", commit+":"+repo.branches.drawingFile(key))
+	if gitErr != nil {
+		return "", fmt.Errorf("drawing %s at %s: %w", key, commitish, repoerr.ErrNotFound)
+	}
+	return content, nil
+}
+
+// treeChange sets the content of a file in a tree
+type treeChange struct {
+	file string
+	blob string // the object id of the new content; the file is removed when empty
+}
+
+// writeBlob stores the content in the object database of the repo, returning its object id
+func (branches *gitBranches) writeBlob(ctx context.Context, content string) (string, error) {
+	output, hashErr := runGit(ctx, branches.workDir, nil, strings.NewReader(content), "hash-object", "-w", "--stdin")
+	if hashErr != nil {
+		return "", fmt.Errorf("failed to store content: %w", hashErr)
+	}
+	return strings.TrimSpace(output), nil
+}
+
+// blobAt returns the object id of the file as of the commit; it is empty when the file doesn't exist there
+func (branches *gitBranches) blobAt(ctx context.Context, commit string, file string) (string, error) {
+	output, gitErr := branches.git(ctx, "ls-tree", commit, "--", file)
+	if gitErr != nil {
+		return "", fmt.Errorf("failed to look up %s at %s: %w", file, commit, gitErr)
+	}
+	fields := strings.Fields(output) // <mode> <type> <object> <file>
+	if len(fields) < 3 {
+		return "", nil
+	}
+	return fields[2], nil
+}
+
+// commitTree creates a commit having the tree of the first parent with the changes applied,
+// returning the id of the commit. No branch is updated.
+func (branches *gitBranches) commitTree(ctx context.Context, parents []string, changes []treeChange, message string, author commitAuthor) (string, error) {
+	index, createIndexErr := os.CreateTemp("", "xcaliapp-index-")
+	if createIndexErr != nil {
+		return "", fmt.Errorf("failed to create temporary index: %w", createIndexErr)
+	}
+	index.Close()
+	defer os.Remove(index.Name())
+	indexEnv := []string{"GIT_INDEX_FILE=" + index.Name()}
+	git := func(args ...string) (string, error) {
+		output, gitErr := runGit(ctx, branches.workDir, indexEnv, nil, args...)
+		return strings.TrimSpace(output), gitErr
+	}
+
+	if _, readTreeErr := git("read-tree", parents[0]); readTreeErr != nil {
+		return "", fmt.Errorf("failed to read tree of %s: %w", parents[0], readTreeErr)
+	}
+	for _, change := range changes {
+		if len(change.blob) == 0 {
+			if _, removeErr := git("update-index", "--force-remove", "--", change.file); removeErr != nil {
+				return "", fmt.Errorf("failed to remove %s from the index: %w", change.file, removeErr)
+			}
+			continue
+		}
+		if _, updateErr := git("update-index", "--add", "--cacheinfo", "100644,"+change.blob+","+change.file); updateErr != nil {
+			return "", fmt.Errorf("failed to add %s to the index: %w", change.file, updateErr)
+		}
+	}
+	tree, writeTreeErr := git("write-tree")
+	if writeTreeErr != nil {
+		return "", fmt.Errorf("failed to write tree: %w", writeTreeErr)
+	}
+
+	args := []string{"commit-tree", tree, "-m", message}
+	for _, parent := range parents {
+		args = append(args, "-p", parent)
+	}
+	// the server commits on behalf of the author, so the committer is the identity of the server
+	authorEnv := []string{
+		"GIT_AUTHOR_NAME=" + author.name,
+		"GIT_AUTHOR_EMAIL=" + author.email,
+	}
+	commit, commitErr := runGit(ctx, branches.workDir, authorEnv, nil, args...)
+	if commitErr != nil {
+		return "", fmt.Errorf("failed to commit: %w", commitErr)
+	}
+	return strings.TrimSpace(commit), nil
+}
+
+// advanceBranch moves the branch from the old commit to the new one, failing with a conflict
+// if it has moved on in the meantime. The working copy is updated too when the branch is
+// checked out.
+func (branches *gitBranches) advanceBranch(ctx context.Context, branch string, oldCommit string, newCommit string) error {
+	current, currentErr := branches.current(ctx)
+	if currentErr != nil {
+		return currentErr
+	}
+	if branch == current {
+		head, resolveErr := branches.resolve(ctx, "HEAD")
+		if resolveErr != nil {
+			return resolveErr
+		}
+		if head != oldCommit {
+			return fmt.Errorf("branch %s has moved on: %w", branch, repoerr.ErrConflict)
+		}
+		if output, mergeErr := branches.git(ctx, "merge", "--ff-only", "--quiet", newCommit); mergeErr != nil {
+			if strings.Contains(output, "would be overwritten") {
+				return fmt.Errorf("files changed by the commit have uncommitted changes in the working copy of %s: %w", branch, repoerr.ErrConflict)
+			}
+			return fmt.Errorf("failed to update the working copy of %s: %w", branch, mergeErr)
+		}
+		return nil
+	}
+	if _, updateRefErr := branches.git(ctx, "update-ref", "refs/heads/"+branch, newCommit, oldCommit); updateRefErr != nil {
+		return fmt.Errorf("failed to update branch %s: %w: %w", branch, repoerr.ErrConflict, updateRefErr)
+	}
+	return nil
+}
+
+// commitWorkingCopyChanges commits the changes made to the file in the working copy outside the
+// server (see drawingDirWatcher), so that they are kept in the history instead of blocking the
+// update of the working copy. Must be called with the lock held, for the checked-out branch.
+func (branches *gitBranches) commitWorkingCopyChanges(ctx context.Context, file string) error {
+	status, statusErr := branches.git(ctx, "status", "--porcelain", "--", file)
+	if statusErr != nil {
+		return fmt.Errorf("failed to get the status of %s: %w", file, statusErr)
+	}
+	if len(strings.TrimSpace(status)) == 0 {
+		return nil
+	}
+	if _, addErr := branches.git(ctx, "add", "-A", "--", file); addErr != nil {
+		return fmt.Errorf("failed to add the changes of %s: %w", file, addErr)
+	}
+	if _, commitErr := branches.git(ctx, "commit", "--quiet", "-m", "Changes made in the working copy to "+path.Base(file), "--", file); commitErr != nil {
+		return fmt.Errorf("failed to commit the changes of %s: %w", file, commitErr)
+	}
+	return nil
+}
+
+// commit changes the drawing file on the branch; the file is removed when content is nil.
+// The message given is used unless the context has one. It returns the id of the new commit.
+func (repo *gitRefRepo) commit(ctx context.Context, key string, content *string, defaultMessage string, modifiedBy string) (string, error) {
+	if strings.ContainsAny(key, "/\\") || strings.HasPrefix(key, ".") || len(key) == 0 {
+		return "", fmt.Errorf("invalid drawing id %q: %w", key, repoerr.ErrInvalidInput)
+	}
+
+	repo.branches.lock.Lock()
+	defer repo.branches.lock.Unlock()
+
+	change := treeChange{file: repo.branches.drawingFile(key)}
+	if current, currentErr := repo.branches.current(ctx); currentErr == nil && current == repo.ref {
+		if commitErr := repo.branches.commitWorkingCopyChanges(ctx, change.file); commitErr != nil {
+			return "", commitErr
+		}
+	}
+	parent, resolveErr := repo.branches.resolve(ctx, "refs/heads/"+repo.ref)
+	if resolveErr != nil {
+		return "", fmt.Errorf("%s is not a branch: %w", repo.ref, repoerr.ErrInvalidInput)
+	}
+
+	if content == nil {
+		existing, lookupErr := repo.branches.blobAt(ctx, parent, change.file)
+		if lookupErr != nil {
+			return "", lookupErr
+		}
+		if len(existing) == 0 {
+			return "", fmt.Errorf("drawing %s on %s: %w", key, repo.ref, repoerr.ErrNotFound)
+		}
+	} else {
+		blob, writeErr := repo.branches.writeBlob(ctx, *content)
+		if writeErr != nil {
+			return "", writeErr
+		}
+		change.blob = blob
+	}
+
+	message, author := commitDetails(ctx, modifiedBy, defaultMessage)
+	commit, commitErr := repo.branches.commitTree(ctx, []string{parent}, []treeChange{change}, message, author)
+	if commitErr != nil {
+		return "", fmt.Errorf("failed to commit to %s: %w", repo.ref, commitErr)
+	}
+	if advanceErr := repo.branches.advanceBranch(ctx, repo.ref, parent, commit); advanceErr != nil {
+		return "", advanceErr
+	}
+	return commit, nil
+}
+
+func (repo *gitRefRepo) PutDrawing(ctx context.Context, key string, contentReader io.Reader, modifiedBy string) error {
+	content, readErr := io.ReadAll(contentReader)
+	if readErr != nil {
+		return fmt.Errorf("failed to read drawing content: %w", readErr)
+	}
+	text := string(content)
+	_, commitErr := repo.commit(ctx, key, &text, "Update "+key, modifiedBy)
+	return commitErr
+}
+
+func (repo *gitRefRepo) CopyDrawing(ctx context.Context, sourceId string, destinationId string, modifiedBy string) error {
+	content, getErr := repo.GetDrawing(ctx, sourceId)
+	if getErr != nil {
+		return getErr
+	}
+	_, commitErr := repo.commit(ctx, destinationId, &content, "Copy "+sourceId+" to "+destinationId, modifiedBy)
+	return commitErr
+}
+
+func (repo *gitRefRepo) ListDrawings(ctx context.Context) (map[drawingId]drawingTitle, error) {
+	commit, resolveErr := repo.branches.resolve(ctx, repo.ref)
+	if resolveErr != nil {
+		return nil, resolveErr
+	}
+	args := []string{"ls-tree", "--name-only", commit}
+	if len(repo.branches.path) > 0 {
+		args = append(args, "--", repo.branches.path+"/")
+	}
+	output, gitErr := repo.branches.git(ctx, args...)
+	if gitErr != nil {
+		return nil, fmt.Errorf("failed to list drawings at %s: %w", repo.ref, gitErr)
+	}
+	drawings := map[drawingId]drawingTitle{}
+	for _, line := range strings.Split(output, "\n") {
+		name := path.Base(line)
+		if len(line) == 0 || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, drawingFileExtension) {
+			continue
+		}
+		id := strings.TrimSuffix(name, drawingFileExtension)
+		drawings[id] = id
+	}
+	return drawings, nil
+}
+
+func (repo *gitRefRepo) GetDrawing(ctx context.Context, key string) (string, error) {
+	return repo.readBlob(ctx, repo.ref, key)
+}
+
+func (repo *gitRefRepo) DeleteDrawing(ctx context.Context, key string, modifiedBy string) error {
+	_, commitErr := repo.commit(ctx, key, nil, "Delete "+key, modifiedBy)
+	return commitErr
+}
+
+// ListVersions returns the commits of the ref changing the drawing, latest first
+func (repo *gitRefRepo) ListVersions(ctx context.Context, key string) ([]vcblobstore.BlobVersion, error) {
+	commit, resolveErr := repo.branches.resolve(ctx, repo.ref)
+	if resolveErr != nil {
+		return nil, resolveErr
+	}
+	output, gitErr := repo.branches.git(ctx, "log", "--format=%H%x1f%ae%x1f%aI%x1f%s", commit, "--", repo.branches.drawingFile(key))
+	if gitErr != nil {
+		return nil, fmt.Errorf("failed to list versions of %s at %s: %w", key, repo.ref, gitErr)
+	}
+	versions := []vcblobstore.BlobVersion{}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		fields := strings.Split(line, "\x1f")
+		if len(fields) != 4 {
+			continue
+		}
+		timestamp, parseErr := time.Parse(time.RFC3339, fields[2])
+		if parseErr != nil {
+			return nil, fmt.Errorf("failed to parse commit time %q: %w", fields[2], parseErr)
+		}
+		versions = append(versions, vcblobstore.BlobVersion{
+			VersionID: fields[0],
+			Author:    fields[1],
+			Timestamp: timestamp,
+			Message:   fields[3],
+		})
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("drawing %s at %s: %w", key, repo.ref, repoerr.ErrNotFound)
+	}
+	return versions, nil
+}
+
+func (repo *gitRefRepo) GetVersion(ctx context.Context, key string, versionID string) (string, error) {
+	return repo.readBlob(ctx, versionID, key)
+}
+
+func (repo *gitRefRepo) RestoreVersion(ctx context.Context, key string, versionID string, modifiedBy string) (string, error) {
+	content, getErr := repo.GetVersion(ctx, key, versionID)
+	if getErr != nil {
+		return "", getErr
+	}
+	return repo.commit(ctx, key, &content, "Restore "+key+" to "+versionID, modifiedBy)
+}
+
+// localGitRepo is a LOCAL_GIT store with the changes committed to the checked-out branch via
+// git directly, so that the commits have the messages and the authors given with the requests.
+// Uncommitted changes made to a drawing in the working copy are committed before the change made
+// by the server. The store itself makes the changes when no branch is checked out.
+type localGitRepo struct {
+	drawingRepo
+	branches *gitBranches
+}
+
+func newLocalGitRepo(store drawingRepo, branches *gitBranches) *localGitRepo {
+	return &localGitRepo{drawingRepo: store, branches: branches}
+}
+
+func (repo *localGitRepo) checkedOut(ctx context.Context) (*gitRefRepo, bool) {
+	current, currentErr := repo.branches.current(ctx)
+	if currentErr != nil {
+		return nil, false
+	}
+	return repo.branches.at(current), true
+}
+
+func (repo *localGitRepo) PutDrawing(ctx context.Context, key string, contentReader io.Reader, modifiedBy string) error {
+	if branch, onBranch := repo.checkedOut(ctx); onBranch {
+		return branch.PutDrawing(ctx, key, contentReader, modifiedBy)
+	}
+	return repo.drawingRepo.PutDrawing(ctx, key, contentReader, modifiedBy)
+}
+
+func (repo *localGitRepo) CopyDrawing(ctx context.Context, sourceId string, destinationId string, modifiedBy string) error {
+	if branch, onBranch := repo.checkedOut(ctx); onBranch {
+		return branch.CopyDrawing(ctx, sourceId, destinationId, modifiedBy)
+	}
+	return repo.drawingRepo.CopyDrawing(ctx, sourceId, destinationId, modifiedBy)
+}
+
+func (repo *localGitRepo) DeleteDrawing(ctx context.Context, key string, modifiedBy string) error {
+	if branch, onBranch := repo.checkedOut(ctx); onBranch {
+		return branch.DeleteDrawing(ctx, key, modifiedBy)
+	}
+	return repo.drawingRepo.DeleteDrawing(ctx, key, modifiedBy)
+}
+
+// RestoreVersion looks the version up via the store, as the version ids are the store's
+func (repo *localGitRepo) RestoreVersion(ctx context.Context, key string, versionID string, modifiedBy string) (string, error) {
+	branch, onBranch := repo.checkedOut(ctx)
+	if !onBranch {
+		return repo.drawingRepo.RestoreVersion(ctx, key, versionID, modifiedBy)
+	}
+	content, getErr := repo.drawingRepo.GetVersion(ctx, key, versionID)
+	if getErr != nil {
+		return "", getErr
+	}
+	return branch.commit(ctx, key, &content, "Restore "+key+" to "+versionID, modifiedBy)
+}
+
+// otherRef returns the ref in the "ref" query parameter, or an empty string when there is none
+// or it names the checked-out branch, which is accessed via the repo itself. The error response
+// has been sent when it returns false.
+func (hf *handlerFactory) otherRef(c *gin.Context, logger zerolog.Logger, repoName string) (string, bool) {
+	ref := c.Query("ref")
+	if len(ref) == 0 {
+		return "", true
+	}
+	branches, hasBranches := hf.branches[drawingRepoName(repoName)]
+	if !hasBranches {
+		logger.Info().Str("ref", ref).Msg("refs are not supported by the repo")
+		abortWithError(c, http.StatusBadRequest, fmt.Errorf("drawing repository %s has no refs: %w", repoName, repoerr.ErrInvalidInput))
+		return "", false
+	}
+	current, currentErr := branches.current(c)
+	if currentErr != nil {
+		logger.Error().Err(currentErr).Msg("failed to get the current branch")
+		abortWithRepoError(c, currentErr)
+		return "", false
+	}
+	if ref == current {
+		return "", true
+	}
+	if _, resolveErr := branches.resolve(c, ref); resolveErr != nil {
+		logger.Info().Err(resolveErr).Str("ref", ref).Msg("failed to resolve ref")
+		abortWithRepoError(c, resolveErr)
+		return "", false
+	}
+	return ref, true
+}
+
+// repoAtRef returns the repo as of the ref in the "ref" query parameter, if any, along with the
+// ref unless it names the checked-out branch (see otherRef). The error response has been sent
+// when it returns false.
+func (hf *handlerFactory) repoAtRef(c *gin.Context, logger zerolog.Logger, repoName string, repo drawingRepo) (drawingRepo, string, bool) {
+	ref, found := hf.otherRef(c, logger, repoName)
+	if !found || len(ref) == 0 {
+		return repo, "", found
+	}
+	branches := hf.branches[drawingRepoName(repoName)]
+	if syncRepo, isSynced := repo.(*gitSyncRepo); isSynced {
+		return syncRepo.at(ref, branches.at(ref)), ref, true
+	}
+	return branches.at(ref), ref, true
+}
+
+// checkedOutOnly responds with an error unless the "ref" query parameter is absent or names the
+// checked-out branch, for the operations supported on the checked-out branch only
+func (hf *handlerFactory) checkedOutOnly(c *gin.Context, logger zerolog.Logger, repoName string) bool {
+	ref, found := hf.otherRef(c, logger, repoName)
+	if found && len(ref) > 0 {
+		logger.Info().Str("ref", ref).Msg("operation not supported on refs other than the checked-out branch")
+		abortWithError(c, http.StatusBadRequest, fmt.Errorf("not supported on %s, only on the checked-out branch: %w", ref, repoerr.ErrInvalidInput))
+		return false
+	}
+	return found
+}
+
+// drawingRefKey returns the key under which the writes to the drawing as of the ref are
+// serialized; ref is empty for the checked-out branch (see otherRef)
+func drawingRefKey(drawingId string, ref string) string {
+	if len(ref) > 0 {
+		return drawingId + "@" + ref
+	}
+	return drawingId
+}
+
+type branchList struct {
+	Current  string   `json:"current"`
+	Branches []string `json:"branches"`
+}
+
+type createBranchRequest struct {
+	Name string `json:"name"`
+	From string `json:"from"` // defaults to the current branch
+}
+
+func (hf *handlerFactory) getRepoBranches(c *gin.Context, logger zerolog.Logger) (*gitBranches, bool) {
+	repoName := c.Param("repo")
+	if _, hasRepo := hf.repos.getRepo(drawingRepoName(repoName)); !hasRepo {
+		logger.Info().Msg("failed to find repo")
+		abortWithError(c, http.StatusNotFound, unknownRepoError(repoName))
+		return nil, false
+	}
+	branches, hasBranches := hf.branches[drawingRepoName(repoName)]
+	if !hasBranches {
+		abortWithError(c, http.StatusNotFound, fmt.Errorf("drawing repository %s has no branches: %w", repoName, repoerr.ErrNotFound))
+		return nil, false
+	}
+	return branches, true
+}
+
+func (hf *handlerFactory) listBranches() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		logger := zerolog.Ctx(c.Request.Context()).With().Str("repoName", c.Param("repo")).Logger()
+		branches, found := hf.getRepoBranches(c, logger)
+		if !found {
+			return
+		}
+		current, currentErr := branches.current(c)
+		if currentErr != nil {
+			logger.Error().Err(currentErr).Msg("failed to get the current branch")
+			abortWithRepoError(c, currentErr)
+			return
+		}
+		names, listErr := branches.list(c)
+		if listErr != nil {
+			logger.Error().Err(listErr).Msg("failed to list branches")
+			abortWithRepoError(c, listErr)
+			return
+		}
+		c.JSON(http.StatusOK, branchList{Current: current, Branches: names})
+	}
+}
+
+func (hf *handlerFactory) createBranch() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		logger := zerolog.Ctx(c.Request.Context()).With().Str("repoName", c.Param("repo")).Logger()
+
+		var requestData createBranchRequest
+		if bindErr := c.ShouldBindJSON(&requestData); bindErr != nil {
+			logger.Debug().Err(bindErr).Msg("failed to unmarshal request body")
+			abortWithError(c, http.StatusBadRequest, bindErr)
+			return
+		}
+		if len(requestData.Name) == 0 {
+			abortWithError(c, http.StatusBadRequest, errors.New("missing branch name"))
+			return
+		}
+
+		branches, found := hf.getRepoBranches(c, logger)
+		if !found {
+			return
+		}
+		createErr := branches.create(c, requestData.Name, requestData.From)
+		if createErr != nil {
+			logger.Info().Err(createErr).Str("branch", requestData.Name).Msg("failed to create branch")
+			abortWithRepoError(c, createErr)
+			return
+		}
+		c.JSON(http.StatusCreated, requestData.Name)
+	}
+}
+
+// listDrawingsAtRef lists the drawings of a single repo, as of the ref in the "ref" query parameter if any
+func (hf *handlerFactory) listDrawingsAtRef() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		repoName := c.Param("repo")
+		logger := zerolog.Ctx(c.Request.Context()).With().Str("repoName", repoName).Str("ref", c.Query("ref")).Logger()
+
+		repo, hasRepo := hf.repos.getRepo(drawingRepoName(repoName))
+		if !hasRepo {
+			logger.Info().Msg("failed to find repo")
+			abortWithError(c, http.StatusNotFound, unknownRepoError(repoName))
+			return
+		}
+		repo, _, found := hf.repoAtRef(c, logger, repoName, repo)
+		if !found {
+			return
+		}
+		list, listErr := repo.ListDrawings(c)
+		if listErr != nil {
+			logger.Error().Err(listErr).Msg("failed to list drawing titles")
+			abortWithRepoError(c, listErr)
+			return
+		}
+		items := []drawingRepoItem{}
+		for id, title := range list {
+			items = append(items, drawingRepoItem{Id: id, Title: title})
+		}
+		c.JSON(http.StatusOK, items)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"myxcaliapp/backend/drawingrepotest"
+	"myxcaliapp/backend/repoerr"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/suite"
+)
+
+func setGitTestEnvironment(t *testing.T) {
+	t.Setenv("GIT_AUTHOR_NAME", "test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+}
+
+// newTestWorkingCopy creates a git repository with the "main" branch checked out
+func newTestWorkingCopy(t *testing.T) string {
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-b", "main"},
+		{"commit", "--allow-empty", "-m", "initial"},
+	} {
+		output, gitErr := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+		if gitErr != nil {
+			t.Fatalf("git %v: %v: %s", args, gitErr, output)
+		}
+	}
+	return dir
+}
+
+func TestGitRefRepoConformance(t *testing.T) {
+	setGitTestEnvironment(t)
+	suite.Run(t, &drawingrepotest.DrawingRepoSuite{NewRepo: func() drawingrepotest.DrawingRepo {
+		branches := newGitBranches(newTestWorkingCopy(t), "diagrams")
+		if createErr := branches.create(t.Context(), "feature", ""); createErr != nil {
+			t.Fatal(createErr)
+		}
+		return branches.at("feature")
+	}})
+}
+
+type gitBranchesTestSuite struct {
+	suite.Suite
+	workDir  string
+	branches *gitBranches
+}
+
+func TestGitBranches(t *testing.T) {
+	setGitTestEnvironment(t)
+	suite.Run(t, &gitBranchesTestSuite{})
+}
+
+func (t *gitBranchesTestSuite) SetupTest() {
+	t.workDir = newTestWorkingCopy(t.T())
+	t.branches = newGitBranches(t.workDir, "diagrams")
+}
+
+func (t *gitBranchesTestSuite) TestCommitMessageAndAuthor() {
+	repo := newLocalGitRepo(newMemoryStore(), t.branches)
+	users := userDirectory{"jdoe": {FullName: "Jane Doe", Email: "jane.doe@example.com"}}
+	author := users.author("jdoe")
+	ctx := withCommitInfo(t.T().Context(), commitInfo{message: "Add the database", author: &author})
+
+	t.Require().NoError(repo.PutDrawing(ctx, "d1", strings.NewReader("v1"), "jdoe"))
+	t.Require().NoError(repo.PutDrawing(t.T().Context(), "d1", strings.NewReader("v2"), "joe"))
+
+	log, logErr := t.branches.git(t.T().Context(), "log", "--format=%an|%ae|%cn|%s", "main")
+	t.Require().NoError(logErr)
+	t.Equal([]string{"joe|joe|test|Update d1", "Jane Doe|jane.doe@example.com|test|Add the database", "test|test@example.com|test|initial"}, strings.Split(strings.TrimSpace(log), "\n"), "the server is the committer")
+
+	content, readErr := os.ReadFile(filepath.Join(t.workDir, "diagrams", "d1"+drawingFileExtension))
+	t.Require().NoError(readErr)
+	t.Equal("v2", string(content))
+	versions, versionsErr := t.branches.at("main").ListVersions(t.T().Context(), "d1")
+	t.Require().NoError(versionsErr)
+	t.Require().Len(versions, 2)
+	t.Equal("jane.doe@example.com", versions[1].Author)
+	t.Equal("Add the database", versions[1].Message)
+}
+
+func (t *gitBranchesTestSuite) TestWritesWithUncommittedChanges() {
+	ctx := t.T().Context()
+	repo := newLocalGitRepo(newMemoryStore(), t.branches)
+	t.Require().NoError(repo.PutDrawing(ctx, "d1", strings.NewReader("v1"), "joe"))
+	fileName := filepath.Join(t.workDir, "diagrams", "d1"+drawingFileExtension)
+	t.Require().NoError(os.WriteFile(fileName, []byte("edited outside"), 0o644))
+	t.Require().NoError(os.WriteFile(filepath.Join(t.workDir, "diagrams", "d2"+drawingFileExtension), []byte("new outside"), 0o644))
+
+	t.Require().NoError(repo.PutDrawing(ctx, "d1", strings.NewReader("v2"), "joe"))
+	t.Require().NoError(repo.PutDrawing(ctx, "d2", strings.NewReader("v2"), "joe"))
+
+	content, readErr := os.ReadFile(fileName)
+	t.Require().NoError(readErr)
+	t.Equal("v2", string(content))
+	log, logErr := t.branches.git(ctx, "log", "--format=%s", "main")
+	t.Require().NoError(logErr)
+	t.Equal([]string{
+		"Update d2", "Changes made in the working copy to d2" + drawingFileExtension,
+		"Update d1", "Changes made in the working copy to d1" + drawingFileExtension,
+		"Update d1", "initial",
+	}, strings.Split(strings.TrimSpace(log), "\n"), "the changes made outside the server are kept in the history")
+	edited, editedErr := t.branches.at("main~3").GetDrawing(ctx, "d1")
+	t.Require().NoError(editedErr)
+	t.Equal("edited outside", edited)
+
+	t.Require().NoError(os.WriteFile(fileName, []byte("edited again"), 0o644))
+	t.Require().NoError(repo.DeleteDrawing(ctx, "d1", "joe"))
+	t.NoFileExists(fileName)
+}
+
+func (t *gitBranchesTestSuite) TestCreateAndList() {
+	ctx := t.T().Context()
+	t.Require().NoError(t.branches.create(ctx, "feature-x", ""))
+	t.Require().NoError(t.branches.create(ctx, "feature-y", "feature-x"))
+
+	t.ErrorIs(t.branches.create(ctx, "feature-x", ""), repoerr.ErrConflict)
+	t.ErrorIs(t.branches.create(ctx, "bad..name", ""), repoerr.ErrInvalidInput)
+	t.ErrorIs(t.branches.create(ctx, "feature-z", "no-such-ref"), repoerr.ErrNotFound)
+
+	names, listErr := t.branches.list(ctx)
+	t.Require().NoError(listErr)
+	t.Equal([]string{"feature-x", "feature-y", "main"}, names)
+	current, currentErr := t.branches.current(ctx)
+	t.Require().NoError(currentErr)
+	t.Equal("main", current)
+}
+
+func (t *gitBranchesTestSuite) TestWritesLeaveWorkingCopyAlone() {
+	ctx := t.T().Context()
+	t.Require().NoError(t.branches.create(ctx, "feature", ""))
+
+	t.Require().NoError(t.branches.at("feature").PutDrawing(ctx, "drawing", strings.NewReader("on feature"), "joe"))
+
+	t.NoFileExists(filepath.Join(t.workDir, "diagrams", "drawing"+drawingFileExtension))
+	_, getErr := t.branches.at("main").GetDrawing(ctx, "drawing")
+	t.ErrorIs(getErr, repoerr.ErrNotFound)
+
+	versions, listErr := t.branches.at("feature").ListVersions(ctx, "drawing")
+	t.Require().NoError(listErr)
+	t.Require().Len(versions, 1)
+	content, getVersionErr := t.branches.at(versions[0].VersionID).GetDrawing(ctx, "drawing")
+	t.Require().NoError(getVersionErr)
+	t.Equal("on feature", content)
+
+	putErr := t.branches.at(versions[0].VersionID).PutDrawing(ctx, "drawing", strings.NewReader("detached"), "joe")
+	t.ErrorIs(putErr, repoerr.ErrInvalidInput)
+}
+
+func (t *gitBranchesTestSuite) TestRefsViaServer() {
+	useTestPasswordFile(t.T())
+	gin.SetMode(gin.TestMode)
+	s := newTestServer(t.T(), drawingReposConfigs{
+		firstTestRepo: drawingRepoConfig{name: firstTestRepo, label: "First Repo", storeType: LOCAL_GIT, root: t.workDir, path: "diagrams"},
+	})
+	t.Require().NoError(t.branches.create(t.T().Context(), "feature", ""))
+	httpServer := httptest.NewServer(s.createEngine())
+	defer httpServer.Close()
+	send := func(method string, path string, body string) *http.Response {
+		request, _ := http.NewRequestWithContext(t.T().Context(), method, httpServer.URL+path, strings.NewReader(body))
+		request.SetBasicAuth(testUser, "pass")
+		response, requestErr := http.DefaultClient.Do(request)
+		t.Require().NoError(requestErr)
+		return response
+	}
+	status := func(method string, path string, body string) int {
+		response := send(method, path, body)
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	events := send(http.MethodGet, "/api/drawings/events", "")
+	defer events.Body.Close()
+	t.Require().Equal(http.StatusOK, events.StatusCode)
+
+	t.Equal(http.StatusOK, status(http.MethodPut, "/api/drawing/"+firstTestRepo+"/on-feature?ref=feature", `{"content":"v1"}`))
+	t.Equal(http.StatusOK, status(http.MethodPut, "/api/drawing/"+firstTestRepo+"/on-main?ref=main", `{"content":"v1"}`))
+	scanner := bufio.NewScanner(events.Body)
+	for scanner.Scan() {
+		if data, isData := strings.CutPrefix(scanner.Text(), "data:"); isData {
+			var event changeEvent
+			t.Require().NoError(json.Unmarshal([]byte(data), &event))
+			t.Equal("on-main", event.Id, "changes on other branches are not published")
+			break
+		}
+	}
+
+	t.Equal(http.StatusBadRequest, status(http.MethodPost, "/api/drawing/"+firstTestRepo+"/on-feature/copy?ref=feature", `{"targetId":"copied"}`))
+	url := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/api/drawing/" + firstTestRepo + "/on-feature/live?ref=feature"
+	authorization := http.Header{}
+	request, _ := http.NewRequest(http.MethodGet, "/", nil)
+	request.SetBasicAuth(testUser, "pass")
+	authorization.Set("Authorization", request.Header.Get("Authorization"))
+	_, response, dialErr := websocket.DefaultDialer.Dial(url, authorization)
+	t.Error(dialErr)
+	t.Require().NotNil(response)
+	t.Equal(http.StatusBadRequest, response.StatusCode, "live sessions are only on the checked-out branch")
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"myxcaliapp/backend/repoerr"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+	"vcblobstore"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultGitlabBaseURL  = "https://gitlab.com"
+	defaultGitlabBranch   = "main"
+	drawingFileExtension  = ".excalidraw"
+	gitlabListPageSize    = 100
+	gitlabTokenHeaderName = "PRIVATE-TOKEN"
+	gitlabNextPageHeader  = "X-Next-Page"
+)
+
+// gitlabStore keeps drawings as files in a GitLab project, each save being a commit on the configured branch
+type gitlabStore struct {
+	baseURL    string
+	project    string
+	branch     string
+	path       string
+	token      string
+	httpClient *http.Client
+	logger     zerolog.Logger
+}
+
+type gitlabStoreError struct {
+	method     string
+	url        string
+	statusCode int
+	message    string
+}
+
+func (err *gitlabStoreError) Error() string {
+	return fmt.Sprintf("GitLab request %s %s failed with status %d: %s", err.method, err.url, err.statusCode, err.message)
+}
+
+// Is maps the status of the GitLab response to the repoerr taxonomy
+func (err *gitlabStoreError) Is(target error) bool {
+	switch err.statusCode {
+	case http.StatusNotFound:
+		return target == repoerr.ErrNotFound
+	case http.StatusConflict:
+		return target == repoerr.ErrConflict
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return target == repoerr.ErrForbidden
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return target == repoerr.ErrUnavailable
+	default:
+		return false
+	}
+}
+
+func newGitlabStore(baseURL string, project string, branch string, drawingsPath string, token string, logger zerolog.Logger) (*gitlabStore, error) {
+	if len(project) == 0 {
+		return nil, fmt.Errorf("missing GitLab project")
+	}
+	if len(baseURL) == 0 {
+		baseURL = defaultGitlabBaseURL
+	}
+	if len(branch) == 0 {
+		branch = defaultGitlabBranch
+	}
+	return &gitlabStore{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		project:    project,
+		branch:     branch,
+		path:       drawingsPath,
+		token:      token,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		logger:     logger,
+	}, nil
+}
+
+func (store *gitlabStore) projectURL(pathElements ...string) string {
+	return store.baseURL + "/api/v4/projects/" + url.PathEscape(store.project) + "/" + strings.Join(pathElements, "/")
+}
+
+func (store *gitlabStore) filePath(key string) string {
+	return path.Join(store.path, key+drawingFileExtension)
+}
+
+func (store *gitlabStore) fileURL(key string, suffix string) string {
+	return store.projectURL("repository", "files", url.PathEscape(store.filePath(key))) + suffix
+}
+
+// do sends a request to the GitLab API and returns the response, which the caller must close,
+// when its status is 2xx
+func (store *gitlabStore) do(ctx context.Context, method string, requestURL string, body any) (*http.Response, error) {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyBytes, marshalErr := json.Marshal(body)
+		if marshalErr != nil {
+			return nil, fmt.Errorf("failed to marshal GitLab request body: %w", marshalErr)
+		}
+		bodyReader = bytes.NewReader(bodyBytes)
+	}
+
+	request, requestErr := http.NewRequestWithContext(ctx, method, requestURL, bodyReader)
+	if requestErr != nil {
+		return nil, fmt.Errorf("failed to create GitLab request: %w", requestErr)
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if len(store.token) > 0 {
+		request.Header.Set(gitlabTokenHeaderName, store.token)
+	}
+
+	response, sendErr := store.httpClient.Do(request)
+	if sendErr != nil {
+		return nil, fmt.Errorf("%w: failed to send GitLab request %s %s: %w", repoerr.ErrUnavailable, method, requestURL, sendErr)
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		defer response.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return nil, &gitlabStoreError{method, requestURL, response.StatusCode, string(message)}
+	}
+	return response, nil
+}
+
+func (store *gitlabStore) doJSON(ctx context.Context, method string, requestURL string, body any, result any) (http.Header, error) {
+	response, err := store.do(ctx, method, requestURL, body)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if result != nil {
+		decodeErr := json.NewDecoder(response.Body).Decode(result)
+		if decodeErr != nil {
+			return nil, fmt.Errorf("failed to decode GitLab response for %s %s: %w", method, requestURL, decodeErr)
+		}
+	}
+	return response.Header, nil
+}
+
+func (store *gitlabStore) getRawFile(ctx context.Context, key string, ref string) (string, error) {
+	response, err := store.do(ctx, http.MethodGet, store.fileURL(key, "/raw?ref="+url.QueryEscape(ref)), nil)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	content, readErr := io.ReadAll(response.Body)
+	if readErr != nil {
+		return "", fmt.Errorf("failed to read content of %s: %w", key, readErr)
+	}
+	return string(content), nil
+}
+
+func (store *gitlabStore) fileExists(ctx context.Context, key string) (bool, error) {
+	response, err := store.do(ctx, http.MethodHead, store.fileURL(key, "?ref="+url.QueryEscape(store.branch)), nil)
+	if err != nil {
+		if errors.Is(err, repoerr.ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	response.Body.Close()
+	return true, nil
+}
+
+type gitlabCommitAction struct {
+	Action   string `json:"action"`
+	FilePath string `json:"file_path"`
+	Content  string `json:"content,omitempty"`
+}
+
+type gitlabCommitRequest struct {
+	Branch        string               `json:"branch"`
+	CommitMessage string               `json:"commit_message"`
+	AuthorName    string               `json:"author_name,omitempty"`
+	AuthorEmail   string               `json:"author_email,omitempty"`
+	Actions       []gitlabCommitAction `json:"actions"`
+}
+
+type gitlabCommit struct {
+	Id            string    `json:"id"`
+	Title         string    `json:"title"`
+	Message       string    `json:"message"`
+	AuthorName    string    `json:"author_name"`
+	AuthorEmail   string    `json:"author_email"`
+	CommittedDate time.Time `json:"committed_date"`
+}
+
+// commit commits the actions with the message given unless the context has one
+func (store *gitlabStore) commit(ctx context.Context, defaultMessage string, modifiedBy string, actions ...gitlabCommitAction) (*gitlabCommit, error) {
+	message, author := commitDetails(ctx, modifiedBy, defaultMessage)
+	request := gitlabCommitRequest{
+		Branch:        store.branch,
+		CommitMessage: message,
+		AuthorName:    author.name,
+		Actions:       actions,
+	}
+	if strings.Contains(author.email, "@") {
+		request.AuthorEmail = author.email
+	}
+
+	var created gitlabCommit
+	_, err := store.doJSON(ctx, http.MethodPost, store.projectURL("repository", "commits"), request, &created)
+	if err != nil {
+		return nil, err
+	}
+	store.logger.Debug().Str("commit", created.Id).Str("message", message).Msg("commit created")
+	return &created, nil
+}
+
+func (store *gitlabStore) putContent(ctx context.Context, key string, content string, message string, modifiedBy string) (*gitlabCommit, error) {
+	exists, existsErr := store.fileExists(ctx, key)
+	if existsErr != nil {
+		return nil, existsErr
+	}
+	action := "create"
+	if exists {
+		action = "update"
+	}
+	return store.commit(ctx, message, modifiedBy, gitlabCommitAction{
+		Action:   action,
+		FilePath: store.filePath(key),
+		Content:  content,
+	})
+}
+
+func (store *gitlabStore) PutDrawing(ctx context.Context, key string, contentReader io.Reader, modifiedBy string) error {
+	content, readErr := io.ReadAll(contentReader)
+	if readErr != nil {
+		return fmt.Errorf("failed to read content of %s: %w", key, readErr)
+	}
+	_, err := store.putContent(ctx, key, string(content), fmt.Sprintf("Update %s", key), modifiedBy)
+	return err
+}
+
+func (store *gitlabStore) CopyDrawing(ctx context.Context, sourceId string, destinationId string, modifiedBy string) error {
+	content, getErr := store.getRawFile(ctx, sourceId, store.branch)
+	if getErr != nil {
+		return getErr
+	}
+	_, err := store.putContent(ctx, destinationId, content, fmt.Sprintf("Copy %s to %s", sourceId, destinationId), modifiedBy)
+	return err
+}
+
+type gitlabTreeEntry struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+func (store *gitlabStore) ListDrawings(ctx context.Context) (map[drawingId]drawingTitle, error) {
+	drawings := map[drawingId]drawingTitle{}
+
+	page := "1"
+	for len(page) > 0 {
+		query := url.Values{}
+		query.Set("ref", store.branch)
+		query.Set("per_page", fmt.Sprintf("%d", gitlabListPageSize))
+		query.Set("page", page)
+		if len(store.path) > 0 {
+			query.Set("path", store.path)
+		}
+
+		var entries []gitlabTreeEntry
+		header, err := store.doJSON(ctx, http.MethodGet, store.projectURL("repository", "tree")+"?"+query.Encode(), nil, &entries)
+		if err != nil {
+			if errors.Is(err, repoerr.ErrNotFound) {
+				// The drawings directory doesn't exist until the first drawing is saved
+				return drawings, nil
+			}
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if entry.Type != "blob" || !strings.HasSuffix(entry.Name, drawingFileExtension) {
+				continue
+			}
+			id := strings.TrimSuffix(entry.Name, drawingFileExtension)
+			drawings[id] = id
+		}
+
+		page = header.Get(gitlabNextPageHeader)
+	}
+
+	return drawings, nil
+}
+
+func (store *gitlabStore) GetDrawing(ctx context.Context, key string) (string, error) {
+	return store.getRawFile(ctx, key, store.branch)
+}
+
+func (store *gitlabStore) DeleteDrawing(ctx context.Context, key string, modifiedBy string) error {
+	exists, existsErr := store.fileExists(ctx, key)
+	if existsErr != nil {
+		return existsErr
+	}
+	if !exists {
+		return fmt.Errorf("drawing %s: %w", key, repoerr.ErrNotFound)
+	}
+	_, err := store.commit(ctx, fmt.Sprintf("Delete %s", key), modifiedBy, gitlabCommitAction{
+		Action:   "delete",
+		FilePath: store.filePath(key),
+	})
+	return err
+}
+
+func (store *gitlabStore) ListVersions(ctx context.Context, key string) ([]vcblobstore.BlobVersion, error) {
+	versions := []vcblobstore.BlobVersion{}
+
+	page := "1"
+	for len(page) > 0 {
+		query := url.Values{}
+		query.Set("ref_name", store.branch)
+		query.Set("path", store.filePath(key))
+		query.Set("per_page", fmt.Sprintf("%d", gitlabListPageSize))
+		query.Set("page", page)
+
+		var commits []gitlabCommit
+		header, err := store.doJSON(ctx, http.MethodGet, store.projectURL("repository", "commits")+"?"+query.Encode(), nil, &commits)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, commit := range commits {
+			author := commit.AuthorEmail
+			if len(author) == 0 {
+				author = commit.AuthorName
+			}
+			versions = append(versions, vcblobstore.BlobVersion{
+				VersionID: commit.Id,
+				Author:    author,
+				Timestamp: commit.CommittedDate,
+				Message:   commit.Title,
+			})
+		}
+
+		page = header.Get(gitlabNextPageHeader)
+	}
+
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("drawing %s: %w", key, repoerr.ErrNotFound)
+	}
+	return versions, nil
+}
+
+func (store *gitlabStore) GetVersion(ctx context.Context, key string, versionID string) (string, error) {
+	return store.getRawFile(ctx, key, versionID)
+}
+
+func (store *gitlabStore) RestoreVersion(ctx context.Context, key string, versionID string, modifiedBy string) (string, error) {
+	content, getErr := store.getRawFile(ctx, key, versionID)
+	if getErr != nil {
+		return "", getErr
+	}
+	commit, err := store.putContent(ctx, key, content, fmt.Sprintf("Restore %s to %s", key, versionID), modifiedBy)
+	if err != nil {
+		return "", err
+	}
+	return commit.Id, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/suite"
+)
+
+const (
+	fakeGitlabProject = "design/diagrams"
+	fakeGitlabBranch  = "main"
+	fakeGitlabToken   = "glpat-test"
+)
+
+// fakeGitlab implements the subset of the GitLab REST API used by gitlabStore
+type fakeGitlab struct {
+	lock      sync.Mutex
+	commits   []gitlabCommit                 // oldest first
+	snapshots map[string]map[string]string   // commit id -> file path -> content
+	touched   map[string]map[string]struct{} // commit id -> paths changed by the commit
+}
+
+func newFakeGitlab() *fakeGitlab {
+	return &fakeGitlab{
+		snapshots: map[string]map[string]string{},
+		touched:   map[string]map[string]struct{}{},
+	}
+}
+
+func (fake *fakeGitlab) filesAt(ref string) (map[string]string, bool) {
+	if ref == fakeGitlabBranch {
+		if len(fake.commits) == 0 {
+			return map[string]string{}, true
+		}
+		ref = fake.commits[len(fake.commits)-1].Id
+	}
+	files, ok := fake.snapshots[ref]
+	return files, ok
+}
+
+func (fake *fakeGitlab) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	if r.Header.Get(gitlabTokenHeaderName) != fakeGitlabToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	prefix := "/api/v4/projects/" + url.PathEscape(fakeGitlabProject) + "/repository/"
+	escapedPath := r.URL.EscapedPath()
+	if !strings.HasPrefix(escapedPath, prefix) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	resource := escapedPath[len(prefix):]
+	query := r.URL.Query()
+
+	switch {
+	case strings.HasPrefix(resource, "files/"):
+		raw := strings.HasSuffix(resource, "/raw")
+		filePath, _ := url.PathUnescape(strings.TrimSuffix(strings.TrimPrefix(resource, "files/"), "/raw"))
+		files, refFound := fake.filesAt(query.Get("ref"))
+		content, fileFound := files[filePath]
+		if !refFound || !fileFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if raw {
+			w.Write([]byte(content))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case resource == "tree":
+		files, _ := fake.filesAt(query.Get("ref"))
+		entries := []gitlabTreeEntry{}
+		for filePath := range files {
+			if path.Dir(filePath) == query.Get("path") {
+				entries = append(entries, gitlabTreeEntry{Name: path.Base(filePath), Type: "blob"})
+			}
+		}
+		if len(entries) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(entries)
+	case resource == "commits" && r.Method == http.MethodGet:
+		commits := []gitlabCommit{}
+		for i := len(fake.commits) - 1; i >= 0; i-- {
+			if _, touched := fake.touched[fake.commits[i].Id][query.Get("path")]; touched {
+				commits = append(commits, fake.commits[i])
+			}
+		}
+		json.NewEncoder(w).Encode(commits)
+	case resource == "commits" && r.Method == http.MethodPost:
+		fake.createCommit(w, r)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (fake *fakeGitlab) createCommit(w http.ResponseWriter, r *http.Request) {
+	var request gitlabCommitRequest
+	if decodeErr := json.NewDecoder(r.Body).Decode(&request); decodeErr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	current, _ := fake.filesAt(request.Branch)
+	files := map[string]string{}
+	for filePath, content := range current {
+		files[filePath] = content
+	}
+	touched := map[string]struct{}{}
+	for _, action := range request.Actions {
+		_, exists := files[action.FilePath]
+		switch {
+		case action.Action == "create" && !exists, action.Action == "update" && exists:
+			files[action.FilePath] = action.Content
+		case action.Action == "delete" && exists:
+			delete(files, action.FilePath)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		touched[action.FilePath] = struct{}{}
+	}
+
+	commit := gitlabCommit{
+		Id:            fmt.Sprintf("commit-%d", len(fake.commits)+1),
+		Title:         request.CommitMessage,
+		Message:       request.CommitMessage,
+		AuthorName:    request.AuthorName,
+		AuthorEmail:   request.AuthorEmail,
+		CommittedDate: time.Now().UTC(),
+	}
+	fake.commits = append(fake.commits, commit)
+	fake.snapshots[commit.Id] = files
+	fake.touched[commit.Id] = touched
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(commit)
+}
+
+type gitlabStoreTestSuite struct {
+	suite.Suite
+	server *httptest.Server
+	store  *gitlabStore
+}
+
+func TestGitlabStore(t *testing.T) {
+	suite.Run(t, &gitlabStoreTestSuite{})
+}
+
+func (t *gitlabStoreTestSuite) SetupTest() {
+	t.server = httptest.NewServer(newFakeGitlab())
+	store, err := newGitlabStore(t.server.URL, fakeGitlabProject, fakeGitlabBranch, "doc/diagrams", fakeGitlabToken, zerolog.Nop())
+	t.Require().NoError(err)
+	t.store = store
+}
+
+func (t *gitlabStoreTestSuite) TearDownTest() {
+	t.server.Close()
+}
+
+func (t *gitlabStoreTestSuite) TestPutGetAndList() {
+	ctx := t.T().Context()
+
+	emptyList, emptyListErr := t.store.ListDrawings(ctx)
+	t.NoError(emptyListErr)
+	t.Empty(emptyList)
+
+	t.NoError(t.store.PutDrawing(ctx, "first", strings.NewReader("content 1"), "joe@example.com"))
+	t.NoError(t.store.PutDrawing(ctx, "first", strings.NewReader("content 2"), "joe@example.com"))
+	t.NoError(t.store.CopyDrawing(ctx, "first", "second", "jane@example.com"))
+
+	content, getErr := t.store.GetDrawing(ctx, "first")
+	t.NoError(getErr)
+	t.Equal("content 2", content)
+
+	list, listErr := t.store.ListDrawings(ctx)
+	t.NoError(listErr)
+	t.Equal(map[drawingId]drawingTitle{"first": "first", "second": "second"}, list)
+
+	t.NoError(t.store.DeleteDrawing(ctx, "second", "jane@example.com"))
+	_, getDeletedErr := t.store.GetDrawing(ctx, "second")
+	t.Error(getDeletedErr)
+}
+
+func (t *gitlabStoreTestSuite) TestVersions() {
+	ctx := t.T().Context()
+
+	t.NoError(t.store.PutDrawing(ctx, "drawing", strings.NewReader("v1"), "joe@example.com"))
+	t.NoError(t.store.PutDrawing(ctx, "drawing", strings.NewReader("v2"), "jane@example.com"))
+
+	versions, listErr := t.store.ListVersions(ctx, "drawing")
+	t.NoError(listErr)
+	t.Len(versions, 2)
+	t.Equal("jane@example.com", versions[0].Author)
+	t.Equal("joe@example.com", versions[1].Author)
+
+	oldContent, getVersionErr := t.store.GetVersion(ctx, "drawing", versions[1].VersionID)
+	t.NoError(getVersionErr)
+	t.Equal("v1", oldContent)
+
+	restoredVersion, restoreErr := t.store.RestoreVersion(ctx, "drawing", versions[1].VersionID, "jim@example.com")
+	t.NoError(restoreErr)
+
+	content, getErr := t.store.GetDrawing(ctx, "drawing")
+	t.NoError(getErr)
+	t.Equal("v1", content)
+
+	versionsAfterRestore, listAfterRestoreErr := t.store.ListVersions(ctx, "drawing")
+	t.NoError(listAfterRestoreErr)
+	t.Len(versionsAfterRestore, 3)
+	t.Equal(restoredVersion, versionsAfterRestore[0].VersionID)
+}
+
+func (t *gitlabStoreTestSuite) TestWrongToken() {
+	store, err := newGitlabStore(t.server.URL, fakeGitlabProject, fakeGitlabBranch, "doc/diagrams", "wrong", zerolog.Nop())
+	t.Require().NoError(err)
+
+	_, listErr := store.ListDrawings(t.T().Context())
+
+	t.Error(listErr)
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"myxcaliapp/backend/repoerr"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+const defaultPushDelay = 10 * time.Second
+
+type gitSyncOptions struct {
+	remote    string        // e.g. "origin"
+	branch    string        // the remote branch; the current local branch when empty
+	pull      bool          // whether to pull (rebase) from the remote before writes
+	pushDelay time.Duration // pushes are debounced by this long; zero pushes after every commit
+}
+
+// gitSyncStatus tells how the working copy of the repo is in sync with its remote
+type gitSyncStatus struct {
+	Remote      string    `json:"remote"`
+	Branch      string    `json:"branch,omitempty"`
+	PendingPush bool      `json:"pendingPush"`
+	LastPull    time.Time `json:"lastPull,omitzero"`
+	LastPush    time.Time `json:"lastPush,omitzero"`
+	LastError   string    `json:"lastError,omitempty"`
+	LastErrorAt time.Time `json:"lastErrorAt,omitzero"`
+}
+
+// gitSyncRepo keeps a repo stored in a git working copy (i.e. LOCAL_GIT) in sync with a remote:
+// it pulls before writes and pushes the commits made by the writes
+type gitSyncRepo struct {
+	drawingRepo
+	workDir string
+	options gitSyncOptions
+	logger  zerolog.Logger
+
+	gitLock sync.Mutex // serializes the git operations on the working copy
+
+	statusLock  sync.Mutex
+	status      gitSyncStatus
+	pushTimer   *time.Timer
+	pendingRefs map[string]struct{} // the branches other than the checked-out one with commits to push
+}
+
+func newGitSyncRepo(repo drawingRepo, workDir string, options gitSyncOptions, logger zerolog.Logger) *gitSyncRepo {
+	return &gitSyncRepo{
+		drawingRepo: repo,
+		workDir:     workDir,
+		options:     options,
+		logger:      logger.With().Str("gitRemote", options.remote).Logger(),
+		status:      gitSyncStatus{Remote: options.remote, Branch: options.branch},
+		pendingRefs: map[string]struct{}{},
+	}
+}
+
+// runGit runs git in the working copy with the extra environment variables and standard input
+// given, returning the combined output
+func runGit(ctx context.Context, workDir string, env []string, stdin io.Reader, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", workDir}, args...)...)
+	cmd.Env = append(append(os.Environ(), "GIT_TERMINAL_PROMPT=0"), env...)
+	cmd.Stdin = stdin
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	runErr := cmd.Run()
+	if runErr != nil {
+		return output.String(), fmt.Errorf("git %s: %w: %s", strings.Join(args, " "), runErr, strings.TrimSpace(output.String()))
+	}
+	return output.String(), nil
+}
+
+func (r *gitSyncRepo) git(ctx context.Context, args ...string) (string, error) {
+	return runGit(ctx, r.workDir, nil, nil, args...)
+}
+
+// remoteBranch must be called with the git lock held
+func (r *gitSyncRepo) remoteBranch(ctx context.Context) (string, error) {
+	if len(r.options.branch) > 0 {
+		return r.options.branch, nil
+	}
+	output, gitErr := r.git(ctx, "rev-parse", "--abbrev-ref", "HEAD")
+	if gitErr != nil {
+		return "", gitErr
+	}
+	return strings.TrimSpace(output), nil
+}
+
+func (r *gitSyncRepo) recordError(err error) {
+	r.statusLock.Lock()
+	defer r.statusLock.Unlock()
+	r.status.LastError = err.Error()
+	r.status.LastErrorAt = time.Now()
+}
+
+// pullLocked must be called with the git lock held
+func (r *gitSyncRepo) pullLocked(ctx context.Context) error {
+	branch, branchErr := r.remoteBranch(ctx)
+	if branchErr != nil {
+		return fmt.Errorf("failed to determine the branch to pull: %w: %w", repoerr.ErrUnavailable, branchErr)
+	}
+	output, pullErr := r.git(ctx, "pull", "--rebase", r.options.remote, branch)
+	if pullErr != nil && strings.Contains(output, "couldn't find remote ref") {
+		r.logger.Debug().Str("branch", branch).Msg("nothing to pull, the branch doesn't exist on the remote yet")
+		return nil
+	}
+	if pullErr != nil {
+		if _, abortErr := r.git(ctx, "rebase", "--abort"); abortErr != nil {
+			r.logger.Debug().Err(abortErr).Msg("no rebase to abort after failed pull")
+		}
+		kind := repoerr.ErrUnavailable
+		if strings.Contains(output, "CONFLICT") {
+			kind = repoerr.ErrConflict
+		}
+		err := fmt.Errorf("failed to pull from %s: %w: %w", r.options.remote, kind, pullErr)
+		r.recordError(err)
+		return err
+	}
+
+	r.statusLock.Lock()
+	r.status.LastPull = time.Now()
+	r.statusLock.Unlock()
+	return nil
+}
+
+// write runs the operation making a commit on the checked-out branch, pulling before it and
+// pushing after it as configured
+func (r *gitSyncRepo) write(ctx context.Context, operation func() error) error {
+	return r.writeBranch(ctx, "", operation)
+}
+
+// writeBranch runs the operation making a commit on the branch, the checked-out one when empty.
+// Only the checked-out branch is pulled before; any branch written is pushed after. The write
+// succeeds once the commit is made: a failed push is left pending and reported in the sync status.
+func (r *gitSyncRepo) writeBranch(ctx context.Context, branch string, operation func() error) error {
+	r.gitLock.Lock()
+	checkedOut := true
+	if len(branch) > 0 {
+		current, currentErr := r.git(ctx, "rev-parse", "--abbrev-ref", "HEAD")
+		if currentErr != nil {
+			r.gitLock.Unlock()
+			return fmt.Errorf("failed to determine the checked-out branch: %w: %w", repoerr.ErrUnavailable, currentErr)
+		}
+		checkedOut = strings.TrimSpace(current) == branch
+	}
+	if r.options.pull && checkedOut {
+		if pullErr := r.pullLocked(ctx); pullErr != nil {
+			r.gitLock.Unlock()
+			r.logger.Error().Err(pullErr).Msg("failed to pull before write")
+			return pullErr
+		}
+	}
+	operationErr := operation()
+	r.gitLock.Unlock()
+	if operationErr != nil {
+		return operationErr
+	}
+
+	if !checkedOut {
+		r.statusLock.Lock()
+		r.pendingRefs[branch] = struct{}{}
+		r.statusLock.Unlock()
+	}
+
+	if r.options.pushDelay == 0 {
+		if pushErr := r.push(ctx); pushErr != nil {
+			r.logger.Info().Msg("the commit is kept to be pushed later")
+		}
+		return nil
+	}
+	r.statusLock.Lock()
+	defer r.statusLock.Unlock()
+	r.status.PendingPush = true
+	if r.pushTimer == nil {
+		r.pushTimer = time.AfterFunc(r.options.pushDelay, func() {
+			_ = r.push(context.Background())
+		})
+	} else {
+		r.pushTimer.Reset(r.options.pushDelay)
+	}
+	return nil
+}
+
+func isPushRejection(output string) bool {
+	return strings.Contains(output, "[rejected]") || strings.Contains(output, "non-fast-forward") || strings.Contains(output, "fetch first")
+}
+
+// push pushes the local commits to the remote. A push rejected because the remote has moved on
+// is retried once after pulling, if pulling is enabled.
+func (r *gitSyncRepo) push(ctx context.Context) error {
+	r.gitLock.Lock()
+	defer r.gitLock.Unlock()
+
+	r.statusLock.Lock()
+	r.status.PendingPush = false
+	pendingRefs := r.pendingRefs
+	r.pendingRefs = map[string]struct{}{}
+	r.statusLock.Unlock()
+
+	restorePendingRefs := func() {
+		r.statusLock.Lock()
+		r.status.PendingPush = true
+		for ref := range pendingRefs {
+			r.pendingRefs[ref] = struct{}{}
+		}
+		r.statusLock.Unlock()
+	}
+
+	branch, branchErr := r.remoteBranch(ctx)
+	if branchErr != nil {
+		restorePendingRefs()
+		err := fmt.Errorf("failed to determine the branch to push: %w: %w", repoerr.ErrUnavailable, branchErr)
+		r.recordError(err)
+		r.logger.Error().Err(err).Send()
+		return err
+	}
+	refspecs := []string{"HEAD:refs/heads/" + branch}
+	for ref := range pendingRefs {
+		refspecs = append(refspecs, "refs/heads/"+ref+":refs/heads/"+ref)
+	}
+	sort.Strings(refspecs[1:])
+	pushArgs := append([]string{"push", r.options.remote}, refspecs...)
+
+	output, pushErr := r.git(ctx, pushArgs...)
+	if pushErr != nil && isPushRejection(output) && r.options.pull {
+		r.logger.Info().Msg("push rejected, pulling and retrying")
+		if pullErr := r.pullLocked(ctx); pullErr != nil {
+			restorePendingRefs()
+			r.logger.Error().Err(pullErr).Msg("failed to pull after rejected push")
+			return pullErr
+		}
+		output, pushErr = r.git(ctx, pushArgs...)
+	}
+	if pushErr != nil {
+		restorePendingRefs()
+		kind := repoerr.ErrUnavailable
+		if isPushRejection(output) {
+			kind = repoerr.ErrConflict
+		}
+		err := fmt.Errorf("failed to push to %s %s: %w: %w", r.options.remote, branch, kind, pushErr)
+		r.recordError(err)
+		r.logger.Error().Err(err).Send()
+		return err
+	}
+
+	r.statusLock.Lock()
+	r.status.LastPush = time.Now()
+	r.status.LastError = ""
+	r.status.LastErrorAt = time.Time{}
+	r.statusLock.Unlock()
+	return nil
+}
+
+// close stops the debounced push, pushing the pending commits right away
+func (r *gitSyncRepo) close(ctx context.Context) error {
+	r.statusLock.Lock()
+	if r.pushTimer != nil {
+		r.pushTimer.Stop()
+	}
+	pending := r.status.PendingPush || len(r.pendingRefs) > 0
+	r.statusLock.Unlock()
+	if !pending {
+		return nil
+	}
+	return r.push(ctx)
+}
+
+func (r *gitSyncRepo) syncStatus() gitSyncStatus {
+	r.statusLock.Lock()
+	defer r.statusLock.Unlock()
+	return r.status
+}
+
+func (r *gitSyncRepo) PutDrawing(ctx context.Context, key string, contentReader io.Reader, modifiedBy string) error {
+	return r.write(ctx, func() error {
+		return r.drawingRepo.PutDrawing(ctx, key, contentReader, modifiedBy)
+	})
+}
+
+func (r *gitSyncRepo) CopyDrawing(ctx context.Context, sourceId string, destinationId string, modifiedBy string) error {
+	return r.write(ctx, func() error {
+		return r.drawingRepo.CopyDrawing(ctx, sourceId, destinationId, modifiedBy)
+	})
+}
+
+func (r *gitSyncRepo) DeleteDrawing(ctx context.Context, key string, modifiedBy string) error {
+	return r.write(ctx, func() error {
+		return r.drawingRepo.DeleteDrawing(ctx, key, modifiedBy)
+	})
+}
+
+func (r *gitSyncRepo) RestoreVersion(ctx context.Context, key string, versionID string, modifiedBy string) (string, error) {
+	var restored string
+	writeErr := r.write(ctx, func() error {
+		var restoreErr error
+		restored, restoreErr = r.drawingRepo.RestoreVersion(ctx, key, versionID, modifiedBy)
+		return restoreErr
+	})
+	return restored, writeErr
+}
+
+// gitSyncRefRepo writes to a branch other than the checked-out one (see gitRefRepo) in sync with
+// the remote of the repo
+type gitSyncRefRepo struct {
+	drawingRepo
+	sync   *gitSyncRepo
+	branch string
+}
+
+// at returns the repo as of the ref, with the writes to it pushed
+func (r *gitSyncRepo) at(ref string, repo drawingRepo) *gitSyncRefRepo {
+	return &gitSyncRefRepo{drawingRepo: repo, sync: r, branch: ref}
+}
+
+func (r *gitSyncRefRepo) PutDrawing(ctx context.Context, key string, contentReader io.Reader, modifiedBy string) error {
+	return r.sync.writeBranch(ctx, r.branch, func() error {
+		return r.drawingRepo.PutDrawing(ctx, key, contentReader, modifiedBy)
+	})
+}
+
+func (r *gitSyncRefRepo) CopyDrawing(ctx context.Context, sourceId string, destinationId string, modifiedBy string) error {
+	return r.sync.writeBranch(ctx, r.branch, func() error {
+		return r.drawingRepo.CopyDrawing(ctx, sourceId, destinationId, modifiedBy)
+	})
+}
+
+func (r *gitSyncRefRepo) DeleteDrawing(ctx context.Context, key string, modifiedBy string) error {
+	return r.sync.writeBranch(ctx, r.branch, func() error {
+		return r.drawingRepo.DeleteDrawing(ctx, key, modifiedBy)
+	})
+}
+
+func (r *gitSyncRefRepo) RestoreVersion(ctx context.Context, key string, versionID string, modifiedBy string) (string, error) {
+	var restored string
+	writeErr := r.sync.writeBranch(ctx, r.branch, func() error {
+		var restoreErr error
+		restored, restoreErr = r.drawingRepo.RestoreVersion(ctx, key, versionID, modifiedBy)
+		return restoreErr
+	})
+	return restored, writeErr
+}
+
+func (hf *handlerFactory) getGitSyncRepo(c *gin.Context, logger zerolog.Logger) (*gitSyncRepo, bool) {
+	repoName := c.Param("repo")
+	repo, hasRepo := hf.repos.getRepo(drawingRepoName(repoName))
+	if !hasRepo {
+		logger.Info().Msg("failed to find repo")
+		abortWithError(c, http.StatusNotFound, unknownRepoError(repoName))
+		return nil, false
+	}
+	syncRepo, isSynced := repo.(*gitSyncRepo)
+	if !isSynced {
+		abortWithError(c, http.StatusNotFound, fmt.Errorf("drawing repository %s has no remote: %w", repoName, repoerr.ErrNotFound))
+		return nil, false
+	}
+	return syncRepo, true
+}
+
+func (hf *handlerFactory) getRepoSyncStatus() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		logger := zerolog.Ctx(c.Request.Context()).With().Str("repoName", c.Param("repo")).Logger()
+		syncRepo, found := hf.getGitSyncRepo(c, logger)
+		if !found {
+			return
+		}
+		c.JSON(http.StatusOK, syncRepo.syncStatus())
+	}
+}
+
+// pushRepo pushes the pending commits of the repo right away
+func (hf *handlerFactory) pushRepo() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		logger := zerolog.Ctx(c.Request.Context()).With().Str("repoName", c.Param("repo")).Logger()
+		syncRepo, found := hf.getGitSyncRepo(c, logger)
+		if !found {
+			return
+		}
+		pushErr := syncRepo.push(c)
+		if pushErr != nil {
+			abortWithRepoError(c, pushErr)
+			return
+		}
+		c.JSON(http.StatusOK, syncRepo.syncStatus())
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"io"
+	"myxcaliapp/backend/repoerr"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// committingStore stands in for the local git store: it commits every drawing it stores to the working copy
+type committingStore struct {
+	*memoryStore
+	t       *gitSyncTestSuite
+	workDir string
+}
+
+func (store *committingStore) PutDrawing(ctx context.Context, key string, contentReader io.Reader, modifiedBy string) error {
+	content, readErr := io.ReadAll(contentReader)
+	if readErr != nil {
+		return readErr
+	}
+	writeErr := os.WriteFile(filepath.Join(store.workDir, key+drawingFileExtension), content, 0o644)
+	if writeErr != nil {
+		return writeErr
+	}
+	store.t.git(store.workDir, "add", "-A")
+	store.t.git(store.workDir, "commit", "-m", "update "+key)
+	return store.memoryStore.PutDrawing(ctx, key, strings.NewReader(string(content)), modifiedBy)
+}
+
+type gitSyncTestSuite struct {
+	suite.Suite
+	remote  string
+	workDir string
+	other   string
+}
+
+func TestGitSync(t *testing.T) {
+	suite.Run(t, &gitSyncTestSuite{})
+}
+
+func (t *gitSyncTestSuite) git(dir string, args ...string) string {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	output, gitErr := cmd.CombinedOutput()
+	t.Require().NoError(gitErr, string(output))
+	return strings.TrimSpace(string(output))
+}
+
+func (t *gitSyncTestSuite) SetupTest() {
+	setGitTestEnvironment(t.T())
+
+	root := t.T().TempDir()
+	t.remote = filepath.Join(root, "remote.git")
+	t.workDir = filepath.Join(root, "work")
+	t.other = filepath.Join(root, "other")
+
+	t.git(root, "init", "--bare", "-b", "main", t.remote)
+	t.git(root, "clone", t.remote, t.workDir)
+	t.git(t.workDir, "checkout", "-b", "main")
+	t.git(t.workDir, "commit", "--allow-empty", "-m", "initial")
+	t.git(t.workDir, "push", "origin", "main")
+	t.git(root, "clone", t.remote, t.other)
+}
+
+func (t *gitSyncTestSuite) newRepo(options gitSyncOptions) *gitSyncRepo {
+	options.remote = "origin"
+	store := &committingStore{memoryStore: newMemoryStore(), t: t, workDir: t.workDir}
+	return newGitSyncRepo(store, t.workDir, options, getLogger())
+}
+
+// pushFromOther pushes a change to the remote from another clone
+func (t *gitSyncTestSuite) pushFromOther(fileName string) {
+	t.git(t.other, "pull", "origin", "main")
+	t.Require().NoError(os.WriteFile(filepath.Join(t.other, fileName), []byte("other"), 0o644))
+	t.git(t.other, "add", "-A")
+	t.git(t.other, "commit", "-m", "other change")
+	t.git(t.other, "push", "origin", "main")
+}
+
+func (t *gitSyncTestSuite) remoteLog() string {
+	return t.git(t.remote, "log", "--format=%s", "main")
+}
+
+func (t *gitSyncTestSuite) TestPushAfterCommit() {
+	repo := t.newRepo(gitSyncOptions{pull: true})
+
+	t.Require().NoError(repo.PutDrawing(t.T().Context(), "drawing", strings.NewReader("content"), "joe"))
+
+	t.Equal("update drawing\ninitial", t.remoteLog())
+	status := repo.syncStatus()
+	t.False(status.LastPush.IsZero())
+	t.Empty(status.LastError)
+}
+
+func (t *gitSyncTestSuite) TestPullBeforeWrite() {
+	repo := t.newRepo(gitSyncOptions{pull: true})
+	t.pushFromOther("other.txt")
+
+	t.Require().NoError(repo.PutDrawing(t.T().Context(), "drawing", strings.NewReader("content"), "joe"))
+
+	t.FileExists(filepath.Join(t.workDir, "other.txt"))
+	t.Equal("update drawing\nother change\ninitial", t.remoteLog())
+}
+
+func (t *gitSyncTestSuite) TestRejectedPush() {
+	repo := t.newRepo(gitSyncOptions{pull: false})
+	t.pushFromOther("other.txt")
+
+	putErr := repo.PutDrawing(t.T().Context(), "drawing", strings.NewReader("content"), "joe")
+
+	t.NoError(putErr, "the commit is made, the push is left pending")
+	status := repo.syncStatus()
+	t.Contains(status.LastError, "failed to push")
+	t.True(status.PendingPush)
+	t.Equal("other change\ninitial", t.remoteLog())
+
+	pushErr := repo.push(t.T().Context())
+	t.ErrorIs(pushErr, repoerr.ErrConflict)
+	t.Equal(409, repoErrorStatus(pushErr))
+}
+
+func (t *gitSyncTestSuite) TestDebouncedPush() {
+	repo := t.newRepo(gitSyncOptions{pull: true, pushDelay: 100 * time.Millisecond})
+
+	t.Require().NoError(repo.PutDrawing(t.T().Context(), "first", strings.NewReader("content"), "joe"))
+	t.Require().NoError(repo.PutDrawing(t.T().Context(), "second", strings.NewReader("content"), "joe"))
+	t.True(repo.syncStatus().PendingPush)
+	t.Equal("initial", t.remoteLog())
+
+	t.Eventually(func() bool {
+		return !repo.syncStatus().PendingPush && !repo.syncStatus().LastPush.IsZero()
+	}, 5*time.Second, 10*time.Millisecond)
+	t.Equal("update second\nupdate first\ninitial", t.remoteLog())
+}
+
+func (t *gitSyncTestSuite) TestWritesToOtherBranchesArePushed() {
+	ctx := t.T().Context()
+	repo := t.newRepo(gitSyncOptions{pull: true})
+	branches := newGitBranches(t.workDir, "")
+	t.Require().NoError(branches.create(ctx, "feature", ""))
+
+	feature := repo.at("feature", branches.at("feature"))
+	t.Require().NoError(feature.PutDrawing(ctx, "drawing", strings.NewReader(scene(2, 1)), "joe"))
+
+	t.Equal("Update drawing\ninitial", t.git(t.remote, "log", "--format=%s", "feature"))
+	t.Equal("initial", t.remoteLog())
+}
+
+func (t *gitSyncTestSuite) TestMergesArePushed() {
+	ctx := t.T().Context()
+	repo := t.newRepo(gitSyncOptions{pull: true})
+	branches := newGitBranches(t.workDir, "")
+	t.Require().NoError(branches.create(ctx, "feature", ""))
+	t.Require().NoError(repo.at("feature", branches.at("feature")).PutDrawing(ctx, "drawing", strings.NewReader(scene(2, 1)), "joe"))
+	t.pushFromOther("other.txt")
+
+	board := newReviewBoard(branches, repo)
+	p, createErr := board.create(ctx, "joe", createProposalRequest{Title: "Rework", SourceBranch: "feature"})
+	t.Require().NoError(createErr)
+	_, approveErr := board.approve(ctx, p.Id, "jane")
+	t.Require().NoError(approveErr)
+	_, _, mergeErr := board.merge(ctx, p.Id, "jane")
+	t.Require().NoError(mergeErr)
+
+	log := t.remoteLog()
+	t.True(strings.HasPrefix(log, "Merge feature into main: Rework\n"), log)
+	t.Contains(log, "other change", "pulled before merging")
+}
+
+func (t *gitSyncTestSuite) TestMergeWithFailedPush() {
+	ctx := t.T().Context()
+	repo := t.newRepo(gitSyncOptions{pull: false})
+	branches := newGitBranches(t.workDir, "")
+	t.Require().NoError(branches.create(ctx, "feature", ""))
+	t.Require().NoError(repo.at("feature", branches.at("feature")).PutDrawing(ctx, "drawing", strings.NewReader(scene(2, 1)), "joe"))
+	t.pushFromOther("other.txt")
+
+	board := newReviewBoard(branches, repo)
+	p, createErr := board.create(ctx, "joe", createProposalRequest{Title: "Rework", SourceBranch: "feature"})
+	t.Require().NoError(createErr)
+	_, approveErr := board.approve(ctx, p.Id, "jane")
+	t.Require().NoError(approveErr)
+	merged, _, mergeErr := board.merge(ctx, p.Id, "jane")
+	t.Require().NoError(mergeErr, "the merge commit is made, the push is left pending")
+	t.Equal(proposalMerged, merged.Status)
+	t.True(repo.syncStatus().PendingPush)
+	t.Contains(repo.syncStatus().LastError, "failed to push")
+
+	stored, loadErr := board.load(ctx, p.Id)
+	t.Require().NoError(loadErr)
+	t.Equal(proposalMerged, stored.Status)
+	t.Equal(merged.MergeCommit, stored.MergeCommit)
+	_, _, retryErr := board.merge(ctx, p.Id, "jane")
+	t.ErrorContains(retryErr, "is merged")
+}
+
+func (t *gitSyncTestSuite) TestClosePushesPendingCommits() {
+	repo := t.newRepo(gitSyncOptions{pull: true, pushDelay: time.Hour})
+	t.Require().NoError(repo.PutDrawing(t.T().Context(), "drawing", strings.NewReader("content"), "joe"))
+	t.Equal("initial", t.remoteLog())
+
+	t.Require().NoError(repo.close(t.T().Context()))
+	t.Equal("update drawing\ninitial", t.remoteLog())
+	t.False(repo.syncStatus().PendingPush)
+}
+
+func (t *gitSyncTestSuite) TestServerClose() {
+	useTestPasswordFile(t.T())
+	t.T().Setenv("XCALIAPP_SESSION_STORE", boltSessionStore)
+	t.T().Setenv("XCALIAPP_SESSION_PATH", filepath.Join(t.T().TempDir(), "sessions.db"))
+	t.T().Setenv("XCALIAPP_SESSION_KEYS", newTestSessionKey)
+	s, serverErr := newServer(drawingReposConfigs{
+		firstTestRepo: drawingRepoConfig{name: firstTestRepo, storeType: LOCAL_GIT, root: t.workDir, path: "drawings", watchInterval: "10ms", remote: "origin", pushDelay: "1h"},
+	})
+	t.Require().NoError(serverErr)
+	s.createEngine()
+	repo, _ := s.repos.getRepo(firstTestRepo)
+	t.Require().NoError(repo.PutDrawing(t.T().Context(), "drawing", strings.NewReader("content"), testUser))
+
+	closed := make(chan error)
+	go func() { closed <- s.Close() }()
+	select {
+	case closeErr := <-closed:
+		t.NoError(closeErr)
+	case <-time.After(5 * time.Second):
+		t.FailNow("the background work of the server didn't stop")
+	}
+	t.Error(s.ctx.Err())
+	t.Equal(2, strings.Count(t.remoteLog(), "\n")+1, "the pending commit is pushed")
+	_, loadErr := s.sessions.(*serverSideSessionStore).backend.load("ABC", time.Now())
+	t.Error(loadErr, "the session database is closed")
+}
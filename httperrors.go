@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"myxcaliapp/backend/repoerr"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errorResponse is the body of every error response of the API
+type errorResponse struct {
+	Status  int    `json:"status"`
+	Error   string `json:"error"`
+	Message string `json:"message,omitempty"`
+}
+
+// repoErrorResponses maps the errors of the repoerr taxonomy to HTTP statuses. The fixed message
+// is sent instead of the error, which may tell details of the backend, such as file paths.
+var repoErrorResponses = []struct {
+	err     error
+	status  int
+	message string
+}{
+	{repoerr.ErrNotFound, http.StatusNotFound, "not found"},
+	{repoerr.ErrConflict, http.StatusConflict, "conflicting with the current state"},
+	{repoerr.ErrInvalidInput, http.StatusBadRequest, "invalid input"},
+	{repoerr.ErrForbidden, http.StatusForbidden, "forbidden"},
+	{repoerr.ErrUnavailable, http.StatusServiceUnavailable, "the storage backend is unavailable"},
+}
+
+// repoErrorResponse returns the status and the message to respond with for the error; anything
+// outside the repoerr taxonomy is an internal error
+func repoErrorResponse(err error) (int, string) {
+	for _, response := range repoErrorResponses {
+		if errors.Is(err, response.err) {
+			return response.status, response.message
+		}
+	}
+	return http.StatusInternalServerError, ""
+}
+
+func repoErrorStatus(err error) int {
+	status, _ := repoErrorResponse(err)
+	return status
+}
+
+// abortWithError records the error with the context and responds with a JSON error body.
+// The error message is only disclosed for client errors, so the errors of the repos, which may
+// tell details of the backend, go through abortWithRepoError instead.
+func abortWithError(c *gin.Context, status int, err error) {
+	_ = c.Error(err)
+	response := errorResponse{
+		Status: status,
+		Error:  http.StatusText(status),
+	}
+	if status < http.StatusInternalServerError {
+		response.Message = err.Error()
+	}
+	c.AbortWithStatusJSON(status, response)
+}
+
+// abortWithRepoError responds to the error of a repo with the fixed message of its kind
+func abortWithRepoError(c *gin.Context, err error) {
+	_ = c.Error(err)
+	status, message := repoErrorResponse(err)
+	c.AbortWithStatusJSON(status, errorResponse{
+		Status:  status,
+		Error:   http.StatusText(status),
+		Message: message,
+	})
+}
+
+func unknownRepoError(repoName string) error {
+	return fmt.Errorf("drawing repository %s: %w", repoName, repoerr.ErrNotFound)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"myxcaliapp/backend/repoerr"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+)
+
+type httpErrorsTestSuite struct {
+	suite.Suite
+}
+
+func TestHttpErrors(t *testing.T) {
+	suite.Run(t, &httpErrorsTestSuite{})
+}
+
+func (t *httpErrorsTestSuite) respond(err error) (int, errorResponse) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	abortWithRepoError(c, err)
+	var response errorResponse
+	t.Require().NoError(json.Unmarshal(recorder.Body.Bytes(), &response))
+	return recorder.Code, response
+}
+
+func (t *httpErrorsTestSuite) TestFixedMessages() {
+	_, pathErr := os.ReadFile("/srv/drawings/secret/missing.excalidraw")
+	status, response := t.respond(fmt.Errorf("failed to read drawing: %w: %w", repoerr.ErrNotFound, pathErr))
+	t.Equal(http.StatusNotFound, status)
+	t.Equal("not found", response.Message)
+	t.NotContains(response.Message, "/srv")
+}
+
+func (t *httpErrorsTestSuite) TestOnlyRepoErrorsAreMapped() {
+	for _, err := range []error{
+		&fs.PathError{Op: "open", Path: "/srv/drawings/locked", Err: fs.ErrPermission},
+		&fs.PathError{Op: "open", Path: "/srv/drawings/existing", Err: fs.ErrExist},
+		fs.ErrInvalid,
+		fs.ErrNotExist,
+	} {
+		status, response := t.respond(err)
+		t.Equal(http.StatusInternalServerError, status, err.Error())
+		t.Empty(response.Message)
+	}
+}
+
+func (t *httpErrorsTestSuite) TestStoreErrorsAreTranslated() {
+	store := newStoreErrorsRepo(&notExistStore{newMemoryStore()})
+	_, getErr := store.GetDrawing(t.T().Context(), "missing")
+	t.ErrorIs(getErr, repoerr.ErrNotFound)
+	t.ErrorIs(store.DeleteDrawing(t.T().Context(), "missing", "joe"), repoerr.ErrNotFound)
+}
+
+// notExistStore reports missing drawings with fs.ErrNotExist, the way stores outside the repoerr
+// taxonomy do
+type notExistStore struct {
+	*memoryStore
+}
+
+func (store *notExistStore) GetDrawing(ctx context.Context, key string) (string, error) {
+	return "", &fs.PathError{Op: "open", Path: key, Err: fs.ErrNotExist}
+}
+
+func (store *notExistStore) DeleteDrawing(ctx context.Context, key string, modifiedBy string) error {
+	return &fs.PathError{Op: "remove", Path: key, Err: fs.ErrNotExist}
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -9,6 +14,14 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "users" {
+		if commandErr := runUsersCommand(os.Args[2:], readPasswordFromStdin, os.Stderr); commandErr != nil {
+			fmt.Fprintln(os.Stderr, commandErr)
+			os.Exit(1)
+		}
+		return
+	}
+
 	draRepoConfigs, err := getDrawingRepoConfigs()
 	if err != nil {
 		panic(err)
@@ -22,7 +35,9 @@ func main() {
 	logger := getLogger()
 	logger.Info().Interface("drawingRepos", draRepoConfigs).Int("port", s.config.port).Msg("starting server...")
 
-	s.start()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	s.start(ctx)
 }
 
 func RequestLogger(g *gin.Context) {
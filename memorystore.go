@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"myxcaliapp/backend/repoerr"
+	"strconv"
+	"sync"
+	"time"
+	"vcblobstore"
+)
+
+type memoryStoreVersion struct {
+	id        string
+	author    string
+	message   string
+	timestamp time.Time
+	content   string
+}
+
+type memoryStoreDrawing struct {
+	versions []memoryStoreVersion // oldest first
+	deleted  bool
+}
+
+// memoryStore keeps drawings with their full history in memory. It is meant for tests and demos:
+// everything is lost when the server stops.
+type memoryStore struct {
+	lock          sync.RWMutex
+	drawings      map[string]*memoryStoreDrawing
+	lastVersionId int
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		drawings: map[string]*memoryStoreDrawing{},
+	}
+}
+
+// put must be called with the write lock held
+func (store *memoryStore) put(key string, content string, modifiedBy string, message string) string {
+	drawing, exists := store.drawings[key]
+	if !exists {
+		drawing = &memoryStoreDrawing{}
+		store.drawings[key] = drawing
+	}
+	store.lastVersionId++
+	version := memoryStoreVersion{
+		id:        strconv.Itoa(store.lastVersionId),
+		author:    modifiedBy,
+		message:   message,
+		timestamp: time.Now().UTC(),
+		content:   content,
+	}
+	drawing.versions = append(drawing.versions, version)
+	drawing.deleted = false
+	return version.id
+}
+
+// current must be called with the lock held
+func (store *memoryStore) current(key string) (*memoryStoreDrawing, error) {
+	drawing, exists := store.drawings[key]
+	if !exists || drawing.deleted {
+		return nil, fmt.Errorf("drawing %s: %w", key, repoerr.ErrNotFound)
+	}
+	return drawing, nil
+}
+
+// version must be called with the lock held
+func (store *memoryStore) version(key string, versionID string) (*memoryStoreVersion, error) {
+	drawing, exists := store.drawings[key]
+	if !exists {
+		return nil, fmt.Errorf("drawing %s: %w", key, repoerr.ErrNotFound)
+	}
+	for i := range drawing.versions {
+		if drawing.versions[i].id == versionID {
+			return &drawing.versions[i], nil
+		}
+	}
+	return nil, fmt.Errorf("version %s of drawing %s: %w", versionID, key, repoerr.ErrNotFound)
+}
+
+func (store *memoryStore) PutDrawing(ctx context.Context, key string, contentReader io.Reader, modifiedBy string) error {
+	content, readErr := io.ReadAll(contentReader)
+	if readErr != nil {
+		return fmt.Errorf("failed to read content of %s: %w", key, readErr)
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	message, _ := commitDetails(ctx, modifiedBy, "")
+	store.put(key, string(content), modifiedBy, message)
+	return nil
+}
+
+func (store *memoryStore) CopyDrawing(ctx context.Context, sourceId string, destinationId string, modifiedBy string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	source, err := store.current(sourceId)
+	if err != nil {
+		return err
+	}
+	message, _ := commitDetails(ctx, modifiedBy, "")
+	store.put(destinationId, source.versions[len(source.versions)-1].content, modifiedBy, message)
+	return nil
+}
+
+func (store *memoryStore) ListDrawings(ctx context.Context) (map[drawingId]drawingTitle, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	drawings := map[drawingId]drawingTitle{}
+	for key, drawing := range store.drawings {
+		if !drawing.deleted {
+			drawings[key] = key
+		}
+	}
+	return drawings, nil
+}
+
+func (store *memoryStore) GetDrawing(ctx context.Context, key string) (string, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	drawing, err := store.current(key)
+	if err != nil {
+		return "", err
+	}
+	return drawing.versions[len(drawing.versions)-1].content, nil
+}
+
+// DeleteDrawing hides the drawing, but keeps its history, so that it can still be restored
+func (store *memoryStore) DeleteDrawing(ctx context.Context, key string, modifiedBy string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	drawing, err := store.current(key)
+	if err != nil {
+		return err
+	}
+	drawing.deleted = true
+	return nil
+}
+
+// ListVersions lists the versions of a drawing, latest first
+func (store *memoryStore) ListVersions(ctx context.Context, key string) ([]vcblobstore.BlobVersion, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	drawing, exists := store.drawings[key]
+	if !exists {
+		return nil, fmt.Errorf("drawing %s: %w", key, repoerr.ErrNotFound)
+	}
+
+	versions := []vcblobstore.BlobVersion{}
+	for i := len(drawing.versions) - 1; i >= 0; i-- {
+		versions = append(versions, vcblobstore.BlobVersion{
+			VersionID: drawing.versions[i].id,
+			Author:    drawing.versions[i].author,
+			Timestamp: drawing.versions[i].timestamp,
+			Message:   drawing.versions[i].message,
+		})
+	}
+	return versions, nil
+}
+
+func (store *memoryStore) GetVersion(ctx context.Context, key string, versionID string) (string, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	version, err := store.version(key, versionID)
+	if err != nil {
+		return "", err
+	}
+	return version.content, nil
+}
+
+// RestoreVersion saves the content of the version as the latest version and returns its id
+func (store *memoryStore) RestoreVersion(ctx context.Context, key string, versionID string, modifiedBy string) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	version, err := store.version(key, versionID)
+	if err != nil {
+		return "", err
+	}
+	message, _ := commitDetails(ctx, modifiedBy, "")
+	return store.put(key, version.content, modifiedBy, message), nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"golang.org/x/oauth2"
+)
+
+const oidcLoginKey = "oidc-login"
+
+const oidcDiscoveryTimeout = 10 * time.Second
+
+const (
+	oidcLoginPath    = "/auth/login"
+	oidcCallbackPath = "/auth/callback"
+	oidcLogoutPath   = "/auth/logout"
+)
+
+var defaultOIDCScopes = []string{oidc.ScopeOpenID, "profile", "email"}
+
+type oidcConfig struct {
+	issuer        string
+	clientId      string
+	clientSecret  string
+	redirectURL   string   // the URL of the callback endpoint as seen by the browser
+	scopes        []string // "openid" is always requested
+	usernameClaim string   // the ID-token claim used as the username, e.g. "email" or "preferred_username"
+}
+
+func (config oidcConfig) enabled() bool {
+	return len(config.issuer) > 0
+}
+
+func (config oidcConfig) validate() error {
+	if !config.enabled() {
+		return nil
+	}
+	if len(config.clientId) == 0 {
+		return fmt.Errorf("missing OIDC client id for issuer %s", config.issuer)
+	}
+	redirectURL, parseErr := url.Parse(config.redirectURL)
+	if parseErr != nil || (redirectURL.Scheme != "http" && redirectURL.Scheme != "https") || len(redirectURL.Host) == 0 {
+		return fmt.Errorf("invalid OIDC redirect URL %q", config.redirectURL)
+	}
+	if len(config.usernameClaim) == 0 {
+		return fmt.Errorf("missing OIDC username claim")
+	}
+	return nil
+}
+
+// oidcLoginState is kept in the session between the redirect to the provider and the callback
+type oidcLoginState struct {
+	State    string
+	Nonce    string
+	Verifier string // PKCE code verifier
+	Redirect string // where the user is sent after logging in
+}
+
+// oidcAuthenticator logs users in via the authorization-code flow of an OpenID Connect provider.
+// The provider is discovered on first use, so that the server starts even if the provider is down.
+type oidcAuthenticator struct {
+	config oidcConfig
+
+	lock     sync.Mutex
+	oauth2   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+func newOIDCAuthenticator(config oidcConfig) *oidcAuthenticator {
+	return &oidcAuthenticator{config: config}
+}
+
+// provider returns the client configuration and the ID-token verifier of the provider. The
+// discovery isn't bound to the request triggering it, as its result is kept for the later ones.
+func (authenticator *oidcAuthenticator) provider() (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	authenticator.lock.Lock()
+	defer authenticator.lock.Unlock()
+	if authenticator.oauth2 != nil {
+		return authenticator.oauth2, authenticator.verifier, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), oidcDiscoveryTimeout)
+	defer cancel()
+	provider, discoveryErr := oidc.NewProvider(ctx, authenticator.config.issuer)
+	if discoveryErr != nil {
+		return nil, nil, fmt.Errorf("failed to discover OIDC provider %s: %w", authenticator.config.issuer, discoveryErr)
+	}
+	scopes := []string{oidc.ScopeOpenID}
+	for _, scope := range authenticator.config.scopes {
+		if scope != oidc.ScopeOpenID {
+			scopes = append(scopes, scope)
+		}
+	}
+	authenticator.oauth2 = &oauth2.Config{
+		ClientID:     authenticator.config.clientId,
+		ClientSecret: authenticator.config.clientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  authenticator.config.redirectURL,
+		Scopes:       scopes,
+	}
+	authenticator.verifier = provider.Verifier(&oidc.Config{ClientID: authenticator.config.clientId})
+	return authenticator.oauth2, authenticator.verifier, nil
+}
+
+func randomToken() (string, error) {
+	token := make([]byte, 32)
+	if _, readErr := rand.Read(token); readErr != nil {
+		return "", readErr
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// localRedirect returns the path to send the user to after logging in, accepting only paths on
+// this server, so that the login can't be abused for redirecting elsewhere
+func localRedirect(redirect string) string {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		return "/"
+	}
+	return redirect
+}
+
+// login redirects the user to the provider
+func (authenticator *oidcAuthenticator) login() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		logger := zerolog.Ctx(c.Request.Context())
+
+		oauth2Config, _, providerErr := authenticator.provider()
+		if providerErr != nil {
+			logger.Error().Err(providerErr).Send()
+			abortWithError(c, http.StatusServiceUnavailable, providerErr)
+			return
+		}
+
+		login := oidcLoginState{
+			Verifier: oauth2.GenerateVerifier(),
+			Redirect: localRedirect(c.Query("redirect")),
+		}
+		var stateErr, nonceErr error
+		login.State, stateErr = randomToken()
+		login.Nonce, nonceErr = randomToken()
+		if randomErr := errors.Join(stateErr, nonceErr); randomErr != nil {
+			logger.Error().Err(randomErr).Msg("failed to generate login state")
+			abortWithError(c, http.StatusInternalServerError, randomErr)
+			return
+		}
+
+		session := sessions.Default(c)
+		session.Set(oidcLoginKey, login)
+		if saveErr := session.Save(); saveErr != nil {
+			logger.Error().Err(saveErr).Msg("failed to save login state")
+			abortWithError(c, http.StatusInternalServerError, saveErr)
+			return
+		}
+		c.Redirect(http.StatusFound, oauth2Config.AuthCodeURL(login.State, oidc.Nonce(login.Nonce), oauth2.S256ChallengeOption(login.Verifier)))
+	}
+}
+
+// callback completes the login with the authorization code sent by the provider
+func (authenticator *oidcAuthenticator) callback() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		logger := zerolog.Ctx(c.Request.Context())
+
+		session := sessions.Default(c)
+		login, hasLogin := session.Get(oidcLoginKey).(oidcLoginState)
+		session.Delete(oidcLoginKey)
+		if saveErr := session.Save(); saveErr != nil {
+			logger.Error().Err(saveErr).Msg("failed to clear login state")
+		}
+		if !hasLogin || len(login.State) == 0 || c.Query("state") != login.State {
+			logger.Info().Bool("hasLogin", hasLogin).Msg("login state mismatch")
+			abortWithError(c, http.StatusBadRequest, errors.New("invalid login state, please log in again"))
+			return
+		}
+		if providerError := c.Query("error"); len(providerError) > 0 {
+			logger.Info().Str("error", providerError).Str("description", c.Query("error_description")).Msg("login refused by the provider")
+			abortWithError(c, http.StatusUnauthorized, fmt.Errorf("login failed: %s", providerError))
+			return
+		}
+
+		oauth2Config, verifier, providerErr := authenticator.provider()
+		if providerErr != nil {
+			logger.Error().Err(providerErr).Send()
+			abortWithError(c, http.StatusServiceUnavailable, providerErr)
+			return
+		}
+		token, exchangeErr := oauth2Config.Exchange(c.Request.Context(), c.Query("code"), oauth2.VerifierOption(login.Verifier))
+		if exchangeErr != nil {
+			logger.Info().Err(exchangeErr).Msg("failed to exchange authorization code")
+			abortWithError(c, http.StatusUnauthorized, errors.New("login failed: invalid authorization code"))
+			return
+		}
+		rawIDToken, hasIDToken := token.Extra("id_token").(string)
+		if !hasIDToken {
+			logger.Info().Msg("no ID token in token response")
+			abortWithError(c, http.StatusUnauthorized, errors.New("login failed: no ID token"))
+			return
+		}
+		idToken, verifyErr := verifier.Verify(c.Request.Context(), rawIDToken)
+		if verifyErr != nil {
+			logger.Info().Err(verifyErr).Msg("invalid ID token")
+			abortWithError(c, http.StatusUnauthorized, errors.New("login failed: invalid ID token"))
+			return
+		}
+		if idToken.Nonce != login.Nonce {
+			logger.Info().Msg("ID token nonce mismatch")
+			abortWithError(c, http.StatusUnauthorized, errors.New("login failed: invalid ID token"))
+			return
+		}
+
+		user, claimsErr := authenticator.userFromClaims(idToken)
+		if claimsErr != nil {
+			logger.Info().Err(claimsErr).Msg("unusable ID token claims")
+			abortWithError(c, http.StatusForbidden, claimsErr)
+			return
+		}
+
+		if renewErr := renewSession(c, session); renewErr != nil {
+			logger.Error().Err(renewErr).Msg("failed to renew session")
+			abortWithError(c, http.StatusInternalServerError, errors.New("login failed"))
+			return
+		}
+		session.Set(userKey, user)
+		if saveErr := session.Save(); saveErr != nil {
+			logger.Error().Err(saveErr).Msg("failed to save session")
+			abortWithError(c, http.StatusInternalServerError, saveErr)
+			return
+		}
+		logger.Info().Str("username", user.Username).Msg("user logged in")
+		c.Redirect(http.StatusFound, login.Redirect)
+	}
+}
+
+func (authenticator *oidcAuthenticator) userFromClaims(idToken *oidc.IDToken) (User, error) {
+	claims := map[string]any{}
+	if claimsErr := idToken.Claims(&claims); claimsErr != nil {
+		return User{}, fmt.Errorf("failed to parse ID token claims: %w", claimsErr)
+	}
+	username, _ := claims[authenticator.config.usernameClaim].(string)
+	if len(username) == 0 {
+		return User{}, fmt.Errorf("no %s claim in the ID token", authenticator.config.usernameClaim)
+	}
+	if authenticator.config.usernameClaim == "email" {
+		if verified, hasVerified := claims["email_verified"].(bool); hasVerified && !verified {
+			return User{}, fmt.Errorf("email address %s is not verified", username)
+		}
+	}
+	return User{Username: username}, nil
+}
+
+func logout(c *gin.Context) {
+	session := sessions.Default(c)
+	session.Clear()
+	session.Options(sessions.Options{Path: "/", MaxAge: -1})
+	if saveErr := session.Save(); saveErr != nil {
+		zerolog.Ctx(c.Request.Context()).Error().Err(saveErr).Msg("failed to clear session")
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"vcblobstore"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/suite"
+)
+
+const oidcTestClientId = "xcaliapp"
+
+type mockOIDCAuthorization struct {
+	nonce         string
+	codeChallenge string
+	claims        map[string]any
+}
+
+// mockOIDCProvider is an OpenID Connect provider logging in the configured user without asking
+type mockOIDCProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]any // of the user logging in
+
+	lock  sync.Mutex
+	codes map[string]mockOIDCAuthorization
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	key, keyErr := rsa.GenerateKey(rand.Reader, 2048)
+	if keyErr != nil {
+		t.Fatal(keyErr)
+	}
+	provider := &mockOIDCProvider{key: key, codes: map[string]mockOIDCAuthorization{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", provider.discovery)
+	mux.HandleFunc("GET /keys", provider.keys)
+	mux.HandleFunc("GET /authorize", provider.authorize)
+	mux.HandleFunc("POST /token", provider.token)
+	provider.server = httptest.NewServer(mux)
+	t.Cleanup(provider.server.Close)
+	return provider
+}
+
+func (provider *mockOIDCProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                provider.server.URL,
+		"authorization_endpoint":                provider.server.URL + "/authorize",
+		"token_endpoint":                        provider.server.URL + "/token",
+		"jwks_uri":                              provider.server.URL + "/keys",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (provider *mockOIDCProvider) keys(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &provider.key.PublicKey, KeyID: "test", Algorithm: string(jose.RS256), Use: "sig"},
+	}})
+}
+
+func (provider *mockOIDCProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != oidcTestClientId || query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	code := rand.Text()
+	provider.lock.Lock()
+	provider.codes[code] = mockOIDCAuthorization{
+		nonce:         query.Get("nonce"),
+		codeChallenge: query.Get("code_challenge"),
+		claims:        provider.claims,
+	}
+	provider.lock.Unlock()
+	http.Redirect(w, r, query.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {query.Get("state")}}.Encode(), http.StatusFound)
+}
+
+func (provider *mockOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	provider.lock.Lock()
+	authorization, known := provider.codes[r.FormValue("code")]
+	delete(provider.codes, r.FormValue("code"))
+	provider.lock.Unlock()
+	challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !known || base64.RawURLEncoding.EncodeToString(challenge[:]) != authorization.codeChallenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	claims := map[string]any{
+		"iss":   provider.server.URL,
+		"aud":   oidcTestClientId,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": authorization.nonce,
+	}
+	for name, value := range authorization.claims {
+		claims[name] = value
+	}
+	signer, signerErr := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: provider.key, KeyID: "test"}}, (&jose.SignerOptions{}).WithType("JWT"))
+	payload, marshalErr := json.Marshal(claims)
+	if signerErr != nil || marshalErr != nil {
+		http.Error(w, "failed to sign ID token", http.StatusInternalServerError)
+		return
+	}
+	signed, signErr := signer.Sign(payload)
+	if signErr != nil {
+		http.Error(w, signErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	idToken, serializeErr := signed.CompactSerialize()
+	if serializeErr != nil {
+		http.Error(w, serializeErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": "access-token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+type oidcTestSuite struct {
+	suite.Suite
+	provider *mockOIDCProvider
+	engine   *gin.Engine
+	cookies  []*http.Cookie
+}
+
+func TestOIDC(t *testing.T) {
+	suite.Run(t, &oidcTestSuite{})
+}
+
+func (t *oidcTestSuite) SetupTest() {
+	gin.SetMode(gin.TestMode)
+	t.provider = newMockOIDCProvider(t.T())
+	t.provider.claims = map[string]any{"sub": "1234", "email": "jane@example.com", "email_verified": true}
+	t.T().Setenv("XCALIAPP_OIDC_ISSUER", t.provider.server.URL)
+	t.T().Setenv("XCALIAPP_OIDC_CLIENTID", oidcTestClientId)
+	t.T().Setenv("XCALIAPP_OIDC_CLIENTSECRET", "secret")
+	t.T().Setenv("XCALIAPP_OIDC_REDIRECTURL", "http://xcaliapp.test"+oidcCallbackPath)
+	t.cookies = nil
+}
+
+func (t *oidcTestSuite) startServer() {
+	s := newTestServer(t.T(), drawingReposConfigs{
+		firstTestRepo: drawingRepoConfig{name: firstTestRepo, label: "First Repo", storeType: MEMORY},
+	})
+	t.engine = s.createEngine()
+}
+
+// send sends the request to the server with the cookies received so far
+func (t *oidcTestSuite) send(method string, target string, header http.Header) *httptest.ResponseRecorder {
+	return t.sendBody(method, target, nil, header)
+}
+
+func (t *oidcTestSuite) sendBody(method string, target string, body io.Reader, header http.Header) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, body)
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	for _, cookie := range t.cookies {
+		request.AddCookie(cookie)
+	}
+	recorder := httptest.NewRecorder()
+	t.engine.ServeHTTP(recorder, request)
+	if cookies := recorder.Result().Cookies(); len(cookies) > 0 {
+		// like browsers, keep the last cookie of each name
+		t.cookies = nil
+		for _, cookie := range cookies {
+			t.cookies = slices.DeleteFunc(t.cookies, func(kept *http.Cookie) bool { return kept.Name == cookie.Name })
+			t.cookies = append(t.cookies, cookie)
+		}
+	}
+	return recorder
+}
+
+// authorize follows the redirect to the provider, returning the redirect back to the server
+func (t *oidcTestSuite) authorize(login *httptest.ResponseRecorder) *url.URL {
+	t.Require().Equal(http.StatusFound, login.Code)
+	client := http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	response, getErr := client.Get(login.Header().Get("Location"))
+	t.Require().NoError(getErr)
+	defer response.Body.Close()
+	t.Require().Equal(http.StatusFound, response.StatusCode)
+	callback, parseErr := url.Parse(response.Header.Get("Location"))
+	t.Require().NoError(parseErr)
+	t.Equal(oidcCallbackPath, callback.Path)
+	return callback
+}
+
+func (t *oidcTestSuite) TestLogin() {
+	t.startServer()
+	unauthenticated := t.send(http.MethodGet, "/api/drawings", nil)
+	t.Equal(http.StatusUnauthorized, unauthenticated.Code)
+	t.Empty(unauthenticated.Header().Get("WWW-Authenticate"))
+
+	callback := t.authorize(t.send(http.MethodGet, oidcLoginPath+"?redirect=/drawings", nil))
+	loggedIn := t.send(http.MethodGet, callback.RequestURI(), nil)
+	t.Require().Equal(http.StatusFound, loggedIn.Code)
+	t.Equal("/drawings", loggedIn.Header().Get("Location"))
+
+	t.Equal(http.StatusOK, t.send(http.MethodGet, "/api/drawings", nil).Code)
+	created := t.sendBody(http.MethodPost, "/api/drawing/"+firstTestRepo, strings.NewReader(`{"content": "v1"}`), nil)
+	t.Require().Equal(http.StatusOK, created.Code)
+	var id string
+	t.Require().NoError(json.Unmarshal(created.Body.Bytes(), &id))
+	var versions []vcblobstore.BlobVersion
+	t.Require().NoError(json.Unmarshal(t.send(http.MethodGet, "/api/drawing/"+firstTestRepo+"/"+id+"/versions", nil).Body.Bytes(), &versions))
+	t.Require().Len(versions, 1)
+	t.Equal("jane@example.com", versions[0].Author)
+
+	t.Equal(http.StatusNoContent, t.send(http.MethodPost, oidcLogoutPath, nil).Code)
+	t.Equal(http.StatusUnauthorized, t.send(http.MethodGet, "/api/drawings", nil).Code)
+}
+
+func (t *oidcTestSuite) TestSessionRenewedOnLogin() {
+	sessionDir := t.T().TempDir()
+	t.T().Setenv("XCALIAPP_SESSION_STORE", fileSessionStore)
+	t.T().Setenv("XCALIAPP_SESSION_PATH", sessionDir)
+	t.T().Setenv("XCALIAPP_SESSION_KEYS", newTestSessionKey)
+	t.startServer()
+	callback := t.authorize(t.send(http.MethodGet, oidcLoginPath, nil))
+	preLoginCookies := t.cookies
+	t.Require().NotEmpty(preLoginCookies)
+	t.Require().Equal(http.StatusFound, t.send(http.MethodGet, callback.RequestURI(), nil).Code)
+	t.Equal(http.StatusOK, t.send(http.MethodGet, "/api/drawings", nil).Code)
+	t.NotEqual(preLoginCookies[0].Value, t.cookies[0].Value)
+	sessionFiles, readDirErr := os.ReadDir(sessionDir)
+	t.Require().NoError(readDirErr)
+	t.Len(sessionFiles, 1, "the session from before the login is deleted")
+
+	t.cookies = preLoginCookies
+	t.Equal(http.StatusUnauthorized, t.send(http.MethodGet, "/api/drawings", nil).Code, "the session id planted before the login isn't authenticated")
+}
+
+func (t *oidcTestSuite) TestBrowserRedirectedToLogin() {
+	t.startServer()
+	recorder := t.send(http.MethodGet, "/drawings?repo=first", http.Header{"Accept": {"text/html,application/xhtml+xml"}})
+	t.Equal(http.StatusFound, recorder.Code)
+	t.Equal(oidcLoginPath+"?redirect=%2Fdrawings%3Frepo%3Dfirst", recorder.Header().Get("Location"))
+}
+
+func (t *oidcTestSuite) TestForeignRedirectIgnored() {
+	t.startServer()
+	callback := t.authorize(t.send(http.MethodGet, oidcLoginPath+"?redirect=//evil.example.com", nil))
+	loggedIn := t.send(http.MethodGet, callback.RequestURI(), nil)
+	t.Equal(http.StatusFound, loggedIn.Code)
+	t.Equal("/", loggedIn.Header().Get("Location"))
+}
+
+func (t *oidcTestSuite) TestStateMismatch() {
+	t.startServer()
+	callback := t.authorize(t.send(http.MethodGet, oidcLoginPath, nil))
+	query := callback.Query()
+	query.Set("state", "forged")
+	t.Equal(http.StatusBadRequest, t.send(http.MethodGet, oidcCallbackPath+"?"+query.Encode(), nil).Code)
+	t.Equal(http.StatusUnauthorized, t.send(http.MethodGet, "/api/drawings", nil).Code)
+}
+
+func (t *oidcTestSuite) TestUnverifiedEmail() {
+	t.provider.claims["email_verified"] = false
+	t.startServer()
+	callback := t.authorize(t.send(http.MethodGet, oidcLoginPath, nil))
+	t.Equal(http.StatusForbidden, t.send(http.MethodGet, callback.RequestURI(), nil).Code)
+	t.Equal(http.StatusUnauthorized, t.send(http.MethodGet, "/api/drawings", nil).Code)
+}
+
+func (t *oidcTestSuite) TestBasicFallback() {
+	useTestPasswordFile(t.T())
+	t.startServer()
+	basic := http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte(testUser+":pass"))}}
+	t.Equal(http.StatusUnauthorized, t.send(http.MethodGet, "/api/drawings", basic).Code)
+
+	t.T().Setenv("XCALIAPP_BASICAUTH", "true")
+	t.startServer()
+	t.Equal(http.StatusOK, t.send(http.MethodGet, "/api/drawings", basic).Code)
+}
+
+func (t *oidcTestSuite) TestInvalidConfig() {
+	t.T().Setenv("XCALIAPP_OIDC_REDIRECTURL", "")
+	_, err := newServer(drawingReposConfigs{})
+	t.Error(err)
+}
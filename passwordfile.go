@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	defaultPasswordFileReloadInterval = 5 * time.Second
+	passwordFilePermissions           = 0o600
+)
+
+const (
+	bcryptScheme   = "bcrypt"
+	argon2idScheme = "argon2id"
+)
+
+// argon2id parameters of the new hashes, as recommended by RFC 9106 for memory-constrained environments
+const (
+	argon2idTime      = 3
+	argon2idMemory    = 64 * 1024 // KiB
+	argon2idThreads   = 4
+	argon2idKeyLength = 32
+	argon2idSaltSize  = 16
+)
+
+// dummyPasswordHash is checked against for unknown users, so that they take as long to reject as known ones
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// hashPassword hashes the password with the scheme: bcrypt or argon2id
+func hashPassword(password string, scheme string) (string, error) {
+	switch scheme {
+	case bcryptScheme:
+		hash, hashErr := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if hashErr != nil {
+			return "", hashErr
+		}
+		return string(hash), nil
+	case argon2idScheme:
+		salt := make([]byte, argon2idSaltSize)
+		if _, readErr := rand.Read(salt); readErr != nil {
+			return "", readErr
+		}
+		key := argon2.IDKey([]byte(password), salt, argon2idTime, argon2idMemory, argon2idThreads, argon2idKeyLength)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2idMemory, argon2idTime, argon2idThreads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	default:
+		return "", fmt.Errorf("unsupported password hash scheme %q", scheme)
+	}
+}
+
+// argon2idHash is an argon2id hash in the PHC string format:
+// $argon2id$v=19$m=<memory KiB>,t=<iterations>,p=<threads>$<salt>$<key>
+type argon2idHash struct {
+	memory     uint32
+	iterations uint32
+	threads    uint8
+	salt       []byte
+	key        []byte
+}
+
+// the limits of the argon2id parameters accepted from the password file, so that a bad line
+// can't make logins crash or exhaust the memory of the server
+const (
+	maxArgon2idMemory     = 1024 * 1024 // KiB
+	maxArgon2idIterations = 64
+	minArgon2idKeyLength  = 16
+	maxArgon2idKeyLength  = 64
+)
+
+func parseArgon2idHash(hash string) (argon2idHash, error) {
+	var parsed argon2idHash
+	var version int
+	parts := strings.Split(hash, "$") // "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	if len(parts) != 6 || parts[1] != argon2idScheme {
+		return parsed, fmt.Errorf("malformed argon2id hash")
+	}
+	if _, scanErr := fmt.Sscanf(parts[2], "v=%d", &version); scanErr != nil || version != argon2.Version {
+		return parsed, fmt.Errorf("unsupported argon2id version %q", parts[2])
+	}
+	if _, scanErr := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &parsed.memory, &parsed.iterations, &parsed.threads); scanErr != nil {
+		return parsed, fmt.Errorf("malformed argon2id parameters %q", parts[3])
+	}
+	switch {
+	case parsed.threads == 0:
+		return parsed, fmt.Errorf("invalid argon2id parallelism 0")
+	case parsed.iterations == 0 || parsed.iterations > maxArgon2idIterations:
+		return parsed, fmt.Errorf("argon2id iterations %d out of range 1-%d", parsed.iterations, maxArgon2idIterations)
+	case parsed.memory < 8*uint32(parsed.threads) || parsed.memory > maxArgon2idMemory:
+		return parsed, fmt.Errorf("argon2id memory %d KiB out of range %d-%d", parsed.memory, 8*uint32(parsed.threads), maxArgon2idMemory)
+	}
+	var saltErr, keyErr error
+	parsed.salt, saltErr = base64.RawStdEncoding.DecodeString(parts[4])
+	parsed.key, keyErr = base64.RawStdEncoding.DecodeString(parts[5])
+	if saltErr != nil || keyErr != nil || len(parsed.salt) == 0 || len(parsed.key) < minArgon2idKeyLength || len(parsed.key) > maxArgon2idKeyLength {
+		return parsed, fmt.Errorf("malformed argon2id hash")
+	}
+	return parsed, nil
+}
+
+// isBcryptHash tells whether the hash has one of the bcrypt prefixes the bcrypt package accepts
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// checkPasswordHash tells whether the password matches the hash: a bcrypt hash or an argon2id
+// hash in the PHC string format
+func checkPasswordHash(hash string, password string) (bool, error) {
+	switch {
+	case isBcryptHash(hash):
+		compareErr := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(compareErr, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return compareErr == nil, compareErr
+	case strings.HasPrefix(hash, "$argon2id$"):
+		parsed, parseErr := parseArgon2idHash(hash)
+		if parseErr != nil {
+			return false, parseErr
+		}
+		computed := argon2.IDKey([]byte(password), parsed.salt, parsed.iterations, parsed.memory, parsed.threads, uint32(len(parsed.key)))
+		return subtle.ConstantTimeCompare(parsed.key, computed) == 1, nil
+	default:
+		return false, fmt.Errorf("unsupported password hash")
+	}
+}
+
+// parsePasswordFile parses the "username:hash" lines of an htpasswd-style file; empty lines and
+// lines starting with '#' are skipped. The lines which can't be used are reported as problems.
+func parsePasswordFile(content []byte) (map[string]string, []string) {
+	hashes := map[string]string{}
+	problems := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, hasHash := strings.Cut(line, ":")
+		switch {
+		case !hasHash || len(username) == 0:
+			problems = append(problems, fmt.Sprintf("line %d: not a username:hash pair", lineNumber))
+		case !isBcryptHash(hash) && !strings.HasPrefix(hash, "$argon2id$"):
+			problems = append(problems, fmt.Sprintf("line %d: user %s: only bcrypt and argon2id hashes are supported", lineNumber, username))
+		default:
+			if strings.HasPrefix(hash, "$argon2id$") {
+				if _, parseErr := parseArgon2idHash(hash); parseErr != nil {
+					problems = append(problems, fmt.Sprintf("line %d: user %s: %v", lineNumber, username, parseErr))
+					continue
+				}
+			}
+			hashes[username] = hash
+		}
+	}
+	return hashes, problems
+}
+
+// passwordFile checks Basic credentials against the users of an htpasswd-style file, which is
+// reloaded when it changes. The users of the last successfully read version of the file remain
+// in effect while the file can't be read.
+type passwordFile struct {
+	fileName string
+	logger   zerolog.Logger
+
+	lock    sync.RWMutex
+	hashes  map[string]string
+	modTime time.Time
+	size    int64
+}
+
+func loadPasswordFile(fileName string, logger zerolog.Logger) (*passwordFile, error) {
+	file := &passwordFile{
+		fileName: fileName,
+		logger:   logger.With().Str("passwordFile", fileName).Logger(),
+	}
+	if reloadErr := file.reload(); reloadErr != nil {
+		return nil, reloadErr
+	}
+	return file, nil
+}
+
+func (file *passwordFile) reload() error {
+	info, statErr := os.Stat(file.fileName)
+	if statErr != nil {
+		return fmt.Errorf("failed to read password file: %w", statErr)
+	}
+	content, readErr := os.ReadFile(file.fileName)
+	if readErr != nil {
+		return fmt.Errorf("failed to read password file: %w", readErr)
+	}
+	hashes, problems := parsePasswordFile(content)
+	for _, problem := range problems {
+		file.logger.Warn().Str("problem", problem).Msg("skipping unusable line of the password file")
+	}
+
+	file.lock.Lock()
+	defer file.lock.Unlock()
+	file.hashes = hashes
+	file.modTime = info.ModTime()
+	file.size = info.Size()
+	file.logger.Info().Int("userCount", len(hashes)).Msg("password file loaded")
+	return nil
+}
+
+// reloadIfChanged reloads the file if its modification time or size has changed
+func (file *passwordFile) reloadIfChanged() {
+	info, statErr := os.Stat(file.fileName)
+	if statErr != nil {
+		if errors.Is(statErr, fs.ErrNotExist) {
+			file.logger.Error().Msg("password file missing, keeping the users last loaded")
+		} else {
+			file.logger.Error().Err(statErr).Msg("failed to check the password file")
+		}
+		return
+	}
+	file.lock.RLock()
+	changed := !info.ModTime().Equal(file.modTime) || info.Size() != file.size
+	file.lock.RUnlock()
+	if !changed {
+		return
+	}
+	if reloadErr := file.reload(); reloadErr != nil {
+		file.logger.Error().Err(reloadErr).Msg("failed to reload the password file")
+	}
+}
+
+func (file *passwordFile) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			file.reloadIfChanged()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (file *passwordFile) check(username string, password string) bool {
+	file.lock.RLock()
+	hash, known := file.hashes[username]
+	file.lock.RUnlock()
+	if !known {
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return false
+	}
+	matches, checkErr := checkPasswordHash(hash, password)
+	if checkErr != nil {
+		file.logger.Error().Err(checkErr).Str("username", username).Msg("failed to check password")
+		return false
+	}
+	return matches
+}
+
+// has tells whether the user is in the file
+func (file *passwordFile) has(username string) bool {
+	file.lock.RLock()
+	defer file.lock.RUnlock()
+	_, known := file.hashes[username]
+	return known
+}
+
+// updatePasswordFile sets the hash of the user in the file, removing the user when the hash is
+// empty; the other lines are kept as they are. The file is created if it doesn't exist.
+func updatePasswordFile(fileName string, username string, hash string) error {
+	content, readErr := os.ReadFile(fileName)
+	if readErr != nil && !errors.Is(readErr, fs.ErrNotExist) {
+		return fmt.Errorf("failed to read password file: %w", readErr)
+	}
+
+	var updated bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if lineUser, _, _ := strings.Cut(strings.TrimSpace(line), ":"); lineUser == username {
+			continue
+		}
+		updated.WriteString(line + "\n")
+	}
+	if len(hash) > 0 {
+		updated.WriteString(username + ":" + hash + "\n")
+	}
+
+	if writeErr := writeFile(fileName, updated.Bytes(), passwordFilePermissions); writeErr != nil {
+		return fmt.Errorf("failed to write password file: %w", writeErr)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+)
+
+type passwordFileTestSuite struct {
+	suite.Suite
+	fileName string
+}
+
+func TestPasswordFile(t *testing.T) {
+	suite.Run(t, &passwordFileTestSuite{})
+}
+
+func (t *passwordFileTestSuite) SetupTest() {
+	t.fileName = filepath.Join(t.T().TempDir(), "htpasswd")
+}
+
+// usersCommand runs the users command on the password file, with the password given
+func (t *passwordFileTestSuite) usersCommand(password string, args ...string) error {
+	return runUsersCommand(append(args[:1], append([]string{"-file", t.fileName}, args[1:]...)...), func() (string, error) {
+		return password, nil
+	}, io.Discard)
+}
+
+func (t *passwordFileTestSuite) TestHashSchemes() {
+	for _, scheme := range []string{bcryptScheme, argon2idScheme} {
+		hash, hashErr := hashPassword("secret", scheme)
+		t.Require().NoError(hashErr)
+
+		matches, checkErr := checkPasswordHash(hash, "secret")
+		t.NoError(checkErr)
+		t.True(matches, scheme)
+		matches, checkErr = checkPasswordHash(hash, "wrong")
+		t.NoError(checkErr)
+		t.False(matches, scheme)
+	}
+
+	// htpasswd -B writes bcrypt hashes with the $2y$ prefix
+	hash, hashErr := hashPassword("pass", bcryptScheme)
+	t.Require().NoError(hashErr)
+	matches, checkErr := checkPasswordHash("$2y$"+strings.TrimPrefix(hash, "$2a$"), "pass")
+	t.NoError(checkErr)
+	t.True(matches)
+
+	_, unsupportedErr := hashPassword("secret", "md5")
+	t.Error(unsupportedErr)
+	_, malformedErr := checkPasswordHash("$argon2id$v=19$m=65536", "secret")
+	t.Error(malformedErr)
+}
+
+func (t *passwordFileTestSuite) TestParse() {
+	hashes, problems := parsePasswordFile([]byte("# users\n\njoe:$2y$05$abc\njane:$argon2id$v=19$x\nbob:$apr1$abc\nann:$2x$05$abc\nnohash\n"))
+
+	t.Equal(map[string]string{"joe": "$2y$05$abc"}, hashes)
+	t.Len(problems, 4, "malformed argon2id hashes are rejected on load")
+}
+
+func (t *passwordFileTestSuite) TestUnsafeArgon2idParameters() {
+	hash, hashErr := hashPassword("secret", argon2idScheme)
+	t.Require().NoError(hashErr)
+	withParameters := func(parameters string) string {
+		parts := strings.Split(hash, "$")
+		parts[3] = parameters
+		return strings.Join(parts, "$")
+	}
+	content := "good:" + hash + "\n" +
+		"nothreads:" + withParameters("m=65536,t=3,p=0") + "\n" +
+		"noiterations:" + withParameters("m=65536,t=0,p=4") + "\n" +
+		"hugememory:" + withParameters("m=4294967295,t=3,p=4") + "\n" +
+		"tinymemory:" + withParameters("m=1,t=3,p=4") + "\n"
+
+	hashes, problems := parsePasswordFile([]byte(content))
+	t.Equal(map[string]string{"good": hash}, hashes)
+	t.Len(problems, 4)
+
+	matches, checkErr := checkPasswordHash(withParameters("m=65536,t=3,p=0"), "secret")
+	t.False(matches)
+	t.Error(checkErr, "rejected instead of panicking")
+}
+
+func (t *passwordFileTestSuite) TestUsersCommand() {
+	t.Require().NoError(t.usersCommand("first", "add", "joe"))
+	t.Require().NoError(t.usersCommand("second", "add", "-hash", argon2idScheme, "jane"))
+	t.Error(t.usersCommand("other", "add", "joe"))
+	t.Error(t.usersCommand("other", "passwd", "nobody"))
+	t.Error(t.usersCommand("", "add", "bob"))
+	t.Error(t.usersCommand("other", "add", "bad:name"))
+
+	file, loadErr := loadPasswordFile(t.fileName, getLogger())
+	t.Require().NoError(loadErr)
+	t.True(file.check("joe", "first"))
+	t.True(file.check("jane", "second"))
+	t.False(file.check("jane", "first"))
+	t.False(file.check("nobody", "first"))
+
+	t.Require().NoError(t.usersCommand("changed", "passwd", "joe"))
+	t.Require().NoError(t.usersCommand("", "remove", "jane"))
+	t.Error(t.usersCommand("", "remove", "jane"))
+	t.Require().NoError(file.reload())
+	t.False(file.check("joe", "first"))
+	t.True(file.check("joe", "changed"))
+	t.False(file.check("jane", "second"))
+
+	info, statErr := os.Stat(t.fileName)
+	t.Require().NoError(statErr)
+	t.Equal(os.FileMode(passwordFilePermissions), info.Mode().Perm())
+}
+
+func (t *passwordFileTestSuite) TestReloadIfChanged() {
+	t.Require().NoError(t.usersCommand("first", "add", "joe"))
+	file, loadErr := loadPasswordFile(t.fileName, getLogger())
+	t.Require().NoError(loadErr)
+
+	t.Require().NoError(t.usersCommand("second", "add", "jane"))
+	file.reloadIfChanged()
+	t.True(file.check("jane", "second"))
+
+	t.Require().NoError(os.Remove(t.fileName))
+	file.reloadIfChanged()
+	t.True(file.check("joe", "first"), "the users last loaded remain in effect")
+
+	_, missingErr := loadPasswordFile(t.fileName, getLogger())
+	t.True(errors.Is(missingErr, os.ErrNotExist))
+}
+
+func (t *passwordFileTestSuite) TestBasicAuthentication() {
+	t.Require().NoError(t.usersCommand("secret", "add", "joe"))
+	t.T().Setenv("XCALIAPP_PASSWORDFILE", t.fileName)
+	gin.SetMode(gin.TestMode)
+	s := newTestServer(t.T(), drawingReposConfigs{})
+	engine := s.createEngine()
+
+	status := func(username string, password string) int {
+		request := httptest.NewRequest(http.MethodGet, "/api/drawings", nil)
+		request.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":"+password)))
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+	t.Equal(http.StatusOK, status("joe", "secret"))
+	t.Equal(http.StatusUnauthorized, status("joe", "wrong"))
+
+	t.Require().NoError(t.usersCommand("", "remove", "joe"))
+	t.Require().NoError(os.Chtimes(t.fileName, time.Now(), time.Now().Add(time.Second)))
+	s.passwords.reloadIfChanged()
+	t.Equal(http.StatusUnauthorized, status("joe", "secret"))
+}
+
+func (t *passwordFileTestSuite) TestBasicAuthenticationRequiresPasswordFile() {
+	t.T().Setenv("XCALIAPP_PASSWORDFILE", "")
+	_, serverErr := newServer(drawingReposConfigs{})
+	t.ErrorContains(serverErr, "XCALIAPP_PASSWORDFILE")
+
+	t.T().Setenv("XCALIAPP_PASSWORDFILE", t.fileName)
+	_, serverErr = newServer(drawingReposConfigs{})
+	t.True(errors.Is(serverErr, os.ErrNotExist), "the password file must exist")
+}
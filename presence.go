@@ -0,0 +1,258 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+const (
+	presenceTTL         = 30 * time.Second
+	presenceSweepPeriod = 10 * time.Second
+)
+
+type presenceEntry struct {
+	Username string    `json:"username"`
+	Since    time.Time `json:"since"`
+	LastSeen time.Time `json:"lastSeen"`
+	streams  int       // open event streams of the user, which keep the entry alive
+}
+
+// presenceTracker keeps track of who has which drawing open. Users are present while they
+// keep sending heartbeats or keep an event stream open.
+type presenceTracker struct {
+	lock        sync.Mutex
+	ttl         time.Duration
+	now         func() time.Time
+	drawings    map[string]map[string]*presenceEntry         // drawing key -> username -> entry
+	subscribers map[string]map[chan []presenceEntry]struct{} // drawing key -> subscribers
+}
+
+func newPresenceTracker(ttl time.Duration) *presenceTracker {
+	return &presenceTracker{
+		ttl:         ttl,
+		now:         time.Now,
+		drawings:    map[string]map[string]*presenceEntry{},
+		subscribers: map[string]map[chan []presenceEntry]struct{}{},
+	}
+}
+
+func presenceKey(repoName string, drawingId string) string {
+	return repoName + "/" + drawingId
+}
+
+// listLocked must be called with the lock held
+func (tracker *presenceTracker) listLocked(key string) []presenceEntry {
+	entries := []presenceEntry{}
+	for _, entry := range tracker.drawings[key] {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Username < entries[j].Username })
+	return entries
+}
+
+// notifyLocked must be called with the lock held. Subscribers only ever get the latest list.
+func (tracker *presenceTracker) notifyLocked(key string) {
+	entries := tracker.listLocked(key)
+	for subscriber := range tracker.subscribers[key] {
+		select {
+		case <-subscriber:
+		default:
+		}
+		subscriber <- entries
+	}
+}
+
+func (tracker *presenceTracker) list(key string) []presenceEntry {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	return tracker.listLocked(key)
+}
+
+// touch records a heartbeat of the user; stream tells whether it comes from a newly opened event stream
+func (tracker *presenceTracker) touch(key string, username string, stream bool) []presenceEntry {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	now := tracker.now()
+	entries, hasEntries := tracker.drawings[key]
+	if !hasEntries {
+		entries = map[string]*presenceEntry{}
+		tracker.drawings[key] = entries
+	}
+	entry, present := entries[username]
+	if !present {
+		entry = &presenceEntry{Username: username, Since: now}
+		entries[username] = entry
+	}
+	entry.LastSeen = now
+	if stream {
+		entry.streams++
+	}
+	if !present {
+		tracker.notifyLocked(key)
+	}
+	return tracker.listLocked(key)
+}
+
+// leave removes the user; stream tells whether it comes from an event stream being closed,
+// in which case the user stays present as long as other streams of theirs are open
+func (tracker *presenceTracker) leave(key string, username string, stream bool) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	entry, present := tracker.drawings[key][username]
+	if !present {
+		return
+	}
+	if stream {
+		entry.streams--
+		if entry.streams > 0 {
+			return
+		}
+	}
+	delete(tracker.drawings[key], username)
+	if len(tracker.drawings[key]) == 0 {
+		delete(tracker.drawings, key)
+	}
+	tracker.notifyLocked(key)
+}
+
+// subscribe returns a channel receiving the current list of users and every change to it
+func (tracker *presenceTracker) subscribe(key string) (<-chan []presenceEntry, func()) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	subscriber := make(chan []presenceEntry, 1)
+	subscriber <- tracker.listLocked(key)
+	if _, hasSubscribers := tracker.subscribers[key]; !hasSubscribers {
+		tracker.subscribers[key] = map[chan []presenceEntry]struct{}{}
+	}
+	tracker.subscribers[key][subscriber] = struct{}{}
+
+	return subscriber, func() {
+		tracker.lock.Lock()
+		defer tracker.lock.Unlock()
+		delete(tracker.subscribers[key], subscriber)
+		if len(tracker.subscribers[key]) == 0 {
+			delete(tracker.subscribers, key)
+		}
+	}
+}
+
+// expire removes the users who haven't sent a heartbeat within the TTL and have no open stream
+func (tracker *presenceTracker) expire() {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	deadline := tracker.now().Add(-tracker.ttl)
+	for key, entries := range tracker.drawings {
+		changed := false
+		for username, entry := range entries {
+			if entry.streams == 0 && entry.LastSeen.Before(deadline) {
+				delete(entries, username)
+				changed = true
+			}
+		}
+		if len(entries) == 0 {
+			delete(tracker.drawings, key)
+		}
+		if changed {
+			tracker.notifyLocked(key)
+		}
+	}
+}
+
+// expirePeriodically expires the users no longer present until stop is closed
+func (tracker *presenceTracker) expirePeriodically(period time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			tracker.expire()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (hf *handlerFactory) getPresence() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, hf.presence.list(presenceKey(c.Param("repo"), c.Param("id"))))
+	}
+}
+
+func (hf *handlerFactory) presenceHeartbeat() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		logger := zerolog.Ctx(c.Request.Context())
+
+		user, userExtractErr := getUserFromContext(c)
+		if userExtractErr != nil {
+			logger.Error().Err(userExtractErr).Msg("failed to extract user from context")
+			abortWithError(c, http.StatusInternalServerError, userExtractErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, hf.presence.touch(presenceKey(c.Param("repo"), c.Param("id")), user.Username, false))
+	}
+}
+
+func (hf *handlerFactory) leavePresence() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		logger := zerolog.Ctx(c.Request.Context())
+
+		user, userExtractErr := getUserFromContext(c)
+		if userExtractErr != nil {
+			logger.Error().Err(userExtractErr).Msg("failed to extract user from context")
+			abortWithError(c, http.StatusInternalServerError, userExtractErr)
+			return
+		}
+
+		hf.presence.leave(presenceKey(c.Param("repo"), c.Param("id")), user.Username, false)
+		c.Status(http.StatusOK)
+	}
+}
+
+// presenceEvents streams the list of users having the drawing open as server-sent events.
+// The user of the stream counts as present while the stream is open.
+func (hf *handlerFactory) presenceEvents() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		logger := zerolog.Ctx(c.Request.Context())
+
+		user, userExtractErr := getUserFromContext(c)
+		if userExtractErr != nil {
+			logger.Error().Err(userExtractErr).Msg("failed to extract user from context")
+			abortWithError(c, http.StatusInternalServerError, userExtractErr)
+			return
+		}
+
+		key := presenceKey(c.Param("repo"), c.Param("id"))
+		events, unsubscribe := hf.presence.subscribe(key)
+		defer unsubscribe()
+		hf.presence.touch(key, user.Username, true)
+		defer hf.presence.leave(key, user.Username, true)
+
+		heartbeat := time.NewTicker(hf.presence.ttl / 3)
+		defer heartbeat.Stop()
+
+		c.Header("Cache-Control", "no-cache")
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case entries := <-events:
+				c.SSEvent("presence", entries)
+				return true
+			case <-heartbeat.C:
+				hf.presence.touch(key, user.Username, false)
+				return true
+			case <-c.Request.Context().Done():
+				return false
+			}
+		})
+	}
+}
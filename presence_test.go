@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type presenceTestSuite struct {
+	suite.Suite
+	now     time.Time
+	tracker *presenceTracker
+}
+
+func TestPresence(t *testing.T) {
+	suite.Run(t, &presenceTestSuite{})
+}
+
+func (t *presenceTestSuite) SetupTest() {
+	t.now = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	t.tracker = newPresenceTracker(30 * time.Second)
+	t.tracker.now = func() time.Time { return t.now }
+}
+
+func usernames(entries []presenceEntry) []string {
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Username)
+	}
+	return names
+}
+
+func (t *presenceTestSuite) TestHeartbeatsAndExpiry() {
+	t.tracker.touch("repo/drawing", "joe", false)
+	t.now = t.now.Add(20 * time.Second)
+	t.tracker.touch("repo/drawing", "jane", false)
+	t.now = t.now.Add(20 * time.Second)
+
+	t.tracker.expire()
+
+	t.Equal([]string{"jane"}, usernames(t.tracker.list("repo/drawing")))
+	t.Empty(t.tracker.list("repo/other-drawing"))
+}
+
+func (t *presenceTestSuite) TestStreamsKeepUsersPresent() {
+	t.tracker.touch("repo/drawing", "joe", true)
+	t.tracker.touch("repo/drawing", "joe", true)
+	t.now = t.now.Add(time.Hour)
+	t.tracker.expire()
+	t.Equal([]string{"joe"}, usernames(t.tracker.list("repo/drawing")))
+
+	t.tracker.leave("repo/drawing", "joe", true)
+	t.Equal([]string{"joe"}, usernames(t.tracker.list("repo/drawing")))
+
+	t.tracker.leave("repo/drawing", "joe", true)
+	t.Empty(t.tracker.list("repo/drawing"))
+}
+
+func (t *presenceTestSuite) TestSubscribe() {
+	t.tracker.touch("repo/drawing", "joe", false)
+
+	events, unsubscribe := t.tracker.subscribe("repo/drawing")
+	defer unsubscribe()
+
+	t.Equal([]string{"joe"}, usernames(<-events))
+	t.tracker.touch("repo/drawing", "jane", false)
+	t.Equal([]string{"jane", "joe"}, usernames(<-events))
+	t.tracker.leave("repo/drawing", "joe", false)
+	t.Equal([]string{"jane"}, usernames(<-events))
+}
+
+func (t *presenceTestSuite) TestExpirePeriodicallyStops() {
+	t.tracker.touch("repo/drawing", "joe", false)
+	t.now = t.now.Add(time.Hour)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		t.tracker.expirePeriodically(time.Millisecond, stop)
+		close(stopped)
+	}()
+
+	t.Eventually(func() bool { return len(t.tracker.list("repo/drawing")) == 0 }, time.Second, time.Millisecond)
+	close(stop)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fail("still expiring after stop")
+	}
+}
@@ -0,0 +1,22 @@
+// Package repoerr defines the errors drawing repository implementations return, so that the
+// server can tell the kinds of failures apart and respond with the matching HTTP status.
+//
+// Implementations wrap the errors, e.g. fmt.Errorf("drawing %s: %w", key, repoerr.ErrNotFound),
+// and callers check them with errors.Is. Errors of the underlying storage (e.g. fs.ErrNotExist)
+// are translated by the implementations; they aren't treated as any of these.
+package repoerr
+
+import "errors"
+
+var (
+	// ErrNotFound is returned for missing drawings and versions
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when the operation collides with the current state of the drawing
+	ErrConflict = errors.New("conflict")
+	// ErrInvalidInput is returned for malformed keys, version ids or content
+	ErrInvalidInput = errors.New("invalid input")
+	// ErrForbidden is returned when the backend refuses the operation
+	ErrForbidden = errors.New("forbidden")
+	// ErrUnavailable is returned when the backend can't be reached or fails temporarily
+	ErrUnavailable = errors.New("backend unavailable")
+)
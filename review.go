@@ -0,0 +1,724 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"myxcaliapp/backend/repoerr"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+)
+
+type proposalStatus string
+
+const (
+	proposalOpen   proposalStatus = "open"
+	proposalMerged proposalStatus = "merged"
+	proposalClosed proposalStatus = "closed"
+)
+
+// requiredApprovals is the number of approvals by users other than the author needed for merging
+const requiredApprovals = 1
+
+const proposalsDirName = "xcaliapp-proposals"
+
+var proposalIdPattern = regexp.MustCompile(`^[0-9a-v]{20}$`)
+
+type proposalComment struct {
+	Id        string    `json:"id"`
+	Author    string    `json:"author"`
+	Text      string    `json:"text"`
+	DrawingId string    `json:"drawingId,omitempty"` // the drawing commented on, if any
+	ElementId string    `json:"elementId,omitempty"` // the element commented on, if any
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// proposalApproval approves the source branch as of a commit; later pushes to the branch need
+// approving again
+type proposalApproval struct {
+	User       string    `json:"user"`
+	Commit     string    `json:"commit"`
+	ApprovedAt time.Time `json:"approvedAt"`
+}
+
+// proposal is a reviewable set of drawing changes made on a branch, to be merged into another one
+type proposal struct {
+	Id           string             `json:"id"`
+	Title        string             `json:"title"`
+	Description  string             `json:"description,omitempty"`
+	Author       string             `json:"author"`
+	SourceBranch string             `json:"sourceBranch"`
+	TargetBranch string             `json:"targetBranch"`
+	Status       proposalStatus     `json:"status"`
+	CreatedAt    time.Time          `json:"createdAt"`
+	Comments     []proposalComment  `json:"comments"`
+	Approvals    []proposalApproval `json:"approvals"`
+	MergedBy     string             `json:"mergedBy,omitempty"`
+	MergedAt     time.Time          `json:"mergedAt,omitzero"`
+	MergeCommit  string             `json:"mergeCommit,omitempty"`
+	BaseCommit   string             `json:"baseCommit,omitempty"`   // the merge base, recorded on merging
+	SourceCommit string             `json:"sourceCommit,omitempty"` // the merged commit of the source branch
+}
+
+// approvalsOf counts the approvals of the given commit of the source branch
+func (p *proposal) approvalsOf(commit string) int {
+	count := 0
+	for _, approval := range p.Approvals {
+		if approval.Commit == commit {
+			count++
+		}
+	}
+	return count
+}
+
+// proposalChange is the change of a drawing in a proposal
+type proposalChange struct {
+	DrawingId string       `json:"drawingId"`
+	Status    string       `json:"status"` // "added", "modified" or "deleted"
+	Diff      *drawingDiff `json:"diff"`
+}
+
+// proposalConflict is a file changed differently on both branches; for drawings, the elements
+// changed differently are listed
+type proposalConflict struct {
+	File     string   `json:"file"`
+	Elements []string `json:"elements,omitempty"`
+}
+
+// reviewBoard keeps the proposals of a git-backed repo as JSON files in its git directory, so
+// that they survive restarts without showing up in the working copy
+type reviewBoard struct {
+	branches *gitBranches
+	remote   *gitSyncRepo // keeps the branches in sync with the remote of the repo, if it has one
+	lock     sync.Mutex
+}
+
+func newReviewBoard(branches *gitBranches, remote *gitSyncRepo) *reviewBoard {
+	return &reviewBoard{branches: branches, remote: remote}
+}
+
+func (board *reviewBoard) dir(ctx context.Context) (string, error) {
+	gitDir, gitErr := board.branches.git(ctx, "rev-parse", "--absolute-git-dir")
+	if gitErr != nil {
+		return "", fmt.Errorf("failed to find the git directory: %w", gitErr)
+	}
+	dir := filepath.Join(strings.TrimSpace(gitDir), proposalsDirName)
+	if mkdirErr := os.MkdirAll(dir, fsStoreDirPermissions); mkdirErr != nil {
+		return "", fmt.Errorf("failed to create proposals directory: %w", mkdirErr)
+	}
+	return dir, nil
+}
+
+// load must be called with the lock held
+func (board *reviewBoard) load(ctx context.Context, id string) (*proposal, error) {
+	if !proposalIdPattern.MatchString(id) {
+		return nil, fmt.Errorf("proposal %s: %w", id, repoerr.ErrNotFound)
+	}
+	dir, dirErr := board.dir(ctx)
+	if dirErr != nil {
+		return nil, dirErr
+	}
+	content, readErr := os.ReadFile(filepath.Join(dir, id+".json"))
+	if readErr != nil {
+		if errors.Is(readErr, fs.ErrNotExist) {
+			return nil, fmt.Errorf("proposal %s: %w", id, repoerr.ErrNotFound)
+		}
+		return nil, fmt.Errorf("failed to read proposal %s: %w", id, readErr)
+	}
+	var p proposal
+	if unmarshalErr := json.Unmarshal(content, &p); unmarshalErr != nil {
+		return nil, fmt.Errorf("failed to parse proposal %s: %w", id, unmarshalErr)
+	}
+	return &p, nil
+}
+
+// save must be called with the lock held
+func (board *reviewBoard) save(ctx context.Context, p *proposal) error {
+	dir, dirErr := board.dir(ctx)
+	if dirErr != nil {
+		return dirErr
+	}
+	content, marshalErr := json.MarshalIndent(p, "", "  ")
+	if marshalErr != nil {
+		return fmt.Errorf("failed to marshal proposal %s: %w", p.Id, marshalErr)
+	}
+	if writeErr := writeFile(filepath.Join(dir, p.Id+".json"), content, fsStoreFilePermissions); writeErr != nil {
+		return fmt.Errorf("failed to write proposal %s: %w", p.Id, writeErr)
+	}
+	return nil
+}
+
+func (board *reviewBoard) get(ctx context.Context, id string) (*proposal, error) {
+	board.lock.Lock()
+	defer board.lock.Unlock()
+	return board.load(ctx, id)
+}
+
+// list returns the proposals with the given status, or all of them when it is empty, oldest first
+func (board *reviewBoard) list(ctx context.Context, status proposalStatus) ([]proposal, error) {
+	board.lock.Lock()
+	defer board.lock.Unlock()
+
+	dir, dirErr := board.dir(ctx)
+	if dirErr != nil {
+		return nil, dirErr
+	}
+	entries, readDirErr := os.ReadDir(dir)
+	if readDirErr != nil {
+		return nil, fmt.Errorf("failed to list proposals: %w", readDirErr)
+	}
+	proposals := []proposal{}
+	for _, entry := range entries {
+		id, isProposal := strings.CutSuffix(entry.Name(), ".json")
+		if !isProposal || !proposalIdPattern.MatchString(id) {
+			continue
+		}
+		p, loadErr := board.load(ctx, id)
+		if loadErr != nil {
+			return nil, loadErr
+		}
+		if len(status) == 0 || p.Status == status {
+			proposals = append(proposals, *p)
+		}
+	}
+	sort.Slice(proposals, func(i, j int) bool { return proposals[i].CreatedAt.Before(proposals[j].CreatedAt) })
+	return proposals, nil
+}
+
+// update applies the modification to the stored proposal
+func (board *reviewBoard) update(ctx context.Context, id string, modify func(p *proposal) error) (*proposal, error) {
+	board.lock.Lock()
+	defer board.lock.Unlock()
+
+	p, loadErr := board.load(ctx, id)
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	if modifyErr := modify(p); modifyErr != nil {
+		return nil, modifyErr
+	}
+	if saveErr := board.save(ctx, p); saveErr != nil {
+		return nil, saveErr
+	}
+	return p, nil
+}
+
+// approve records the approval of the current head of the source branch by the user, who
+// mustn't be the author. It replaces an earlier approval by the user.
+func (board *reviewBoard) approve(ctx context.Context, id string, user string) (*proposal, error) {
+	return board.update(ctx, id, func(p *proposal) error {
+		if p.Status != proposalOpen {
+			return fmt.Errorf("proposal %s is %s: %w", p.Id, p.Status, repoerr.ErrConflict)
+		}
+		if p.Author == user {
+			return fmt.Errorf("authors can't approve their own proposals: %w", repoerr.ErrForbidden)
+		}
+		source, resolveErr := board.branches.resolve(ctx, "refs/heads/"+p.SourceBranch)
+		if resolveErr != nil {
+			return resolveErr
+		}
+		approvals := []proposalApproval{}
+		for _, approval := range p.Approvals {
+			if approval.User != user {
+				approvals = append(approvals, approval)
+			}
+		}
+		p.Approvals = append(approvals, proposalApproval{User: user, Commit: source, ApprovedAt: time.Now().UTC()})
+		return nil
+	})
+}
+
+// close closes the proposal without merging it; only its author or an admin may close it
+func (board *reviewBoard) close(ctx context.Context, id string, user string, isAdmin bool) (*proposal, error) {
+	return board.update(ctx, id, func(p *proposal) error {
+		if p.Author != user && !isAdmin {
+			return fmt.Errorf("only the author or an admin may close proposal %s: %w", p.Id, repoerr.ErrForbidden)
+		}
+		if p.Status != proposalOpen {
+			return fmt.Errorf("proposal %s is %s: %w", p.Id, p.Status, repoerr.ErrConflict)
+		}
+		p.Status = proposalClosed
+		return nil
+	})
+}
+
+type createProposalRequest struct {
+	Title        string `json:"title"`
+	Description  string `json:"description"`
+	SourceBranch string `json:"sourceBranch"`
+	TargetBranch string `json:"targetBranch"` // defaults to the current branch
+}
+
+func (board *reviewBoard) create(ctx context.Context, author string, request createProposalRequest) (*proposal, error) {
+	if len(strings.TrimSpace(request.Title)) == 0 {
+		return nil, fmt.Errorf("missing title: %w", repoerr.ErrInvalidInput)
+	}
+	target := request.TargetBranch
+	if len(target) == 0 {
+		current, currentErr := board.branches.current(ctx)
+		if currentErr != nil {
+			return nil, currentErr
+		}
+		target = current
+	}
+	if request.SourceBranch == target {
+		return nil, fmt.Errorf("the source and the target branch are the same: %w", repoerr.ErrInvalidInput)
+	}
+	for _, branch := range []string{request.SourceBranch, target} {
+		if _, resolveErr := board.branches.resolve(ctx, "refs/heads/"+branch); resolveErr != nil {
+			return nil, fmt.Errorf("branch %s: %w", branch, repoerr.ErrNotFound)
+		}
+	}
+
+	p := &proposal{
+		Id:           xid.New().String(),
+		Title:        request.Title,
+		Description:  request.Description,
+		Author:       author,
+		SourceBranch: request.SourceBranch,
+		TargetBranch: target,
+		Status:       proposalOpen,
+		CreatedAt:    time.Now().UTC(),
+		Comments:     []proposalComment{},
+		Approvals:    []proposalApproval{},
+	}
+
+	board.lock.Lock()
+	defer board.lock.Unlock()
+	if saveErr := board.save(ctx, p); saveErr != nil {
+		return nil, saveErr
+	}
+	return p, nil
+}
+
+func (board *reviewBoard) mergeBase(ctx context.Context, a string, b string) (string, error) {
+	output, gitErr := board.branches.git(ctx, "merge-base", a, b)
+	if gitErr != nil {
+		return "", fmt.Errorf("the branches have no common history: %w: %w", repoerr.ErrConflict, gitErr)
+	}
+	return strings.TrimSpace(output), nil
+}
+
+// changedFiles returns the files changed between the commits
+func (board *reviewBoard) changedFiles(ctx context.Context, from string, to string) ([]string, error) {
+	output, gitErr := board.branches.git(ctx, "diff", "--name-only", "--no-renames", from, to)
+	if gitErr != nil {
+		return nil, fmt.Errorf("failed to list changed files: %w", gitErr)
+	}
+	return strings.Fields(output), nil
+}
+
+func (board *reviewBoard) isDrawingFile(file string) bool {
+	dir, name := path.Split(file)
+	return path.Clean(dir) == path.Clean(board.branches.path) && strings.HasSuffix(name, drawingFileExtension)
+}
+
+// fileAt returns the content of the file as of the commit; it is empty when the file doesn't exist there
+func (board *reviewBoard) fileAt(ctx context.Context, commit string, file string) (string, error) {
+	blob, lookupErr := board.branches.blobAt(ctx, commit, file)
+	if lookupErr != nil || len(blob) == 0 {
+		return "", lookupErr
+	}
+	content, gitErr := board.branches.git(ctx, "cat-file", "blob", blob)
+	if gitErr != nil {
+		return "", fmt.Errorf("failed to read %s at %s: %w", file, commit, gitErr)
+	}
+	return content, nil
+}
+
+// changes returns the element-level changes of the drawings made on the source branch of the
+// proposal since it forked off the target branch
+func (board *reviewBoard) changes(ctx context.Context, p *proposal) ([]proposalChange, error) {
+	base, source := p.BaseCommit, p.SourceCommit
+	if p.Status != proposalMerged {
+		var resolveErr error
+		source, resolveErr = board.branches.resolve(ctx, "refs/heads/"+p.SourceBranch)
+		if resolveErr != nil {
+			return nil, resolveErr
+		}
+		target, targetErr := board.branches.resolve(ctx, "refs/heads/"+p.TargetBranch)
+		if targetErr != nil {
+			return nil, targetErr
+		}
+		var mergeBaseErr error
+		base, mergeBaseErr = board.mergeBase(ctx, target, source)
+		if mergeBaseErr != nil {
+			return nil, mergeBaseErr
+		}
+	}
+
+	files, filesErr := board.changedFiles(ctx, base, source)
+	if filesErr != nil {
+		return nil, filesErr
+	}
+	changes := []proposalChange{}
+	for _, file := range files {
+		if !board.isDrawingFile(file) {
+			continue
+		}
+		before, beforeErr := board.fileAt(ctx, base, file)
+		if beforeErr != nil {
+			return nil, beforeErr
+		}
+		after, afterErr := board.fileAt(ctx, source, file)
+		if afterErr != nil {
+			return nil, afterErr
+		}
+		diff, diffErr := diffScenes(before, after)
+		if diffErr != nil {
+			return nil, fmt.Errorf("failed to compare %s: %w", file, diffErr)
+		}
+		change := proposalChange{
+			DrawingId: strings.TrimSuffix(path.Base(file), drawingFileExtension),
+			Status:    "modified",
+			Diff:      diff,
+		}
+		if len(before) == 0 {
+			change.Status = "added"
+		} else if len(after) == 0 {
+			change.Status = "deleted"
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// writeBranch runs the operation committing to the branch, in sync with the remote if there is one
+func (board *reviewBoard) writeBranch(ctx context.Context, branch string, operation func() error) error {
+	if board.remote == nil {
+		return operation()
+	}
+	return board.remote.writeBranch(ctx, branch, operation)
+}
+
+// mergeBranches commits the merge of the source branch of the proposal into its target branch,
+// returning the merge commit, the merge base and the merged commit of the source branch
+func (board *reviewBoard) mergeBranches(ctx context.Context, p *proposal, user string) (string, string, string, []proposalConflict, error) {
+	target, targetErr := board.branches.resolve(ctx, "refs/heads/"+p.TargetBranch)
+	if targetErr != nil {
+		return "", "", "", nil, targetErr
+	}
+	source, sourceErr := board.branches.resolve(ctx, "refs/heads/"+p.SourceBranch)
+	if sourceErr != nil {
+		return "", "", "", nil, sourceErr
+	}
+	if p.approvalsOf(source) < requiredApprovals {
+		return "", "", "", nil, fmt.Errorf("proposal %s needs %d approval(s) of the current state of %s: %w", p.Id, requiredApprovals, p.SourceBranch, repoerr.ErrConflict)
+	}
+	base, mergeBaseErr := board.mergeBase(ctx, target, source)
+	if mergeBaseErr != nil {
+		return "", "", "", nil, mergeBaseErr
+	}
+	if base == source {
+		return "", "", "", nil, fmt.Errorf("%s has no changes to merge into %s: %w", p.SourceBranch, p.TargetBranch, repoerr.ErrConflict)
+	}
+
+	files, filesErr := board.changedFiles(ctx, base, source)
+	if filesErr != nil {
+		return "", "", "", nil, filesErr
+	}
+	changes := []treeChange{}
+	conflicts := []proposalConflict{}
+	for _, file := range files {
+		blobs := [3]string{}
+		for i, commit := range []string{base, target, source} {
+			blob, lookupErr := board.branches.blobAt(ctx, commit, file)
+			if lookupErr != nil {
+				return "", "", "", nil, lookupErr
+			}
+			blobs[i] = blob
+		}
+		baseBlob, targetBlob, sourceBlob := blobs[0], blobs[1], blobs[2]
+		switch {
+		case sourceBlob == targetBlob:
+			continue
+		case targetBlob == baseBlob:
+			changes = append(changes, treeChange{file: file, blob: sourceBlob})
+			continue
+		case !board.isDrawingFile(file) || len(targetBlob) == 0 || len(sourceBlob) == 0:
+			conflicts = append(conflicts, proposalConflict{File: file})
+			continue
+		}
+
+		contents := [3]string{}
+		for i, commit := range []string{base, target, source} {
+			content, readErr := board.fileAt(ctx, commit, file)
+			if readErr != nil {
+				return "", "", "", nil, readErr
+			}
+			contents[i] = content
+		}
+		merged, elementConflicts, mergeErr := mergeScenes(contents[0], contents[1], contents[2])
+		if mergeErr != nil || len(elementConflicts) > 0 {
+			conflicts = append(conflicts, proposalConflict{File: file, Elements: elementConflicts})
+			continue
+		}
+		blob, writeErr := board.branches.writeBlob(ctx, merged)
+		if writeErr != nil {
+			return "", "", "", nil, writeErr
+		}
+		changes = append(changes, treeChange{file: file, blob: blob})
+	}
+	if len(conflicts) > 0 {
+		return "", "", "", conflicts, nil
+	}
+
+	message, author := commitDetails(ctx, user, fmt.Sprintf("Merge %s into %s: %s", p.SourceBranch, p.TargetBranch, p.Title))
+	commit, commitErr := board.branches.commitTree(ctx, []string{target, source}, changes, message, author)
+	if commitErr != nil {
+		return "", "", "", nil, commitErr
+	}
+	board.branches.lock.Lock()
+	advanceErr := board.branches.advanceBranch(ctx, p.TargetBranch, target, commit)
+	board.branches.lock.Unlock()
+	if advanceErr != nil {
+		return "", "", "", nil, advanceErr
+	}
+	return commit, base, source, nil, nil
+}
+
+// merge merges the source branch of the proposal into its target branch. Drawings changed on
+// both branches are merged element by element; the conflicts are returned when that fails.
+func (board *reviewBoard) merge(ctx context.Context, id string, user string) (*proposal, []proposalConflict, error) {
+	board.lock.Lock()
+	defer board.lock.Unlock()
+
+	p, loadErr := board.load(ctx, id)
+	if loadErr != nil {
+		return nil, nil, loadErr
+	}
+	if p.Status != proposalOpen {
+		return nil, nil, fmt.Errorf("proposal %s is %s: %w", id, p.Status, repoerr.ErrConflict)
+	}
+
+	var mergeCommit, base, source string
+	var conflicts []proposalConflict
+	writeErr := board.writeBranch(ctx, p.TargetBranch, func() error {
+		var mergeErr error
+		mergeCommit, base, source, conflicts, mergeErr = board.mergeBranches(ctx, p, user)
+		return mergeErr
+	})
+	if len(conflicts) > 0 {
+		return nil, conflicts, nil
+	}
+	// Once the merge commit is on the target branch, the proposal is merged whatever happens
+	// after; the state of the push is reported by the sync status of the repo.
+	if len(mergeCommit) == 0 {
+		return nil, nil, writeErr
+	}
+
+	p.Status = proposalMerged
+	p.MergedBy = user
+	p.MergedAt = time.Now().UTC()
+	p.MergeCommit = mergeCommit
+	p.BaseCommit = base
+	p.SourceCommit = source
+	if saveErr := board.save(ctx, p); saveErr != nil {
+		return nil, nil, saveErr
+	}
+	return p, nil, nil
+}
+
+// mergeProposalResponse is the merged proposal with the sync status of the repo, telling whether
+// the merge has been pushed
+type mergeProposalResponse struct {
+	*proposal
+	Sync *gitSyncStatus `json:"sync,omitempty"`
+}
+
+// proposalConflictResponse is sent when a proposal can't be merged because of conflicting changes
+type proposalConflictResponse struct {
+	errorResponse
+	Conflicts []proposalConflict `json:"conflicts"`
+}
+
+type addCommentRequest struct {
+	Text      string `json:"text"`
+	DrawingId string `json:"drawingId"`
+	ElementId string `json:"elementId"`
+}
+
+func (hf *handlerFactory) getReviewBoard(c *gin.Context, logger zerolog.Logger) (*reviewBoard, bool) {
+	if _, found := hf.getRepoBranches(c, logger); !found {
+		return nil, false
+	}
+	return hf.reviews[drawingRepoName(c.Param("repo"))], true
+}
+
+// proposalHandler resolves the user and the review board of the repo before calling the handler
+func (hf *handlerFactory) proposalHandler(handle func(c *gin.Context, logger zerolog.Logger, board *reviewBoard, user *User)) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		logger := zerolog.Ctx(c.Request.Context()).With().Str("repoName", c.Param("repo")).Str("proposalId", c.Param("proposalId")).Logger()
+
+		user, userExtractErr := getUserFromContext(c)
+		if userExtractErr != nil {
+			logger.Error().Err(userExtractErr).Msg("failed to extract user from context")
+			abortWithError(c, http.StatusInternalServerError, userExtractErr)
+			return
+		}
+		board, found := hf.getReviewBoard(c, logger)
+		if !found {
+			return
+		}
+		handle(c, logger, board, user)
+	}
+}
+
+func (hf *handlerFactory) listProposals() func(c *gin.Context) {
+	return hf.proposalHandler(func(c *gin.Context, logger zerolog.Logger, board *reviewBoard, user *User) {
+		proposals, listErr := board.list(c, proposalStatus(c.Query("status")))
+		if listErr != nil {
+			logger.Error().Err(listErr).Msg("failed to list proposals")
+			abortWithRepoError(c, listErr)
+			return
+		}
+		c.JSON(http.StatusOK, proposals)
+	})
+}
+
+func (hf *handlerFactory) createProposal() func(c *gin.Context) {
+	return hf.proposalHandler(func(c *gin.Context, logger zerolog.Logger, board *reviewBoard, user *User) {
+		var requestData createProposalRequest
+		if bindErr := c.ShouldBindJSON(&requestData); bindErr != nil {
+			logger.Debug().Err(bindErr).Msg("failed to unmarshal request body")
+			abortWithError(c, http.StatusBadRequest, bindErr)
+			return
+		}
+		p, createErr := board.create(c, user.Username, requestData)
+		if createErr != nil {
+			logger.Info().Err(createErr).Msg("failed to create proposal")
+			abortWithRepoError(c, createErr)
+			return
+		}
+		c.JSON(http.StatusCreated, p)
+	})
+}
+
+func (hf *handlerFactory) getProposal() func(c *gin.Context) {
+	return hf.proposalHandler(func(c *gin.Context, logger zerolog.Logger, board *reviewBoard, user *User) {
+		p, getErr := board.get(c, c.Param("proposalId"))
+		if getErr != nil {
+			logger.Info().Err(getErr).Msg("failed to get proposal")
+			abortWithRepoError(c, getErr)
+			return
+		}
+		c.JSON(http.StatusOK, p)
+	})
+}
+
+func (hf *handlerFactory) getProposalChanges() func(c *gin.Context) {
+	return hf.proposalHandler(func(c *gin.Context, logger zerolog.Logger, board *reviewBoard, user *User) {
+		p, getErr := board.get(c, c.Param("proposalId"))
+		if getErr != nil {
+			logger.Info().Err(getErr).Msg("failed to get proposal")
+			abortWithRepoError(c, getErr)
+			return
+		}
+		changes, changesErr := board.changes(c, p)
+		if changesErr != nil {
+			logger.Error().Err(changesErr).Msg("failed to compute the changes of the proposal")
+			abortWithRepoError(c, changesErr)
+			return
+		}
+		c.JSON(http.StatusOK, changes)
+	})
+}
+
+func (hf *handlerFactory) commentProposal() func(c *gin.Context) {
+	return hf.proposalHandler(func(c *gin.Context, logger zerolog.Logger, board *reviewBoard, user *User) {
+		var requestData addCommentRequest
+		if bindErr := c.ShouldBindJSON(&requestData); bindErr != nil {
+			logger.Debug().Err(bindErr).Msg("failed to unmarshal request body")
+			abortWithError(c, http.StatusBadRequest, bindErr)
+			return
+		}
+		if len(strings.TrimSpace(requestData.Text)) == 0 {
+			abortWithError(c, http.StatusBadRequest, errors.New("missing comment text"))
+			return
+		}
+		p, updateErr := board.update(c, c.Param("proposalId"), func(p *proposal) error {
+			p.Comments = append(p.Comments, proposalComment{
+				Id:        xid.New().String(),
+				Author:    user.Username,
+				Text:      requestData.Text,
+				DrawingId: requestData.DrawingId,
+				ElementId: requestData.ElementId,
+				CreatedAt: time.Now().UTC(),
+			})
+			return nil
+		})
+		if updateErr != nil {
+			logger.Info().Err(updateErr).Msg("failed to comment on proposal")
+			abortWithRepoError(c, updateErr)
+			return
+		}
+		c.JSON(http.StatusOK, p)
+	})
+}
+
+func (hf *handlerFactory) approveProposal() func(c *gin.Context) {
+	return hf.proposalHandler(func(c *gin.Context, logger zerolog.Logger, board *reviewBoard, user *User) {
+		p, updateErr := board.approve(c, c.Param("proposalId"), user.Username)
+		if updateErr != nil {
+			logger.Info().Err(updateErr).Msg("failed to approve proposal")
+			abortWithRepoError(c, updateErr)
+			return
+		}
+		c.JSON(http.StatusOK, p)
+	})
+}
+
+func (hf *handlerFactory) closeProposal() func(c *gin.Context) {
+	return hf.proposalHandler(func(c *gin.Context, logger zerolog.Logger, board *reviewBoard, user *User) {
+		isAdmin := hf.roleOf(c, user.Username, drawingRepoName(c.Param("repo"))) >= adminRole
+		p, updateErr := board.close(c, c.Param("proposalId"), user.Username, isAdmin)
+		if updateErr != nil {
+			logger.Info().Err(updateErr).Msg("failed to close proposal")
+			abortWithRepoError(c, updateErr)
+			return
+		}
+		c.JSON(http.StatusOK, p)
+	})
+}
+
+func (hf *handlerFactory) mergeProposal() func(c *gin.Context) {
+	return hf.proposalHandler(func(c *gin.Context, logger zerolog.Logger, board *reviewBoard, user *User) {
+		p, conflicts, mergeErr := board.merge(hf.commitContext(c, user.Username, ""), c.Param("proposalId"), user.Username)
+		if mergeErr != nil {
+			logger.Info().Err(mergeErr).Msg("failed to merge proposal")
+			abortWithRepoError(c, mergeErr)
+			return
+		}
+		if len(conflicts) > 0 {
+			logger.Info().Interface("conflicts", conflicts).Msg("conflicting changes")
+			c.AbortWithStatusJSON(http.StatusConflict, proposalConflictResponse{
+				errorResponse: errorResponse{
+					Status:  http.StatusConflict,
+					Error:   http.StatusText(http.StatusConflict),
+					Message: "the proposal conflicts with changes made on the target branch",
+				},
+				Conflicts: conflicts,
+			})
+			return
+		}
+		response := mergeProposalResponse{proposal: p}
+		if board.remote != nil {
+			status := board.remote.syncStatus()
+			response.Sync = &status
+		}
+		c.JSON(http.StatusOK, response)
+	})
+}
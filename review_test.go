@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"myxcaliapp/backend/repoerr"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type reviewTestSuite struct {
+	suite.Suite
+	workDir  string
+	branches *gitBranches
+	board    *reviewBoard
+}
+
+func TestReview(t *testing.T) {
+	setGitTestEnvironment(t)
+	suite.Run(t, &reviewTestSuite{})
+}
+
+func (t *reviewTestSuite) SetupTest() {
+	t.workDir = newTestWorkingCopy(t.T())
+	t.branches = newGitBranches(t.workDir, "diagrams")
+	t.board = newReviewBoard(t.branches, nil)
+}
+
+// scene returns a scene with the elements "a" and "b" at the given revisions
+func scene(aVersion int, bVersion int) string {
+	return fmt.Sprintf(`{"type":"excalidraw","elements":[{"id":"a","type":"rectangle","x":%d,"version":%d,"versionNonce":%d},{"id":"b","type":"rectangle","x":%d,"version":%d,"versionNonce":%d}]}`,
+		aVersion, aVersion, aVersion, bVersion, bVersion, bVersion)
+}
+
+func (t *reviewTestSuite) put(branch string, content string) {
+	t.Require().NoError(t.branches.at(branch).PutDrawing(t.T().Context(), "drawing", strings.NewReader(content), "someone"))
+}
+
+func (t *reviewTestSuite) propose() *proposal {
+	p, createErr := t.board.create(t.T().Context(), "joe", createProposalRequest{Title: "Rework", SourceBranch: "feature"})
+	t.Require().NoError(createErr)
+	t.Equal("main", p.TargetBranch)
+	return p
+}
+
+func (t *reviewTestSuite) TestReviewAndMerge() {
+	ctx := t.T().Context()
+	t.put("main", scene(1, 1))
+	t.Require().NoError(t.branches.create(ctx, "feature", ""))
+	t.put("feature", scene(2, 1))
+	t.put("main", scene(1, 3))
+
+	p := t.propose()
+
+	changes, changesErr := t.board.changes(ctx, p)
+	t.Require().NoError(changesErr)
+	t.Require().Len(changes, 1)
+	t.Equal("drawing", changes[0].DrawingId)
+	t.Equal("modified", changes[0].Status)
+	t.Len(changes[0].Diff.Moved, 1)
+
+	_, _, unapprovedErr := t.board.merge(ctx, p.Id, "joe")
+	t.ErrorIs(unapprovedErr, repoerr.ErrConflict)
+	_, selfApproveErr := t.board.approve(ctx, p.Id, "joe")
+	t.ErrorIs(selfApproveErr, repoerr.ErrForbidden)
+	_, approveErr := t.board.approve(ctx, p.Id, "jane")
+	t.Require().NoError(approveErr)
+
+	merged, conflicts, mergeErr := t.board.merge(ctx, p.Id, "jane")
+	t.Require().NoError(mergeErr)
+	t.Empty(conflicts)
+	t.Equal(proposalMerged, merged.Status)
+
+	content, readErr := os.ReadFile(filepath.Join(t.workDir, "diagrams", "drawing"+drawingFileExtension))
+	t.Require().NoError(readErr)
+	elements, parseErr := parseSceneElements(string(content))
+	t.Require().NoError(parseErr)
+	t.Equal(float64(2), elements["a"]["version"])
+	t.Equal(float64(3), elements["b"]["version"])
+
+	changesAfterMerge, changesAfterMergeErr := t.board.changes(ctx, merged)
+	t.Require().NoError(changesAfterMergeErr)
+	t.Len(changesAfterMerge, 1)
+
+	proposals, listErr := t.board.list(ctx, proposalMerged)
+	t.Require().NoError(listErr)
+	t.Len(proposals, 1)
+}
+
+func (t *reviewTestSuite) TestConflictingChanges() {
+	ctx := t.T().Context()
+	t.put("main", scene(1, 1))
+	t.Require().NoError(t.branches.create(ctx, "feature", ""))
+	t.put("feature", scene(2, 1))
+	t.put("main", scene(3, 1))
+
+	p := t.propose()
+	_, approveErr := t.board.approve(ctx, p.Id, "jane")
+	t.Require().NoError(approveErr)
+
+	_, conflicts, mergeErr := t.board.merge(ctx, p.Id, "jane")
+
+	t.Require().NoError(mergeErr)
+	t.Equal([]proposalConflict{{File: "diagrams/drawing" + drawingFileExtension, Elements: []string{"a"}}}, conflicts)
+	stillOpen, getErr := t.board.get(ctx, p.Id)
+	t.Require().NoError(getErr)
+	t.Equal(proposalOpen, stillOpen.Status)
+}
+
+func (t *reviewTestSuite) TestApprovalOfOutdatedChanges() {
+	ctx := t.T().Context()
+	t.put("main", scene(1, 1))
+	t.Require().NoError(t.branches.create(ctx, "feature", ""))
+	t.put("feature", scene(2, 1))
+
+	p := t.propose()
+	_, approveErr := t.board.approve(ctx, p.Id, "jane")
+	t.Require().NoError(approveErr)
+	t.put("feature", scene(2, 4))
+
+	_, _, mergeErr := t.board.merge(ctx, p.Id, "joe")
+	t.ErrorIs(mergeErr, repoerr.ErrConflict, "the approval predates the latest change")
+
+	reapproved, reapproveErr := t.board.approve(ctx, p.Id, "jane")
+	t.Require().NoError(reapproveErr)
+	t.Len(reapproved.Approvals, 1)
+	merged, _, mergeErr := t.board.merge(ctx, p.Id, "joe")
+	t.Require().NoError(mergeErr)
+	t.Equal(proposalMerged, merged.Status)
+}
+
+func (t *reviewTestSuite) TestClose() {
+	ctx := t.T().Context()
+	t.put("main", scene(1, 1))
+	t.Require().NoError(t.branches.create(ctx, "feature", ""))
+	t.put("feature", scene(2, 1))
+
+	p := t.propose()
+	_, otherErr := t.board.close(ctx, p.Id, "jane", false)
+	t.ErrorIs(otherErr, repoerr.ErrForbidden)
+	closed, closeErr := t.board.close(ctx, p.Id, "joe", false)
+	t.Require().NoError(closeErr)
+	t.Equal(proposalClosed, closed.Status)
+
+	other := t.propose()
+	_, adminCloseErr := t.board.close(ctx, other.Id, "jane", true)
+	t.NoError(adminCloseErr)
+}
@@ -5,15 +5,19 @@ import (
 	"crypto/rand"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"myxcaliapp/backend/repoerr"
 	"net"
 	"net/http"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 	"vcblobstore"
 
 	"github.com/gin-contrib/sessions"
-	"github.com/gin-contrib/sessions/memstore"
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog"
 )
@@ -21,6 +25,7 @@ import (
 type drawingId = string
 type drawingTitle = string
 
+// drawingRepo implementations are expected to pass the conformance suite in the drawingrepotest package
 type drawingRepo interface {
 	PutDrawing(ctx context.Context, key string, contentReader io.Reader, modifiedBy string) error
 	CopyDrawing(ctx context.Context, sourceId string, destinationId string, modifiedBy string) error
@@ -61,20 +66,33 @@ type drawingRepoContent struct {
 type drawingLists map[drawingRepoName]drawingRepoContent
 
 type server struct {
-	ctx    context.Context
-	config options
-	repos  drawingRepos
+	ctx         context.Context
+	cancel      context.CancelFunc
+	background  sync.WaitGroup // the goroutines running until the context is canceled
+	config      options
+	repos       drawingRepos
+	repoConfigs drawingReposConfigs
+	branches    map[drawingRepoName]*gitBranches
+	passwords   *passwordFile
+	tokens      *apiTokenStore
+	sessions    sessions.Store
 }
 
 type putDrawingRequest struct {
-	Content string `json:"content"`
+	Content     string `json:"content"`
+	BaseVersion string `json:"baseVersion,omitempty"` // the version the client's changes are based on
+	Message     string `json:"message,omitempty"`     // the commit message for version-controlled repos
 }
 
-func (s *server) start() {
-	h := handlerFactory{
-		s.repos,
-	}
+type transferDrawingRequest struct {
+	TargetRepo string `json:"targetRepo"` // defaults to the source repo
+	TargetId   string `json:"targetId"`   // a new id is generated when empty
+}
 
+const shutdownTimeout = 10 * time.Second
+
+// start serves the requests until the context is canceled, then shuts the server down
+func (s *server) start(ctx context.Context) {
 	port := s.config.port
 
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
@@ -86,30 +104,169 @@ func (s *server) start() {
 		panic(fmt.Sprintf("Error while starting to listen at %s: %v", portSpec, err))
 	}
 
+	logger := getLogger()
+	httpServer := &http.Server{Handler: s.createEngine()}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if shutdownErr := httpServer.Shutdown(shutdownCtx); shutdownErr != nil {
+			logger.Error().Err(shutdownErr).Msg("failed to shut down the HTTP server")
+		}
+	}()
+	if serveErr := httpServer.Serve(listener); serveErr != nil && !errors.Is(serveErr, http.ErrServerClosed) {
+		logger.Error().Err(serveErr).Msg("failed to serve")
+	}
+	if closeErr := s.Close(); closeErr != nil {
+		logger.Error().Err(closeErr).Msg("failed to close the server")
+	}
+}
+
+// Close stops the background work of the server, pushes the pending commits and closes the
+// session store
+func (s *server) Close() error {
+	s.cancel()
+	s.background.Wait()
+
+	var errs []error
+	for _, repo := range s.repos {
+		if syncRepo, isSynced := repo.(*gitSyncRepo); isSynced {
+			errs = append(errs, syncRepo.close(context.Background()))
+		}
+	}
+	if serverSide, isServerSide := s.sessions.(*serverSideSessionStore); isServerSide {
+		errs = append(errs, serverSide.close())
+	}
+	return errors.Join(errs...)
+}
+
+func (s *server) createEngine() *gin.Engine {
+	locks := newDrawingLocks()
+	changes := newChangeFeed()
+	presence := newPresenceTracker(presenceTTL)
+	s.background.Go(func() { presence.expirePeriodically(presenceSweepPeriod, s.ctx.Done()) })
+	editLocks := newEditLocks(editLockTTL)
+	s.background.Go(func() { editLocks.expirePeriodically(editLockSweepPeriod, s.ctx.Done()) })
+	collab := newCollabHub(locks, editLocks, changes, s.config.users)
+	branches := s.branches
+	reviews := map[drawingRepoName]*reviewBoard{}
+	for name, repoBranches := range branches {
+		repo, _ := s.repos.getRepo(name)
+		remote, _ := repo.(*gitSyncRepo)
+		reviews[name] = newReviewBoard(repoBranches, remote)
+	}
+	h := handlerFactory{
+		repos:     s.repos,
+		locks:     locks,
+		collab:    collab,
+		changes:   changes,
+		presence:  presence,
+		editLocks: editLocks,
+		branches:  branches,
+		reviews:   reviews,
+		access:    newAccessControl(s.config.access, s.config.admins),
+		users:     s.config.users,
+		tokens:    s.tokens,
+	}
+
+	s.watchRepos(changes, collab)
+
 	rootEngine := gin.Default()
 	rootEngine.Use(RequestLogger)
-	sessionStore := memstore.NewStore([]byte("secret"))
-	rootEngine.Use(sessions.Sessions("mysession", sessionStore))
+	if serverSide, isServerSide := s.sessions.(*serverSideSessionStore); isServerSide {
+		s.background.Go(func() { serverSide.purgeExpiredPeriodically(sessionPurgePeriod, s.ctx.Done(), getLogger()) })
+	}
+	rootEngine.Use(sessions.Sessions(sessionCookieName, s.sessions))
 	rootEngine.NoRoute(gin.WrapH(AssetHandler("/", "webclient_dist", getLogger())))
 	gob.Register(User{})
-	rootEngine.Use(checkBasicAuthentication(basicConfig{passwordCreds: s.config.passwordCreds}))
+	gob.Register(oidcLoginState{})
+	authentication := authenticationConfig{tokens: s.tokens}
+	if s.passwords != nil {
+		authentication.basic = s.passwords
+		s.background.Go(func() { s.passwords.watch(defaultPasswordFileReloadInterval, s.ctx.Done()) })
+	}
+	if s.config.oidc.enabled() {
+		authentication.oidc = newOIDCAuthenticator(s.config.oidc)
+		rootEngine.GET(oidcLoginPath, authentication.oidc.login())
+		rootEngine.GET(oidcCallbackPath, authentication.oidc.callback())
+	}
+	rootEngine.POST(oidcLogoutPath, logout)
+	rootEngine.Use(checkAuthentication(authentication))
 
 	rootEngine.GET("/drawings", gin.WrapH(AssetHandler("/", "webclient_dist", getLogger())))
 
 	api := rootEngine.Group("/api")
+	api.GET("/tokens", h.listAPITokens())
+	api.POST("/tokens", h.createAPIToken())
+	api.DELETE("/tokens/:tokenId", h.revokeAPIToken())
 	api.GET("/drawingRepositories", h.getDrawingRepositories())
+	api.GET("/drawingRepositories/:repo/sync", h.requireRole(readerRole), h.getRepoSyncStatus())
+	api.POST("/drawingRepositories/:repo/sync", h.requireRole(editorRole), h.pushRepo())
+	api.GET("/drawingRepositories/:repo/branches", h.requireRole(readerRole), h.listBranches())
+	api.POST("/drawingRepositories/:repo/branches", h.requireRole(editorRole), h.createBranch())
+	api.GET("/drawingRepositories/:repo/drawings", h.requireRole(readerRole), h.listDrawingsAtRef())
+	api.GET("/drawingRepositories/:repo/proposals", h.requireRole(readerRole), h.listProposals())
+	api.POST("/drawingRepositories/:repo/proposals", h.requireRole(editorRole), h.createProposal())
+	api.GET("/drawingRepositories/:repo/proposals/:proposalId", h.requireRole(readerRole), h.getProposal())
+	api.GET("/drawingRepositories/:repo/proposals/:proposalId/changes", h.requireRole(readerRole), h.getProposalChanges())
+	api.POST("/drawingRepositories/:repo/proposals/:proposalId/comments", h.requireRole(editorRole), h.commentProposal())
+	api.POST("/drawingRepositories/:repo/proposals/:proposalId/approve", h.requireRole(editorRole), h.approveProposal())
+	api.POST("/drawingRepositories/:repo/proposals/:proposalId/close", h.requireRole(editorRole), h.closeProposal())
+	api.POST("/drawingRepositories/:repo/proposals/:proposalId/merge", h.requireRole(editorRole), h.mergeProposal())
 	api.GET("/drawings", h.getDrawingListsHandler())
-	api.POST("/drawing/:repo", h.createNewDrawing())
-	api.PUT("/drawing/:repo/:id", h.updateDrawing())
-	api.GET("/drawing/:repo/:id", h.getDrawingContent())
-	api.DELETE("/drawing/:repo/:id", h.deleteDrawing())
+	api.GET("/drawings/events", h.drawingChangeEvents())
+	api.POST("/drawing/:repo", h.requireRole(editorRole), h.createNewDrawing())
+	api.PUT("/drawing/:repo/:id", h.requireRole(editorRole), h.updateDrawing())
+	api.GET("/drawing/:repo/:id", h.requireRole(readerRole), h.getDrawingContent())
+	api.DELETE("/drawing/:repo/:id", h.requireRole(editorRole), h.deleteDrawing())
+	api.GET("/drawing/:repo/:id/versions", h.requireRole(readerRole), h.listDrawingVersions())
+	api.GET("/drawing/:repo/:id/versions/:versionId", h.requireRole(readerRole), h.getDrawingVersion())
+	api.POST("/drawing/:repo/:id/versions/:versionId/restore", h.requireRole(editorRole), h.restoreDrawingVersion())
+	api.GET("/drawing/:repo/:id/diff", h.requireRole(readerRole), h.diffDrawingVersions())
+	api.POST("/drawing/:repo/:id/copy", h.requireRole(readerRole), h.copyDrawing())
+	api.POST("/drawing/:repo/:id/move", h.requireRole(editorRole), h.moveDrawing())
+	api.GET("/drawing/:repo/:id/live", h.requireRole(editorRole), h.liveDrawing())
+	api.GET("/drawing/:repo/:id/presence", h.requireRole(readerRole), h.getPresence())
+	api.POST("/drawing/:repo/:id/presence", h.requireRole(readerRole), h.presenceHeartbeat())
+	api.DELETE("/drawing/:repo/:id/presence", h.requireRole(readerRole), h.leavePresence())
+	api.GET("/drawing/:repo/:id/presence/events", h.requireRole(readerRole), h.presenceEvents())
+	api.GET("/drawing/:repo/:id/lock", h.requireRole(readerRole), h.getEditLock())
+	api.PUT("/drawing/:repo/:id/lock", h.requireRole(editorRole), h.acquireEditLock())
+	api.DELETE("/drawing/:repo/:id/lock", h.requireRole(editorRole), h.releaseEditLock())
+
+	return rootEngine
+}
 
-	http.Serve(listener, rootEngine)
+// watchRepos starts watching the repos kept in working copies for changes made outside the server
+func (s *server) watchRepos(changes *changeFeed, collab *collabHub) {
+	for name, repoConfig := range s.repoConfigs {
+		interval, _ := repoConfig.getWatchInterval()
+		if interval == 0 {
+			continue
+		}
+		dir := filepath.Join(repoConfig.root, repoConfig.path)
+		watcher := newDrawingDirWatcher(name, dir, interval, changes, collab, getLogger())
+		s.background.Go(func() { watcher.watch(s.ctx.Done()) })
+	}
 }
 
+// gitBranchesOf returns the branch access of the repos kept in git working copies
+func gitBranchesOf(repoConfigs drawingReposConfigs) map[drawingRepoName]*gitBranches {
+	branches := map[drawingRepoName]*gitBranches{}
+	for name, repoConfig := range repoConfigs {
+		if repoConfig.storeType == LOCAL_GIT {
+			branches[drawingRepoName(name)] = newGitBranches(repoConfig.root, repoConfig.path)
+		}
+	}
+	return branches
+}
+
+// getUserFromContext returns the user authenticated with an API token or the user of the session
 func getUserFromContext(c *gin.Context) (*User, error) {
-	session := sessions.Default(c)
-	untypedUser := session.Get(userKey)
+	untypedUser, viaToken := c.Get(userKey)
+	if !viaToken {
+		untypedUser = sessions.Default(c).Get(userKey)
+	}
 
 	if untypedUser == nil {
 		return nil, fmt.Errorf("no user in session")
@@ -124,7 +281,17 @@ func getUserFromContext(c *gin.Context) (*User, error) {
 }
 
 type handlerFactory struct {
-	repos drawingRepos
+	repos     drawingRepos
+	locks     *drawingLocks
+	collab    *collabHub
+	changes   *changeFeed
+	presence  *presenceTracker
+	editLocks *editLocks
+	branches  map[drawingRepoName]*gitBranches
+	reviews   map[drawingRepoName]*reviewBoard
+	access    *accessControl
+	users     userDirectory
+	tokens    *apiTokenStore
 }
 
 func addListFromStoreToFullList(repoRef drawingRepoRef, list map[drawingId]drawingTitle, fullList drawingLists) {
@@ -138,27 +305,50 @@ func addListFromStoreToFullList(repoRef drawingRepoRef, list map[drawingId]drawi
 	fullList[repoRef.Name] = content
 }
 
+// getDrawingRepositories lists the repos the user may read
 func (hf *handlerFactory) getDrawingRepositories() func(c *gin.Context) {
 	return func(c *gin.Context) {
+		logger := zerolog.Ctx(c.Request.Context())
+
+		user, userExtractErr := getUserFromContext(c)
+		if userExtractErr != nil {
+			logger.Error().Err(userExtractErr).Msg("failed to extract user from context")
+			abortWithError(c, http.StatusInternalServerError, userExtractErr)
+			return
+		}
+
 		repoList := []drawingRepoRef{}
 		for key := range hf.repos {
-			repoList = append(repoList, key)
+			if hf.canRead(c, user.Username, key.Name) {
+				repoList = append(repoList, key)
+			}
 		}
 		c.JSON(http.StatusOK, repoList)
 	}
 }
 
+// getDrawingListsHandler lists the drawings in the repos the user may read
 func (hf *handlerFactory) getDrawingListsHandler() func(c *gin.Context) {
 	return func(c *gin.Context) {
 		logger := zerolog.Ctx(c.Request.Context())
 
+		user, userExtractErr := getUserFromContext(c)
+		if userExtractErr != nil {
+			logger.Error().Err(userExtractErr).Msg("failed to extract user from context")
+			abortWithError(c, http.StatusInternalServerError, userExtractErr)
+			return
+		}
+
 		fullList := drawingLists{}
 
 		for repoRef, store := range hf.repos {
+			if !hf.canRead(c, user.Username, repoRef.Name) {
+				continue
+			}
 			list, listErr := store.ListDrawings(c)
 			if listErr != nil {
 				logger.Error().Err(listErr).Msg("failed to list drawing titles")
-				c.AbortWithError(http.StatusInternalServerError, listErr)
+				abortWithRepoError(c, listErr)
 				return
 			}
 			addListFromStoreToFullList(repoRef, list, fullList)
@@ -171,58 +361,208 @@ func (hf *handlerFactory) getDrawingListsHandler() func(c *gin.Context) {
 func (hf *handlerFactory) createNewDrawing() func(c *gin.Context) {
 	return func(c *gin.Context) {
 		id := rand.Text()
-		hf.putDrawing(c, c.Param("repo"), id)
-		c.JSON(200, id)
+		if hf.putDrawing(c, c.Param("repo"), id, drawingCreated) {
+			c.JSON(200, id)
+		}
 	}
 }
 
 func (hf *handlerFactory) updateDrawing() func(c *gin.Context) {
 	return func(c *gin.Context) {
 		id := c.Param("id")
-		hf.putDrawing(c, c.Param("repo"), id)
-		c.JSON(200, id)
+		if hf.putDrawing(c, c.Param("repo"), id, drawingUpdated) {
+			c.JSON(200, id)
+		}
 	}
 }
 
-func (hf *handlerFactory) putDrawing(c *gin.Context, drawingRepo string, drawingId string) {
+// putDrawing stores the drawing in the request body and reports whether it succeeded.
+// The error response has been sent when it didn't.
+func (hf *handlerFactory) putDrawing(c *gin.Context, drawingRepo string, drawingId string, change changeEventType) bool {
 	logger := zerolog.Ctx(c.Request.Context()).With().Str("drawingRepo", drawingRepo).Str("drawingId", drawingId).Logger()
 
 	body, readBodyErr := io.ReadAll(c.Request.Body)
 	if readBodyErr != nil {
 		logger.Error().Err(readBodyErr).Msg("failed to read request body")
-		c.AbortWithError(http.StatusInternalServerError, readBodyErr)
-		return
+		abortWithError(c, http.StatusInternalServerError, readBodyErr)
+		return false
 	}
 	var requestData putDrawingRequest
 	requestBodyUnmarshalErr := json.Unmarshal(body, &requestData)
 	if requestBodyUnmarshalErr != nil {
 		logger.Error().Err(requestBodyUnmarshalErr).Msg("failed to unmarshal request body")
-		c.AbortWithError(http.StatusInternalServerError, requestBodyUnmarshalErr)
-		return
+		abortWithError(c, http.StatusBadRequest, requestBodyUnmarshalErr)
+		return false
 	}
 	logger.Debug().Str("content", requestData.Content).Send()
-	contentReader := strings.NewReader(requestData.Content)
+	message, messageErr := checkCommitMessage(requestData.Message)
+	if messageErr != nil {
+		logger.Info().Err(messageErr).Msg("invalid commit message")
+		abortWithError(c, http.StatusBadRequest, messageErr)
+		return false
+	}
 
 	user, userExtractErr := getUserFromContext(c)
 	if userExtractErr != nil {
 		logger.Error().Err(userExtractErr).Msg("failed to extract user from context")
-		c.AbortWithError(http.StatusInternalServerError, userExtractErr)
-		return
+		abortWithError(c, http.StatusInternalServerError, userExtractErr)
+		return false
 	}
 
 	repo, hasRepo := hf.repos.getRepo(drawingRepoName(drawingRepo))
 	if !hasRepo {
-		logger.Error().Msg("failed to find repo")
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
+		logger.Info().Msg("failed to find repo")
+		abortWithError(c, http.StatusNotFound, unknownRepoError(drawingRepo))
+		return false
+	}
+	repo, ref, atRef := hf.repoAtRef(c, logger, drawingRepo, repo)
+	if !atRef {
+		return false
 	}
 
-	putDrawingErr := repo.PutDrawing(c, drawingId, contentReader, user.Username)
+	if !hf.checkEditLock(c, logger, drawingRepo, drawingId, user.Username) {
+		return false
+	}
+
+	release := hf.locks.acquire(drawingRepo, drawingRefKey(drawingId, ref))
+	defer release()
+
+	content := requestData.Content
+	ifMatch := c.GetHeader("If-Match")
+	if len(ifMatch) > 0 || len(requestData.BaseVersion) > 0 {
+		var upToDate bool
+		content, upToDate = hf.reconcileWithCurrent(c, logger, repo, drawingId, ifMatch, requestData)
+		if !upToDate {
+			return false
+		}
+	}
+
+	putDrawingErr := repo.PutDrawing(hf.commitContext(c, user.Username, message), drawingId, strings.NewReader(content), user.Username)
 	if putDrawingErr != nil {
 		logger.Error().Err(putDrawingErr).Msg("failed to store drawing %s: %w")
-		c.AbortWithError(http.StatusInternalServerError, putDrawingErr)
-		return
+		abortWithRepoError(c, putDrawingErr)
+		return false
+	}
+	c.Header("ETag", contentETag(content))
+	if len(ref) == 0 { // the change feed and the watchers are about the checked-out branch
+		hf.changes.publish(change, drawingRepo, drawingId, user.Username)
 	}
+	return true
+}
+
+// staleDrawingResponse is sent when the drawing has been changed since the client read it
+type staleDrawingResponse struct {
+	errorResponse
+	ETag                string   `json:"etag,omitempty"`                // of the current content; empty if the drawing doesn't exist
+	Content             string   `json:"content,omitempty"`             // the current content
+	ConflictingElements []string `json:"conflictingElements,omitempty"` // the ids of the elements changed both by the client and by others
+}
+
+func (hf *handlerFactory) abortWithStaleDrawing(c *gin.Context, status int, message string, current string, currentExists bool, conflicts []string) {
+	response := staleDrawingResponse{
+		errorResponse: errorResponse{
+			Status:  status,
+			Error:   http.StatusText(status),
+			Message: message,
+		},
+		ConflictingElements: conflicts,
+	}
+	if currentExists {
+		response.ETag = contentETag(current)
+		response.Content = current
+		c.Header("ETag", response.ETag)
+	}
+	c.AbortWithStatusJSON(status, response)
+}
+
+// reconcileWithCurrent checks whether the client's copy of the drawing is up to date. When it
+// isn't, the changes of the client are merged with those stored since the base version of the
+// client's copy. The base version is taken from the request, or else looked up by the If-Match
+// entity tag among the recent versions of the drawing.
+// It returns the content to store; the error response has been sent when it returns false.
+func (hf *handlerFactory) reconcileWithCurrent(c *gin.Context, logger zerolog.Logger, repo drawingRepo, drawingId string, ifMatch string, requestData putDrawingRequest) (string, bool) {
+	current, getCurrentErr := repo.GetDrawing(c, drawingId)
+	if getCurrentErr != nil {
+		if repoErrorStatus(getCurrentErr) != http.StatusNotFound {
+			logger.Error().Err(getCurrentErr).Msg("failed to get current drawing content")
+			abortWithRepoError(c, getCurrentErr)
+			return "", false
+		}
+		if len(ifMatch) > 0 {
+			logger.Info().Str("ifMatch", ifMatch).Msg("precondition failed: no such drawing")
+			hf.abortWithStaleDrawing(c, http.StatusPreconditionFailed, "the drawing doesn't exist", "", false, nil)
+			return "", false
+		}
+		return requestData.Content, true
+	}
+	currentETag := contentETag(current)
+
+	if len(ifMatch) > 0 && strongETagMatches(ifMatch, currentETag) {
+		return requestData.Content, true
+	}
+
+	base, baseFound := hf.findMergeBase(c, logger, repo, drawingId, requestData.BaseVersion, ifMatch)
+	if !baseFound {
+		logger.Info().Str("ifMatch", ifMatch).Str("currentETag", currentETag).Msg("precondition failed: no base version to merge with")
+		hf.abortWithStaleDrawing(c, http.StatusPreconditionFailed, "the drawing has been changed since it was read", current, true, nil)
+		return "", false
+	}
+	if contentETag(base) == currentETag {
+		return requestData.Content, true
+	}
+
+	merged, conflicts, mergeErr := mergeScenes(base, current, requestData.Content)
+	if mergeErr != nil {
+		logger.Info().Err(mergeErr).Msg("precondition failed: failed to merge")
+		hf.abortWithStaleDrawing(c, http.StatusPreconditionFailed, "the drawing has been changed since it was read and the changes couldn't be merged", current, true, nil)
+		return "", false
+	}
+	if len(conflicts) > 0 {
+		logger.Info().Strs("conflicts", conflicts).Msg("conflicting changes")
+		hf.abortWithStaleDrawing(c, http.StatusConflict, "some elements have been changed by others too", current, true, conflicts)
+		return "", false
+	}
+
+	logger.Debug().Msg("merged with the changes stored since the base version")
+	c.Header(mergedHeaderName, "true")
+	return merged, true
+}
+
+// mergeBaseSearchDepth limits how many of the latest versions are looked at when searching
+// for the base version by entity tag
+const mergeBaseSearchDepth = 20
+
+const mergedHeaderName = "X-Drawing-Merged"
+
+func (hf *handlerFactory) findMergeBase(c *gin.Context, logger zerolog.Logger, repo drawingRepo, drawingId string, baseVersion string, ifMatch string) (string, bool) {
+	if len(baseVersion) > 0 {
+		base, getBaseErr := repo.GetVersion(c, drawingId, baseVersion)
+		if getBaseErr != nil {
+			logger.Info().Err(getBaseErr).Str("baseVersion", baseVersion).Msg("failed to get base version")
+			return "", false
+		}
+		return base, true
+	}
+
+	versions, listErr := repo.ListVersions(c, drawingId)
+	if listErr != nil {
+		logger.Info().Err(listErr).Msg("failed to list versions when looking for the base version")
+		return "", false
+	}
+	for i, version := range versions {
+		if i == mergeBaseSearchDepth {
+			break
+		}
+		content, getVersionErr := repo.GetVersion(c, drawingId, version.VersionID)
+		if getVersionErr != nil {
+			logger.Info().Err(getVersionErr).Str("versionId", version.VersionID).Msg("failed to get version when looking for the base version")
+			return "", false
+		}
+		if strongETagMatches(ifMatch, contentETag(content)) {
+			return content, true
+		}
+	}
+	return "", false
 }
 
 func (hf *handlerFactory) getDrawingContent() func(c *gin.Context) {
@@ -234,18 +574,29 @@ func (hf *handlerFactory) getDrawingContent() func(c *gin.Context) {
 
 		repo, hasRepo := hf.repos.getRepo(drawingRepoName(repoName))
 		if !hasRepo {
-			logger.Error().Msg("failed to find repo")
-			c.AbortWithStatus(http.StatusInternalServerError)
+			logger.Info().Msg("failed to find repo")
+			abortWithError(c, http.StatusNotFound, unknownRepoError(repoName))
+			return
+		}
+		repo, _, atRef := hf.repoAtRef(c, logger, repoName, repo)
+		if !atRef {
 			return
 		}
 
 		content, getContentErr := repo.GetDrawing(c, drawingId)
 		if getContentErr != nil {
 			logger.Error().Err(getContentErr).Msg("failed to get drawing content")
-			c.AbortWithError(http.StatusInternalServerError, getContentErr)
+			abortWithRepoError(c, getContentErr)
 			return
 		}
 		logger.Debug().Int("content length", len(content)).Msg("content found")
+
+		etag := contentETag(content)
+		c.Header("ETag", etag)
+		if ifNoneMatch := c.GetHeader("If-None-Match"); len(ifNoneMatch) > 0 && weakETagMatches(ifNoneMatch, etag) {
+			c.Status(http.StatusNotModified)
+			return
+		}
 		c.JSON(http.StatusOK, content)
 	}
 }
@@ -259,51 +610,407 @@ func (hf *handlerFactory) deleteDrawing() func(c *gin.Context) {
 
 		if len(drawingId) == 0 {
 			logger.Debug().Msg("Missing 'id' path parameter")
-			c.AbortWithStatus(http.StatusBadRequest)
+			abortWithError(c, http.StatusBadRequest, errors.New("missing 'id' path parameter"))
 			return
 		}
 		user, userExtractErr := getUserFromContext(c)
 		if userExtractErr != nil {
 			logger.Error().Err(userExtractErr).Msg("failed to extract user from context")
-			c.AbortWithError(http.StatusInternalServerError, userExtractErr)
+			abortWithError(c, http.StatusInternalServerError, userExtractErr)
 			return
 		}
 
 		repo, hasRepo := hf.repos.getRepo(drawingRepoName(repoName))
 		if !hasRepo {
-			logger.Error().Str("repoName", repoName).Msg("failed to find repo")
-			c.AbortWithStatus(http.StatusInternalServerError)
+			logger.Info().Str("repoName", repoName).Msg("failed to find repo")
+			abortWithError(c, http.StatusNotFound, unknownRepoError(repoName))
+			return
+		}
+		repo, ref, atRef := hf.repoAtRef(c, logger, repoName, repo)
+		if !atRef {
+			return
+		}
+
+		if !hf.checkEditLock(c, logger, repoName, drawingId, user.Username) {
 			return
 		}
 
-		err := repo.DeleteDrawing(c, drawingId, user.Username)
+		err := repo.DeleteDrawing(hf.commitContext(c, user.Username, ""), drawingId, user.Username)
 		if err != nil {
 			logger.Error().Err(err).Msg("failed to delete the object with the old name")
-			c.AbortWithError(http.StatusInternalServerError, err)
+			abortWithRepoError(c, err)
 			return
 		}
+		if len(ref) == 0 {
+			hf.changes.publish(drawingDeleted, repoName, drawingId, user.Username)
+		}
 		c.Status(http.StatusOK)
 	}
 }
 
+func (hf *handlerFactory) listDrawingVersions() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		repoName := c.Param("repo")
+		drawingId := c.Param("id")
+
+		logger := zerolog.Ctx(c.Request.Context()).With().Str("repoName", repoName).Str("drawingId", drawingId).Logger()
+
+		repo, hasRepo := hf.repos.getRepo(drawingRepoName(repoName))
+		if !hasRepo {
+			logger.Info().Msg("failed to find repo")
+			abortWithError(c, http.StatusNotFound, unknownRepoError(repoName))
+			return
+		}
+		repo, _, atRef := hf.repoAtRef(c, logger, repoName, repo)
+		if !atRef {
+			return
+		}
+
+		versions, listErr := repo.ListVersions(c, drawingId)
+		if listErr != nil {
+			logger.Error().Err(listErr).Msg("failed to list drawing versions")
+			abortWithRepoError(c, listErr)
+			return
+		}
+		if versions == nil {
+			versions = []vcblobstore.BlobVersion{}
+		}
+		logger.Debug().Int("version count", len(versions)).Msg("versions found")
+		c.JSON(http.StatusOK, versions)
+	}
+}
+
+func (hf *handlerFactory) getDrawingVersion() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		repoName := c.Param("repo")
+		drawingId := c.Param("id")
+		versionId := c.Param("versionId")
+
+		logger := zerolog.Ctx(c.Request.Context()).With().Str("repoName", repoName).Str("drawingId", drawingId).Str("versionId", versionId).Logger()
+
+		repo, hasRepo := hf.repos.getRepo(drawingRepoName(repoName))
+		if !hasRepo {
+			logger.Info().Msg("failed to find repo")
+			abortWithError(c, http.StatusNotFound, unknownRepoError(repoName))
+			return
+		}
+		repo, _, atRef := hf.repoAtRef(c, logger, repoName, repo)
+		if !atRef {
+			return
+		}
+
+		content, getVersionErr := repo.GetVersion(c, drawingId, versionId)
+		if getVersionErr != nil {
+			logger.Error().Err(getVersionErr).Msg("failed to get drawing version")
+			abortWithRepoError(c, getVersionErr)
+			return
+		}
+		logger.Debug().Int("content length", len(content)).Msg("version content found")
+		c.JSON(http.StatusOK, content)
+	}
+}
+
+func (hf *handlerFactory) restoreDrawingVersion() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		repoName := c.Param("repo")
+		drawingId := c.Param("id")
+		versionId := c.Param("versionId")
+
+		logger := zerolog.Ctx(c.Request.Context()).With().Str("repoName", repoName).Str("drawingId", drawingId).Str("versionId", versionId).Logger()
+
+		user, userExtractErr := getUserFromContext(c)
+		if userExtractErr != nil {
+			logger.Error().Err(userExtractErr).Msg("failed to extract user from context")
+			abortWithError(c, http.StatusInternalServerError, userExtractErr)
+			return
+		}
+
+		repo, hasRepo := hf.repos.getRepo(drawingRepoName(repoName))
+		if !hasRepo {
+			logger.Info().Msg("failed to find repo")
+			abortWithError(c, http.StatusNotFound, unknownRepoError(repoName))
+			return
+		}
+		repo, ref, atRef := hf.repoAtRef(c, logger, repoName, repo)
+		if !atRef {
+			return
+		}
+
+		if !hf.checkEditLock(c, logger, repoName, drawingId, user.Username) {
+			return
+		}
+
+		restored, restoreErr := repo.RestoreVersion(hf.commitContext(c, user.Username, ""), drawingId, versionId, user.Username)
+		if restoreErr != nil {
+			logger.Error().Err(restoreErr).Msg("failed to restore drawing version")
+			abortWithRepoError(c, restoreErr)
+			return
+		}
+		if len(ref) == 0 {
+			hf.changes.publish(drawingRestored, repoName, drawingId, user.Username)
+		}
+		c.JSON(http.StatusOK, restored)
+	}
+}
+
+// diffDrawingVersions compares the versions in the "from" and "to" query parameters.
+// The current content of the drawing is used when "to" is omitted.
+func (hf *handlerFactory) diffDrawingVersions() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		repoName := c.Param("repo")
+		drawingId := c.Param("id")
+		fromVersionId := c.Query("from")
+		toVersionId := c.Query("to")
+
+		logger := zerolog.Ctx(c.Request.Context()).With().Str("repoName", repoName).Str("drawingId", drawingId).Str("from", fromVersionId).Str("to", toVersionId).Logger()
+
+		if len(fromVersionId) == 0 {
+			logger.Debug().Msg("Missing 'from' query parameter")
+			abortWithError(c, http.StatusBadRequest, errors.New("missing 'from' query parameter"))
+			return
+		}
+
+		repo, hasRepo := hf.repos.getRepo(drawingRepoName(repoName))
+		if !hasRepo {
+			logger.Info().Msg("failed to find repo")
+			abortWithError(c, http.StatusNotFound, unknownRepoError(repoName))
+			return
+		}
+		repo, _, atRef := hf.repoAtRef(c, logger, repoName, repo)
+		if !atRef {
+			return
+		}
+
+		fromContent, getFromErr := repo.GetVersion(c, drawingId, fromVersionId)
+		if getFromErr != nil {
+			logger.Error().Err(getFromErr).Msg("failed to get 'from' version")
+			abortWithRepoError(c, getFromErr)
+			return
+		}
+
+		var toContent string
+		var getToErr error
+		if len(toVersionId) == 0 {
+			toContent, getToErr = repo.GetDrawing(c, drawingId)
+		} else {
+			toContent, getToErr = repo.GetVersion(c, drawingId, toVersionId)
+		}
+		if getToErr != nil {
+			logger.Error().Err(getToErr).Msg("failed to get 'to' version")
+			abortWithRepoError(c, getToErr)
+			return
+		}
+
+		diff, diffErr := diffScenes(fromContent, toContent)
+		if diffErr != nil {
+			logger.Error().Err(diffErr).Msg("failed to compare versions")
+			abortWithError(c, http.StatusInternalServerError, diffErr)
+			return
+		}
+		c.JSON(http.StatusOK, diff)
+	}
+}
+
+func (hf *handlerFactory) copyDrawing() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		hf.transferDrawing(c, false)
+	}
+}
+
+func (hf *handlerFactory) moveDrawing() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		hf.transferDrawing(c, true)
+	}
+}
+
+// transferDrawing copies a drawing within a repo or to another repo, deleting the source
+// drawing afterwards in case of a move
+func (hf *handlerFactory) transferDrawing(c *gin.Context, deleteSource bool) {
+	sourceRepoName := c.Param("repo")
+	sourceId := c.Param("id")
+
+	logger := zerolog.Ctx(c.Request.Context()).With().Str("sourceRepo", sourceRepoName).Str("sourceId", sourceId).Bool("move", deleteSource).Logger()
+
+	var requestData transferDrawingRequest
+	bindErr := c.ShouldBindJSON(&requestData)
+	if bindErr != nil && !errors.Is(bindErr, io.EOF) {
+		logger.Debug().Err(bindErr).Msg("failed to unmarshal request body")
+		abortWithError(c, http.StatusBadRequest, bindErr)
+		return
+	}
+	targetRepoName := requestData.TargetRepo
+	if len(targetRepoName) == 0 {
+		targetRepoName = sourceRepoName
+	}
+	targetId := requestData.TargetId
+	if len(targetId) == 0 {
+		targetId = rand.Text()
+	}
+	logger = logger.With().Str("targetRepo", targetRepoName).Str("targetId", targetId).Logger()
+
+	if targetRepoName == sourceRepoName && targetId == sourceId {
+		logger.Debug().Msg("source and target are the same")
+		abortWithError(c, http.StatusBadRequest, errors.New("source and target are the same"))
+		return
+	}
+
+	user, userExtractErr := getUserFromContext(c)
+	if userExtractErr != nil {
+		logger.Error().Err(userExtractErr).Msg("failed to extract user from context")
+		abortWithError(c, http.StatusInternalServerError, userExtractErr)
+		return
+	}
+
+	sourceRepo, hasSourceRepo := hf.repos.getRepo(drawingRepoName(sourceRepoName))
+	if !hasSourceRepo {
+		logger.Info().Msg("failed to find source repo")
+		abortWithError(c, http.StatusNotFound, unknownRepoError(sourceRepoName))
+		return
+	}
+	if !hf.checkedOutOnly(c, logger, sourceRepoName) {
+		return
+	}
+	if !hf.checkRole(c, logger, targetRepoName, user.Username, editorRole) {
+		return
+	}
+	targetRepo, hasTargetRepo := hf.repos.getRepo(drawingRepoName(targetRepoName))
+	if !hasTargetRepo {
+		logger.Info().Msg("failed to find target repo")
+		abortWithError(c, http.StatusNotFound, unknownRepoError(targetRepoName))
+		return
+	}
+
+	if !hf.checkEditLock(c, logger, targetRepoName, targetId, user.Username) {
+		return
+	}
+	if deleteSource && !hf.checkEditLock(c, logger, sourceRepoName, sourceId, user.Username) {
+		return
+	}
+
+	_, targetErr := targetRepo.GetDrawing(c, targetId)
+	if targetErr == nil {
+		logger.Info().Msg("target drawing already exists")
+		abortWithError(c, http.StatusConflict, fmt.Errorf("drawing %s already exists in drawing repository %s", targetId, targetRepoName))
+		return
+	}
+	if !errors.Is(targetErr, repoerr.ErrNotFound) {
+		logger.Error().Err(targetErr).Msg("failed to check target drawing")
+		abortWithRepoError(c, targetErr)
+		return
+	}
+
+	if targetRepoName == sourceRepoName {
+		copyErr := sourceRepo.CopyDrawing(hf.commitContext(c, user.Username, ""), sourceId, targetId, user.Username)
+		if copyErr != nil {
+			logger.Error().Err(copyErr).Msg("failed to copy drawing")
+			abortWithRepoError(c, copyErr)
+			return
+		}
+	} else {
+		content, getContentErr := sourceRepo.GetDrawing(c, sourceId)
+		if getContentErr != nil {
+			logger.Error().Err(getContentErr).Msg("failed to get source drawing content")
+			abortWithRepoError(c, getContentErr)
+			return
+		}
+		putDrawingErr := targetRepo.PutDrawing(hf.commitContext(c, user.Username, ""), targetId, strings.NewReader(content), user.Username)
+		if putDrawingErr != nil {
+			logger.Error().Err(putDrawingErr).Msg("failed to store drawing in target repo")
+			abortWithRepoError(c, putDrawingErr)
+			return
+		}
+	}
+
+	if deleteSource {
+		deleteErr := sourceRepo.DeleteDrawing(hf.commitContext(c, user.Username, ""), sourceId, user.Username)
+		if deleteErr != nil {
+			logger.Error().Err(deleteErr).Msg("failed to delete source drawing after copying it")
+			// the move fails as a whole: the source is kept, so the copy is removed
+			if rollbackErr := targetRepo.DeleteDrawing(hf.commitContext(c, user.Username, ""), targetId, user.Username); rollbackErr != nil {
+				logger.Error().Err(rollbackErr).Msg("failed to remove the copy of the drawing not moved")
+			}
+			abortWithRepoError(c, deleteErr)
+			return
+		}
+	}
+
+	hf.changes.publish(drawingCreated, targetRepoName, targetId, user.Username)
+	if deleteSource {
+		hf.changes.publish(drawingDeleted, sourceRepoName, sourceId, user.Username)
+	}
+
+	c.JSON(http.StatusOK, targetId)
+}
+
 func newServer(repoConfigs drawingReposConfigs) (*server, error) {
-	ctx := context.Background()
+	users, usersErr := getUserDirectory()
+	if usersErr != nil {
+		return nil, usersErr
+	}
+	access, accessErr := getAccessConfig()
+	if accessErr != nil {
+		return nil, accessErr
+	}
+	oidcSettings, oidcErr := getOIDCConfig()
+	if oidcErr != nil {
+		return nil, oidcErr
+	}
+	passwordFileName := getPasswordFileName()
+	basicAuth, basicAuthErr := getBasicAuth(oidcSettings.enabled(), passwordFileName)
+	if basicAuthErr != nil {
+		return nil, basicAuthErr
+	}
+	var passwords *passwordFile
+	if basicAuth {
+		var loadErr error
+		passwords, loadErr = loadPasswordFile(passwordFileName, getLogger())
+		if loadErr != nil {
+			return nil, loadErr
+		}
+	}
+
+	sessionSettings, sessionSettingsErr := getSessionConfig()
+	if sessionSettingsErr != nil {
+		return nil, sessionSettingsErr
+	}
+	sessionStore, sessionStoreErr := newSessionStore(sessionSettings)
+	if sessionStoreErr != nil {
+		return nil, sessionStoreErr
+	}
+	tokens, tokensErr := loadAPITokenStore(getTokenFileName())
+	if tokensErr != nil {
+		if serverSide, isServerSide := sessionStore.(*serverSideSessionStore); isServerSide {
+			serverSide.close()
+		}
+		return nil, tokensErr
+	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	branches := gitBranchesOf(repoConfigs)
 	repos := drawingRepos{}
 	for name, repoConfig := range repoConfigs {
-		repos[drawingRepoRef{drawingRepoName(name), drawingRepoLabel(repoConfig.label)}] = newDrawingRepo(ctx, repoConfig)
+		repos[drawingRepoRef{drawingRepoName(name), drawingRepoLabel(repoConfig.label)}] = newDrawingRepo(ctx, repoConfig, branches[drawingRepoName(name)])
 	}
 
 	return &server{
-		ctx: ctx,
+		ctx:    ctx,
+		cancel: cancel,
 		config: options{
 			getServerPort(),
-			[]passwordCredentials{{
-				Username: getUsername(),
-				Password: "pass",
-			}},
 			LOCAL_GIT,
+			getAdmins(),
+			access,
+			users,
+			oidcSettings,
+			basicAuth,
+			passwordFileName,
+			sessionSettings,
 		},
-		repos: repos,
+		repos:       repos,
+		repoConfigs: repoConfigs,
+		branches:    branches,
+		passwords:   passwords,
+		tokens:      tokens,
+		sessions:    sessionStore,
 	}, nil
 }
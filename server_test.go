@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"myxcaliapp/backend/repoerr"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"vcblobstore"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	firstTestRepo  = "first"
+	secondTestRepo = "second"
+	testUser       = "user@example.com"
+	otherTestUser  = "other@example.com"
+	adminTestUser  = "admin@example.com"
+)
+
+type serverTestSuite struct {
+	suite.Suite
+	engine    *gin.Engine
+	passwords *passwordFile
+}
+
+func TestServer(t *testing.T) {
+	suite.Run(t, &serverTestSuite{})
+}
+
+// useTestPasswordFile lets the test users log in with the password "pass"
+func useTestPasswordFile(t *testing.T) {
+	var content strings.Builder
+	for _, username := range []string{testUser, otherTestUser, adminTestUser} {
+		hash, hashErr := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost) // keeps the tests fast
+		if hashErr != nil {
+			t.Fatal(hashErr)
+		}
+		content.WriteString(username + ":" + string(hash) + "\n")
+	}
+	fileName := filepath.Join(t.TempDir(), "htpasswd")
+	if writeErr := os.WriteFile(fileName, []byte(content.String()), passwordFilePermissions); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	t.Setenv("XCALIAPP_PASSWORDFILE", fileName)
+}
+
+// newTestServer creates the server, closing it when the test ends
+func newTestServer(t *testing.T, repoConfigs drawingReposConfigs) *server {
+	s, err := newServer(repoConfigs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if closeErr := s.Close(); closeErr != nil {
+			t.Error(closeErr)
+		}
+	})
+	return s
+}
+
+func (t *serverTestSuite) SetupTest() {
+	gin.SetMode(gin.TestMode)
+	useTestPasswordFile(t.T())
+	s := newTestServer(t.T(), drawingReposConfigs{
+		firstTestRepo:  drawingRepoConfig{name: firstTestRepo, label: "First Repo", storeType: MEMORY},
+		secondTestRepo: drawingRepoConfig{name: secondTestRepo, label: "Second Repo", storeType: MEMORY},
+	})
+	s.config.admins = []string{adminTestUser}
+	t.engine = s.createEngine()
+	t.passwords = s.passwords
+}
+
+func (t *serverTestSuite) send(method string, path string, body any) *httptest.ResponseRecorder {
+	return t.sendWithHeader(method, path, body, http.Header{})
+}
+
+func (t *serverTestSuite) sendWithHeader(method string, path string, body any, header http.Header) *httptest.ResponseRecorder {
+	return t.sendAs(testUser, method, path, body, header)
+}
+
+func (t *serverTestSuite) sendAs(username string, method string, path string, body any, header http.Header) *httptest.ResponseRecorder {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyBytes, marshalErr := json.Marshal(body)
+		t.Require().NoError(marshalErr)
+		bodyReader = bytes.NewReader(bodyBytes)
+	}
+	request := httptest.NewRequest(method, path, bodyReader)
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	request.SetBasicAuth(username, "pass")
+	recorder := httptest.NewRecorder()
+	t.engine.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// sendWithToken sends the request authenticated with the API token instead of Basic credentials
+func (t *serverTestSuite) sendWithToken(token string, method string, path string, body any) *httptest.ResponseRecorder {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyBytes, marshalErr := json.Marshal(body)
+		t.Require().NoError(marshalErr)
+		bodyReader = bytes.NewReader(bodyBytes)
+	}
+	request := httptest.NewRequest(method, path, bodyReader)
+	request.Header.Set("Authorization", "Bearer "+token)
+	recorder := httptest.NewRecorder()
+	t.engine.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// sendForJSON sends the request, checks the status and unmarshals the response body into result
+func (t *serverTestSuite) sendForJSON(method string, path string, body any, expectedStatus int, result any) {
+	recorder := t.send(method, path, body)
+	t.Require().Equal(expectedStatus, recorder.Code, recorder.Body.String())
+	if result != nil {
+		t.Require().NoError(json.Unmarshal(recorder.Body.Bytes(), result))
+	}
+}
+
+func (t *serverTestSuite) createDrawing(repo string, content string) string {
+	var id string
+	t.sendForJSON(http.MethodPost, "/api/drawing/"+repo, putDrawingRequest{Content: content}, http.StatusOK, &id)
+	t.Require().NotEmpty(id)
+	return id
+}
+
+func (t *serverTestSuite) getDrawing(repo string, id string) string {
+	var content string
+	t.sendForJSON(http.MethodGet, "/api/drawing/"+repo+"/"+id, nil, http.StatusOK, &content)
+	return content
+}
+
+func (t *serverTestSuite) listVersions(repo string, id string) []vcblobstore.BlobVersion {
+	var versions []vcblobstore.BlobVersion
+	t.sendForJSON(http.MethodGet, "/api/drawing/"+repo+"/"+id+"/versions", nil, http.StatusOK, &versions)
+	return versions
+}
+
+func (t *serverTestSuite) TestAuthenticationRequired() {
+	request := httptest.NewRequest(http.MethodGet, "/api/drawings", nil)
+	recorder := httptest.NewRecorder()
+
+	t.engine.ServeHTTP(recorder, request)
+
+	t.Equal(http.StatusUnauthorized, recorder.Code)
+	t.Equal("Basic", recorder.Header().Get("WWW-Authenticate"))
+}
+
+func (t *serverTestSuite) TestWebClient() {
+	recorder := t.send(http.MethodGet, "/drawings", nil)
+
+	t.Equal(http.StatusOK, recorder.Code)
+}
+
+func (t *serverTestSuite) TestGetDrawingRepositories() {
+	var repos []drawingRepoRef
+
+	t.sendForJSON(http.MethodGet, "/api/drawingRepositories", nil, http.StatusOK, &repos)
+
+	t.ElementsMatch([]drawingRepoRef{
+		{Name: firstTestRepo, Label: "First Repo"},
+		{Name: secondTestRepo, Label: "Second Repo"},
+	}, repos)
+}
+
+func (t *serverTestSuite) TestCreateUpdateGetAndList() {
+	id := t.createDrawing(firstTestRepo, "content 1")
+	t.Equal("content 1", t.getDrawing(firstTestRepo, id))
+
+	var updatedId string
+	t.sendForJSON(http.MethodPut, "/api/drawing/"+firstTestRepo+"/"+id, putDrawingRequest{Content: "content 2"}, http.StatusOK, &updatedId)
+	t.Equal(id, updatedId)
+	t.Equal("content 2", t.getDrawing(firstTestRepo, id))
+
+	var lists drawingLists
+	t.sendForJSON(http.MethodGet, "/api/drawings", nil, http.StatusOK, &lists)
+	t.Equal([]drawingRepoItem{{Id: id, Title: id}}, lists[firstTestRepo].Items)
+	t.Empty(lists[secondTestRepo].Items)
+}
+
+func (t *serverTestSuite) TestDelete() {
+	id := t.createDrawing(firstTestRepo, "content")
+
+	t.sendForJSON(http.MethodDelete, "/api/drawing/"+firstTestRepo+"/"+id, nil, http.StatusOK, nil)
+
+	t.Equal(http.StatusNotFound, t.send(http.MethodGet, "/api/drawing/"+firstTestRepo+"/"+id, nil).Code)
+	t.Equal(http.StatusNotFound, t.send(http.MethodDelete, "/api/drawing/"+firstTestRepo+"/"+id, nil).Code)
+}
+
+func (t *serverTestSuite) TestUnknownRepo() {
+	var response errorResponse
+
+	t.sendForJSON(http.MethodGet, "/api/drawing/no-such-repo/some-id", nil, http.StatusNotFound, &response)
+
+	t.Equal(http.StatusNotFound, response.Status)
+	t.Equal("Not Found", response.Error)
+	t.Contains(response.Message, "no-such-repo")
+}
+
+func (t *serverTestSuite) TestCommitMessage() {
+	id := t.createDrawing(firstTestRepo, "v1")
+	t.sendForJSON(http.MethodPut, "/api/drawing/"+firstTestRepo+"/"+id, putDrawingRequest{Content: "v2", Message: "  Add the database  "}, http.StatusOK, nil)
+
+	versions := t.listVersions(firstTestRepo, id)
+	t.Require().Len(versions, 2)
+	t.Equal("Add the database", versions[0].Message)
+	t.Empty(versions[1].Message)
+
+	tooLong := putDrawingRequest{Content: "v3", Message: strings.Repeat("x", maxCommitMessageLength+1)}
+	t.Equal(http.StatusBadRequest, t.send(http.MethodPut, "/api/drawing/"+firstTestRepo+"/"+id, tooLong).Code)
+}
+
+func (t *serverTestSuite) TestInvalidRequestBody() {
+	recorder := t.send(http.MethodPut, "/api/drawing/"+firstTestRepo+"/some-id", "not an object")
+
+	t.Equal(http.StatusBadRequest, recorder.Code)
+}
+
+func (t *serverTestSuite) TestVersions() {
+	id := t.createDrawing(firstTestRepo, "v1")
+	t.sendForJSON(http.MethodPut, "/api/drawing/"+firstTestRepo+"/"+id, putDrawingRequest{Content: "v2"}, http.StatusOK, nil)
+
+	versions := t.listVersions(firstTestRepo, id)
+	t.Require().Len(versions, 2)
+	t.Equal(testUser, versions[0].Author)
+
+	var oldContent string
+	t.sendForJSON(http.MethodGet, "/api/drawing/"+firstTestRepo+"/"+id+"/versions/"+versions[1].VersionID, nil, http.StatusOK, &oldContent)
+	t.Equal("v1", oldContent)
+
+	t.sendForJSON(http.MethodPost, "/api/drawing/"+firstTestRepo+"/"+id+"/versions/"+versions[1].VersionID+"/restore", nil, http.StatusOK, nil)
+	t.Equal("v1", t.getDrawing(firstTestRepo, id))
+	t.Len(t.listVersions(firstTestRepo, id), 3)
+}
+
+func (t *serverTestSuite) TestDiff() {
+	id := t.createDrawing(firstTestRepo, `{"elements":[{"id":"a","type":"rectangle","x":0}]}`)
+	t.sendForJSON(http.MethodPut, "/api/drawing/"+firstTestRepo+"/"+id, putDrawingRequest{Content: `{"elements":[{"id":"a","type":"rectangle","x":1},{"id":"b","type":"text"}]}`}, http.StatusOK, nil)
+	versions := t.listVersions(firstTestRepo, id)
+
+	var diff drawingDiff
+	t.sendForJSON(http.MethodGet, "/api/drawing/"+firstTestRepo+"/"+id+"/diff?from="+versions[1].VersionID, nil, http.StatusOK, &diff)
+
+	t.Equal([]elementChange{{Id: "b", Type: "text"}}, diff.Added)
+	t.Equal([]elementChange{{Id: "a", Type: "rectangle", ChangedProperties: []string{"x"}}}, diff.Moved)
+
+	t.Equal(http.StatusBadRequest, t.send(http.MethodGet, "/api/drawing/"+firstTestRepo+"/"+id+"/diff", nil).Code)
+}
+
+func (t *serverTestSuite) TestCopyAndMove() {
+	id := t.createDrawing(firstTestRepo, "content")
+
+	var copyId string
+	t.sendForJSON(http.MethodPost, "/api/drawing/"+firstTestRepo+"/"+id+"/copy", nil, http.StatusOK, &copyId)
+	t.NotEqual(id, copyId)
+	t.Equal("content", t.getDrawing(firstTestRepo, copyId))
+
+	var movedId string
+	t.sendForJSON(http.MethodPost, "/api/drawing/"+firstTestRepo+"/"+id+"/move", transferDrawingRequest{TargetRepo: secondTestRepo, TargetId: "moved"}, http.StatusOK, &movedId)
+	t.Equal("moved", movedId)
+	t.Equal("content", t.getDrawing(secondTestRepo, movedId))
+	t.Equal(http.StatusNotFound, t.send(http.MethodGet, "/api/drawing/"+firstTestRepo+"/"+id, nil).Code)
+}
+
+func (t *serverTestSuite) TestCopyDoesNotOverwrite() {
+	id := t.createDrawing(firstTestRepo, "source")
+	t.sendForJSON(http.MethodPut, "/api/drawing/"+firstTestRepo+"/taken", putDrawingRequest{Content: "taken"}, http.StatusOK, nil)
+	existingId := t.createDrawing(secondTestRepo, "existing")
+
+	t.Equal(http.StatusConflict, t.send(http.MethodPost, "/api/drawing/"+firstTestRepo+"/"+id+"/copy", transferDrawingRequest{TargetId: "taken"}).Code)
+	t.Equal("taken", t.getDrawing(firstTestRepo, "taken"))
+	t.Equal(http.StatusConflict, t.send(http.MethodPost, "/api/drawing/"+firstTestRepo+"/"+id+"/move", transferDrawingRequest{TargetRepo: secondTestRepo, TargetId: existingId}).Code)
+	t.Equal("existing", t.getDrawing(secondTestRepo, existingId))
+	t.Equal("source", t.getDrawing(firstTestRepo, id))
+}
+
+// undeletableRepo fails to delete drawings
+type undeletableRepo struct {
+	drawingRepo
+}
+
+func (repo undeletableRepo) DeleteDrawing(ctx context.Context, key string, modifiedBy string) error {
+	return fmt.Errorf("drawing %s: %w", key, repoerr.ErrUnavailable)
+}
+
+func (t *serverTestSuite) TestFailedMoveKeepsSource() {
+	s := newTestServer(t.T(), drawingReposConfigs{
+		firstTestRepo:  drawingRepoConfig{name: firstTestRepo, label: "First Repo", storeType: MEMORY},
+		secondTestRepo: drawingRepoConfig{name: secondTestRepo, label: "Second Repo", storeType: MEMORY},
+	})
+	firstRef := drawingRepoRef{Name: firstTestRepo, Label: "First Repo"}
+	s.repos[firstRef] = undeletableRepo{s.repos[firstRef]}
+	t.engine = s.createEngine()
+	id := t.createDrawing(firstTestRepo, "content")
+
+	t.Equal(http.StatusServiceUnavailable, t.send(http.MethodPost, "/api/drawing/"+firstTestRepo+"/"+id+"/move", transferDrawingRequest{TargetRepo: secondTestRepo, TargetId: "moved"}).Code)
+	t.Equal("content", t.getDrawing(firstTestRepo, id))
+	t.Equal(http.StatusNotFound, t.send(http.MethodGet, "/api/drawing/"+secondTestRepo+"/moved", nil).Code, "the copy is removed")
+}
+
+func (t *serverTestSuite) TestConditionalUpdate() {
+	id := t.createDrawing(firstTestRepo, "v1")
+	drawingPath := "/api/drawing/" + firstTestRepo + "/" + id
+
+	getResponse := t.send(http.MethodGet, drawingPath, nil)
+	etag := getResponse.Header().Get("ETag")
+	t.Require().NotEmpty(etag)
+	t.Equal(http.StatusNotModified, t.sendWithHeader(http.MethodGet, drawingPath, nil, http.Header{"If-None-Match": {etag}}).Code)
+	t.Equal(http.StatusNotModified, t.sendWithHeader(http.MethodGet, drawingPath, nil, http.Header{"If-None-Match": {"W/" + etag}}).Code)
+	weakUpdateResponse := t.sendWithHeader(http.MethodPut, drawingPath, putDrawingRequest{Content: "v2"}, http.Header{"If-Match": {"W/" + etag}})
+	t.Equal(http.StatusPreconditionFailed, weakUpdateResponse.Code, "If-Match uses the strong comparison")
+
+	updateResponse := t.sendWithHeader(http.MethodPut, drawingPath, putDrawingRequest{Content: "v2"}, http.Header{"If-Match": {etag}})
+	t.Require().Equal(http.StatusOK, updateResponse.Code)
+	newETag := updateResponse.Header().Get("ETag")
+	t.NotEqual(etag, newETag)
+
+	staleUpdateResponse := t.sendWithHeader(http.MethodPut, drawingPath, putDrawingRequest{Content: "v3"}, http.Header{"If-Match": {etag}})
+	t.Equal(http.StatusPreconditionFailed, staleUpdateResponse.Code)
+	var conflict staleDrawingResponse
+	t.Require().NoError(json.Unmarshal(staleUpdateResponse.Body.Bytes(), &conflict))
+	t.Equal(newETag, conflict.ETag)
+	t.Equal("v2", conflict.Content)
+	t.Equal("v2", t.getDrawing(firstTestRepo, id))
+
+	missingResponse := t.sendWithHeader(http.MethodPut, "/api/drawing/"+firstTestRepo+"/missing", putDrawingRequest{Content: "v1"}, http.Header{"If-Match": {"*"}})
+	t.Equal(http.StatusPreconditionFailed, missingResponse.Code)
+}
+
+func (t *serverTestSuite) TestMergeConcurrentUpdates() {
+	base := `{"elements":[{"id":"a","x":0,"version":1,"versionNonce":11},{"id":"b","x":0,"version":1,"versionNonce":21}]}`
+	id := t.createDrawing(firstTestRepo, base)
+	drawingPath := "/api/drawing/" + firstTestRepo + "/" + id
+	baseETag := t.send(http.MethodGet, drawingPath, nil).Header().Get("ETag")
+
+	firstUpdate := `{"elements":[{"id":"a","x":5,"version":2,"versionNonce":12},{"id":"b","x":0,"version":1,"versionNonce":21}]}`
+	t.Require().Equal(http.StatusOK, t.sendWithHeader(http.MethodPut, drawingPath, putDrawingRequest{Content: firstUpdate}, http.Header{"If-Match": {baseETag}}).Code)
+
+	secondUpdate := `{"elements":[{"id":"a","x":0,"version":1,"versionNonce":11},{"id":"b","x":7,"version":2,"versionNonce":22}]}`
+	mergeResponse := t.sendWithHeader(http.MethodPut, drawingPath, putDrawingRequest{Content: secondUpdate}, http.Header{"If-Match": {baseETag}})
+	t.Require().Equal(http.StatusOK, mergeResponse.Code, mergeResponse.Body.String())
+	t.Equal("true", mergeResponse.Header().Get(mergedHeaderName))
+
+	merged, parseErr := parseSceneElements(t.getDrawing(firstTestRepo, id))
+	t.Require().NoError(parseErr)
+	t.Equal(float64(5), merged["a"]["x"])
+	t.Equal(float64(7), merged["b"]["x"])
+
+	conflictingUpdate := `{"elements":[{"id":"a","x":9,"version":2,"versionNonce":13},{"id":"b","x":0,"version":1,"versionNonce":21}]}`
+	conflictResponse := t.sendWithHeader(http.MethodPut, drawingPath, putDrawingRequest{Content: conflictingUpdate}, http.Header{"If-Match": {baseETag}})
+	t.Equal(http.StatusConflict, conflictResponse.Code)
+	var conflict staleDrawingResponse
+	t.Require().NoError(json.Unmarshal(conflictResponse.Body.Bytes(), &conflict))
+	t.Equal([]string{"a"}, conflict.ConflictingElements)
+}
+
+func (t *serverTestSuite) TestPresence() {
+	presencePath := "/api/drawing/" + firstTestRepo + "/some-drawing/presence"
+
+	var viewers []presenceEntry
+	t.sendForJSON(http.MethodPost, presencePath, nil, http.StatusOK, &viewers)
+	t.Equal([]string{testUser}, usernames(viewers))
+
+	t.sendForJSON(http.MethodGet, presencePath, nil, http.StatusOK, &viewers)
+	t.Equal([]string{testUser}, usernames(viewers))
+
+	t.sendForJSON(http.MethodDelete, presencePath, nil, http.StatusOK, nil)
+	t.sendForJSON(http.MethodGet, presencePath, nil, http.StatusOK, &viewers)
+	t.Empty(viewers)
+}
+
+func (t *serverTestSuite) TestAccessControl() {
+	s := newTestServer(t.T(), drawingReposConfigs{
+		firstTestRepo:  drawingRepoConfig{name: firstTestRepo, label: "First Repo", storeType: MEMORY},
+		secondTestRepo: drawingRepoConfig{name: secondTestRepo, label: "Second Repo", storeType: MEMORY},
+	})
+	s.config.access = &accessConfig{
+		Groups: map[string][]string{"owners": {testUser}},
+		Repos: map[string][]roleAssignment{
+			allRepos:      {{Group: "owners", Role: "admin"}},
+			firstTestRepo: {{User: otherTestUser, Role: "reader"}},
+		},
+	}
+	t.engine = s.createEngine()
+
+	firstId := t.createDrawing(firstTestRepo, "first content")
+	secondId := t.createDrawing(secondTestRepo, "second content")
+
+	var repos []drawingRepoRef
+	t.Require().NoError(json.Unmarshal(t.sendAs(otherTestUser, http.MethodGet, "/api/drawingRepositories", nil, http.Header{}).Body.Bytes(), &repos))
+	t.Equal([]drawingRepoRef{{Name: firstTestRepo, Label: "First Repo"}}, repos)
+	var lists drawingLists
+	t.Require().NoError(json.Unmarshal(t.sendAs(otherTestUser, http.MethodGet, "/api/drawings", nil, http.Header{}).Body.Bytes(), &lists))
+	t.Len(lists, 1)
+	t.Contains(lists, drawingRepoName(firstTestRepo))
+
+	t.Equal(http.StatusOK, t.sendAs(otherTestUser, http.MethodGet, "/api/drawing/"+firstTestRepo+"/"+firstId, nil, http.Header{}).Code)
+	t.Equal(http.StatusForbidden, t.sendAs(otherTestUser, http.MethodPut, "/api/drawing/"+firstTestRepo+"/"+firstId, putDrawingRequest{Content: "changed"}, http.Header{}).Code)
+	t.Equal(http.StatusForbidden, t.sendAs(otherTestUser, http.MethodDelete, "/api/drawing/"+firstTestRepo+"/"+firstId, nil, http.Header{}).Code)
+	t.Equal(http.StatusForbidden, t.sendAs(otherTestUser, http.MethodPost, "/api/drawing/"+firstTestRepo+"/"+firstId+"/copy", nil, http.Header{}).Code)
+	t.Equal(http.StatusNotFound, t.sendAs(otherTestUser, http.MethodPost, "/api/drawing/"+firstTestRepo+"/"+firstId+"/copy", transferDrawingRequest{TargetRepo: secondTestRepo}, http.Header{}).Code)
+	t.Equal(http.StatusNotFound, t.sendAs(otherTestUser, http.MethodGet, "/api/drawing/"+secondTestRepo+"/"+secondId, nil, http.Header{}).Code)
+	t.Equal("first content", t.getDrawing(firstTestRepo, firstId))
+
+	t.sendForJSON(http.MethodPut, "/api/drawing/"+firstTestRepo+"/"+firstId+"/lock", nil, http.StatusOK, nil)
+	t.sendForJSON(http.MethodPost, "/api/drawing/"+secondTestRepo+"/"+secondId+"/copy", transferDrawingRequest{TargetRepo: firstTestRepo}, http.StatusOK, nil)
+}
+
+func (t *serverTestSuite) TestAPITokens() {
+	firstId := t.createDrawing(firstTestRepo, "first content")
+	secondId := t.createDrawing(secondTestRepo, "second content")
+
+	var readToken createAPITokenResponse
+	t.sendForJSON(http.MethodPost, "/api/tokens", createAPITokenRequest{Name: "backup", Repos: []string{firstTestRepo}, Scope: readScope}, http.StatusCreated, &readToken)
+	t.NotEmpty(readToken.Token)
+	t.Empty(readToken.Hash)
+	var writeToken createAPITokenResponse
+	t.sendForJSON(http.MethodPost, "/api/tokens", createAPITokenRequest{Name: "ci", Scope: writeScope}, http.StatusCreated, &writeToken)
+
+	t.Equal(http.StatusOK, t.sendWithToken(readToken.Token, http.MethodGet, "/api/drawing/"+firstTestRepo+"/"+firstId, nil).Code)
+	t.Equal(http.StatusNotFound, t.sendWithToken(readToken.Token, http.MethodGet, "/api/drawing/"+secondTestRepo+"/"+secondId, nil).Code)
+	t.Equal(http.StatusForbidden, t.sendWithToken(readToken.Token, http.MethodPut, "/api/drawing/"+firstTestRepo+"/"+firstId, putDrawingRequest{Content: "changed"}).Code)
+	var repos []drawingRepoRef
+	t.Require().NoError(json.Unmarshal(t.sendWithToken(readToken.Token, http.MethodGet, "/api/drawingRepositories", nil).Body.Bytes(), &repos))
+	t.Equal([]drawingRepoRef{{Name: firstTestRepo, Label: "First Repo"}}, repos)
+
+	t.Equal(http.StatusOK, t.sendWithToken(writeToken.Token, http.MethodPut, "/api/drawing/"+secondTestRepo+"/"+secondId, putDrawingRequest{Content: "changed"}).Code)
+	t.Equal("changed", t.getDrawing(secondTestRepo, secondId))
+	t.Equal(http.StatusForbidden, t.sendWithToken(writeToken.Token, http.MethodGet, "/api/tokens", nil).Code, "tokens can't manage tokens")
+
+	var tokens []apiToken
+	t.sendForJSON(http.MethodGet, "/api/tokens", nil, http.StatusOK, &tokens)
+	t.Len(tokens, 2)
+	t.False(tokens[0].LastUsedAt.IsZero())
+	t.Equal(http.StatusNotFound, t.sendAs(otherTestUser, http.MethodDelete, "/api/tokens/"+readToken.Id, nil, http.Header{}).Code)
+	t.sendForJSON(http.MethodDelete, "/api/tokens/"+readToken.Id, nil, http.StatusNoContent, nil)
+
+	recorder := t.sendWithToken(readToken.Token, http.MethodGet, "/api/drawing/"+firstTestRepo+"/"+firstId, nil)
+	t.Equal(http.StatusUnauthorized, recorder.Code)
+	t.Equal(`Bearer error="invalid_token"`, recorder.Header().Get("WWW-Authenticate"))
+
+	t.Equal(http.StatusBadRequest, t.send(http.MethodPost, "/api/tokens", createAPITokenRequest{Name: "bad", Scope: "admin"}).Code)
+	t.Equal(http.StatusBadRequest, t.send(http.MethodPost, "/api/tokens", createAPITokenRequest{Name: "bad", Repos: []string{"nosuchrepo"}, Scope: readScope}).Code)
+	t.Equal(http.StatusBadRequest, t.send(http.MethodPost, "/api/tokens", createAPITokenRequest{Name: "bad", Scope: readScope, ExpiresAt: time.Now().Add(-time.Hour)}).Code)
+}
+
+func (t *serverTestSuite) TestAPITokenOfRemovedUser() {
+	var token createAPITokenResponse
+	t.sendForJSON(http.MethodPost, "/api/tokens", createAPITokenRequest{Name: "ci", Scope: readScope}, http.StatusCreated, &token)
+	t.Equal(http.StatusOK, t.sendWithToken(token.Token, http.MethodGet, "/api/drawings", nil).Code)
+
+	t.Require().NoError(updatePasswordFile(os.Getenv("XCALIAPP_PASSWORDFILE"), testUser, ""))
+	t.Require().NoError(t.passwords.reload())
+	recorder := t.sendWithToken(token.Token, http.MethodGet, "/api/drawings", nil)
+	t.Equal(http.StatusUnauthorized, recorder.Code)
+	t.Equal(`Bearer error="invalid_token"`, recorder.Header().Get("WWW-Authenticate"))
+}
+
+func (t *serverTestSuite) TestEditLocks() {
+	id := t.createDrawing(firstTestRepo, "content 1")
+	drawingPath := "/api/drawing/" + firstTestRepo + "/" + id
+	lockPath := drawingPath + "/lock"
+
+	t.Equal(http.StatusNotFound, t.send(http.MethodGet, lockPath, nil).Code)
+
+	var acquired editLock
+	t.sendForJSON(http.MethodPut, lockPath, nil, http.StatusOK, &acquired)
+	t.Equal(testUser, acquired.Holder)
+	var renewed editLock
+	t.sendForJSON(http.MethodPut, lockPath, nil, http.StatusOK, &renewed)
+	t.Equal(acquired.AcquiredAt, renewed.AcquiredAt)
+
+	recorder := t.sendAs(otherTestUser, http.MethodGet, lockPath, nil, http.Header{})
+	t.Equal(http.StatusOK, recorder.Code)
+
+	recorder = t.sendAs(otherTestUser, http.MethodPut, lockPath, nil, http.Header{})
+	t.Equal(http.StatusLocked, recorder.Code)
+	recorder = t.sendAs(otherTestUser, http.MethodPut, drawingPath, putDrawingRequest{Content: "content 2"}, http.Header{})
+	t.Equal(http.StatusLocked, recorder.Code)
+	var lockResponse editLockResponse
+	t.Require().NoError(json.Unmarshal(recorder.Body.Bytes(), &lockResponse))
+	t.Equal(testUser, lockResponse.Lock.Holder)
+	t.Equal(http.StatusLocked, t.sendAs(otherTestUser, http.MethodDelete, drawingPath, nil, http.Header{}).Code)
+	t.Equal(http.StatusForbidden, t.sendAs(otherTestUser, http.MethodDelete, lockPath, nil, http.Header{}).Code)
+	t.Equal(http.StatusForbidden, t.sendAs(otherTestUser, http.MethodDelete, lockPath+"?force=true", nil, http.Header{}).Code)
+	t.Equal("content 1", t.getDrawing(firstTestRepo, id))
+
+	t.sendForJSON(http.MethodPut, drawingPath, putDrawingRequest{Content: "content 2"}, http.StatusOK, nil)
+
+	t.Equal(http.StatusOK, t.sendAs(adminTestUser, http.MethodDelete, lockPath+"?force=true", nil, http.Header{}).Code)
+	t.Equal(http.StatusNotFound, t.send(http.MethodGet, lockPath, nil).Code)
+	t.Equal(http.StatusOK, t.sendAs(otherTestUser, http.MethodPut, drawingPath, putDrawingRequest{Content: "content 3"}, http.Header{}).Code)
+	t.Equal("content 3", t.getDrawing(firstTestRepo, id))
+}
+
+func (t *serverTestSuite) TestDrawingChangeEvents() {
+	httpServer := httptest.NewServer(t.engine)
+	defer httpServer.Close()
+
+	request, _ := http.NewRequestWithContext(t.T().Context(), http.MethodGet, httpServer.URL+"/api/drawings/events", nil)
+	request.SetBasicAuth(testUser, "pass")
+	response, requestErr := http.DefaultClient.Do(request)
+	t.Require().NoError(requestErr)
+	defer response.Body.Close()
+	t.Require().Equal(http.StatusOK, response.StatusCode)
+
+	id := t.createDrawing(firstTestRepo, "content 1")
+	t.sendForJSON(http.MethodPut, "/api/drawing/"+firstTestRepo+"/"+id, putDrawingRequest{Content: "content 2"}, http.StatusOK, nil)
+	t.sendForJSON(http.MethodDelete, "/api/drawing/"+firstTestRepo+"/"+id, nil, http.StatusOK, nil)
+
+	scanner := bufio.NewScanner(response.Body)
+	events := []changeEvent{}
+	for len(events) < 3 && scanner.Scan() {
+		data, isData := strings.CutPrefix(scanner.Text(), "data:")
+		if !isData {
+			continue
+		}
+		var event changeEvent
+		t.Require().NoError(json.Unmarshal([]byte(data), &event))
+		events = append(events, event)
+	}
+	t.Require().Len(events, 3)
+	for i, expectedType := range []changeEventType{drawingCreated, drawingUpdated, drawingDeleted} {
+		t.Equal(expectedType, events[i].Type)
+		t.Equal(firstTestRepo, events[i].Repo)
+		t.Equal(id, events[i].Id)
+		t.Equal(testUser, events[i].User)
+	}
+}
+
+func (t *serverTestSuite) TestRefOnRepoWithoutBranches() {
+	id := t.createDrawing(firstTestRepo, "content")
+
+	t.Equal(http.StatusBadRequest, t.send(http.MethodGet, "/api/drawing/"+firstTestRepo+"/"+id+"?ref=feature", nil).Code)
+	t.Equal(http.StatusNotFound, t.send(http.MethodGet, "/api/drawingRepositories/"+firstTestRepo+"/branches", nil).Code)
+
+	var items []drawingRepoItem
+	t.sendForJSON(http.MethodGet, "/api/drawingRepositories/"+firstTestRepo+"/drawings", nil, http.StatusOK, &items)
+	t.Equal([]drawingRepoItem{{Id: id, Title: id}}, items)
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/memstore"
+	"github.com/gomodule/redigo/redis"
+	"github.com/gorilla/securecookie"
+	gsessions "github.com/gorilla/sessions"
+	"github.com/rs/zerolog"
+	bolt "go.etcd.io/bbolt"
+)
+
+// the types of the session stores
+const (
+	memorySessionStore = "memory" // the sessions are lost on restart
+	fileSessionStore   = "file"
+	boltSessionStore   = "bolt"
+	redisSessionStore  = "redis"
+)
+
+const (
+	sessionCookieName     = "mysession"
+	minSessionKeyLength   = 32
+	defaultSessionMaxAge  = 12 * time.Hour
+	sessionPurgePeriod    = 10 * time.Minute
+	redisSessionKeyPrefix = "xcaliapp:session:"
+)
+
+var (
+	sessionBoltBucket = []byte("sessions")
+	sessionIdPattern  = regexp.MustCompile("^[A-Z2-7]{26}$") // as generated by rand.Text
+)
+
+type sessionConfig struct {
+	storeType string
+	path      string   // the directory of the file store or the database file of the bolt store
+	redisURL  string   // e.g. "redis://:password@localhost:6379/0"
+	keys      [][]byte // the first key signs the cookies, all of them are accepted, so that the key can be rotated
+	secure    bool
+	sameSite  http.SameSite
+	maxAge    time.Duration
+}
+
+func (config sessionConfig) validate() error {
+	switch config.storeType {
+	case memorySessionStore:
+	case fileSessionStore, boltSessionStore:
+		if len(config.path) == 0 {
+			return fmt.Errorf("the %s session store requires a path", config.storeType)
+		}
+	case redisSessionStore:
+		if len(config.redisURL) == 0 {
+			return fmt.Errorf("the %s session store requires a URL", config.storeType)
+		}
+	default:
+		return fmt.Errorf("unknown session store type %q", config.storeType)
+	}
+	if config.storeType != memorySessionStore && len(config.keys) == 0 {
+		return fmt.Errorf("the %s session store requires a session key, otherwise the sessions are lost on restart anyway", config.storeType)
+	}
+	for i, key := range config.keys {
+		if len(key) < minSessionKeyLength {
+			return fmt.Errorf("session key #%d is shorter than %d bytes", i+1, minSessionKeyLength)
+		}
+	}
+	if config.maxAge <= 0 {
+		return fmt.Errorf("invalid session max age %v", config.maxAge)
+	}
+	if config.sameSite == http.SameSiteNoneMode && !config.secure {
+		return errors.New("SameSite=None session cookies must be secure")
+	}
+	return nil
+}
+
+func (config sessionConfig) cookieOptions() sessions.Options {
+	return sessions.Options{
+		Path:     "/",
+		MaxAge:   int(config.maxAge.Seconds()),
+		Secure:   config.secure,
+		HttpOnly: true,
+		SameSite: config.sameSite,
+	}
+}
+
+// keyPairs returns the keys as the hash-key, encryption-key pairs of securecookie; the cookies
+// only carry the session ids, so they are signed, not encrypted
+func (config sessionConfig) keyPairs() [][]byte {
+	keys := config.keys
+	if len(keys) == 0 {
+		keys = [][]byte{securecookie.GenerateRandomKey(minSessionKeyLength)}
+	}
+	pairs := [][]byte{}
+	for _, key := range keys {
+		pairs = append(pairs, key, nil)
+	}
+	return pairs
+}
+
+// sessionBackend keeps the encoded values of the sessions by id
+type sessionBackend interface {
+	load(id string, now time.Time) ([]byte, error) // nil when the session doesn't exist or has expired
+	save(id string, data []byte, expires time.Time) error
+	delete(id string) error
+	purgeExpired(now time.Time) error
+	close() error
+}
+
+func newSessionStore(config sessionConfig) (sessions.Store, error) {
+	var backend sessionBackend
+	switch config.storeType {
+	case memorySessionStore:
+		store := memstore.NewStore(config.keyPairs()...)
+		store.Options(config.cookieOptions())
+		return store, nil
+	case fileSessionStore:
+		if mkdirErr := os.MkdirAll(config.path, 0o700); mkdirErr != nil {
+			return nil, fmt.Errorf("failed to create session directory %s: %w", config.path, mkdirErr)
+		}
+		backend = fileSessionBackend{dir: config.path}
+	case boltSessionStore:
+		boltBackend, openErr := openBoltSessionBackend(config.path)
+		if openErr != nil {
+			return nil, openErr
+		}
+		backend = boltBackend
+	case redisSessionStore:
+		backend = newRedisSessionBackend(config.redisURL)
+	default:
+		return nil, fmt.Errorf("unknown session store type %q", config.storeType)
+	}
+
+	codecs := securecookie.CodecsFromPairs(config.keyPairs()...)
+	for _, codec := range codecs {
+		codec.(*securecookie.SecureCookie).MaxAge(int(config.maxAge.Seconds()))
+	}
+	options := config.cookieOptions()
+	return &serverSideSessionStore{codecs: codecs, options: options.ToGorillaOptions(), backend: backend, now: time.Now}, nil
+}
+
+// serverSideSessionStore keeps the values of the sessions in a backend; the cookies only carry
+// the signed session ids
+type serverSideSessionStore struct {
+	codecs  []securecookie.Codec
+	options *gsessions.Options
+	backend sessionBackend
+	now     func() time.Time
+}
+
+func (store *serverSideSessionStore) Options(options sessions.Options) {
+	store.options = options.ToGorillaOptions()
+}
+
+func (store *serverSideSessionStore) Get(r *http.Request, name string) (*gsessions.Session, error) {
+	return gsessions.GetRegistry(r).Get(store, name)
+}
+
+// New returns the session of the cookie, or a new session if there is no valid cookie or the
+// session has expired
+func (store *serverSideSessionStore) New(r *http.Request, name string) (*gsessions.Session, error) {
+	session := gsessions.NewSession(store, name)
+	options := *store.options
+	session.Options = &options
+	session.IsNew = true
+
+	cookie, cookieErr := r.Cookie(name)
+	if cookieErr != nil {
+		return session, nil
+	}
+	var id string
+	if decodeErr := securecookie.DecodeMulti(name, cookie.Value, &id, store.codecs...); decodeErr != nil || !sessionIdPattern.MatchString(id) {
+		return session, nil // e.g. signed with a key no longer in use
+	}
+	data, loadErr := store.backend.load(id, store.now())
+	if loadErr != nil || data == nil {
+		return session, loadErr
+	}
+	if deserializeErr := (securecookie.GobEncoder{}).Deserialize(data, &session.Values); deserializeErr != nil {
+		return session, fmt.Errorf("failed to decode session: %w", deserializeErr)
+	}
+	session.ID = id
+	session.IsNew = false
+	return session, nil
+}
+
+// Save saves the session, deleting it if its max age is negative
+func (store *serverSideSessionStore) Save(r *http.Request, w http.ResponseWriter, session *gsessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if len(session.ID) > 0 {
+			if deleteErr := store.backend.delete(session.ID); deleteErr != nil {
+				return deleteErr
+			}
+		}
+		http.SetCookie(w, gsessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if len(session.ID) == 0 {
+		session.ID = rand.Text()
+	}
+	data, serializeErr := (securecookie.GobEncoder{}).Serialize(session.Values)
+	if serializeErr != nil {
+		return fmt.Errorf("failed to encode session: %w", serializeErr)
+	}
+	maxAge := time.Duration(session.Options.MaxAge) * time.Second
+	if maxAge == 0 {
+		maxAge = defaultSessionMaxAge // the cookie lasts as long as the browser session
+	}
+	if saveErr := store.backend.save(session.ID, data, store.now().Add(maxAge)); saveErr != nil {
+		return saveErr
+	}
+	encoded, encodeErr := securecookie.EncodeMulti(session.Name(), session.ID, store.codecs...)
+	if encodeErr != nil {
+		return encodeErr
+	}
+	http.SetCookie(w, gsessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+func (store *serverSideSessionStore) purgeExpiredPeriodically(interval time.Duration, stop <-chan struct{}, logger zerolog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if purgeErr := store.backend.purgeExpired(store.now()); purgeErr != nil {
+				logger.Error().Err(purgeErr).Msg("failed to purge expired sessions")
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (store *serverSideSessionStore) close() error {
+	return store.backend.close()
+}
+
+// encodeSessionRecord prefixes the data with the expiry, for the backends which don't expire
+// entries themselves
+func encodeSessionRecord(data []byte, expires time.Time) []byte {
+	return append(binary.BigEndian.AppendUint64(nil, uint64(expires.Unix())), data...)
+}
+
+func decodeSessionRecord(record []byte) ([]byte, time.Time, bool) {
+	if len(record) < 8 {
+		return nil, time.Time{}, false
+	}
+	return record[8:], time.Unix(int64(binary.BigEndian.Uint64(record[:8])), 0), true
+}
+
+// fileSessionBackend keeps each session in a file named after its id
+type fileSessionBackend struct {
+	dir string
+}
+
+func (backend fileSessionBackend) load(id string, now time.Time) ([]byte, error) {
+	record, readErr := os.ReadFile(filepath.Join(backend.dir, id))
+	if errors.Is(readErr, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if readErr != nil {
+		return nil, fmt.Errorf("failed to read session: %w", readErr)
+	}
+	data, expires, valid := decodeSessionRecord(record)
+	if !valid || !now.Before(expires) {
+		return nil, nil
+	}
+	return data, nil
+}
+
+func (backend fileSessionBackend) save(id string, data []byte, expires time.Time) error {
+	if writeErr := writeFile(filepath.Join(backend.dir, id), encodeSessionRecord(data, expires), 0o600); writeErr != nil {
+		return fmt.Errorf("failed to write session: %w", writeErr)
+	}
+	return nil
+}
+
+func (backend fileSessionBackend) delete(id string) error {
+	if removeErr := os.Remove(filepath.Join(backend.dir, id)); removeErr != nil && !errors.Is(removeErr, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete session: %w", removeErr)
+	}
+	return nil
+}
+
+func (backend fileSessionBackend) purgeExpired(now time.Time) error {
+	entries, readErr := os.ReadDir(backend.dir)
+	if readErr != nil {
+		return fmt.Errorf("failed to list sessions: %w", readErr)
+	}
+	for _, entry := range entries {
+		if !sessionIdPattern.MatchString(entry.Name()) {
+			continue
+		}
+		record, readErr := os.ReadFile(filepath.Join(backend.dir, entry.Name()))
+		if readErr != nil {
+			continue // e.g. deleted meanwhile
+		}
+		if _, expires, valid := decodeSessionRecord(record); !valid || !now.Before(expires) {
+			if deleteErr := backend.delete(entry.Name()); deleteErr != nil {
+				return deleteErr
+			}
+		}
+	}
+	return nil
+}
+
+func (backend fileSessionBackend) close() error {
+	return nil
+}
+
+// boltSessionBackend keeps the sessions in a bbolt database
+type boltSessionBackend struct {
+	db *bolt.DB
+}
+
+func openBoltSessionBackend(fileName string) (*boltSessionBackend, error) {
+	db, openErr := bolt.Open(fileName, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if openErr != nil {
+		return nil, fmt.Errorf("failed to open session database %s: %w", fileName, openErr)
+	}
+	updateErr := db.Update(func(tx *bolt.Tx) error {
+		_, createErr := tx.CreateBucketIfNotExists(sessionBoltBucket)
+		return createErr
+	})
+	if updateErr != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize session database %s: %w", fileName, updateErr)
+	}
+	return &boltSessionBackend{db: db}, nil
+}
+
+func (backend *boltSessionBackend) load(id string, now time.Time) ([]byte, error) {
+	var data []byte
+	viewErr := backend.db.View(func(tx *bolt.Tx) error {
+		record, expires, valid := decodeSessionRecord(tx.Bucket(sessionBoltBucket).Get([]byte(id)))
+		if valid && now.Before(expires) {
+			data = bytes.Clone(record) // the record is only valid during the transaction
+		}
+		return nil
+	})
+	if viewErr != nil {
+		return nil, fmt.Errorf("failed to read session: %w", viewErr)
+	}
+	return data, nil
+}
+
+func (backend *boltSessionBackend) save(id string, data []byte, expires time.Time) error {
+	updateErr := backend.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionBoltBucket).Put([]byte(id), encodeSessionRecord(data, expires))
+	})
+	if updateErr != nil {
+		return fmt.Errorf("failed to write session: %w", updateErr)
+	}
+	return nil
+}
+
+func (backend *boltSessionBackend) delete(id string) error {
+	updateErr := backend.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionBoltBucket).Delete([]byte(id))
+	})
+	if updateErr != nil {
+		return fmt.Errorf("failed to delete session: %w", updateErr)
+	}
+	return nil
+}
+
+func (backend *boltSessionBackend) close() error {
+	return backend.db.Close()
+}
+
+func (backend *boltSessionBackend) purgeExpired(now time.Time) error {
+	updateErr := backend.db.Update(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(sessionBoltBucket).Cursor()
+		for id, record := cursor.First(); id != nil; {
+			if _, expires, valid := decodeSessionRecord(record); !valid || !now.Before(expires) {
+				if deleteErr := cursor.Delete(); deleteErr != nil {
+					return deleteErr
+				}
+				id, record = cursor.Seek(id) // the cursor is moved by the deletion
+				continue
+			}
+			id, record = cursor.Next()
+		}
+		return nil
+	})
+	if updateErr != nil {
+		return fmt.Errorf("failed to purge sessions: %w", updateErr)
+	}
+	return nil
+}
+
+// redisSessionBackend keeps the sessions in a Redis-compatible server, which expires them
+type redisSessionBackend struct {
+	pool *redis.Pool
+}
+
+func newRedisSessionBackend(url string) *redisSessionBackend {
+	return &redisSessionBackend{pool: &redis.Pool{
+		MaxIdle:     4,
+		IdleTimeout: 5 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(url, redis.DialConnectTimeout(5*time.Second))
+		},
+	}}
+}
+
+func (backend *redisSessionBackend) load(id string, now time.Time) ([]byte, error) {
+	conn := backend.pool.Get()
+	defer conn.Close()
+	data, getErr := redis.Bytes(conn.Do("GET", redisSessionKeyPrefix+id))
+	if errors.Is(getErr, redis.ErrNil) {
+		return nil, nil
+	}
+	if getErr != nil {
+		return nil, fmt.Errorf("failed to read session: %w", getErr)
+	}
+	return data, nil
+}
+
+func (backend *redisSessionBackend) save(id string, data []byte, expires time.Time) error {
+	conn := backend.pool.Get()
+	defer conn.Close()
+	ttl := max(time.Until(expires).Milliseconds(), 1)
+	if _, setErr := conn.Do("SET", redisSessionKeyPrefix+id, data, "PX", ttl); setErr != nil {
+		return fmt.Errorf("failed to write session: %w", setErr)
+	}
+	return nil
+}
+
+func (backend *redisSessionBackend) delete(id string) error {
+	conn := backend.pool.Get()
+	defer conn.Close()
+	if _, delErr := conn.Do("DEL", redisSessionKeyPrefix+id); delErr != nil {
+		return fmt.Errorf("failed to delete session: %w", delErr)
+	}
+	return nil
+}
+
+func (backend *redisSessionBackend) purgeExpired(now time.Time) error {
+	return nil
+}
+
+func (backend *redisSessionBackend) close() error {
+	return backend.pool.Close()
+}
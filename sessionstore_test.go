@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+)
+
+const (
+	oldTestSessionKey = "old-session-key-0123456789abcdefghij"
+	newTestSessionKey = "new-session-key-0123456789abcdefghij"
+)
+
+type sessionStoreTestSuite struct {
+	suite.Suite
+}
+
+func TestSessionStore(t *testing.T) {
+	suite.Run(t, &sessionStoreTestSuite{})
+}
+
+func (t *sessionStoreTestSuite) SetupSuite() {
+	gob.Register(User{})
+}
+
+func (t *sessionStoreTestSuite) checkBackend(backend sessionBackend) {
+	now := time.Now()
+	t.Require().NoError(backend.save("A", []byte("first"), now.Add(time.Hour)))
+	t.Require().NoError(backend.save("B", []byte("second"), now.Add(2*time.Hour)))
+
+	data, loadErr := backend.load("A", now)
+	t.Require().NoError(loadErr)
+	t.Equal("first", string(data))
+	data, loadErr = backend.load("C", now)
+	t.Require().NoError(loadErr)
+	t.Nil(data)
+
+	t.Require().NoError(backend.delete("B"))
+	data, _ = backend.load("B", now)
+	t.Nil(data)
+	t.Require().NoError(backend.delete("B"), "deleting a missing session is no error")
+}
+
+func (t *sessionStoreTestSuite) TestFileBackend() {
+	backend := fileSessionBackend{dir: t.T().TempDir()}
+	t.checkBackend(backend)
+
+	now := time.Now()
+	expiredId, liveId := "AAAAAAAAAAAAAAAAAAAAAAAAAA", "BBBBBBBBBBBBBBBBBBBBBBBBBB"
+	t.Require().NoError(backend.save(expiredId, []byte("expired"), now.Add(-time.Second)))
+	t.Require().NoError(backend.save(liveId, []byte("live"), now.Add(time.Hour)))
+	data, _ := backend.load(expiredId, now)
+	t.Nil(data)
+	t.Require().NoError(backend.purgeExpired(now))
+	_, statErr := os.Stat(filepath.Join(backend.dir, expiredId))
+	t.True(os.IsNotExist(statErr))
+	info, statErr := os.Stat(filepath.Join(backend.dir, liveId))
+	t.Require().NoError(statErr)
+	t.Equal(os.FileMode(0o600), info.Mode().Perm())
+}
+
+func (t *sessionStoreTestSuite) TestBoltBackend() {
+	backend, openErr := openBoltSessionBackend(filepath.Join(t.T().TempDir(), "sessions.db"))
+	t.Require().NoError(openErr)
+	defer backend.db.Close()
+	t.checkBackend(backend)
+
+	now := time.Now()
+	for i, expires := range []time.Time{now.Add(-time.Hour), now.Add(-time.Second), now.Add(time.Hour), now.Add(-time.Minute)} {
+		t.Require().NoError(backend.save(fmt.Sprintf("id%d", i), []byte("data"), expires))
+	}
+	t.Require().NoError(backend.purgeExpired(now))
+	for i, expected := range []bool{false, false, true, false} {
+		data, _ := backend.load(fmt.Sprintf("id%d", i), now.Add(-2*time.Hour))
+		t.Equal(expected, data != nil, i)
+	}
+}
+
+func (t *sessionStoreTestSuite) TestRedisBackend() {
+	server := newFakeRedisServer(t.T())
+	t.checkBackend(newRedisSessionBackend("redis://" + server.address))
+	t.Contains(server.keys(), redisSessionKeyPrefix+"A")
+}
+
+func (t *sessionStoreTestSuite) TestKeyRotation() {
+	backend := fileSessionBackend{dir: t.T().TempDir()}
+	storeWith := func(keys ...string) *serverSideSessionStore {
+		config := sessionConfig{storeType: fileSessionStore, path: backend.dir, maxAge: time.Hour, sameSite: http.SameSiteLaxMode}
+		for _, key := range keys {
+			config.keys = append(config.keys, []byte(key))
+		}
+		store, storeErr := newSessionStore(config)
+		t.Require().NoError(storeErr)
+		return store.(*serverSideSessionStore)
+	}
+
+	oldStore := storeWith(oldTestSessionKey)
+	session, _ := oldStore.New(httptest.NewRequest(http.MethodGet, "/", nil), sessionCookieName)
+	session.Values[userKey] = User{"joe"}
+	recorder := httptest.NewRecorder()
+	t.Require().NoError(oldStore.Save(nil, recorder, session))
+	cookie := recorder.Result().Cookies()[0]
+	t.True(cookie.HttpOnly)
+	t.Equal(http.SameSiteLaxMode, cookie.SameSite)
+
+	load := func(store *serverSideSessionStore) any {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.AddCookie(cookie)
+		loaded, loadErr := store.New(request, sessionCookieName)
+		t.Require().NoError(loadErr)
+		return loaded.Values[userKey]
+	}
+	t.Equal(User{"joe"}, load(oldStore))
+	t.Equal(User{"joe"}, load(storeWith(newTestSessionKey, oldTestSessionKey)), "the old key is still accepted")
+	t.Nil(load(storeWith(newTestSessionKey)), "the old key has been retired")
+}
+
+func (t *sessionStoreTestSuite) TestSessionsSurviveRestart() {
+	t.T().Setenv("XCALIAPP_SESSION_STORE", boltSessionStore)
+	t.T().Setenv("XCALIAPP_SESSION_PATH", filepath.Join(t.T().TempDir(), "sessions.db"))
+	t.T().Setenv("XCALIAPP_SESSION_KEYS", newTestSessionKey+","+oldTestSessionKey)
+	useTestPasswordFile(t.T())
+	gin.SetMode(gin.TestMode)
+	serve := func(s *server, request *http.Request) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		s.createEngine().ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	first, firstErr := newServer(drawingReposConfigs{})
+	t.Require().NoError(firstErr)
+	request := httptest.NewRequest(http.MethodGet, "/api/drawings", nil)
+	request.SetBasicAuth(testUser, "pass")
+	recorder := serve(first, request)
+	t.Require().Equal(http.StatusOK, recorder.Code)
+	cookies := recorder.Result().Cookies()
+	t.Require().Len(cookies, 1)
+	t.True(cookies[0].Secure)
+	t.Equal(int(defaultSessionMaxAge.Seconds()), cookies[0].MaxAge)
+	t.Require().NoError(first.Close())
+
+	second := newTestServer(t.T(), drawingReposConfigs{})
+	withCookie := func(method string, path string) *http.Request {
+		request := httptest.NewRequest(method, path, nil)
+		request.AddCookie(cookies[0])
+		return request
+	}
+	t.Equal(http.StatusOK, serve(second, withCookie(http.MethodGet, "/api/drawings")).Code)
+	t.Equal(http.StatusNoContent, serve(second, withCookie(http.MethodPost, oidcLogoutPath)).Code)
+	t.Equal(http.StatusUnauthorized, serve(second, withCookie(http.MethodGet, "/api/drawings")).Code)
+}
+
+func (t *sessionStoreTestSuite) TestConfig() {
+	keyFileName := filepath.Join(t.T().TempDir(), "keys")
+	t.Require().NoError(os.WriteFile(keyFileName, []byte("# the current key first\n"+newTestSessionKey+"\n\n"+oldTestSessionKey+"\n"), 0o600))
+	t.T().Setenv("XCALIAPP_SESSION_STORE", fileSessionStore)
+	t.T().Setenv("XCALIAPP_SESSION_PATH", t.T().TempDir())
+	t.T().Setenv("XCALIAPP_SESSION_KEYFILE", keyFileName)
+	t.T().Setenv("XCALIAPP_SESSION_SAMESITE", "Strict")
+	t.T().Setenv("XCALIAPP_SESSION_MAXAGE", "30m")
+
+	config, configErr := getSessionConfig()
+	t.Require().NoError(configErr)
+	t.Equal([][]byte{[]byte(newTestSessionKey), []byte(oldTestSessionKey)}, config.keys)
+	t.Equal(http.SameSiteStrictMode, config.sameSite)
+	t.Equal(30*time.Minute, config.maxAge)
+	t.True(config.secure)
+
+	t.T().Setenv("XCALIAPP_SESSION_SAMESITE", "none")
+	t.T().Setenv("XCALIAPP_SESSION_SECURE", "false")
+	_, configErr = getSessionConfig()
+	t.ErrorContains(configErr, "SameSite=None")
+
+	t.T().Setenv("XCALIAPP_SESSION_SAMESITE", "")
+	t.T().Setenv("XCALIAPP_SESSION_KEYFILE", "")
+	_, configErr = getSessionConfig()
+	t.ErrorContains(configErr, "requires a session key")
+
+	t.T().Setenv("XCALIAPP_SESSION_KEYS", "short")
+	_, configErr = getSessionConfig()
+	t.ErrorContains(configErr, "shorter than")
+}
+
+// fakeRedisServer understands the few commands of the Redis protocol the session backend uses
+type fakeRedisServer struct {
+	address string
+	lock    sync.Mutex
+	values  map[string]string
+}
+
+func newFakeRedisServer(t *testing.T) *fakeRedisServer {
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+	t.Cleanup(func() { listener.Close() })
+	server := &fakeRedisServer{address: listener.Addr().String(), values: map[string]string{}}
+	go func() {
+		for {
+			conn, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (server *fakeRedisServer) keys() []string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	keys := []string{}
+	for key := range server.values {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (server *fakeRedisServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	readLine := func() (string, error) {
+		line, readErr := reader.ReadString('\n')
+		return strings.TrimRight(line, "\r\n"), readErr
+	}
+	for {
+		header, readErr := readLine()
+		if readErr != nil || !strings.HasPrefix(header, "*") {
+			return
+		}
+		argCount, _ := strconv.Atoi(header[1:])
+		args := make([]string, argCount)
+		for i := range args {
+			lengthLine, _ := readLine()
+			length, _ := strconv.Atoi(strings.TrimPrefix(lengthLine, "$"))
+			arg := make([]byte, length+2)
+			if _, readErr := io.ReadFull(reader, arg); readErr != nil {
+				return
+			}
+			args[i] = string(arg[:length])
+		}
+
+		server.lock.Lock()
+		var reply string
+		switch strings.ToUpper(args[0]) {
+		case "SET":
+			server.values[args[1]] = args[2]
+			reply = "+OK\r\n"
+		case "GET":
+			if value, exists := server.values[args[1]]; exists {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+			} else {
+				reply = "$-1\r\n"
+			}
+		case "DEL":
+			_, exists := server.values[args[1]]
+			delete(server.values, args[1])
+			reply = ":" + map[bool]string{true: "1", false: "0"}[exists] + "\r\n"
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		server.lock.Unlock()
+		if _, writeErr := io.WriteString(conn, reply); writeErr != nil {
+			return
+		}
+	}
+}
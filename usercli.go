@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+const usersCommandUsage = `usage: %s users add|passwd|remove [-file FILE] [-hash bcrypt|argon2id] USERNAME
+
+Manages the users of the password file, which defaults to $XCALIAPP_PASSWORDFILE.
+The password is prompted for on terminals, read from the first line of the standard input otherwise.
+`
+
+// runUsersCommand adds users to the password file, sets their passwords or removes them
+func runUsersCommand(args []string, readPassword func() (string, error), output io.Writer) error {
+	usage := func() {
+		fmt.Fprintf(output, usersCommandUsage, os.Args[0])
+	}
+	if len(args) == 0 {
+		usage()
+		return errors.New("missing users command")
+	}
+	action := args[0]
+	flags := flag.NewFlagSet("users "+action, flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.Usage = usage
+	fileName := flags.String("file", getPasswordFileName(), "the password file")
+	scheme := flags.String("hash", bcryptScheme, "the password hash scheme: bcrypt or argon2id")
+	if parseErr := flags.Parse(args[1:]); parseErr != nil {
+		return parseErr
+	}
+	if flags.NArg() != 1 || len(*fileName) == 0 {
+		usage()
+		return errors.New("missing username or password file")
+	}
+	username := flags.Arg(0)
+	if strings.ContainsAny(username, ":\n") || strings.TrimSpace(username) != username {
+		return fmt.Errorf("invalid username %q", username)
+	}
+
+	content, readErr := os.ReadFile(*fileName)
+	if readErr != nil && !errors.Is(readErr, os.ErrNotExist) {
+		return fmt.Errorf("failed to read password file: %w", readErr)
+	}
+	hashes, _ := parsePasswordFile(content)
+	_, exists := hashes[username]
+
+	switch action {
+	case "add", "passwd":
+		if action == "add" && exists {
+			return fmt.Errorf("user %s already exists", username)
+		}
+		if action == "passwd" && !exists {
+			return fmt.Errorf("no such user: %s", username)
+		}
+		password, passwordErr := readPassword()
+		if passwordErr != nil {
+			return passwordErr
+		}
+		if len(password) == 0 {
+			return errors.New("empty password")
+		}
+		hash, hashErr := hashPassword(password, *scheme)
+		if hashErr != nil {
+			return hashErr
+		}
+		return updatePasswordFile(*fileName, username, hash)
+	case "remove":
+		if !exists {
+			return fmt.Errorf("no such user: %s", username)
+		}
+		return updatePasswordFile(*fileName, username, "")
+	default:
+		usage()
+		return fmt.Errorf("unknown users command %q", action)
+	}
+}
+
+// readPasswordFromStdin prompts for the password twice on terminals, otherwise it reads the first
+// line of the standard input
+func readPasswordFromStdin() (string, error) {
+	stdin := int(os.Stdin.Fd())
+	if !term.IsTerminal(stdin) {
+		line, readErr := bufio.NewReader(os.Stdin).ReadString('\n')
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return "", fmt.Errorf("failed to read password: %w", readErr)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, readErr := term.ReadPassword(stdin)
+	fmt.Fprintln(os.Stderr)
+	if readErr != nil {
+		return "", fmt.Errorf("failed to read password: %w", readErr)
+	}
+	fmt.Fprint(os.Stderr, "Repeat password: ")
+	repeated, repeatErr := term.ReadPassword(stdin)
+	fmt.Fprintln(os.Stderr)
+	if repeatErr != nil {
+		return "", fmt.Errorf("failed to read password: %w", repeatErr)
+	}
+	if string(password) != string(repeated) {
+		return "", errors.New("the passwords don't match")
+	}
+	return string(password), nil
+}
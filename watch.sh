@@ -28,7 +28,7 @@ trap cleanup EXIT SIGINT SIGTERM
 build_and_run() {
   task plain
   LOG_LEVEL=debug \
-    XCALIAPP_USERNAME="peter.dunay.kovacs@gmail.com" \
+    XCALIAPP_PASSWORDFILE="${XCALIAPP_PASSWORDFILE:-${HOME}/.config/xcaliapp/htpasswd}" \
     SERVER_PORT=8888 \
     XCALIAPP_DRAWINGREPO_LIST="xcaliapp:XCalidraw Application,wsgw:WebSocket Gateway" \
     XCALIAPP_DRAWINGREPO_xcaliapp_STORETYPE=LOCAL_GIT \